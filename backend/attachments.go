@@ -0,0 +1,475 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Largest upload in megabytes when ATTACHMENT_MAX_SIZE_MB is not set
+const defaultAttachmentMaxSizeMB = 100
+
+// Keeps a file from being removed from the store while another upload of
+// the same content is being recorded
+var attachmentStoreMutex sync.Mutex
+
+/*
+Uploads a file to a sample or a collection. The body is multipart/form-data
+with the file in the "file" field. Files larger than ATTACHMENT_MAX_SIZE_MB,
+100 MB by default, are rejected. Identical files are stored once.
+
+Query params:
+
+	sample_id?: int, // One of sample_id and collection_id is required
+	collection_id?: int
+
+Result:
+
+	{ id: int }
+*/
+func insertAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(User)
+	sampleId, collectionId, status, err := readAttachmentParentParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if sampleId != nil {
+		if status, err := checkSampleWritable(*sampleId); err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+	}
+
+	maxSize, err := attachmentMaxSize()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	reader, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "body must be multipart/form-data", http.StatusBadRequest)
+		return
+	}
+
+	var part io.ReadCloser
+	var filename, contentType string
+	for {
+		p, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, "invalid multipart body", http.StatusBadRequest)
+			return
+		}
+		if p.FormName() == "file" {
+			part = p
+			filename = filepath.Base(strings.ReplaceAll(p.FileName(), "\\", "/"))
+			contentType = p.Header.Get("Content-Type")
+			break
+		}
+	}
+	if part == nil {
+		http.Error(w, "file is required", http.StatusBadRequest)
+		return
+	}
+	if filename == "" || filename == "." || filename == "/" {
+		http.Error(w, "file must have a filename", http.StatusBadRequest)
+		return
+	}
+	if len(filename) > 255 {
+		http.Error(w, "filename must be at most 255 characters", http.StatusBadRequest)
+		return
+	}
+
+	// Write to a temporary file first, the name is only known from the content
+	dir := attachmentStoreDir()
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		http.Error(w, "failed to store file", http.StatusInternalServerError)
+		return
+	}
+	tmp, err := os.CreateTemp(dir, "upload-*")
+	if err != nil {
+		http.Error(w, "failed to store file", http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	head := &sniffWriter{}
+	size, err := io.Copy(io.MultiWriter(tmp, hash, head), io.LimitReader(part, maxSize+1))
+	if err != nil {
+		http.Error(w, "failed to read file", http.StatusBadRequest)
+		return
+	}
+	if size > maxSize {
+		http.Error(w, fmt.Sprintf("file is larger than %d MB", maxSize>>20), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err := tmp.Close(); err != nil {
+		http.Error(w, "failed to store file", http.StatusInternalServerError)
+		return
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+
+	if _, _, err := mime.ParseMediaType(contentType); err != nil || contentType == "application/octet-stream" {
+		contentType = http.DetectContentType(head.bytes)
+	}
+
+	attachmentStoreMutex.Lock()
+	defer attachmentStoreMutex.Unlock()
+
+	path := attachmentPath(sum)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			http.Error(w, "failed to store file", http.StatusInternalServerError)
+			return
+		}
+		if err := os.Rename(tmp.Name(), path); err != nil {
+			http.Error(w, "failed to store file", http.StatusInternalServerError)
+			return
+		}
+	} else if err != nil {
+		http.Error(w, "failed to store file", http.StatusInternalServerError)
+		return
+	}
+
+	query := `
+		INSERT INTO attachments (sample_id, collection_id, sha256, filename, content_type, size, user_id, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	result, err := DB.Exec(query, sampleId, collectionId, sum, filename, contentType, size, user.Id, time.Now().Unix())
+	if err != nil {
+		removeUnusedAttachmentFile(sum)
+		http.Error(w, "failed to insert attachment", http.StatusInternalServerError)
+		return
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		http.Error(w, "failed to insert attachment", http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintf(w, "{\"id\":  %d}", id)
+}
+
+/*
+Gets the files of a sample or a collection, oldest first. The files of the
+samples in a collection are not included.
+
+Query params:
+
+	sample_id?: int, // One of sample_id and collection_id is required
+	collection_id?: int
+
+Result:
+
+	[{
+		id: int,
+		sample_id: int, // Omitted for files of a collection
+		collection_id: int, // Omitted for files of a sample
+		filename: string,
+		content_type: string,
+		size: int, // Bytes
+		sha256: string,
+		user_id: int,
+		created_at: int
+	}]
+*/
+func fetchAttachmentsHandler(w http.ResponseWriter, r *http.Request) {
+	sampleId, collectionId, status, err := readAttachmentParentParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	query := `
+		SELECT id, sample_id, collection_id, filename, content_type, size, sha256, user_id, created_at
+		FROM attachments
+	`
+	var rows *sql.Rows
+	if sampleId != nil {
+		rows, err = DB.Query(query+" WHERE sample_id = ? ORDER BY created_at, id", *sampleId)
+	} else {
+		rows, err = DB.Query(query+" WHERE collection_id = ? ORDER BY created_at, id", *collectionId)
+	}
+	if err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	attachments := []Attachment{}
+	for rows.Next() {
+		var a Attachment
+		if err := rows.Scan(&a.Id, &a.SampleId, &a.CollectionId, &a.Filename, &a.ContentType, &a.Size, &a.Sha256, &a.UserId, &a.CreatedAt); err != nil {
+			http.Error(w, "error when reading from database", http.StatusInternalServerError)
+			return
+		}
+		attachments = append(attachments, a)
+	}
+	if err = rows.Err(); err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(attachments)
+}
+
+/*
+Downloads a file. Range requests are supported.
+
+Query params:
+
+	attachment_id: int
+*/
+func downloadAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	attachment, status, err := readAttachment(r.FormValue("attachment_id"))
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	file, err := os.Open(attachmentPath(attachment.Sha256))
+	if err != nil {
+		http.Error(w, "file is missing from the store", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Type", attachment.ContentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Filename}))
+	w.Header().Set("ETag", "\""+attachment.Sha256+"\"")
+	http.ServeContent(w, r, attachment.Filename, time.Unix(attachment.CreatedAt, 0), file)
+}
+
+/*
+Deletes a file. The content is removed from the store once no sample or
+collection uses it.
+
+Query params:
+
+	attachment_id: int
+*/
+func deleteAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	attachment, status, err := readAttachment(r.FormValue("attachment_id"))
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if attachment.SampleId != nil {
+		if status, err := checkSampleWritable(*attachment.SampleId); err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+	}
+
+	attachmentStoreMutex.Lock()
+	defer attachmentStoreMutex.Unlock()
+
+	if _, err := DB.Exec("DELETE FROM attachments WHERE id = ?", attachment.Id); err != nil {
+		http.Error(w, "error when deleting attachment from database", http.StatusInternalServerError)
+		return
+	}
+	if err := removeUnusedAttachmentFile(attachment.Sha256); err != nil {
+		http.Error(w, "failed to remove file", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+type Attachment struct {
+	Id           int    `json:"id"`
+	SampleId     *int   `json:"sample_id,omitempty"`
+	CollectionId *int   `json:"collection_id,omitempty"`
+	Filename     string `json:"filename"`
+	ContentType  string `json:"content_type"`
+	Size         int64  `json:"size"`
+	Sha256       string `json:"sha256"`
+	UserId       *int   `json:"user_id,omitempty"`
+	CreatedAt    int64  `json:"created_at"`
+}
+
+// Reads sample_id or collection_id from the query and checks that the record
+// exists and is not in the trash. Returns an HTTP status with the error.
+func readAttachmentParentParams(r *http.Request) (*int, *int, int, error) {
+	query := r.URL.Query()
+	_sampleId, _collectionId := query.Get("sample_id"), query.Get("collection_id")
+	if (_sampleId == "") == (_collectionId == "") {
+		return nil, nil, http.StatusBadRequest, fmt.Errorf("one of sample_id and collection_id is required")
+	}
+
+	if _sampleId != "" {
+		id, err := strconv.Atoi(_sampleId)
+		if err != nil {
+			return nil, nil, http.StatusBadRequest, fmt.Errorf("sample_id must be a positive int")
+		}
+		if status, err := checkAttachmentParent(&id, nil); err != nil {
+			return nil, nil, status, err
+		}
+		return &id, nil, 0, nil
+	}
+
+	id, err := strconv.Atoi(_collectionId)
+	if err != nil {
+		return nil, nil, http.StatusBadRequest, fmt.Errorf("collection_id must be a positive int")
+	}
+	if status, err := checkAttachmentParent(nil, &id); err != nil {
+		return nil, nil, status, err
+	}
+	return nil, &id, 0, nil
+}
+
+// Checks that the sample or collection of an attachment exists and is not in the trash
+func checkAttachmentParent(sampleId *int, collectionId *int) (int, error) {
+	var found bool
+	var err error
+	if sampleId != nil {
+		query := `
+			SELECT EXISTS(
+				SELECT 1 FROM samples s JOIN collections c ON c.id = s.collection_id
+				WHERE s.id = ? AND s.deleted_at IS NULL AND c.deleted_at IS NULL
+			)
+		`
+		err = DB.QueryRow(query, *sampleId).Scan(&found)
+		if err == nil && !found {
+			return http.StatusNotFound, fmt.Errorf("sample not found")
+		}
+	} else {
+		err = DB.QueryRow("SELECT EXISTS(SELECT 1 FROM collections WHERE id = ? AND deleted_at IS NULL)", *collectionId).Scan(&found)
+		if err == nil && !found {
+			return http.StatusNotFound, fmt.Errorf("collection not found")
+		}
+	}
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("error when reading from database")
+	}
+	return 0, nil
+}
+
+// Files of a sample can only change while the sample itself can
+func checkSampleWritable(sampleId int) (int, error) {
+	locked, err := isSampleLocked(sampleId)
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("error when reading from database")
+	}
+	if locked {
+		return http.StatusConflict, fmt.Errorf("sample is locked by its workflow state")
+	}
+	return 0, nil
+}
+
+// Reads an attachment whose sample or collection is not in the trash
+func readAttachment(_attachmentId string) (Attachment, int, error) {
+	attachmentId, err := strconv.Atoi(_attachmentId)
+	if err != nil {
+		return Attachment{}, http.StatusBadRequest, fmt.Errorf("attachment_id must be a positive int")
+	}
+
+	var a Attachment
+	query := `
+		SELECT id, sample_id, collection_id, filename, content_type, size, sha256, user_id, created_at
+		FROM attachments WHERE id = ?
+	`
+	err = DB.QueryRow(query, attachmentId).Scan(&a.Id, &a.SampleId, &a.CollectionId, &a.Filename, &a.ContentType, &a.Size, &a.Sha256, &a.UserId, &a.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return Attachment{}, http.StatusNotFound, fmt.Errorf("attachment not found")
+		}
+		return Attachment{}, http.StatusInternalServerError, fmt.Errorf("error when reading from database")
+	}
+	if status, err := checkAttachmentParent(a.SampleId, a.CollectionId); err != nil {
+		if status == http.StatusNotFound {
+			return Attachment{}, status, fmt.Errorf("attachment not found")
+		}
+		return Attachment{}, status, err
+	}
+	return a, 0, nil
+}
+
+// Reads the upload size limit in bytes from the environment
+func attachmentMaxSize() (int64, error) {
+	_size := os.Getenv("ATTACHMENT_MAX_SIZE_MB")
+	if _size == "" {
+		return defaultAttachmentMaxSizeMB << 20, nil
+	}
+	size, err := strconv.ParseInt(_size, 10, 64)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("ATTACHMENT_MAX_SIZE_MB must be a positive int")
+	}
+	return size << 20, nil
+}
+
+func attachmentStoreDir() string {
+	return filepath.Join(db_files, "attachments")
+}
+
+// Files are spread over subdirectories by the first two characters of their hash
+func attachmentPath(sum string) string {
+	return filepath.Join(attachmentStoreDir(), sum[:2], sum)
+}
+
+// Removes a file from the store if no attachment uses it anymore. The caller
+// must hold attachmentStoreMutex.
+func removeUnusedAttachmentFile(sum string) error {
+	var used bool
+	if err := DB.QueryRow("SELECT EXISTS(SELECT 1 FROM attachments WHERE sha256 = ?)", sum).Scan(&used); err != nil {
+		return fmt.Errorf("removeUnusedAttachmentFile: %v", err)
+	}
+	if used {
+		return nil
+	}
+	if err := os.Remove(attachmentPath(sum)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("removeUnusedAttachmentFile: %v", err)
+	}
+	return nil
+}
+
+// Removes every file from the store that no attachment uses, e.g. after
+// samples and collections were purged from the trash
+func removeUnusedAttachmentFiles() error {
+	attachmentStoreMutex.Lock()
+	defer attachmentStoreMutex.Unlock()
+
+	files, err := filepath.Glob(filepath.Join(attachmentStoreDir(), "*", "*"))
+	if err != nil {
+		return fmt.Errorf("removeUnusedAttachmentFiles: %v", err)
+	}
+	for _, file := range files {
+		sum := filepath.Base(file)
+		if len(sum) != sha256.Size*2 {
+			continue
+		}
+		if err := removeUnusedAttachmentFile(sum); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Keeps the first 512 bytes written, enough to detect the content type
+type sniffWriter struct {
+	bytes []byte
+}
+
+func (s *sniffWriter) Write(p []byte) (int, error) {
+	if n := 512 - len(s.bytes); n > 0 {
+		s.bytes = append(s.bytes, p[:min(n, len(p))]...)
+	}
+	return len(p), nil
+}
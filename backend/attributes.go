@@ -1,15 +1,17 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 )
 
 /*
-Deletes an attribute from a collection
+Moves an attribute of a collection to the trash
 
 Query params:
 
@@ -26,9 +28,22 @@ func deleteAttributesHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Delete attribute from database
-	query := "DELETE FROM sample_attributes WHERE id = ?"
-	result, err := DB.Exec(query, attributeId)
+	// Read the collection before the attribute is gone, so webhooks can be notified
+	var collectionId int
+	err = DB.QueryRow("SELECT collection_id FROM sample_attributes WHERE id = ?", attributeId).Scan(&collectionId)
+	if err != nil {
+		http.Error(w, "attribute not found", http.StatusNotFound)
+		return
+	}
+
+	// Calculated attributes would lose an input
+	if blocked := checkFormulaDependents(w, collectionId, attributeId); blocked {
+		return
+	}
+
+	// Move attribute to the trash
+	query := "UPDATE sample_attributes SET deleted_at = ? WHERE id = ? AND deleted_at IS NULL"
+	result, err := DB.Exec(query, time.Now().Unix(), attributeId)
 	if err != nil {
 		http.Error(w, "failed to delete attribute", http.StatusInternalServerError)
 		return
@@ -40,19 +55,27 @@ func deleteAttributesHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "attribute not found", http.StatusNotFound)
 		return
 	}
+	emitWebhookEvent(collectionId, "attribute.deleted", map[string]any{"attribute_id": attributeId})
 
 	// Respond with success
 	w.WriteHeader(http.StatusOK)
 }
 
 /*
-Inserts a new attribute for a collection
+Inserts a new attribute for a collection, placed after its other attributes
 
 Query params:
 
 	collection_id: int,
 	name: string,
-	unit_id?: int
+	unit_id?: int,
+	group?: string, // Section the attribute is shown under
+	description?: string, // Help text
+	decimals?: int, // Decimal places to display
+	formula?: string, // Values are calculated from the other attributes, see formula.go
+	replicates?: int, // Number of replicate values per sample, see replicates.go
+	lod?: float, loq?: float, uloq?: float, // Detection limits, in the unit of the attribute
+	substitution?: string // How censored values enter statistics: "half" (default), "sqrt2", "limit", "zero" or "exclude"
 */
 func insertAttributesHandler(w http.ResponseWriter, r *http.Request) {
 	// Parse request body
@@ -76,23 +99,62 @@ func insertAttributesHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		req.UnitId = &_id
 	}
+	req.Display, err = parseAttributeDisplay(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Limits, err = parseDetectionLimits(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Substitution, err = parseSubstitution(r.FormValue("substitution"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	// Insert attribute into database
-	var query string
-	var args []interface{}
+	// Attributes cannot be added to a collection in the trash
+	var exists bool
+	err = DB.QueryRow("SELECT EXISTS(SELECT 1 FROM collections WHERE id = ? AND deleted_at IS NULL)", req.CollectionId).Scan(&exists)
+	if err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "collection not found", http.StatusNotFound)
+		return
+	}
 
-	if req.UnitId != nil {
-		query = "INSERT INTO sample_attributes (collection_id, name, unit_id) VALUES (?, ?, ?)"
-		args = append(args, req.CollectionId, req.Name, *req.UnitId)
-	} else {
-		query = "INSERT INTO sample_attributes (collection_id, name) VALUES (?, ?)"
-		args = append(args, req.CollectionId, req.Name)
+	if formula := r.FormValue("formula"); formula != "" {
+		if _, err := validateFormula(req.CollectionId, 0, req.Name, formula); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req.Formula = &formula
+	}
+	req.Replicates, err = parseAttributeReplicates(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Formula != nil && req.Replicates != nil {
+		http.Error(w, "calculated attributes cannot take replicates", http.StatusBadRequest)
+		return
 	}
 
+	// Insert attribute into database
+	query := `
+		INSERT INTO sample_attributes (collection_id, name, unit_id, group_label, description, decimals, formula, replicates, lod, loq, uloq, substitution, inserted_at, position)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, (SELECT COALESCE(MAX(position), 0) + 1 FROM sample_attributes WHERE collection_id = ?))
+	`
+	args := []interface{}{req.CollectionId, req.Name, req.UnitId, req.Display.Group, req.Display.Description, req.Display.Decimals, req.Formula, req.Replicates, req.Limits.LOD, req.Limits.LOQ, req.Limits.ULOQ, req.Substitution, time.Now().Unix(), req.CollectionId}
+
 	result, err := DB.Exec(query, args...)
 	if err != nil {
 		if strings.Contains(err.Error(), "UNIQUE constraint failed:") {
-			http.Error(w, "atttribute already exists on this collection", http.StatusBadRequest)
+			http.Error(w, attributeExistsMessage(req.CollectionId, req.Name), http.StatusBadRequest)
 			return
 		}
 		http.Error(w, "failed to insert attribute", http.StatusInternalServerError)
@@ -107,14 +169,542 @@ func insertAttributesHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if req.Formula != nil {
+		if err := recomputeCollectionFormulas(req.CollectionId); err != nil {
+			http.Error(w, "error when calculating values", http.StatusInternalServerError)
+			return
+		}
+	}
+	emitWebhookEvent(req.CollectionId, "attribute.created", map[string]any{"attribute_id": id, "name": req.Name, "unit_id": req.UnitId})
+
 	// Respond with success
 	w.WriteHeader(http.StatusCreated)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]int{"attribute_id": int(id)})
 }
 
+/*
+Renames an attribute, changes its unit, display metadata and/or the handling
+of its censored values. With convert_values the stored values, specification
+limits and detection limits are converted from the old unit to the new one,
+otherwise they are kept as they are. The unit cannot change while samples in
+a locked workflow state have values for the attribute.
+
+Query params:
+
+	attribute_id: int,
+	name?: string,
+	unit_id?: int, // Empty to remove the unit
+	convert_values?: bool,
+	group?: string, // Empty to remove the group
+	description?: string,
+	decimals?: int, // Empty to remove the hint
+	formula?: string, // Empty to stop calculating the values, they are kept as they are
+	replicates?: int, // Empty to take single values again. Single values become the
+	                  // first replicate when an attribute starts taking replicates.
+	lod?: float, loq?: float, uloq?: float, // Empty to remove the limit
+	substitution?: string // Empty for the default
+*/
+func updateAttributeHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(User)
+
+	// Parse request
+	_attributeId := r.FormValue("attribute_id")
+	name := r.FormValue("name")
+	_unitId := r.FormValue("unit_id")
+	_convertValues := r.FormValue("convert_values")
+
+	attributeId, err := strconv.Atoi(_attributeId)
+	if err != nil {
+		http.Error(w, "attribute_id must be a positive int", http.StatusBadRequest)
+		return
+	}
+	display, err := parseAttributeDisplay(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limits, err := parseDetectionLimits(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	substitution, err := parseSubstitution(r.FormValue("substitution"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fields := []string{}
+	fieldArgs := []interface{}{}
+	for field, value := range map[string]any{
+		"group": display.Group, "description": display.Description, "decimals": display.Decimals,
+		"lod": limits.LOD, "loq": limits.LOQ, "uloq": limits.ULOQ, "substitution": substitution,
+	} {
+		if r.Form.Has(field) {
+			column := field
+			if field == "group" {
+				column = "group_label"
+			}
+			fields = append(fields, column+" = ?")
+			fieldArgs = append(fieldArgs, value)
+		}
+	}
+	if !r.Form.Has("name") && !r.Form.Has("unit_id") && !r.Form.Has("formula") && !r.Form.Has("replicates") && len(fields) == 0 {
+		http.Error(w, "name, unit_id, group, description, decimals, formula, replicates, a detection limit or substitution is required", http.StatusBadRequest)
+		return
+	}
+	if r.Form.Has("name") && name == "" {
+		http.Error(w, "name cannot be empty", http.StatusBadRequest)
+		return
+	}
+	var unitId *int
+	if _unitId != "" {
+		id, err := strconv.Atoi(_unitId)
+		if err != nil {
+			http.Error(w, "invalid unit_id", http.StatusBadRequest)
+			return
+		}
+		unitId = &id
+	}
+	convertValues := false
+	if _convertValues != "" {
+		convertValues, err = strconv.ParseBool(_convertValues)
+		if err != nil {
+			http.Error(w, "convert_values must be a bool", http.StatusBadRequest)
+			return
+		}
+	}
+
+	replicates, err := parseAttributeReplicates(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var collectionId int
+	var oldName string
+	var oldUnitId *int
+	var oldFormula *string
+	var oldReplicates *int
+	err = DB.QueryRow("SELECT collection_id, name, unit_id, formula, replicates FROM sample_attributes WHERE id = ? AND deleted_at IS NULL", attributeId).Scan(&collectionId, &oldName, &oldUnitId, &oldFormula, &oldReplicates)
+	if err != nil {
+		http.Error(w, "attribute not found", http.StatusNotFound)
+		return
+	}
+
+	// Formulas reference attributes by name
+	if r.Form.Has("name") && name != oldName {
+		if blocked := checkFormulaDependents(w, collectionId, attributeId); blocked {
+			return
+		}
+	}
+	var formula *string
+	if _formula := r.FormValue("formula"); _formula != "" {
+		newName := oldName
+		if r.Form.Has("name") {
+			newName = name
+		}
+		if _, err := validateFormula(collectionId, attributeId, newName, _formula); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		formula = &_formula
+	}
+	if !r.Form.Has("formula") {
+		formula = oldFormula
+	}
+	if !r.Form.Has("replicates") {
+		replicates = oldReplicates
+	}
+	if formula != nil && replicates != nil {
+		http.Error(w, "calculated attributes cannot take replicates", http.StatusBadRequest)
+		return
+	}
+
+	// The detection limits that are not changed must still be in order
+	oldLimits, err := readDetectionLimits(DB, attributeId)
+	if err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	if r.Form.Has("lod") {
+		oldLimits.LOD = limits.LOD
+	}
+	if r.Form.Has("loq") {
+		oldLimits.LOQ = limits.LOQ
+	}
+	if r.Form.Has("uloq") {
+		oldLimits.ULOQ = limits.ULOQ
+	}
+	if err := oldLimits.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		http.Error(w, "failed to update attribute", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if r.Form.Has("name") {
+		if _, err := tx.Exec("UPDATE sample_attributes SET name = ? WHERE id = ?", name, attributeId); err != nil {
+			if strings.Contains(err.Error(), "UNIQUE constraint failed:") {
+				tx.Rollback()
+				http.Error(w, attributeExistsMessage(collectionId, name), http.StatusBadRequest)
+				return
+			}
+			http.Error(w, "failed to update attribute", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if r.Form.Has("formula") {
+		if _, err := tx.Exec("UPDATE sample_attributes SET formula = ? WHERE id = ?", formula, attributeId); err != nil {
+			http.Error(w, "failed to update attribute", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if r.Form.Has("replicates") {
+		if status, err := changeAttributeReplicates(tx, attributeId, oldReplicates, replicates, user.Id); err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+	}
+
+	if len(fields) > 0 {
+		query := "UPDATE sample_attributes SET " + strings.Join(fields, ", ") + " WHERE id = ?"
+		if _, err := tx.Exec(query, append(fieldArgs, attributeId)...); err != nil {
+			http.Error(w, "failed to update attribute", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if r.Form.Has("unit_id") {
+		// Values of locked samples are read-only, also in which unit they are
+		if (oldUnitId == nil) != (unitId == nil) || (oldUnitId != nil && unitId != nil && *oldUnitId != *unitId) {
+			if err := checkAttributeUnlocked(tx, attributeId); err != nil {
+				if _, ok := err.(lockedValuesError); ok {
+					http.Error(w, err.Error(), http.StatusConflict)
+					return
+				}
+				http.Error(w, "error when reading from database", http.StatusInternalServerError)
+				return
+			}
+		}
+		if convertValues && oldUnitId != nil && unitId != nil && *oldUnitId != *unitId {
+			from, err := readUnit(tx, *oldUnitId)
+			if err != nil {
+				http.Error(w, "error when reading from database", http.StatusInternalServerError)
+				return
+			}
+			to, err := readUnit(tx, *unitId)
+			if err != nil {
+				http.Error(w, "unit not found", http.StatusBadRequest)
+				return
+			}
+			if err := convertAttributeValues(tx, attributeId, from, to); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		} else if convertValues && (oldUnitId == nil || unitId == nil) {
+			http.Error(w, "values can only be converted between two units", http.StatusBadRequest)
+			return
+		}
+
+		if _, err := tx.Exec("UPDATE sample_attributes SET unit_id = ? WHERE id = ?", unitId, attributeId); err != nil {
+			if strings.Contains(err.Error(), "FOREIGN KEY constraint failed") {
+				http.Error(w, "unit not found", http.StatusBadRequest)
+				return
+			}
+			http.Error(w, "failed to update attribute", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		http.Error(w, "failed to update attribute", http.StatusInternalServerError)
+		return
+	}
+	if convertValues {
+		if err := reevaluateAttributeFlags(attributeId); err != nil {
+			http.Error(w, "error when evaluating values", http.StatusInternalServerError)
+			return
+		}
+	}
+	// Censored values enter formulas by the substitution rule
+	if (r.Form.Has("formula") && formula != nil) || r.Form.Has("substitution") || convertValues {
+		if err := recomputeCollectionFormulas(collectionId); err != nil {
+			http.Error(w, "error when calculating values", http.StatusInternalServerError)
+			return
+		}
+	}
+	emitWebhookEvent(collectionId, "attribute.updated", map[string]any{"attribute_id": attributeId})
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// Converts the stored values, specification and detection limits of an attribute between units.
+// Values keep their declared significant figures, absolute uncertainties are scaled with them.
+// Fails if any stored value is not a number.
+func convertAttributeValues(tx *sql.Tx, attributeId int, from Unit, to Unit) error {
+	if !from.convertibleTo(to) {
+		return fmt.Errorf("cannot convert %s to %s", from.Name, to.Name)
+	}
+
+	query := `
+		SELECT sample_id, value, uncertainty, uncertainty_type, significant_figures
+		FROM sample_attribute_values WHERE attribute_id = ? AND value IS NOT NULL AND value != ''
+	`
+	rows, err := tx.Query(query, attributeId)
+	if err != nil {
+		return fmt.Errorf("convertAttributeValues: %v", err)
+	}
+	type convertedValue struct {
+		value       string
+		uncertainty *string
+	}
+	converted := make(map[int]convertedValue)
+	for rows.Next() {
+		var sampleId int
+		var value string
+		var precision MeasurementPrecision
+		if err := rows.Scan(&sampleId, &value, &precision.Uncertainty, &precision.UncertaintyType, &precision.SignificantFigures); err != nil {
+			rows.Close()
+			return fmt.Errorf("convertAttributeValues: %v", err)
+		}
+		value, err = convertValueString(value, from, to)
+		if err == nil {
+			value, err = applySignificantFigures(value, precision.SignificantFigures)
+		}
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		uncertainty := precision.Uncertainty
+		if uncertainty != nil && *precision.UncertaintyType == uncertaintyAbsolute && from.Id != to.Id {
+			number, err := strconv.ParseFloat(*uncertainty, 64)
+			if err != nil {
+				rows.Close()
+				return fmt.Errorf("convertAttributeValues: %v", err)
+			}
+			scaled := strconv.FormatFloat(number**from.Factor / *to.Factor, 'g', 10, 64)
+			uncertainty = &scaled
+		}
+		converted[sampleId] = convertedValue{value, uncertainty}
+	}
+	rows.Close()
+
+	for sampleId, convertedValue := range converted {
+		value := convertedValue.value
+		if _, err := tx.Exec("UPDATE sample_attribute_values SET value = ?, uncertainty = ? WHERE sample_id = ? AND attribute_id = ?", value, convertedValue.uncertainty, sampleId, attributeId); err != nil {
+			return fmt.Errorf("convertAttributeValues: %v", err)
+		}
+		var flag *string
+		if err := tx.QueryRow("SELECT flag FROM sample_attribute_values WHERE sample_id = ? AND attribute_id = ?", sampleId, attributeId).Scan(&flag); err != nil {
+			return fmt.Errorf("convertAttributeValues: %v", err)
+		}
+		if err := recordValueVersion(tx, sampleId, attributeId, &value, flag, nil); err != nil {
+			return err
+		}
+	}
+
+	// Replicates are converted like the means they make up
+	rows, err = tx.Query("SELECT id, value FROM sample_replicate_values WHERE attribute_id = ?", attributeId)
+	if err != nil {
+		return fmt.Errorf("convertAttributeValues: %v", err)
+	}
+	convertedReplicates := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var value string
+		if err := rows.Scan(&id, &value); err != nil {
+			rows.Close()
+			return fmt.Errorf("convertAttributeValues: %v", err)
+		}
+		convertedReplicates[id], err = convertValueString(value, from, to)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+	}
+	rows.Close()
+	for id, value := range convertedReplicates {
+		if _, err := tx.Exec("UPDATE sample_replicate_values SET value = ? WHERE id = ?", value, id); err != nil {
+			return fmt.Errorf("convertAttributeValues: %v", err)
+		}
+	}
+
+	// Limits are stored in the unit of the attribute too
+	query = `
+		UPDATE attribute_limits SET
+			lower_spec = ? * lower_spec + ?,
+			upper_spec = ? * upper_spec + ?,
+			lower_warn = ? * lower_warn + ?,
+			upper_warn = ? * upper_warn + ?
+		WHERE attribute_id = ?
+	`
+	// to = (from * from.factor + from.offset - to.offset) / to.factor
+	scale, shift := 1.0, 0.0
+	if from.Id != to.Id {
+		scale = *from.Factor / *to.Factor
+		shift = (from.offset() - to.offset()) / *to.Factor
+	}
+	if _, err := tx.Exec(query, scale, shift, scale, shift, scale, shift, scale, shift, attributeId); err != nil {
+		return fmt.Errorf("convertAttributeValues: %v", err)
+	}
+	query = "UPDATE sample_attributes SET lod = ? * lod + ?, loq = ? * loq + ?, uloq = ? * uloq + ? WHERE id = ?"
+	if _, err := tx.Exec(query, scale, shift, scale, shift, scale, shift, attributeId); err != nil {
+		return fmt.Errorf("convertAttributeValues: %v", err)
+	}
+	return nil
+}
+
+// Responds with a conflict if formulas of other attributes reference the attribute,
+// which therefore cannot be renamed or deleted
+func checkFormulaDependents(w http.ResponseWriter, collectionId int, attributeId int) (blocked bool) {
+	var name string
+	if err := DB.QueryRow("SELECT name FROM sample_attributes WHERE id = ?", attributeId).Scan(&name); err != nil {
+		http.Error(w, "attribute not found", http.StatusNotFound)
+		return true
+	}
+	dependents, err := readFormulaDependents(collectionId, name)
+	if err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return true
+	}
+	if len(dependents) > 0 {
+		http.Error(w, "attribute is used by the formula of "+strings.Join(dependents, ", "), http.StatusConflict)
+		return true
+	}
+	return false
+}
+
+// Names stay taken while an attribute is in the trash, so say where the name is used
+func attributeExistsMessage(collectionId int, name string) string {
+	var trashed bool
+	err := DB.QueryRow("SELECT deleted_at IS NOT NULL FROM sample_attributes WHERE collection_id = ? AND name = ?", collectionId, name).Scan(&trashed)
+	if err == nil && trashed {
+		return "an attribute with this name is in the trash"
+	}
+	return "atttribute already exists on this collection"
+}
+
+/*
+Sets the display order of the attributes of a collection
+
+Query params:
+
+	collection_id: int,
+	attribute_ids: string // Comma separated, every attribute of the collection in the new order
+*/
+func reorderAttributesHandler(w http.ResponseWriter, r *http.Request) {
+	collectionId, err := strconv.Atoi(r.FormValue("collection_id"))
+	if err != nil {
+		http.Error(w, "collection_id must be a positive int", http.StatusBadRequest)
+		return
+	}
+	_attributeIds := r.FormValue("attribute_ids")
+	if _attributeIds == "" {
+		http.Error(w, "attribute_ids is required", http.StatusBadRequest)
+		return
+	}
+	var attributeIds []int
+	for _, _id := range strings.Split(_attributeIds, ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(_id))
+		if err != nil {
+			http.Error(w, "attribute_ids must be comma separated ints", http.StatusBadRequest)
+			return
+		}
+		attributeIds = append(attributeIds, id)
+	}
+
+	attributes, err := readCollectionAttributes(collectionId)
+	if err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+
+	// The new order must name every attribute exactly once
+	remaining := make(map[int]bool, len(attributes))
+	for _, attr := range attributes {
+		remaining[attr.AttributeId] = true
+	}
+	for _, id := range attributeIds {
+		if !remaining[id] {
+			http.Error(w, fmt.Sprintf("attribute %d is not part of the collection or listed twice", id), http.StatusBadRequest)
+			return
+		}
+		delete(remaining, id)
+	}
+	if len(remaining) > 0 {
+		http.Error(w, "attribute_ids must list every attribute of the collection", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		http.Error(w, "failed to reorder attributes", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	for i, id := range attributeIds {
+		if _, err := tx.Exec("UPDATE sample_attributes SET position = ? WHERE id = ?", i+1, id); err != nil {
+			http.Error(w, "failed to reorder attributes", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		http.Error(w, "failed to reorder attributes", http.StatusInternalServerError)
+		return
+	}
+	emitWebhookEvent(collectionId, "attribute.updated", map[string]any{"attribute_ids": attributeIds})
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// Parses the number of replicates of an attribute, nil if it is empty
+func parseAttributeReplicates(r *http.Request) (*int, error) {
+	_replicates := r.FormValue("replicates")
+	if _replicates == "" {
+		return nil, nil
+	}
+	replicates, err := strconv.Atoi(_replicates)
+	if err != nil || replicates < 2 || replicates > 100 {
+		return nil, fmt.Errorf("replicates must be an int between 2 and 100")
+	}
+	return &replicates, nil
+}
+
+// Parses the optional display metadata of an attribute. Empty params are returned as nil.
+func parseAttributeDisplay(r *http.Request) (AttributeDisplay, error) {
+	var display AttributeDisplay
+	if group := r.FormValue("group"); group != "" {
+		display.Group = &group
+	}
+	if description := r.FormValue("description"); description != "" {
+		display.Description = &description
+	}
+	if _decimals := r.FormValue("decimals"); _decimals != "" {
+		decimals, err := strconv.Atoi(_decimals)
+		if err != nil || decimals < 0 || decimals > 15 {
+			return display, fmt.Errorf("decimals must be an int between 0 and 15")
+		}
+		display.Decimals = &decimals
+	}
+	return display, nil
+}
+
 type insertAttributeRequest struct {
 	CollectionId int    `json:"collection_id"`
 	Name         string `json:"name"`
 	UnitId       *int   `json:"unit_id,omitempty"` // Nullable
+	Display      AttributeDisplay
+	Formula      *string // Nullable
+	Replicates   *int    // Nullable
+	Limits       DetectionLimits
+	Substitution *string // Nullable
 }
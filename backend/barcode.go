@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Largest number of pixels per module
+const maxBarcodeScale = 20
+
+// Encoders for the symbologies of fetchSampleBarcodeHandler
+var barcodeEncoders = map[string]func(text string) (*barcodeMatrix, error){
+	"code128":    encodeCode128,
+	"datamatrix": encodeDataMatrix,
+	"qr":         encodeQRCode,
+}
+
+/*
+Gets the barcode of the identifier of a sample as an image, for printing
+labels. Samples without an identifier cannot have a barcode.
+
+Query params:
+
+	sample_id: int,
+	symbology?: string, // "code128" (default), "datamatrix" or "qr"
+	format?: string, // "png" (default) or "svg"
+	scale?: int // Pixels per module, 1 to 20, defaults to 4
+*/
+func fetchSampleBarcodeHandler(w http.ResponseWriter, r *http.Request) {
+	sampleId, err := strconv.Atoi(r.FormValue("sample_id"))
+	if err != nil {
+		http.Error(w, "sample_id must be a positive int", http.StatusBadRequest)
+		return
+	}
+	symbology := r.FormValue("symbology")
+	if symbology == "" {
+		symbology = "code128"
+	}
+	encode, ok := barcodeEncoders[symbology]
+	if !ok {
+		http.Error(w, "symbology must be one of: code128, datamatrix, qr", http.StatusBadRequest)
+		return
+	}
+	format := r.FormValue("format")
+	if format == "" {
+		format = "png"
+	}
+	if format != "png" && format != "svg" {
+		http.Error(w, "format must be one of: png, svg", http.StatusBadRequest)
+		return
+	}
+	scale := 4
+	if _scale := r.FormValue("scale"); _scale != "" {
+		scale, err = strconv.Atoi(_scale)
+		if err != nil || scale < 1 || scale > maxBarcodeScale {
+			http.Error(w, fmt.Sprintf("scale must be an int from 1 to %d", maxBarcodeScale), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var identifier *string
+	query := `
+		SELECT s.identifier FROM samples s JOIN collections c ON c.id = s.collection_id
+		WHERE s.id = ? AND s.deleted_at IS NULL AND c.deleted_at IS NULL
+	`
+	err = DB.QueryRow(query, sampleId).Scan(&identifier)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "sample not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	if identifier == nil {
+		http.Error(w, "sample has no identifier, set an identifier pattern on the collection", http.StatusConflict)
+		return
+	}
+
+	matrix, err := encode(*identifier)
+	if err != nil {
+		http.Error(w, "cannot encode identifier: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if format == "svg" {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Write(matrix.svg(scale))
+		return
+	}
+	body, err := matrix.png(scale)
+	if err != nil {
+		http.Error(w, "failed to draw barcode", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(body)
+}
+
+// A grid of dark and light modules with a light quiet zone around it
+type barcodeMatrix struct {
+	width     int
+	height    int
+	quietZone int
+	modules   []bool // Row by row, true is dark
+}
+
+func newBarcodeMatrix(width int, height int, quietZone int) *barcodeMatrix {
+	return &barcodeMatrix{
+		width:     width,
+		height:    height,
+		quietZone: quietZone,
+		modules:   make([]bool, width*height),
+	}
+}
+
+func (m *barcodeMatrix) set(x int, y int, dark bool) {
+	m.modules[y*m.width+x] = dark
+}
+
+func (m *barcodeMatrix) get(x int, y int) bool {
+	return m.modules[y*m.width+x]
+}
+
+func (m *barcodeMatrix) sameRows(a int, b int) bool {
+	for x := 0; x < m.width; x++ {
+		if m.get(x, a) != m.get(x, b) {
+			return false
+		}
+	}
+	return true
+}
+
+// Draws the matrix as a black and white PNG
+func (m *barcodeMatrix) png(scale int) ([]byte, error) {
+	size := image.Rect(0, 0, (m.width+2*m.quietZone)*scale, (m.height+2*m.quietZone)*scale)
+	img := image.NewPaletted(size, color.Palette{color.White, color.Black})
+	for y := 0; y < m.height; y++ {
+		for x := 0; x < m.width; x++ {
+			if !m.get(x, y) {
+				continue
+			}
+			for py := 0; py < scale; py++ {
+				for px := 0; px < scale; px++ {
+					img.SetColorIndex((m.quietZone+x)*scale+px, (m.quietZone+y)*scale+py, 1)
+				}
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("barcodeMatrix.png: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Draws the matrix as an SVG with one rectangle per horizontal run of dark modules
+func (m *barcodeMatrix) svg(scale int) []byte {
+	width := m.width + 2*m.quietZone
+	height := m.height + 2*m.quietZone
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, width*scale, height*scale, width, height)
+	fmt.Fprintf(&b, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, width, height)
+	for y := 0; y < m.height; y++ {
+		for x := 0; x < m.width; {
+			if !m.get(x, y) {
+				x++
+				continue
+			}
+			run := 1
+			for x+run < m.width && m.get(x+run, y) {
+				run++
+			}
+			fmt.Fprintf(&b, "M%d %dh%dv1h-%dz", m.quietZone+x, m.quietZone+y, run, run)
+			x += run
+		}
+	}
+	b.WriteString(`"/></svg>`)
+	return []byte(b.String())
+}
+
+// Arithmetic in GF(256) for the Reed-Solomon error correction of QR codes
+// and Data Matrix, which use different field polynomials
+type galoisField struct {
+	exp [512]byte
+	log [256]int
+}
+
+func newGaloisField(polynomial int) *galoisField {
+	gf := &galoisField{}
+	x := 1
+	for i := 0; i < 255; i++ {
+		gf.exp[i] = byte(x)
+		gf.log[x] = i
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= polynomial
+		}
+	}
+	for i := 255; i < 512; i++ {
+		gf.exp[i] = gf.exp[i-255]
+	}
+	return gf
+}
+
+func (gf *galoisField) mul(a byte, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gf.exp[gf.log[a]+gf.log[b]]
+}
+
+// Returns the n error correction codewords of data. The generator polynomial
+// has the roots a^firstRoot to a^(firstRoot+n-1).
+func (gf *galoisField) reedSolomon(data []byte, n int, firstRoot int) []byte {
+	// Generator coefficients, highest degree first
+	generator := []byte{1}
+	for i := 0; i < n; i++ {
+		root := gf.exp[(firstRoot+i)%255]
+		next := make([]byte, len(generator)+1)
+		for j, coefficient := range generator {
+			next[j] ^= coefficient
+			next[j+1] ^= gf.mul(coefficient, root)
+		}
+		generator = next
+	}
+
+	// Remainder of data * x^n divided by the generator
+	remainder := make([]byte, n)
+	for _, b := range data {
+		factor := b ^ remainder[0]
+		copy(remainder, remainder[1:])
+		remainder[n-1] = 0
+		for i := 0; i < n; i++ {
+			remainder[i] ^= gf.mul(generator[i+1], factor)
+		}
+	}
+	return remainder
+}
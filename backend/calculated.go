@@ -0,0 +1,313 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// sqlExecutor is implemented by both *sql.DB and *sql.Tx
+type sqlExecutor interface {
+	queryRower
+	Query(query string, args ...any) (*sql.Rows, error)
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// An attribute whose values are calculated from a formula
+type calculatedAttribute struct {
+	Id      int
+	Name    string
+	Formula *Formula
+}
+
+// Returns the calculated attributes of a collection, ordered so every
+// attribute comes after the calculated attributes it depends on
+func readCollectionFormulas(q sqlExecutor, collectionId int) ([]calculatedAttribute, error) {
+	rows, err := q.Query("SELECT id, name, formula FROM sample_attributes WHERE collection_id = ? AND formula IS NOT NULL AND deleted_at IS NULL", collectionId)
+	if err != nil {
+		return nil, fmt.Errorf("readCollectionFormulas: %v", err)
+	}
+	defer rows.Close()
+
+	var attributes []calculatedAttribute
+	for rows.Next() {
+		var attr calculatedAttribute
+		var source string
+		if err := rows.Scan(&attr.Id, &attr.Name, &source); err != nil {
+			return nil, fmt.Errorf("readCollectionFormulas: %v", err)
+		}
+		attr.Formula, err = parseFormula(source)
+		if err != nil {
+			return nil, fmt.Errorf("readCollectionFormulas: formula of %s: %v", attr.Name, err)
+		}
+		attributes = append(attributes, attr)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("readCollectionFormulas: %v", err)
+	}
+	return orderFormulas(attributes)
+}
+
+// Sorts calculated attributes by their dependencies, failing if they depend on each other in a cycle
+func orderFormulas(attributes []calculatedAttribute) ([]calculatedAttribute, error) {
+	byName := make(map[string]calculatedAttribute, len(attributes))
+	for _, attr := range attributes {
+		byName[attr.Name] = attr
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int, len(attributes))
+	ordered := make([]calculatedAttribute, 0, len(attributes))
+	var visit func(attr calculatedAttribute, path []string) error
+	visit = func(attr calculatedAttribute, path []string) error {
+		path = append(path, attr.Name)
+		switch state[attr.Name] {
+		case visiting:
+			return fmt.Errorf("formulas depend on each other in a cycle: %s", strings.Join(path, " -> "))
+		case visited:
+			return nil
+		}
+		state[attr.Name] = visiting
+		for _, reference := range attr.Formula.References {
+			if dependency, ok := byName[reference]; ok {
+				if err := visit(dependency, path); err != nil {
+					return err
+				}
+			}
+		}
+		state[attr.Name] = visited
+		ordered = append(ordered, attr)
+		return nil
+	}
+	for _, attr := range attributes {
+		if err := visit(attr, nil); err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
+}
+
+// Parses the formula of an attribute and checks that it only references other
+// attributes of the collection, without creating a cycle. attributeId is 0 for
+// an attribute that does not exist yet.
+func validateFormula(collectionId int, attributeId int, name string, source string) (*Formula, error) {
+	formula, err := parseFormula(source)
+	if err != nil {
+		return nil, fmt.Errorf("invalid formula: %v", err)
+	}
+
+	attributes, err := readCollectionAttributes(collectionId)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool, len(attributes))
+	for _, attr := range attributes {
+		names[attr.Name] = true
+	}
+	for _, reference := range formula.References {
+		if reference == name {
+			return nil, fmt.Errorf("invalid formula: %s cannot reference itself", name)
+		}
+		if !names[reference] {
+			return nil, fmt.Errorf("invalid formula: unknown attribute %q", reference)
+		}
+	}
+
+	calculated, err := readCollectionFormulas(DB, collectionId)
+	if err != nil {
+		return nil, err
+	}
+	others := []calculatedAttribute{{Id: attributeId, Name: name, Formula: formula}}
+	for _, attr := range calculated {
+		if attr.Id != attributeId {
+			others = append(others, attr)
+		}
+	}
+	if _, err := orderFormulas(others); err != nil {
+		return nil, err
+	}
+	return formula, nil
+}
+
+// Calculates the values of every calculated attribute of a sample from its
+// other values. Values that cannot be calculated, e.g. because an input is
+// missing, are removed. The uncertainties of the inputs are propagated to the
+// result, which is written with the fewest significant figures of its inputs.
+func recomputeSampleFormulas(q sqlExecutor, sampleId int) error {
+	var collectionId int
+	if err := q.QueryRow("SELECT collection_id FROM samples WHERE id = ?", sampleId).Scan(&collectionId); err != nil {
+		return fmt.Errorf("recomputeSampleFormulas: %v", err)
+	}
+	calculated, err := readCollectionFormulas(q, collectionId)
+	if err != nil || len(calculated) == 0 {
+		return err
+	}
+
+	// Numeric values of the sample by attribute name, censored values enter by
+	// the substitution rule of their attribute
+	query := `
+		SELECT a.name, v.value, v.censor, a.substitution, v.uncertainty, v.uncertainty_type, v.significant_figures
+		FROM sample_attribute_values v JOIN sample_attributes a ON a.id = v.attribute_id
+		WHERE v.sample_id = ? AND a.deleted_at IS NULL
+	`
+	rows, err := q.Query(query, sampleId)
+	if err != nil {
+		return fmt.Errorf("recomputeSampleFormulas: %v", err)
+	}
+	values := make(map[string]float64)
+	uncertainties := make(map[string]float64)
+	figures := make(map[string]int)
+	for rows.Next() {
+		var name string
+		var value, censor, rule *string
+		var precision MeasurementPrecision
+		if err := rows.Scan(&name, &value, &censor, &rule, &precision.Uncertainty, &precision.UncertaintyType, &precision.SignificantFigures); err != nil {
+			rows.Close()
+			return fmt.Errorf("recomputeSampleFormulas: %v", err)
+		}
+		if value == nil {
+			continue
+		}
+		number, err := strconv.ParseFloat(strings.TrimSpace(*value), 64)
+		if err != nil {
+			continue
+		}
+		if substituted, ok := substituteCensored(number, censor, rule); ok {
+			values[name] = substituted
+			uncertainties[name] = absoluteUncertainty(number, precision)
+			if precision.SignificantFigures != nil {
+				figures[name] = *precision.SignificantFigures
+			}
+		}
+	}
+	rows.Close()
+
+	for _, attr := range calculated {
+		delete(values, attr.Name)
+		delete(uncertainties, attr.Name)
+		delete(figures, attr.Name)
+		result, err := attr.Formula.evaluate(values)
+		if err != nil {
+			result, err := q.Exec("DELETE FROM sample_attribute_values WHERE sample_id = ? AND attribute_id = ?", sampleId, attr.Id)
+			if err != nil {
+				return fmt.Errorf("recomputeSampleFormulas: %v", err)
+			}
+			if removed, err := result.RowsAffected(); err == nil && removed > 0 {
+				if err := recordValueVersion(q, sampleId, attr.Id, nil, nil, nil); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		values[attr.Name] = result
+
+		var precision MeasurementPrecision
+		value := strconv.FormatFloat(result, 'g', 10, 64)
+		if precision.SignificantFigures = propagateSignificantFigures(attr.Formula, figures); precision.SignificantFigures != nil {
+			figures[attr.Name] = *precision.SignificantFigures
+			value = formatSignificantFigures(result, *precision.SignificantFigures)
+		}
+		if uncertainty, ok := propagateUncertainty(attr.Formula, values, uncertainties); ok {
+			uncertainties[attr.Name] = uncertainty
+			formatted, kind := formatSignificantFigures(uncertainty, calculatedUncertaintyFigures), uncertaintyAbsolute
+			precision.Uncertainty, precision.UncertaintyType = &formatted, &kind
+		}
+		flag, err := evaluateValueFlag(q, sampleId, attr.Id, value, nil)
+		if err != nil {
+			return err
+		}
+		// Only changed values get a new version
+		var previous, previousUncertainty *string
+		err = q.QueryRow("SELECT value, uncertainty FROM sample_attribute_values WHERE sample_id = ? AND attribute_id = ?", sampleId, attr.Id).Scan(&previous, &previousUncertainty)
+		if err != nil && err != sql.ErrNoRows {
+			return fmt.Errorf("recomputeSampleFormulas: %v", err)
+		}
+		query := `
+			INSERT INTO sample_attribute_values (sample_id, attribute_id, value, flag, uncertainty, uncertainty_type, significant_figures) VALUES (?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (sample_id, attribute_id) DO UPDATE SET
+				value = excluded.value, flag = excluded.flag,
+				uncertainty = excluded.uncertainty, uncertainty_type = excluded.uncertainty_type, significant_figures = excluded.significant_figures
+		`
+		if _, err := q.Exec(query, sampleId, attr.Id, value, flag, precision.Uncertainty, precision.UncertaintyType, precision.SignificantFigures); err != nil {
+			return fmt.Errorf("recomputeSampleFormulas: %v", err)
+		}
+		uncertaintyChanged := (previousUncertainty == nil) != (precision.Uncertainty == nil) ||
+			(previousUncertainty != nil && *previousUncertainty != *precision.Uncertainty)
+		if previous == nil || *previous != value || uncertaintyChanged {
+			if err := recordValueVersion(q, sampleId, attr.Id, &value, flag, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Calculates the values of every sample of a collection again, after a formula
+// changed. Samples in the trash or in a locked workflow state are left as they are.
+func recomputeCollectionFormulas(collectionId int) error {
+	query := `
+		SELECT s.id FROM samples s
+		LEFT JOIN workflow_states ws ON ws.id = s.status_id
+		WHERE s.collection_id = ? AND s.deleted_at IS NULL AND COALESCE(ws.is_locked, 0) = 0
+	`
+	rows, err := DB.Query(query, collectionId)
+	if err != nil {
+		return fmt.Errorf("recomputeCollectionFormulas: %v", err)
+	}
+	var sampleIds []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return fmt.Errorf("recomputeCollectionFormulas: %v", err)
+		}
+		sampleIds = append(sampleIds, id)
+	}
+	rows.Close()
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return fmt.Errorf("recomputeCollectionFormulas: %v", err)
+	}
+	defer tx.Rollback()
+
+	for _, sampleId := range sampleIds {
+		if err := recomputeSampleFormulas(tx, sampleId); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Whether the values of an attribute are calculated from a formula
+func isCalculatedAttribute(q queryRower, attributeId int) (bool, error) {
+	var calculated bool
+	err := q.QueryRow("SELECT formula IS NOT NULL FROM sample_attributes WHERE id = ?", attributeId).Scan(&calculated)
+	if err != nil && err != sql.ErrNoRows {
+		return false, fmt.Errorf("isCalculatedAttribute: %v", err)
+	}
+	return calculated, nil
+}
+
+// Returns the names of the calculated attributes whose formulas reference an attribute
+func readFormulaDependents(collectionId int, name string) ([]string, error) {
+	calculated, err := readCollectionFormulas(DB, collectionId)
+	if err != nil {
+		return nil, err
+	}
+	var dependents []string
+	for _, attr := range calculated {
+		for _, reference := range attr.Formula.References {
+			if reference == name {
+				dependents = append(dependents, attr.Name)
+				break
+			}
+		}
+	}
+	return dependents, nil
+}
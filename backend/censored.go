@@ -0,0 +1,292 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Censored values are stored as the number they are censored at, with the
+// operator in the censor column. Operators may be written in ASCII.
+var censorOperators = map[string]string{
+	"<": "<", ">": ">",
+	"<=": "≤", ">=": "≥",
+	"≤": "≤", "≥": "≥",
+}
+
+// Rules for the number a censored value enters statistics and formulas with.
+// Values censored from above ("<", "≤") are substituted, values censored from
+// below (">", "≥") always enter with their limit unless they are excluded.
+const (
+	substituteHalf    = "half"    // limit / 2
+	substituteSqrt2   = "sqrt2"   // limit / √2
+	substituteLimit   = "limit"   // the limit itself
+	substituteZero    = "zero"    // 0
+	substituteExclude = "exclude" // left out
+)
+
+var substitutionRules = []string{substituteHalf, substituteSqrt2, substituteLimit, substituteZero, substituteExclude}
+
+/*
+Gets the codes values can be qualified with
+
+Result:
+
+	[{
+		code: string,
+		description: string
+	}]
+*/
+func fetchQualifierCodesHandler(w http.ResponseWriter, r *http.Request) {
+	rows, err := DB.Query("SELECT code, description FROM qualifier_codes ORDER BY code")
+	if err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	codes := []QualifierCode{}
+	for rows.Next() {
+		var code QualifierCode
+		if err := rows.Scan(&code.Code, &code.Description); err != nil {
+			http.Error(w, "error when reading from database", http.StatusInternalServerError)
+			return
+		}
+		codes = append(codes, code)
+	}
+	if err = rows.Err(); err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(codes)
+}
+
+/*
+Adds a code values can be qualified with
+
+Query params:
+
+	code: string, // At most 8 characters, e.g. "J"
+	description: string
+*/
+func insertQualifierCodeHandler(w http.ResponseWriter, r *http.Request) {
+	code := strings.TrimSpace(r.FormValue("code"))
+	description := strings.TrimSpace(r.FormValue("description"))
+	if code == "" || description == "" {
+		http.Error(w, "code and description are required", http.StatusBadRequest)
+		return
+	}
+	if len(code) > 8 {
+		http.Error(w, "code must be at most 8 characters", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := DB.Exec("INSERT INTO qualifier_codes (code, description) VALUES (?, ?)", code, description); err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed:") {
+			http.Error(w, "qualifier code already exists", http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "error inserting to database", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+/*
+Deletes a qualifier code that no value uses
+
+Query params:
+
+	code: string
+*/
+func deleteQualifierCodeHandler(w http.ResponseWriter, r *http.Request) {
+	code := r.FormValue("code")
+	result, err := DB.Exec("DELETE FROM qualifier_codes WHERE code = ?", code)
+	if err != nil {
+		if strings.Contains(err.Error(), "FOREIGN KEY constraint failed") {
+			http.Error(w, "qualifier code is in use", http.StatusConflict)
+			return
+		}
+		http.Error(w, "error when deleting from database", http.StatusInternalServerError)
+		return
+	}
+	if rowsAffected, err := result.RowsAffected(); err != nil || rowsAffected == 0 {
+		http.Error(w, "qualifier code not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+type QualifierCode struct {
+	Code        string `json:"code"`
+	Description string `json:"description"`
+}
+
+// Limits of detection and quantitation of an attribute, all nullable
+type DetectionLimits struct {
+	LOD  *float64 `json:"lod,omitempty"`
+	LOQ  *float64 `json:"loq,omitempty"`
+	ULOQ *float64 `json:"uloq,omitempty"`
+}
+
+// Detection limits must be in increasing order
+func (limits DetectionLimits) validate() error {
+	bounds := []*float64{limits.LOD, limits.LOQ, limits.ULOQ}
+	var previous *float64
+	for _, bound := range bounds {
+		if bound == nil {
+			continue
+		}
+		if previous != nil && *bound < *previous {
+			return fmt.Errorf("detection limits must satisfy lod <= loq <= uloq")
+		}
+		previous = bound
+	}
+	return nil
+}
+
+// Parses the optional detection limits of an attribute. Empty params are returned as nil.
+func parseDetectionLimits(r *http.Request) (DetectionLimits, error) {
+	var limits DetectionLimits
+	bounds := map[string]**float64{"lod": &limits.LOD, "loq": &limits.LOQ, "uloq": &limits.ULOQ}
+	for name, bound := range bounds {
+		_value := r.FormValue(name)
+		if _value == "" {
+			continue
+		}
+		value, ok := parseFiniteNumber(_value)
+		if !ok {
+			return limits, fmt.Errorf("%s must be a finite number", name)
+		}
+		*bound = &value
+	}
+	return limits, limits.validate()
+}
+
+// Parses the substitution rule of an attribute or a request, nil if it is empty
+func parseSubstitution(rule string) (*string, error) {
+	if rule == "" {
+		return nil, nil
+	}
+	for _, known := range substitutionRules {
+		if rule == known {
+			return &rule, nil
+		}
+	}
+	return nil, fmt.Errorf("substitution must be one of: %s", strings.Join(substitutionRules, ", "))
+}
+
+// Reads the detection limits of an attribute
+func readDetectionLimits(q queryRower, attributeId int) (DetectionLimits, error) {
+	var limits DetectionLimits
+	err := q.QueryRow("SELECT lod, loq, uloq FROM sample_attributes WHERE id = ?", attributeId).Scan(&limits.LOD, &limits.LOQ, &limits.ULOQ)
+	if err != nil && err != sql.ErrNoRows {
+		return limits, fmt.Errorf("readDetectionLimits: %v", err)
+	}
+	return limits, nil
+}
+
+// Splits a value into its number and censor. The censor is given on its own
+// or in front of the value, like "<0.5". Instead of a number the value may
+// name a detection limit of the attribute: "<LOD", "<LOQ", ">ULOQ", and "ND"
+// for "<LOD". Values that are not censored are returned as they are.
+func parseCensoredValue(q queryRower, attributeId int, value string, censor string) (string, *string, error) {
+	value = strings.TrimSpace(value)
+	if censor == "" {
+		for _, prefix := range []string{"<=", ">=", "≤", "≥", "<", ">"} {
+			if strings.HasPrefix(value, prefix) {
+				censor = prefix
+				value = strings.TrimSpace(strings.TrimPrefix(value, prefix))
+				break
+			}
+		}
+	}
+	if strings.EqualFold(value, "ND") && censor == "" {
+		censor, value = "<", "LOD"
+	}
+	if censor == "" {
+		return value, nil, nil
+	}
+	operator, ok := censorOperators[censor]
+	if !ok {
+		return "", nil, fmt.Errorf("censor must be one of: <, >, <=, >=, ≤, ≥")
+	}
+
+	// Named detection limits
+	names := map[string]func(DetectionLimits) *float64{
+		"LOD":  func(limits DetectionLimits) *float64 { return limits.LOD },
+		"LOQ":  func(limits DetectionLimits) *float64 { return limits.LOQ },
+		"ULOQ": func(limits DetectionLimits) *float64 { return limits.ULOQ },
+	}
+	if limit, ok := names[strings.ToUpper(value)]; ok {
+		limits, err := readDetectionLimits(q, attributeId)
+		if err != nil {
+			return "", nil, err
+		}
+		bound := limit(limits)
+		if bound == nil {
+			return "", nil, fmt.Errorf("attribute has no %s", strings.ToUpper(value))
+		}
+		value = strconv.FormatFloat(*bound, 'g', 10, 64)
+	}
+
+	if _, ok := parseFiniteNumber(value); !ok {
+		return "", nil, fmt.Errorf("censored values must have a finite number, e.g. <0.5")
+	}
+	return value, &operator, nil
+}
+
+// Checks that a qualifier is one of the qualifier codes
+func checkQualifierCode(q queryRower, qualifier string) (int, error) {
+	var exists bool
+	if err := q.QueryRow("SELECT EXISTS(SELECT 1 FROM qualifier_codes WHERE code = ?)", qualifier).Scan(&exists); err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("error when reading from database")
+	}
+	if !exists {
+		return http.StatusBadRequest, fmt.Errorf("unknown qualifier code %q", qualifier)
+	}
+	return 0, nil
+}
+
+// Returns the number a value enters statistics and formulas with, and false
+// if the rule leaves it out. Values that are not censored enter as they are.
+func substituteCensored(number float64, censor *string, rule *string) (float64, bool) {
+	if censor == nil {
+		return number, true
+	}
+	substitution := substituteHalf
+	if rule != nil {
+		substitution = *rule
+	}
+	if substitution == substituteExclude {
+		return 0, false
+	}
+	if *censor == ">" || *censor == "≥" {
+		return number, true
+	}
+	switch substitution {
+	case substituteSqrt2:
+		return number / math.Sqrt2, true
+	case substituteLimit:
+		return number, true
+	case substituteZero:
+		return 0, true
+	}
+	return number / 2, true
+}
+
+// Writes a censored value the way it was entered, like "<0.5"
+func formatCensoredValue(value string, censor *string) string {
+	if censor == nil {
+		return value
+	}
+	return *censor + value
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Bar and space widths of the Code 128 symbols 0-106, in modules. Every
+// symbol is three bars and three spaces, the stop symbol has a final bar.
+var code128Patterns = [107]string{
+	"212222", "222122", "222221", "121223", "121322", "131222", "122213", "122312", "132212", "221213",
+	"221312", "231212", "112232", "122132", "122231", "113222", "123122", "123221", "223211", "221132",
+	"221231", "213212", "223112", "312131", "311222", "321122", "321221", "312212", "322112", "322211",
+	"212123", "212321", "232121", "111323", "131123", "131321", "112313", "132113", "132311", "211313",
+	"231113", "231311", "112133", "112331", "132131", "113123", "113321", "133121", "313121", "211331",
+	"231131", "213113", "213311", "213131", "311123", "311321", "331121", "312113", "312311", "332111",
+	"314111", "221411", "431111", "111224", "111422", "121124", "121421", "141122", "141221", "112214",
+	"112412", "122114", "122411", "142112", "142211", "241211", "221114", "413111", "241112", "134111",
+	"111242", "121142", "121241", "114212", "124112", "124211", "411212", "421112", "421211", "212141",
+	"214121", "412121", "111143", "111341", "131141", "114113", "114311", "411113", "411311", "113141",
+	"114131", "311141", "411131", "211412", "211214", "211232", "2331112",
+}
+
+const (
+	code128CodeC  = 99
+	code128CodeB  = 100
+	code128StartB = 104
+	code128StartC = 105
+	code128Stop   = 106
+)
+
+// Encodes printable ASCII as Code 128. Runs of digits are packed in pairs
+// with code set C, everything else uses code set B.
+func encodeCode128(text string) (*barcodeMatrix, error) {
+	if text == "" {
+		return nil, fmt.Errorf("nothing to encode")
+	}
+	for i := 0; i < len(text); i++ {
+		if text[i] < 32 || text[i] > 126 {
+			return nil, fmt.Errorf("code128 can only encode printable ASCII")
+		}
+	}
+
+	digitsFrom := func(i int) int {
+		n := 0
+		for i+n < len(text) && text[i+n] >= '0' && text[i+n] <= '9' {
+			n++
+		}
+		return n
+	}
+
+	var symbols []int
+	codeC := false
+	for i := 0; i < len(text); {
+		digits := digitsFrom(i)
+		// Code set C pays off for 4 digits at the start or end, and 6 in the middle
+		worthC := digits >= 6 || (digits >= 4 && (i == 0 || i+digits == len(text)))
+		switch {
+		case len(symbols) == 0 && worthC:
+			symbols = append(symbols, code128StartC)
+			codeC = true
+		case len(symbols) == 0:
+			symbols = append(symbols, code128StartB)
+		case !codeC && worthC:
+			// An odd run starts with a single digit in code set B
+			if digits%2 == 1 {
+				symbols = append(symbols, int(text[i])-32)
+				i++
+				digits--
+			}
+			symbols = append(symbols, code128CodeC)
+			codeC = true
+		}
+
+		if codeC {
+			if digits >= 2 {
+				symbols = append(symbols, int(text[i]-'0')*10+int(text[i+1]-'0'))
+				i += 2
+				continue
+			}
+			symbols = append(symbols, code128CodeB)
+			codeC = false
+		}
+		symbols = append(symbols, int(text[i])-32)
+		i++
+	}
+
+	checksum := symbols[0]
+	for i, symbol := range symbols[1:] {
+		checksum += symbol * (i + 1)
+	}
+	symbols = append(symbols, checksum%103, code128Stop)
+
+	// Draw the bars, each symbol alternates bar and space starting with a bar
+	var modules []bool
+	for _, symbol := range symbols {
+		for i, width := range code128Patterns[symbol] {
+			for j := 0; j < int(width-'0'); j++ {
+				modules = append(modules, i%2 == 0)
+			}
+		}
+	}
+
+	// The bars are a single row stretched to a readable height
+	const quietZone = 10
+	const height = 40
+	matrix := newBarcodeMatrix(len(modules), height, quietZone)
+	for y := 0; y < height; y++ {
+		for x, dark := range modules {
+			matrix.set(x, y, dark)
+		}
+	}
+	return matrix, nil
+}
@@ -7,10 +7,11 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 )
 
 /*
-Deletes a collection from the collections table
+Moves a collection to the trash, together with its attributes and samples
 
 Query params:
 
@@ -27,9 +28,9 @@ func deleteCollectionHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Delete collection from database
-	query := "DELETE FROM collections WHERE id = ?"
-	result, err := DB.Exec(query, collectionId)
+	// Move collection to the trash
+	query := "UPDATE collections SET deleted_at = ? WHERE id = ? AND deleted_at IS NULL"
+	result, err := DB.Exec(query, time.Now().Unix(), collectionId)
 	if err != nil {
 		http.Error(w, "failed to delete collection", http.StatusInternalServerError)
 		return
@@ -58,7 +59,8 @@ Result:
 	[{
 		id: int,
 		name: string,
-		description: string
+		description: string,
+		identifier_pattern: string // Omitted if samples get no identifiers
 	}]
 */
 func fetchCollectionsHandler(w http.ResponseWriter, r *http.Request) {
@@ -67,7 +69,7 @@ func fetchCollectionsHandler(w http.ResponseWriter, r *http.Request) {
 	_id := r.FormValue("id")
 	if _id == "" {
 		// No id, so get all
-		rows, err := DB.Query("SELECT id, name, description FROM collections")
+		rows, err := DB.Query("SELECT id, name, description, identifier_pattern FROM collections WHERE deleted_at IS NULL")
 		if err != nil {
 			http.Error(w, "error when reading from database", http.StatusInternalServerError)
 			return
@@ -76,7 +78,7 @@ func fetchCollectionsHandler(w http.ResponseWriter, r *http.Request) {
 
 		for rows.Next() {
 			var collection Collection
-			if err := rows.Scan(&collection.Id, &collection.Name, &collection.Description); err != nil {
+			if err := rows.Scan(&collection.Id, &collection.Name, &collection.Description, &collection.IdentifierPattern); err != nil {
 				http.Error(w, "error when reading from database", http.StatusInternalServerError)
 				return
 			}
@@ -100,7 +102,7 @@ func fetchCollectionsHandler(w http.ResponseWriter, r *http.Request) {
 		collection := Collection{
 			Id: &id,
 		}
-		err = DB.QueryRow("SELECT name, description FROM collections WHERE id = ?", id).Scan(&collection.Name, &collection.Description)
+		err = DB.QueryRow("SELECT name, description, identifier_pattern FROM collections WHERE id = ? AND deleted_at IS NULL", id).Scan(&collection.Name, &collection.Description, &collection.IdentifierPattern)
 		if err != nil {
 			if err == sql.ErrNoRows {
 				w.WriteHeader(http.StatusNoContent)
@@ -129,7 +131,8 @@ Body:
 
 	{
 		name: string,
-		description: string
+		description: string,
+		identifier_pattern?: string // e.g. "WQ-{YYYY}-{seq:0000}", see identifiers.go
 	}
 */
 func insertCollectionHandler(w http.ResponseWriter, r *http.Request) {
@@ -150,13 +153,21 @@ func insertCollectionHandler(w http.ResponseWriter, r *http.Request) {
 		collection.Description = new(string)
 		*collection.Description = ""
 	}
+	if collection.IdentifierPattern != nil {
+		if *collection.IdentifierPattern == "" {
+			collection.IdentifierPattern = nil
+		} else if _, err := parseIdentifierPattern(*collection.IdentifierPattern); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
 
 	// Insert into database
-	query := "INSERT INTO collections (name, description) VALUES (?, ?)"
-	result, err := DB.Exec(query, collection.Name, collection.Description)
+	query := "INSERT INTO collections (name, description, identifier_pattern) VALUES (?, ?, ?)"
+	result, err := DB.Exec(query, collection.Name, collection.Description, collection.IdentifierPattern)
 	if err != nil {
 		if strings.Contains(err.Error(), "UNIQUE constraint failed: collections.name") {
-			http.Error(w, "collection already exists", http.StatusBadRequest)
+			http.Error(w, collectionExistsMessage(collection.Name), http.StatusBadRequest)
 			return
 		}
 		http.Error(w, "Failed to insert collection", http.StatusInternalServerError)
@@ -176,9 +187,121 @@ func insertCollectionHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "{\"id\":  %d}", id)
 }
 
+/*
+Updates the name, description and/or identifier pattern of a collection.
+Setting an identifier pattern gives identifiers to the samples that have
+none, oldest first. An empty identifier_pattern stops giving identifiers
+to new samples, existing identifiers are kept.
+
+Query params:
+
+	collection_id: int,
+	name?: string,
+	description?: string,
+	identifier_pattern?: string
+*/
+func updateCollectionHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse request
+	_collectionId := r.FormValue("collection_id")
+	name := r.FormValue("name")
+	description := r.FormValue("description")
+	identifierPattern := r.FormValue("identifier_pattern")
+
+	collectionId, err := strconv.Atoi(_collectionId)
+	if err != nil {
+		http.Error(w, "collection_id must be a positive int", http.StatusBadRequest)
+		return
+	}
+
+	query := []string{}
+	args := []interface{}{}
+	if r.Form.Has("name") {
+		if name == "" {
+			http.Error(w, "name cannot be empty", http.StatusBadRequest)
+			return
+		}
+		query = append(query, "name = ?")
+		args = append(args, name)
+	}
+	if r.Form.Has("description") {
+		query = append(query, "description = ?")
+		args = append(args, description)
+	}
+	if r.Form.Has("identifier_pattern") {
+		if identifierPattern == "" {
+			query = append(query, "identifier_pattern = NULL")
+		} else {
+			if _, err := parseIdentifierPattern(identifierPattern); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			query = append(query, "identifier_pattern = ?")
+			args = append(args, identifierPattern)
+		}
+	}
+	if len(query) == 0 {
+		http.Error(w, "name, description or identifier_pattern is required", http.StatusBadRequest)
+		return
+	}
+	args = append(args, collectionId)
+
+	tx, err := DB.Begin()
+	if err != nil {
+		http.Error(w, "failed to update collection", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE collections SET "+strings.Join(query, ", ")+" WHERE id = ? AND deleted_at IS NULL", args...)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed: collections.name") {
+			tx.Rollback()
+			http.Error(w, collectionExistsMessage(name), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "failed to update collection", http.StatusInternalServerError)
+		return
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil || rowsAffected == 0 {
+		http.Error(w, "collection not found", http.StatusNotFound)
+		return
+	}
+
+	if identifierPattern != "" {
+		if err := backfillSampleIdentifiers(tx, collectionId); err != nil {
+			if _, ok := err.(identifierInUseError); ok {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			http.Error(w, "failed to give samples identifiers", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		http.Error(w, "failed to update collection", http.StatusInternalServerError)
+		return
+	}
+	emitWebhookEvent(collectionId, "collection.updated", map[string]any{"collection_id": collectionId})
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// Names stay taken while a collection is in the trash, so say where the name is used
+func collectionExistsMessage(name string) string {
+	var trashed bool
+	err := DB.QueryRow("SELECT deleted_at IS NOT NULL FROM collections WHERE name = ?", name).Scan(&trashed)
+	if err == nil && trashed {
+		return "a collection with this name is in the trash"
+	}
+	return "collection already exists"
+}
+
 // Collection represents the structure of the collection table
 type Collection struct {
-	Id          *int    `json:"id,omitempty"`
-	Name        string  `json:"name"`
-	Description *string `json:"description,omitempty"`
+	Id                *int    `json:"id,omitempty"`
+	Name              string  `json:"name"`
+	Description       *string `json:"description,omitempty"`
+	IdentifierPattern *string `json:"identifier_pattern,omitempty"` // Nullable, see identifiers.go
 }
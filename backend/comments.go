@@ -0,0 +1,614 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Longest comment body in characters
+const maxCommentLength = 10000
+
+/*
+Gets the comment threads of a sample, oldest first with the replies of each
+thread oldest first
+
+Query params:
+
+	sample_id: int,
+	attribute_id?: int, // Only the threads on this value
+	unresolved?: bool // Only threads that are not resolved
+
+Result:
+
+	[{
+		id: int,
+		sample_id: int,
+		attribute_id: int, // Omitted for threads on the sample
+		user_id: int,
+		username: string, // Omitted if the user was deleted
+		body: string,
+		mentions: [{ user_id: int, username: string }],
+		created_at: int,
+		edited_at: int, // Omitted if never edited
+		resolved: bool,
+		resolved_by: int,
+		resolved_at: int,
+		replies: [{
+			id: int,
+			parent_id: int,
+			user_id: int,
+			username: string,
+			body: string,
+			mentions: [{ user_id: int, username: string }],
+			created_at: int,
+			edited_at: int
+		}]
+	}]
+*/
+func fetchCommentsHandler(w http.ResponseWriter, r *http.Request) {
+	sampleId, err := strconv.Atoi(r.FormValue("sample_id"))
+	if err != nil {
+		http.Error(w, "sample_id must be a positive int", http.StatusBadRequest)
+		return
+	}
+	var attributeId *int
+	if _attributeId := r.FormValue("attribute_id"); _attributeId != "" {
+		id, err := strconv.Atoi(_attributeId)
+		if err != nil {
+			http.Error(w, "attribute_id must be a positive int", http.StatusBadRequest)
+			return
+		}
+		attributeId = &id
+	}
+	unresolved := r.FormValue("unresolved") == "true"
+
+	if status, err := checkCommentSample(sampleId); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	mentions, err := readSampleCommentMentions(sampleId)
+	if err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+
+	query := `
+		SELECT c.id, c.sample_id, c.attribute_id, c.parent_id, c.user_id, u.username, c.body,
+			c.resolved_at, c.resolved_by, c.created_at, c.edited_at
+		FROM comments c LEFT JOIN users u ON u.id = c.user_id
+		WHERE c.sample_id = ?
+		ORDER BY c.created_at, c.id
+	`
+	rows, err := DB.Query(query, sampleId)
+	if err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	threads := []*CommentThread{}
+	threadIndex := make(map[int]*CommentThread)
+	var replies []Comment
+	for rows.Next() {
+		var c Comment
+		var resolvedAt *int64
+		var resolvedBy *int
+		if err := rows.Scan(&c.Id, &c.SampleId, &c.AttributeId, &c.ParentId, &c.UserId, &c.Username, &c.Body, &resolvedAt, &resolvedBy, &c.CreatedAt, &c.EditedAt); err != nil {
+			http.Error(w, "error when reading from database", http.StatusInternalServerError)
+			return
+		}
+		c.Mentions = mentions[c.Id]
+		if c.Mentions == nil {
+			c.Mentions = []CommentMention{}
+		}
+		if c.ParentId != nil {
+			replies = append(replies, c)
+			continue
+		}
+		thread := &CommentThread{Comment: c, Resolved: resolvedAt != nil, ResolvedBy: resolvedBy, ResolvedAt: resolvedAt, Replies: []Comment{}}
+		threadIndex[c.Id] = thread
+		if attributeId != nil && (c.AttributeId == nil || *c.AttributeId != *attributeId) {
+			continue
+		}
+		if unresolved && thread.Resolved {
+			continue
+		}
+		threads = append(threads, thread)
+	}
+	if err = rows.Err(); err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	for _, reply := range replies {
+		if thread, ok := threadIndex[*reply.ParentId]; ok {
+			// The thread already tells what the reply is on
+			reply.SampleId = 0
+			reply.AttributeId = nil
+			thread.Replies = append(thread.Replies, reply)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(threads)
+}
+
+/*
+Comments on a sample or one of its values, or replies to a thread. Users are
+mentioned with @username, or @"user name" if the username has spaces, and
+get notified.
+
+Body:
+
+	{
+		sample_id: int, // Not needed for replies
+		attribute_id?: int, // Comment on the value of this attribute
+		parent_id?: int, // Reply to the thread of this comment
+		body: string
+	}
+
+Result:
+
+	{ id: int }
+*/
+func insertCommentHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(User)
+
+	var comment InsertCommentBody
+	if err := json.NewDecoder(r.Body).Decode(&comment); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	body, err := validateCommentBody(comment.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Replies go in the thread of the comment they answer
+	if comment.ParentId != nil {
+		var parentId *int
+		err := DB.QueryRow("SELECT sample_id, attribute_id, parent_id FROM comments WHERE id = ?", *comment.ParentId).Scan(&comment.SampleId, &comment.AttributeId, &parentId)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "parent comment not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, "error when reading from database", http.StatusInternalServerError)
+			return
+		}
+		if parentId != nil {
+			comment.ParentId = parentId
+		}
+	}
+	if comment.SampleId == 0 {
+		http.Error(w, "sample_id is required", http.StatusBadRequest)
+		return
+	}
+	if status, err := checkCommentSample(comment.SampleId); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if comment.AttributeId != nil && comment.ParentId == nil {
+		query := `
+			SELECT EXISTS(
+				SELECT 1 FROM sample_attributes a JOIN samples s ON s.collection_id = a.collection_id
+				WHERE a.id = ? AND s.id = ? AND a.deleted_at IS NULL
+			)
+		`
+		var found bool
+		if err := DB.QueryRow(query, *comment.AttributeId, comment.SampleId).Scan(&found); err != nil {
+			http.Error(w, "error when reading from database", http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(w, "attribute not found in the collection of the sample", http.StatusNotFound)
+			return
+		}
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		http.Error(w, "failed to insert comment", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO comments (sample_id, attribute_id, parent_id, user_id, body, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`
+	result, err := tx.Exec(query, comment.SampleId, comment.AttributeId, comment.ParentId, user.Id, body, time.Now().Unix())
+	if err != nil {
+		http.Error(w, "failed to insert comment", http.StatusInternalServerError)
+		return
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		http.Error(w, "failed to insert comment", http.StatusInternalServerError)
+		return
+	}
+	mentioned, err := saveCommentMentions(tx, int(id), body)
+	if err != nil {
+		http.Error(w, "failed to insert comment", http.StatusInternalServerError)
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		http.Error(w, "failed to insert comment", http.StatusInternalServerError)
+		return
+	}
+
+	if collectionId, err := readSampleCollectionId(comment.SampleId); err == nil {
+		emitWebhookEvent(collectionId, "comment.created", map[string]any{"comment_id": id, "sample_id": comment.SampleId, "attribute_id": comment.AttributeId, "parent_id": comment.ParentId, "mentions": mentioned})
+	}
+	notifyCommentMentions(user, comment.SampleId, int(id), mentioned, body)
+
+	fmt.Fprintf(w, "{\"id\":  %d}", id)
+}
+
+/*
+Edits the body of a comment. Only the author can edit a comment, the body
+before the edit is kept in its history. Users mentioned for the first time
+are notified.
+
+Query params:
+
+	comment_id: int,
+	body: string
+*/
+func updateCommentHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(User)
+	comment, status, err := readComment(r.FormValue("comment_id"))
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if comment.UserId != user.Id {
+		http.Error(w, "only the author can edit a comment", http.StatusForbidden)
+		return
+	}
+	body, err := validateCommentBody(r.FormValue("body"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if body == comment.Body {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		http.Error(w, "failed to update comment", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	now := time.Now().Unix()
+	writtenAt := comment.CreatedAt
+	if comment.EditedAt != nil {
+		writtenAt = *comment.EditedAt
+	}
+	_, err = tx.Exec("INSERT INTO comment_edits (comment_id, body, created_at, edited_at) VALUES (?, ?, ?, ?)", comment.Id, comment.Body, writtenAt, now)
+	if err != nil {
+		http.Error(w, "failed to update comment", http.StatusInternalServerError)
+		return
+	}
+	if _, err = tx.Exec("UPDATE comments SET body = ?, edited_at = ? WHERE id = ?", body, now, comment.Id); err != nil {
+		http.Error(w, "failed to update comment", http.StatusInternalServerError)
+		return
+	}
+	mentioned, err := saveCommentMentions(tx, comment.Id, body)
+	if err != nil {
+		http.Error(w, "failed to update comment", http.StatusInternalServerError)
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		http.Error(w, "failed to update comment", http.StatusInternalServerError)
+		return
+	}
+	// Only users added by the edit are notified
+	notifyCommentMentions(user, comment.SampleId, comment.Id, mentioned, body)
+
+	w.WriteHeader(http.StatusOK)
+}
+
+/*
+Gets the earlier bodies of a comment, oldest first. The current body is not
+included.
+
+Query params:
+
+	comment_id: int
+
+Result:
+
+	[{
+		body: string,
+		created_at: int, // UNIX time the body was written
+		edited_at: int // UNIX time it was replaced
+	}]
+*/
+func fetchCommentHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	comment, status, err := readComment(r.FormValue("comment_id"))
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	rows, err := DB.Query("SELECT body, created_at, edited_at FROM comment_edits WHERE comment_id = ? ORDER BY edited_at, id", comment.Id)
+	if err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	edits := []CommentEdit{}
+	for rows.Next() {
+		var edit CommentEdit
+		if err := rows.Scan(&edit.Body, &edit.CreatedAt, &edit.EditedAt); err != nil {
+			http.Error(w, "error when reading from database", http.StatusInternalServerError)
+			return
+		}
+		edits = append(edits, edit)
+	}
+	if err = rows.Err(); err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(edits)
+}
+
+/*
+Resolves or reopens a thread
+
+Query params:
+
+	comment_id: int, // The first comment of the thread
+	resolved: bool
+*/
+func resolveCommentHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(User)
+	comment, status, err := readComment(r.FormValue("comment_id"))
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if comment.ParentId != nil {
+		http.Error(w, "replies can not be resolved, resolve the first comment of the thread", http.StatusBadRequest)
+		return
+	}
+	resolved, err := strconv.ParseBool(r.FormValue("resolved"))
+	if err != nil {
+		http.Error(w, "resolved must be true or false", http.StatusBadRequest)
+		return
+	}
+
+	if resolved {
+		_, err = DB.Exec("UPDATE comments SET resolved_at = ?, resolved_by = ? WHERE id = ? AND resolved_at IS NULL", time.Now().Unix(), user.Id, comment.Id)
+	} else {
+		_, err = DB.Exec("UPDATE comments SET resolved_at = NULL, resolved_by = NULL WHERE id = ?", comment.Id)
+	}
+	if err != nil {
+		http.Error(w, "failed to update comment", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+type InsertCommentBody struct {
+	SampleId    int    `json:"sample_id"`
+	AttributeId *int   `json:"attribute_id"`
+	ParentId    *int   `json:"parent_id"`
+	Body        string `json:"body"`
+}
+
+type Comment struct {
+	Id          int              `json:"id"`
+	SampleId    int              `json:"sample_id,omitempty"`
+	AttributeId *int             `json:"attribute_id,omitempty"`
+	ParentId    *int             `json:"parent_id,omitempty"`
+	UserId      int              `json:"user_id"`
+	Username    *string          `json:"username,omitempty"`
+	Body        string           `json:"body"`
+	Mentions    []CommentMention `json:"mentions"`
+	CreatedAt   int64            `json:"created_at"`
+	EditedAt    *int64           `json:"edited_at,omitempty"`
+}
+
+// CommentThread is the first comment of a thread with its replies
+type CommentThread struct {
+	Comment
+	Resolved   bool      `json:"resolved"`
+	ResolvedBy *int      `json:"resolved_by,omitempty"`
+	ResolvedAt *int64    `json:"resolved_at,omitempty"`
+	Replies    []Comment `json:"replies"`
+}
+
+type CommentMention struct {
+	UserId   int    `json:"user_id"`
+	Username string `json:"username"`
+}
+
+type CommentEdit struct {
+	Body      string `json:"body"`
+	CreatedAt int64  `json:"created_at"`
+	EditedAt  int64  `json:"edited_at"`
+}
+
+func validateCommentBody(body string) (string, error) {
+	body = strings.TrimSpace(body)
+	if body == "" {
+		return "", fmt.Errorf("body is required")
+	}
+	if len([]rune(body)) > maxCommentLength {
+		return "", fmt.Errorf("body must be at most %d characters", maxCommentLength)
+	}
+	return body, nil
+}
+
+// Comments can be read and written while the sample is not in the trash,
+// also when its workflow state locks it
+func checkCommentSample(sampleId int) (int, error) {
+	query := `
+		SELECT EXISTS(
+			SELECT 1 FROM samples s JOIN collections c ON c.id = s.collection_id
+			WHERE s.id = ? AND s.deleted_at IS NULL AND c.deleted_at IS NULL
+		)
+	`
+	var found bool
+	if err := DB.QueryRow(query, sampleId).Scan(&found); err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("error when reading from database")
+	}
+	if !found {
+		return http.StatusNotFound, fmt.Errorf("sample not found")
+	}
+	return 0, nil
+}
+
+// Reads a comment on a sample that is not in the trash
+func readComment(_commentId string) (Comment, int, error) {
+	commentId, err := strconv.Atoi(_commentId)
+	if err != nil {
+		return Comment{}, http.StatusBadRequest, fmt.Errorf("comment_id must be a positive int")
+	}
+	var c Comment
+	query := "SELECT id, sample_id, attribute_id, parent_id, user_id, body, created_at, edited_at FROM comments WHERE id = ?"
+	err = DB.QueryRow(query, commentId).Scan(&c.Id, &c.SampleId, &c.AttributeId, &c.ParentId, &c.UserId, &c.Body, &c.CreatedAt, &c.EditedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return Comment{}, http.StatusNotFound, fmt.Errorf("comment not found")
+		}
+		return Comment{}, http.StatusInternalServerError, fmt.Errorf("error when reading from database")
+	}
+	if status, err := checkCommentSample(c.SampleId); err != nil {
+		if status == http.StatusNotFound {
+			return Comment{}, status, fmt.Errorf("comment not found")
+		}
+		return Comment{}, status, err
+	}
+	return c, 0, nil
+}
+
+// Reads the mentions of every comment on a sample by comment id
+func readSampleCommentMentions(sampleId int) (map[int][]CommentMention, error) {
+	query := `
+		SELECT m.comment_id, m.user_id, u.username
+		FROM comment_mentions m
+		JOIN comments c ON c.id = m.comment_id
+		JOIN users u ON u.id = m.user_id
+		WHERE c.sample_id = ?
+		ORDER BY u.username
+	`
+	rows, err := DB.Query(query, sampleId)
+	if err != nil {
+		return nil, fmt.Errorf("readSampleCommentMentions: %v", err)
+	}
+	defer rows.Close()
+
+	mentions := make(map[int][]CommentMention)
+	for rows.Next() {
+		var commentId int
+		var mention CommentMention
+		if err := rows.Scan(&commentId, &mention.UserId, &mention.Username); err != nil {
+			return nil, fmt.Errorf("readSampleCommentMentions: %v", err)
+		}
+		mentions[commentId] = append(mentions[commentId], mention)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("readSampleCommentMentions: %v", err)
+	}
+	return mentions, nil
+}
+
+// Replaces the mentions of a comment with the users mentioned in its body and
+// returns the ids of the users that were not mentioned before
+func saveCommentMentions(tx sqlExecutor, commentId int, body string) ([]int, error) {
+	previous := make(map[int]bool)
+	rows, err := tx.Query("SELECT user_id FROM comment_mentions WHERE comment_id = ?", commentId)
+	if err != nil {
+		return nil, fmt.Errorf("saveCommentMentions: %v", err)
+	}
+	for rows.Next() {
+		var userId int
+		if err := rows.Scan(&userId); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("saveCommentMentions: %v", err)
+		}
+		previous[userId] = true
+	}
+	rows.Close()
+
+	if _, err := tx.Exec("DELETE FROM comment_mentions WHERE comment_id = ?", commentId); err != nil {
+		return nil, fmt.Errorf("saveCommentMentions: %v", err)
+	}
+
+	// Names that are not a username are left as text
+	mentioned := []int{}
+	for _, username := range parseMentions(body) {
+		var userId int
+		err := tx.QueryRow("SELECT id FROM users WHERE username = ?", username).Scan(&userId)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("saveCommentMentions: %v", err)
+		}
+		if _, err := tx.Exec("INSERT OR IGNORE INTO comment_mentions (comment_id, user_id) VALUES (?, ?)", commentId, userId); err != nil {
+			return nil, fmt.Errorf("saveCommentMentions: %v", err)
+		}
+		if !previous[userId] {
+			previous[userId] = true
+			mentioned = append(mentioned, userId)
+		}
+	}
+	return mentioned, nil
+}
+
+// Finds the usernames mentioned in a text as @username or @"user name". An @
+// inside a word, as in an email address, is not a mention.
+func parseMentions(text string) []string {
+	var usernames []string
+	runes := []rune(text)
+	for i := 0; i < len(runes); i++ {
+		if runes[i] != '@' || (i > 0 && !unicode.IsSpace(runes[i-1]) && !unicode.IsPunct(runes[i-1])) {
+			continue
+		}
+		start := i + 1
+		if start < len(runes) && runes[start] == '"' {
+			end := start + 1
+			for end < len(runes) && runes[end] != '"' && runes[end] != '\n' {
+				end++
+			}
+			if end < len(runes) && runes[end] == '"' && end > start+1 {
+				usernames = append(usernames, string(runes[start+1:end]))
+				i = end
+			}
+			continue
+		}
+		end := start
+		for end < len(runes) && !unicode.IsSpace(runes[end]) {
+			end++
+		}
+		// Punctuation ending a sentence is not part of the name
+		for end > start && strings.ContainsRune(".,;:!?)", runes[end-1]) {
+			end--
+		}
+		if end > start {
+			usernames = append(usernames, string(runes[start:end]))
+			i = end - 1
+		}
+	}
+	return usernames
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Hands a sample over from the logged in user to another user. Both sign the
+transfer with their password. Once a sample has a custodian only they can
+hand it over. Transfers can not be changed or deleted afterwards.
+
+Body:
+
+	{
+		sample_id: int,
+		password: string, // Of the logged in user, who hands the sample over
+		to_username: string, // Who receives the sample
+		to_password: string,
+		location?: string, // Where the sample was handed over
+		condition: string, // Condition of the sample on receipt, e.g. "sealed, intact"
+		comment?: string
+	}
+
+Result:
+
+	{ id: int }
+*/
+func insertCustodyTransferHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(User)
+
+	var body CustodyTransferBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	if body.SampleId == 0 {
+		http.Error(w, "sample_id is required", http.StatusBadRequest)
+		return
+	}
+	if body.Password == "" || body.ToUsername == "" || body.ToPassword == "" {
+		http.Error(w, "password, to_username and to_password are required", http.StatusBadRequest)
+		return
+	}
+	condition := strings.TrimSpace(body.Condition)
+	if condition == "" {
+		http.Error(w, "condition is required", http.StatusBadRequest)
+		return
+	}
+
+	var custodianId *int
+	err := DB.QueryRow("SELECT custodian_id FROM samples WHERE id = ? AND deleted_at IS NULL", body.SampleId).Scan(&custodianId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "sample not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	if custodianId != nil && *custodianId != user.Id {
+		http.Error(w, "only the current custodian can hand over the sample", http.StatusForbidden)
+		return
+	}
+
+	// Both parties sign with their credentials
+	from, err := readUser(user.Id, true, false)
+	if err != nil || !checkPasswordHash(body.Password, from.HashedPassword) {
+		http.Error(w, "invalid password", http.StatusForbidden)
+		return
+	}
+	to, err := readUserByUsername(body.ToUsername, true, false)
+	if err != nil || !checkPasswordHash(body.ToPassword, to.HashedPassword) {
+		http.Error(w, "invalid username or password of the receiving user", http.StatusForbidden)
+		return
+	}
+	if to.Id == from.Id {
+		http.Error(w, "a sample can not be handed over to yourself", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		http.Error(w, "failed to record transfer", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var previousHash string
+	err = tx.QueryRow("SELECT hash FROM custody_transfers WHERE sample_id = ? ORDER BY id DESC LIMIT 1", body.SampleId).Scan(&previousHash)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, "failed to record transfer", http.StatusInternalServerError)
+		return
+	}
+
+	transfer := CustodyTransfer{
+		FromUserId:   from.Id,
+		FromUsername: from.Username,
+		ToUserId:     to.Id,
+		ToUsername:   to.Username,
+		Location:     body.Location,
+		Condition:    condition,
+		Comment:      body.Comment,
+		CreatedAt:    time.Now().Unix(),
+		PreviousHash: previousHash,
+	}
+	transfer.Hash = transfer.computeHash(body.SampleId)
+
+	query := `
+		INSERT INTO custody_transfers (sample_id, from_user_id, from_username, to_user_id, to_username, location, condition, comment, created_at, previous_hash, hash)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	result, err := tx.Exec(query, body.SampleId, transfer.FromUserId, transfer.FromUsername, transfer.ToUserId, transfer.ToUsername, transfer.Location, transfer.Condition, transfer.Comment, transfer.CreatedAt, transfer.PreviousHash, transfer.Hash)
+	if err != nil {
+		// Another transfer of the sample was recorded in the meantime
+		if strings.Contains(err.Error(), "UNIQUE constraint failed:") {
+			http.Error(w, "the custody of the sample changed, try again", http.StatusConflict)
+			return
+		}
+		http.Error(w, "failed to record transfer", http.StatusInternalServerError)
+		return
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		http.Error(w, "failed to record transfer", http.StatusInternalServerError)
+		return
+	}
+	if _, err = tx.Exec("UPDATE samples SET custodian_id = ? WHERE id = ?", to.Id, body.SampleId); err != nil {
+		http.Error(w, "failed to record transfer", http.StatusInternalServerError)
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		http.Error(w, "failed to record transfer", http.StatusInternalServerError)
+		return
+	}
+
+	if collectionId, err := readSampleCollectionId(body.SampleId); err == nil {
+		emitWebhookEvent(collectionId, "sample.transferred", map[string]any{"sample_id": body.SampleId, "from_user_id": from.Id, "to_user_id": to.Id})
+	}
+
+	fmt.Fprintf(w, "{\"id\":  %d}", id)
+}
+
+/*
+Gets the chain of custody of a sample, oldest transfer first. The chain is
+verified against the stored hashes, so changes made to the database behind
+the API show up as problems.
+
+Query params:
+
+	sample_id: int,
+	format?: string // "json" (default) or "pdf"
+
+Result:
+
+	{
+		sample_id: int,
+		identifier: string, // Omitted if the sample has none
+		custodian_id: int, // Omitted before the first transfer
+		custodian: string, // Username of the custodian
+		verified: bool, // The chain is complete and unchanged
+		problems: [string],
+		transfers: [{
+			id: int,
+			from_user_id: int,
+			from_username: string,
+			to_user_id: int,
+			to_username: string,
+			location: string,
+			condition: string,
+			comment: string,
+			created_at: int,
+			previous_hash: string,
+			hash: string
+		}]
+	}
+*/
+func fetchCustodyReportHandler(w http.ResponseWriter, r *http.Request) {
+	sampleId, err := strconv.Atoi(r.FormValue("sample_id"))
+	if err != nil {
+		http.Error(w, "sample_id must be a positive int", http.StatusBadRequest)
+		return
+	}
+	format := r.FormValue("format")
+	if format != "" && format != "json" && format != "pdf" {
+		http.Error(w, "format must be json or pdf", http.StatusBadRequest)
+		return
+	}
+
+	report := CustodyReport{SampleId: sampleId, Problems: []string{}, Transfers: []CustodyTransfer{}}
+	err = DB.QueryRow("SELECT identifier, custodian_id FROM samples WHERE id = ? AND deleted_at IS NULL", sampleId).Scan(&report.Identifier, &report.CustodianId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "sample not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+
+	query := `
+		SELECT id, from_user_id, from_username, to_user_id, to_username, location, condition, comment, created_at, previous_hash, hash
+		FROM custody_transfers WHERE sample_id = ? ORDER BY id
+	`
+	rows, err := DB.Query(query, sampleId)
+	if err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var t CustodyTransfer
+		if err := rows.Scan(&t.Id, &t.FromUserId, &t.FromUsername, &t.ToUserId, &t.ToUsername, &t.Location, &t.Condition, &t.Comment, &t.CreatedAt, &t.PreviousHash, &t.Hash); err != nil {
+			http.Error(w, "error when reading from database", http.StatusInternalServerError)
+			return
+		}
+		report.Transfers = append(report.Transfers, t)
+	}
+	if err = rows.Err(); err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+
+	report.verify()
+	if report.CustodianId != nil && len(report.Transfers) > 0 {
+		custodian := report.Transfers[len(report.Transfers)-1].ToUsername
+		report.Custodian = &custodian
+	}
+
+	if format == "pdf" {
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"custody-%d.pdf\"", sampleId))
+		w.Write(report.pdf())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+type CustodyTransferBody struct {
+	SampleId   int     `json:"sample_id"`
+	Password   string  `json:"password"`
+	ToUsername string  `json:"to_username"`
+	ToPassword string  `json:"to_password"`
+	Location   *string `json:"location"`
+	Condition  string  `json:"condition"`
+	Comment    *string `json:"comment"`
+}
+
+type CustodyTransfer struct {
+	Id           int     `json:"id"`
+	FromUserId   int     `json:"from_user_id"`
+	FromUsername string  `json:"from_username"`
+	ToUserId     int     `json:"to_user_id"`
+	ToUsername   string  `json:"to_username"`
+	Location     *string `json:"location,omitempty"`
+	Condition    string  `json:"condition"`
+	Comment      *string `json:"comment,omitempty"`
+	CreatedAt    int64   `json:"created_at"`
+	PreviousHash string  `json:"previous_hash"`
+	Hash         string  `json:"hash"`
+}
+
+type CustodyReport struct {
+	SampleId    int               `json:"sample_id"`
+	Identifier  *string           `json:"identifier,omitempty"`
+	CustodianId *int              `json:"custodian_id,omitempty"`
+	Custodian   *string           `json:"custodian,omitempty"`
+	Verified    bool              `json:"verified"`
+	Problems    []string          `json:"problems"`
+	Transfers   []CustodyTransfer `json:"transfers"`
+}
+
+// Hashes everything recorded about a transfer together with the hash of the
+// transfer before it, so no entry can be changed without breaking the chain
+func (t CustodyTransfer) computeHash(sampleId int) string {
+	content, _ := json.Marshal([]any{sampleId, t.FromUserId, t.FromUsername, t.ToUserId, t.ToUsername, t.Location, t.Condition, t.Comment, t.CreatedAt, t.PreviousHash})
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// Checks that every transfer is unchanged, follows the one before it and
+// starts with whoever received the sample last
+func (report *CustodyReport) verify() {
+	previous := CustodyTransfer{}
+	for i, t := range report.Transfers {
+		if t.computeHash(report.SampleId) != t.Hash {
+			report.Problems = append(report.Problems, fmt.Sprintf("transfer %d does not match its hash", t.Id))
+		}
+		if t.PreviousHash != previous.Hash {
+			report.Problems = append(report.Problems, fmt.Sprintf("transfer %d does not follow the transfer before it", t.Id))
+		}
+		if i > 0 && t.FromUserId != previous.ToUserId {
+			report.Problems = append(report.Problems, fmt.Sprintf("transfer %d is from %s, but %s held the sample", t.Id, t.FromUsername, previous.ToUsername))
+		}
+		previous = t
+	}
+
+	switch {
+	case len(report.Transfers) == 0 && report.CustodianId != nil:
+		report.Problems = append(report.Problems, "the sample has a custodian but no transfers")
+	case len(report.Transfers) > 0 && (report.CustodianId == nil || *report.CustodianId != previous.ToUserId):
+		report.Problems = append(report.Problems, "the custodian of the sample is not the receiver of the last transfer")
+	}
+	report.Verified = len(report.Problems) == 0
+}
+
+// Renders the report on A4 pages
+func (report *CustodyReport) pdf() []byte {
+	const width, height, margin = 595.28, 841.89, 50.0
+	const textWidth = width - 2*margin
+	document := newPDFDocument(width, height)
+	page := document.addPage()
+	y := margin
+	line := func(size float64, bold bool, text string) {
+		if y+size*1.4 > height-margin {
+			page = document.addPage()
+			y = margin
+		}
+		page.text(margin, y, size, bold, fitText(text, size, bold, textWidth))
+		y += size * 1.4
+	}
+
+	title := fmt.Sprintf("Chain of custody, sample %d", report.SampleId)
+	if report.Identifier != nil {
+		title += " (" + *report.Identifier + ")"
+	}
+	line(16, true, title)
+	line(9, false, "Generated "+time.Now().UTC().Format("2006-01-02 15:04 UTC"))
+	y += 6
+	if report.Verified {
+		line(10, true, "Chain verified, no problems found")
+	} else {
+		line(10, true, "Chain NOT verified:")
+		for _, problem := range report.Problems {
+			line(10, false, "- "+problem)
+		}
+	}
+	if report.Custodian != nil {
+		line(10, false, "Current custodian: "+*report.Custodian)
+	}
+	y += 10
+
+	if len(report.Transfers) == 0 {
+		line(10, false, "The sample has not been transferred.")
+	}
+	for i, t := range report.Transfers {
+		// Keep the lines of a transfer on one page
+		if y+6*10*1.4 > height-margin {
+			page = document.addPage()
+			y = margin
+		}
+		line(11, true, fmt.Sprintf("%d. %s   %s to %s", i+1, time.Unix(t.CreatedAt, 0).UTC().Format("2006-01-02 15:04 UTC"), t.FromUsername, t.ToUsername))
+		if t.Location != nil {
+			line(10, false, "Location: "+*t.Location)
+		}
+		line(10, false, "Condition on receipt: "+t.Condition)
+		if t.Comment != nil && *t.Comment != "" {
+			line(10, false, "Comment: "+*t.Comment)
+		}
+		line(8, false, "Hash: "+t.Hash)
+		y += 8
+	}
+	return document.bytes()
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Data Matrix uses GF(256) with the polynomial x^8 + x^5 + x^3 + x^2 + 1
+var dataMatrixField = newGaloisField(0x12D)
+
+// Square ECC 200 symbols up to 44x44, which need a single error correction block
+type dataMatrixSize struct {
+	size       int // Modules per side
+	regions    int // Data regions per side
+	dataWords  int
+	errorWords int
+}
+
+var dataMatrixSizes = []dataMatrixSize{
+	{10, 1, 3, 5},
+	{12, 1, 5, 7},
+	{14, 1, 8, 10},
+	{16, 1, 12, 12},
+	{18, 1, 18, 14},
+	{20, 1, 22, 18},
+	{22, 1, 30, 20},
+	{24, 1, 36, 24},
+	{26, 1, 44, 28},
+	{32, 2, 62, 36},
+	{36, 2, 86, 42},
+	{40, 2, 114, 48},
+	{44, 2, 144, 56},
+}
+
+// Encodes text as a square Data Matrix (ECC 200) with ASCII encodation,
+// using the smallest size it fits in
+func encodeDataMatrix(text string) (*barcodeMatrix, error) {
+	if text == "" {
+		return nil, fmt.Errorf("nothing to encode")
+	}
+
+	// Pairs of digits take one codeword, bytes above 127 take two
+	var data []byte
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case isDigit(c) && i+1 < len(text) && isDigit(text[i+1]):
+			data = append(data, 130+(c-'0')*10+(text[i+1]-'0'))
+			i++
+		case c < 128:
+			data = append(data, c+1)
+		default:
+			data = append(data, 235, c-127)
+		}
+	}
+
+	var symbol dataMatrixSize
+	for _, size := range dataMatrixSizes {
+		if len(data) <= size.dataWords {
+			symbol = size
+			break
+		}
+	}
+	if symbol.size == 0 {
+		return nil, fmt.Errorf("data matrix holds at most %d codewords", dataMatrixSizes[len(dataMatrixSizes)-1].dataWords)
+	}
+
+	// The first pad is 129, later pads are scrambled by their position
+	if len(data) < symbol.dataWords {
+		data = append(data, 129)
+	}
+	for len(data) < symbol.dataWords {
+		pad := 129 + (149*(len(data)+1))%253 + 1
+		if pad > 254 {
+			pad -= 254
+		}
+		data = append(data, byte(pad))
+	}
+	codewords := append(data, dataMatrixField.reedSolomon(data, symbol.errorWords, 1)...)
+
+	regionSize := symbol.size/symbol.regions - 2
+	placement := dataMatrixPlacement(regionSize * symbol.regions)
+
+	const quietZone = 1
+	matrix := newBarcodeMatrix(symbol.size, symbol.size, quietZone)
+	for row := 0; row < regionSize*symbol.regions; row++ {
+		for col := 0; col < regionSize*symbol.regions; col++ {
+			value := placement[row][col]
+			dark := value == 1
+			if value >= 10 {
+				dark = codewords[value/10-1]&(1<<(8-value%10)) != 0
+			}
+			// Skip the finder patterns around each data region
+			x := col/regionSize*(regionSize+2) + 1 + col%regionSize
+			y := row/regionSize*(regionSize+2) + 1 + row%regionSize
+			matrix.set(x, y, dark)
+		}
+	}
+
+	// Finder patterns: solid left and bottom edges, alternating top and right edges
+	for regionY := 0; regionY < symbol.regions; regionY++ {
+		for regionX := 0; regionX < symbol.regions; regionX++ {
+			left := regionX * (regionSize + 2)
+			top := regionY * (regionSize + 2)
+			last := regionSize + 1
+			for i := 0; i <= last; i++ {
+				matrix.set(left, top+i, true)
+				matrix.set(left+i, top+last, true)
+				matrix.set(left+i, top, i%2 == 0)
+				if i < last {
+					matrix.set(left+last, top+i, i%2 == 1)
+				}
+			}
+		}
+	}
+	return matrix, nil
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// Returns which codeword bit goes in each module of the data regions joined
+// together, as 10 * codeword + bit with codewords counted from 1 and bit 1
+// the most significant. 1 marks a module that is always dark.
+func dataMatrixPlacement(n int) [][]int {
+	nrow, ncol := n, n
+	placement := make([][]int, nrow)
+	for i := range placement {
+		placement[i] = make([]int, ncol)
+	}
+
+	module := func(row, col, chr, bit int) {
+		if row < 0 {
+			row += nrow
+			col += 4 - (nrow+4)%8
+		}
+		if col < 0 {
+			col += ncol
+			row += 4 - (ncol+4)%8
+		}
+		placement[row][col] = 10*chr + bit
+	}
+	// The usual L shaped placement of the 8 bits of a codeword
+	utah := func(row, col, chr int) {
+		module(row-2, col-2, chr, 1)
+		module(row-2, col-1, chr, 2)
+		module(row-1, col-2, chr, 3)
+		module(row-1, col-1, chr, 4)
+		module(row-1, col, chr, 5)
+		module(row, col-2, chr, 6)
+		module(row, col-1, chr, 7)
+		module(row, col, chr, 8)
+	}
+	// Special placements in the corners
+	corners := [4][8][2]int{
+		{{nrow - 1, 0}, {nrow - 1, 1}, {nrow - 1, 2}, {0, ncol - 2}, {0, ncol - 1}, {1, ncol - 1}, {2, ncol - 1}, {3, ncol - 1}},
+		{{nrow - 3, 0}, {nrow - 2, 0}, {nrow - 1, 0}, {0, ncol - 4}, {0, ncol - 3}, {0, ncol - 2}, {0, ncol - 1}, {1, ncol - 1}},
+		{{nrow - 3, 0}, {nrow - 2, 0}, {nrow - 1, 0}, {0, ncol - 2}, {0, ncol - 1}, {1, ncol - 1}, {2, ncol - 1}, {3, ncol - 1}},
+		{{nrow - 1, 0}, {nrow - 1, ncol - 1}, {0, ncol - 3}, {0, ncol - 2}, {0, ncol - 1}, {1, ncol - 3}, {1, ncol - 2}, {1, ncol - 1}},
+	}
+	corner := func(which, chr int) {
+		for bit, position := range corners[which] {
+			module(position[0], position[1], chr, bit+1)
+		}
+	}
+
+	chr, row, col := 1, 4, 0
+	for row < nrow || col < ncol {
+		if row == nrow && col == 0 {
+			corner(0, chr)
+			chr++
+		}
+		if row == nrow-2 && col == 0 && ncol%4 != 0 {
+			corner(1, chr)
+			chr++
+		}
+		if row == nrow-2 && col == 0 && ncol%8 == 4 {
+			corner(2, chr)
+			chr++
+		}
+		if row == nrow+4 && col == 2 && ncol%8 == 0 {
+			corner(3, chr)
+			chr++
+		}
+
+		// Sweep up and to the right
+		for {
+			if row < nrow && col >= 0 && placement[row][col] == 0 {
+				utah(row, col, chr)
+				chr++
+			}
+			row -= 2
+			col += 2
+			if row < 0 || col >= ncol {
+				break
+			}
+		}
+		row++
+		col += 3
+
+		// Sweep down and to the left
+		for {
+			if row >= 0 && col < ncol && placement[row][col] == 0 {
+				utah(row, col, chr)
+				chr++
+			}
+			row += 2
+			col -= 2
+			if row >= nrow || col < 0 {
+				break
+			}
+		}
+		row += 3
+		col++
+	}
+
+	// The bottom right corner is fixed if no codeword reached it
+	if placement[nrow-1][ncol-1] == 0 {
+		placement[nrow-1][ncol-1] = 1
+		placement[nrow-2][ncol-2] = 1
+	}
+	return placement
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+/*
+Exports the samples of a collection and their values as CSV
+
+Query params:
+
+	collection_id: int,
+	layout?: string // "wide" (default) or "long"
+
+Wide layout, one row per sample:
+
+	sample_id, identifier, created_at, status, note, <attribute> [unit], ...
+
+	Censored values are written with their operator and qualified values
+	with their code, e.g. "<0.5 J". Attributes with uncertain values get a
+	"<attribute> [unit] u" column after their own, relative uncertainties
+	end in "%". Attributes that take replicates get a column per replicate
+	followed by mean, sd and cv columns. Excluded replicates are left empty.
+
+Long layout, one row per value or replicate:
+
+	sample_id, identifier, created_at, attribute, unit, replicate, value, censor, qualifier, uncertainty, significant_figures, instrument, flag, excluded_reason
+
+	Replicates are listed with the reason they were excluded for, their mean
+	is left out. The flag of a mean is given on each of its replicates.
+	Instruments are given by their asset id.
+
+Values are written exactly as they are stored, so declared significant
+figures are kept, e.g. "1.20".
+*/
+func exportSamplesHandler(w http.ResponseWriter, r *http.Request) {
+	collectionId, err := strconv.Atoi(r.FormValue("collection_id"))
+	if err != nil {
+		http.Error(w, "collection_id must be a positive int", http.StatusBadRequest)
+		return
+	}
+	layout := r.FormValue("layout")
+	if layout == "" {
+		layout = "wide"
+	}
+	if layout != "wide" && layout != "long" {
+		http.Error(w, "layout must be wide or long", http.StatusBadRequest)
+		return
+	}
+
+	var collectionName string
+	err = DB.QueryRow("SELECT name FROM collections WHERE id = ? AND deleted_at IS NULL", collectionId).Scan(&collectionName)
+	if err == sql.ErrNoRows {
+		http.Error(w, "collection not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	attributes, err := readCollectionAttributes(collectionId)
+	if err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	units := make(map[int]string)
+	for _, attr := range attributes {
+		if attr.UnitId == nil {
+			continue
+		}
+		unit, err := readUnit(DB, *attr.UnitId)
+		if err != nil {
+			http.Error(w, "error when reading from database", http.StatusInternalServerError)
+			return
+		}
+		units[attr.AttributeId] = unit.Name
+		if unit.Symbol != nil {
+			units[attr.AttributeId] = *unit.Symbol
+		}
+	}
+	samples, err := readExportSamples(collectionId)
+	if err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	sampleValues := make([]map[int]SampleValue, len(samples))
+	sampleReplicates := make([]map[int][]Replicate, len(samples))
+	uncertain := make(map[int]bool)
+	for i, sample := range samples {
+		sampleValues[i], sampleReplicates[i], err = readExportValues(sample.id)
+		if err != nil {
+			http.Error(w, "error when reading from database", http.StatusInternalServerError)
+			return
+		}
+		for attributeId, value := range sampleValues[i] {
+			if value.Uncertainty != nil {
+				uncertain[attributeId] = true
+			}
+		}
+	}
+	// Values name their instrument by its asset id
+	instruments := make(map[int]string)
+	registered, err := readInstruments("SELECT " + instrumentColumns + " FROM instruments")
+	if err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	for _, instrument := range registered {
+		instruments[instrument.Id] = instrument.AssetId
+	}
+
+	// Rows are built before anything is written, so errors can still be reported
+	var rows [][]string
+	if layout == "wide" {
+		header := []string{"sample_id", "identifier", "created_at", "status", "note"}
+		for _, attr := range attributes {
+			name := attr.Name
+			if unit, ok := units[attr.AttributeId]; ok {
+				name += " [" + unit + "]"
+			}
+			if attr.Replicates == nil {
+				header = append(header, name)
+				if uncertain[attr.AttributeId] {
+					header = append(header, name+" u")
+				}
+				continue
+			}
+			for i := 1; i <= *attr.Replicates; i++ {
+				header = append(header, fmt.Sprintf("%s #%d", name, i))
+			}
+			header = append(header, name+" mean", name+" sd", attr.Name+" cv%")
+		}
+		rows = append(rows, header)
+	} else {
+		rows = append(rows, []string{"sample_id", "identifier", "created_at", "attribute", "unit", "replicate", "value", "censor", "qualifier", "uncertainty", "significant_figures", "instrument", "flag", "excluded_reason"})
+	}
+
+	for i, sample := range samples {
+		values, replicates := sampleValues[i], sampleReplicates[i]
+		createdAt := time.Unix(sample.createdAt, 0).UTC().Format(time.RFC3339)
+
+		if layout == "wide" {
+			row := []string{strconv.Itoa(sample.id), sample.identifier, createdAt, sample.status, sample.note}
+			for _, attr := range attributes {
+				if attr.Replicates == nil {
+					value := values[attr.AttributeId]
+					cell := formatCensoredValue(value.Value, value.Censor)
+					if value.Qualifier != nil {
+						cell += " " + *value.Qualifier
+					}
+					row = append(row, cell)
+					if uncertain[attr.AttributeId] {
+						row = append(row, formatUncertainty(value.MeasurementPrecision))
+					}
+					continue
+				}
+				byReplicate := make(map[int]Replicate)
+				for _, rep := range replicates[attr.AttributeId] {
+					byReplicate[rep.Replicate] = rep
+				}
+				for i := 1; i <= *attr.Replicates; i++ {
+					rep, ok := byReplicate[i]
+					if !ok || rep.ExcludedReason != nil {
+						row = append(row, "")
+						continue
+					}
+					row = append(row, rep.Value)
+				}
+				aggregates := aggregateReplicates(replicates[attr.AttributeId])
+				if aggregates == nil {
+					aggregates = &ReplicateAggregates{}
+				}
+				row = append(row, values[attr.AttributeId].Value, formatExportNumber(aggregates.SD), formatExportNumber(aggregates.CV))
+			}
+			rows = append(rows, row)
+			continue
+		}
+
+		for _, attr := range attributes {
+			value, ok := values[attr.AttributeId]
+			flag, censor, qualifier := "", "", ""
+			if ok && value.Flag != nil {
+				flag = *value.Flag
+			}
+			if ok && value.Censor != nil {
+				censor = *value.Censor
+			}
+			if ok && value.Qualifier != nil {
+				qualifier = *value.Qualifier
+			}
+			figures, instrument := "", ""
+			if ok && value.SignificantFigures != nil {
+				figures = strconv.Itoa(*value.SignificantFigures)
+			}
+			if ok && value.InstrumentId != nil {
+				instrument = instruments[*value.InstrumentId]
+			}
+			if attr.Replicates == nil {
+				if ok {
+					rows = append(rows, []string{strconv.Itoa(sample.id), sample.identifier, createdAt, attr.Name, units[attr.AttributeId], "", value.Value, censor, qualifier, formatUncertainty(value.MeasurementPrecision), figures, instrument, flag, ""})
+				}
+				continue
+			}
+			for _, rep := range replicates[attr.AttributeId] {
+				reason := ""
+				if rep.ExcludedReason != nil {
+					reason = *rep.ExcludedReason
+				}
+				rows = append(rows, []string{strconv.Itoa(sample.id), sample.identifier, createdAt, attr.Name, units[attr.AttributeId], strconv.Itoa(rep.Replicate), rep.Value, "", "", "", "", "", flag, reason})
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": collectionName + ".csv"}))
+	writer := csv.NewWriter(w)
+	writer.WriteAll(rows)
+}
+
+type exportSample struct {
+	id         int
+	identifier string
+	createdAt  int64
+	status     string
+	note       string
+}
+
+// Reads the samples of a collection that are not in the trash, oldest first
+func readExportSamples(collectionId int) ([]exportSample, error) {
+	query := `
+		SELECT s.id, COALESCE(s.identifier, ''), s.created_at, COALESCE(ws.name, ''), COALESCE(s.note, '')
+		FROM samples s LEFT JOIN workflow_states ws ON ws.id = s.status_id
+		WHERE s.collection_id = ? AND s.deleted_at IS NULL
+		ORDER BY s.created_at, s.id
+	`
+	rows, err := DB.Query(query, collectionId)
+	if err != nil {
+		return nil, fmt.Errorf("readExportSamples: %v", err)
+	}
+	defer rows.Close()
+
+	var samples []exportSample
+	for rows.Next() {
+		var sample exportSample
+		if err := rows.Scan(&sample.id, &sample.identifier, &sample.createdAt, &sample.status, &sample.note); err != nil {
+			return nil, fmt.Errorf("readExportSamples: %v", err)
+		}
+		samples = append(samples, sample)
+	}
+	return samples, rows.Err()
+}
+
+// Reads the values of a sample by attribute, and the replicates of the attributes that take them
+func readExportValues(sampleId int) (map[int]SampleValue, map[int][]Replicate, error) {
+	query, args := sampleValuesQuery(sampleId, nil)
+	rows, err := DB.Query(query, args...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("readExportValues: %v", err)
+	}
+	defer rows.Close()
+
+	values := make(map[int]SampleValue)
+	for rows.Next() {
+		var val SampleValue
+		if err := rows.Scan(&val.AttributeId, &val.Value, &val.Flag, &val.Censor, &val.Qualifier, &val.Uncertainty, &val.UncertaintyType, &val.SignificantFigures, &val.InstrumentId); err != nil {
+			return nil, nil, fmt.Errorf("readExportValues: %v", err)
+		}
+		values[val.AttributeId] = val
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("readExportValues: %v", err)
+	}
+
+	replicates, err := readSampleReplicates(sampleId)
+	if err != nil {
+		return nil, nil, err
+	}
+	return values, replicates, nil
+}
+
+// Formats an optional number for a CSV cell
+func formatExportNumber(number *float64) string {
+	if number == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*number, 'g', 10, 64)
+}
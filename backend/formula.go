@@ -0,0 +1,517 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+/*
+Formulas of calculated attributes. A formula is an arithmetic expression
+over the other attributes of the same sample, e.g.
+
+	(abs - blank) * dilution / slope
+	if([Glucose mg] > 7, 1, 0)
+
+Attributes are referenced by name, names that are not plain identifiers
+are written in brackets. Operators by precedence, lowest first:
+
+	< <= > >= == !=   (1 if true, 0 if false)
+	+ -
+	* /
+	unary -
+	^                 (right associative)
+
+Functions: abs, sqrt, exp, ln, log(x[, base]) (base 10 by default),
+log10, round(x[, digits]), floor, ceil, pow(x, y), min(...), max(...)
+and if(condition, then, else), which only evaluates the branch it takes.
+*/
+
+// Formula is a parsed formula with the names of the attributes it references
+type Formula struct {
+	Source     string
+	References []string
+	root       formulaNode
+}
+
+type formulaNode interface {
+	eval(values map[string]float64) (float64, error)
+}
+
+// Returned when a referenced attribute has no numeric value
+type missingInputError struct {
+	name string
+}
+
+func (err missingInputError) Error() string {
+	return fmt.Sprintf("%s has no numeric value", err.name)
+}
+
+// Parses a formula, checking its syntax and the functions it calls
+func parseFormula(source string) (*Formula, error) {
+	tokens, err := tokenizeFormula(source)
+	if err != nil {
+		return nil, err
+	}
+	p := formulaParser{tokens: tokens, references: make(map[string]bool)}
+	root, err := p.parseComparison()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokenEnd {
+		return nil, fmt.Errorf("unexpected %q at position %d", p.peek().text, p.peek().pos)
+	}
+
+	formula := &Formula{Source: source, root: root}
+	for _, token := range tokens {
+		if token.kind == tokenName && p.references[token.text] {
+			formula.References = append(formula.References, token.text)
+			delete(p.references, token.text)
+		}
+	}
+	return formula, nil
+}
+
+// Evaluates the formula with the numeric values of the sample, by attribute name
+func (formula *Formula) evaluate(values map[string]float64) (float64, error) {
+	result, err := formula.root.eval(values)
+	if err != nil {
+		return 0, err
+	}
+	if math.IsNaN(result) || math.IsInf(result, 0) {
+		return 0, fmt.Errorf("result is not a finite number")
+	}
+	return result, nil
+}
+
+type tokenKind int
+
+const (
+	tokenEnd tokenKind = iota
+	tokenNumber
+	tokenName
+	tokenOperator
+)
+
+type formulaToken struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func tokenizeFormula(source string) ([]formulaToken, error) {
+	var tokens []formulaToken
+	runes := []rune(source)
+	for i := 0; i < len(runes); {
+		c := runes[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case unicode.IsDigit(c) || (c == '.' && i+1 < len(runes) && unicode.IsDigit(runes[i+1])):
+			start := i
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.') {
+				i++
+			}
+			// Exponent, e.g. 1.5e-3
+			if i < len(runes) && (runes[i] == 'e' || runes[i] == 'E') {
+				j := i + 1
+				if j < len(runes) && (runes[j] == '+' || runes[j] == '-') {
+					j++
+				}
+				if j < len(runes) && unicode.IsDigit(runes[j]) {
+					for i = j; i < len(runes) && unicode.IsDigit(runes[i]); i++ {
+					}
+				}
+			}
+			tokens = append(tokens, formulaToken{tokenNumber, string(runes[start:i]), start})
+		case unicode.IsLetter(c) || c == '_':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_') {
+				i++
+			}
+			tokens = append(tokens, formulaToken{tokenName, string(runes[start:i]), start})
+		case c == '[':
+			start := i
+			end := i + 1
+			for end < len(runes) && runes[end] != ']' {
+				end++
+			}
+			if end == len(runes) {
+				return nil, fmt.Errorf("unclosed [ at position %d", start)
+			}
+			name := strings.TrimSpace(string(runes[start+1 : end]))
+			if name == "" {
+				return nil, fmt.Errorf("empty attribute name at position %d", start)
+			}
+			tokens = append(tokens, formulaToken{tokenName, name, start})
+			i = end + 1
+		default:
+			start := i
+			operator := string(c)
+			if i+1 < len(runes) && runes[i+1] == '=' && strings.ContainsRune("<>=!", c) {
+				operator += "="
+			}
+			switch operator {
+			case "+", "-", "*", "/", "^", "(", ")", ",", "<", ">", "<=", ">=", "==", "!=":
+			default:
+				return nil, fmt.Errorf("unexpected %q at position %d", operator, start)
+			}
+			i += len(operator)
+			tokens = append(tokens, formulaToken{tokenOperator, operator, start})
+		}
+	}
+	return append(tokens, formulaToken{tokenEnd, "end of formula", len(runes)}), nil
+}
+
+// Recursive descent parser, one method per precedence level
+type formulaParser struct {
+	tokens     []formulaToken
+	i          int
+	references map[string]bool
+}
+
+func (p *formulaParser) peek() formulaToken {
+	return p.tokens[p.i]
+}
+
+func (p *formulaParser) next() formulaToken {
+	token := p.tokens[p.i]
+	if token.kind != tokenEnd {
+		p.i++
+	}
+	return token
+}
+
+// Consumes the next token if it is one of the operators
+func (p *formulaParser) accept(operators ...string) (string, bool) {
+	token := p.peek()
+	if token.kind != tokenOperator {
+		return "", false
+	}
+	for _, operator := range operators {
+		if token.text == operator {
+			p.i++
+			return operator, true
+		}
+	}
+	return "", false
+}
+
+func (p *formulaParser) expect(operator string) error {
+	if _, ok := p.accept(operator); !ok {
+		return fmt.Errorf("expected %q at position %d", operator, p.peek().pos)
+	}
+	return nil
+}
+
+func (p *formulaParser) parseComparison() (formulaNode, error) {
+	left, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		operator, ok := p.accept("<", "<=", ">", ">=", "==", "!=")
+		if !ok {
+			return left, nil
+		}
+		right, err := p.parseAdditive()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{operator, left, right}
+	}
+}
+
+func (p *formulaParser) parseAdditive() (formulaNode, error) {
+	left, err := p.parseMultiplicative()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		operator, ok := p.accept("+", "-")
+		if !ok {
+			return left, nil
+		}
+		right, err := p.parseMultiplicative()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{operator, left, right}
+	}
+}
+
+func (p *formulaParser) parseMultiplicative() (formulaNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		operator, ok := p.accept("*", "/")
+		if !ok {
+			return left, nil
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{operator, left, right}
+	}
+}
+
+func (p *formulaParser) parseUnary() (formulaNode, error) {
+	if operator, ok := p.accept("-", "+"); ok {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if operator == "+" {
+			return operand, nil
+		}
+		return negateNode{operand}, nil
+	}
+	return p.parsePower()
+}
+
+func (p *formulaParser) parsePower() (formulaNode, error) {
+	base, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := p.accept("^"); ok {
+		// Right associative, and binds tighter than unary minus on its left only
+		exponent, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return binaryNode{"^", base, exponent}, nil
+	}
+	return base, nil
+}
+
+func (p *formulaParser) parsePrimary() (formulaNode, error) {
+	token := p.next()
+	switch token.kind {
+	case tokenNumber:
+		number, err := strconv.ParseFloat(token.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at position %d", token.text, token.pos)
+		}
+		return numberNode(number), nil
+	case tokenName:
+		// A name followed by ( is a function call, otherwise an attribute
+		if _, ok := p.accept("("); !ok {
+			p.references[token.text] = true
+			return referenceNode(token.text), nil
+		}
+		var args []formulaNode
+		if _, ok := p.accept(")"); !ok {
+			for {
+				arg, err := p.parseComparison()
+				if err != nil {
+					return nil, err
+				}
+				args = append(args, arg)
+				if _, ok := p.accept(","); !ok {
+					break
+				}
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+		}
+		return newCallNode(strings.ToLower(token.text), args, token.pos)
+	case tokenOperator:
+		if token.text == "(" {
+			inner, err := p.parseComparison()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return inner, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected %q at position %d", token.text, token.pos)
+}
+
+type numberNode float64
+
+func (node numberNode) eval(values map[string]float64) (float64, error) {
+	return float64(node), nil
+}
+
+type referenceNode string
+
+func (node referenceNode) eval(values map[string]float64) (float64, error) {
+	value, ok := values[string(node)]
+	if !ok {
+		return 0, missingInputError{string(node)}
+	}
+	return value, nil
+}
+
+type negateNode struct {
+	operand formulaNode
+}
+
+func (node negateNode) eval(values map[string]float64) (float64, error) {
+	value, err := node.operand.eval(values)
+	return -value, err
+}
+
+type binaryNode struct {
+	operator    string
+	left, right formulaNode
+}
+
+func (node binaryNode) eval(values map[string]float64) (float64, error) {
+	left, err := node.left.eval(values)
+	if err != nil {
+		return 0, err
+	}
+	right, err := node.right.eval(values)
+	if err != nil {
+		return 0, err
+	}
+	truth := func(b bool) float64 {
+		if b {
+			return 1
+		}
+		return 0
+	}
+	switch node.operator {
+	case "+":
+		return left + right, nil
+	case "-":
+		return left - right, nil
+	case "*":
+		return left * right, nil
+	case "/":
+		if right == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		return left / right, nil
+	case "^":
+		return math.Pow(left, right), nil
+	case "<":
+		return truth(left < right), nil
+	case "<=":
+		return truth(left <= right), nil
+	case ">":
+		return truth(left > right), nil
+	case ">=":
+		return truth(left >= right), nil
+	case "==":
+		return truth(left == right), nil
+	case "!=":
+		return truth(left != right), nil
+	}
+	return 0, fmt.Errorf("unknown operator %q", node.operator)
+}
+
+// Number of arguments each function takes, as min and max (-1 for any)
+var formulaFunctions = map[string][2]int{
+	"abs":   {1, 1},
+	"sqrt":  {1, 1},
+	"exp":   {1, 1},
+	"ln":    {1, 1},
+	"log":   {1, 2},
+	"log10": {1, 1},
+	"round": {1, 2},
+	"floor": {1, 1},
+	"ceil":  {1, 1},
+	"pow":   {2, 2},
+	"min":   {1, -1},
+	"max":   {1, -1},
+	"if":    {3, 3},
+}
+
+type callNode struct {
+	function string
+	args     []formulaNode
+}
+
+func newCallNode(function string, args []formulaNode, pos int) (formulaNode, error) {
+	arity, ok := formulaFunctions[function]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %q at position %d", function, pos)
+	}
+	if len(args) < arity[0] || (arity[1] >= 0 && len(args) > arity[1]) {
+		return nil, fmt.Errorf("wrong number of arguments to %s at position %d", function, pos)
+	}
+	return callNode{function, args}, nil
+}
+
+func (node callNode) eval(values map[string]float64) (float64, error) {
+	// Only the branch taken is evaluated, so it may reference missing values
+	if node.function == "if" {
+		condition, err := node.args[0].eval(values)
+		if err != nil {
+			return 0, err
+		}
+		if condition != 0 {
+			return node.args[1].eval(values)
+		}
+		return node.args[2].eval(values)
+	}
+
+	args := make([]float64, len(node.args))
+	for i, arg := range node.args {
+		value, err := arg.eval(values)
+		if err != nil {
+			return 0, err
+		}
+		args[i] = value
+	}
+	x := args[0]
+	switch node.function {
+	case "abs":
+		return math.Abs(x), nil
+	case "sqrt":
+		if x < 0 {
+			return 0, fmt.Errorf("sqrt of a negative number")
+		}
+		return math.Sqrt(x), nil
+	case "exp":
+		return math.Exp(x), nil
+	case "ln", "log", "log10":
+		if x <= 0 {
+			return 0, fmt.Errorf("%s of a number that is not positive", node.function)
+		}
+		switch {
+		case node.function == "ln":
+			return math.Log(x), nil
+		case len(args) == 2:
+			if args[1] <= 0 || args[1] == 1 {
+				return 0, fmt.Errorf("invalid logarithm base")
+			}
+			return math.Log(x) / math.Log(args[1]), nil
+		}
+		return math.Log10(x), nil
+	case "round":
+		digits := 0.0
+		if len(args) == 2 {
+			digits = math.Round(args[1])
+		}
+		scale := math.Pow(10, digits)
+		return math.Round(x*scale) / scale, nil
+	case "floor":
+		return math.Floor(x), nil
+	case "ceil":
+		return math.Ceil(x), nil
+	case "pow":
+		return math.Pow(x, args[1]), nil
+	case "min", "max":
+		result := x
+		for _, arg := range args[1:] {
+			if (node.function == "min" && arg < result) || (node.function == "max" && arg > result) {
+				result = arg
+			}
+		}
+		return result, nil
+	}
+	return 0, fmt.Errorf("unknown function %q", node.function)
+}
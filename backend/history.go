@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+/*
+Gets every version of a value, oldest first
+
+Query params:
+
+	sample_id: int,
+	attribute_id: int
+
+Result:
+
+	[{
+		value: string, // Omitted when the value was removed
+		flag: string, // Flag when the version was written
+		censor: string, // "<", ">", "≤" or "≥" for censored values
+		qualifier: string,
+		uncertainty: string,
+		uncertainty_type: string, // "absolute" or "relative" (percent)
+		significant_figures: int,
+		instrument_id: int,
+		user_id: int, // Omitted for values written by the system, like calculated values
+		username: string,
+		created_at: int // 0 for values from before history was kept
+	}]
+*/
+func fetchSampleValueHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	sampleId, err := strconv.Atoi(r.FormValue("sample_id"))
+	if err != nil {
+		http.Error(w, "sample_id must be a positive int", http.StatusBadRequest)
+		return
+	}
+	attributeId, err := strconv.Atoi(r.FormValue("attribute_id"))
+	if err != nil {
+		http.Error(w, "attribute_id must be a positive int", http.StatusBadRequest)
+		return
+	}
+	trashed, err := isSampleTrashed(sampleId)
+	if err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	if trashed {
+		http.Error(w, "sample not found", http.StatusNotFound)
+		return
+	}
+
+	query := `
+		SELECT h.value, h.flag, h.censor, h.qualifier, h.uncertainty, h.uncertainty_type, h.significant_figures, h.instrument_id, h.user_id, u.username, h.created_at
+		FROM sample_value_history h LEFT JOIN users u ON u.id = h.user_id
+		WHERE h.sample_id = ? AND h.attribute_id = ?
+		ORDER BY h.id
+	`
+	rows, err := DB.Query(query, sampleId, attributeId)
+	if err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	versions := []ValueVersion{}
+	for rows.Next() {
+		var version ValueVersion
+		if err := rows.Scan(&version.Value, &version.Flag, &version.Censor, &version.Qualifier,
+			&version.Uncertainty, &version.UncertaintyType, &version.SignificantFigures, &version.InstrumentId, &version.UserId, &version.Username, &version.CreatedAt); err != nil {
+			http.Error(w, "error when reading from database", http.StatusInternalServerError)
+			return
+		}
+		versions = append(versions, version)
+	}
+	if err = rows.Err(); err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(versions)
+}
+
+type ValueVersion struct {
+	Value     *string `json:"value,omitempty"`
+	Flag      *string `json:"flag,omitempty"`
+	Censor    *string `json:"censor,omitempty"`
+	Qualifier *string `json:"qualifier,omitempty"`
+	MeasurementPrecision
+	InstrumentId *int    `json:"instrument_id,omitempty"`
+	UserId       *int    `json:"user_id,omitempty"`
+	Username     *string `json:"username,omitempty"`
+	CreatedAt    int64   `json:"created_at"`
+}
+
+// Stores a version of a value. Call it wherever sample_attribute_values is
+// written, with a nil value when the value is removed and a nil user for
+// values the system wrote, like calculated or converted values. The censor,
+// qualifier, uncertainty, significant figures and instrument are copied from
+// the value as it was written.
+func recordValueVersion(q sqlExecutor, sampleId int, attributeId int, value *string, flag *string, userId *int) error {
+	query := `
+		INSERT INTO sample_value_history (sample_id, attribute_id, value, flag, censor, qualifier, uncertainty, uncertainty_type, significant_figures, instrument_id, user_id, created_at)
+		SELECT ?, ?, ?, ?, v.censor, v.qualifier, v.uncertainty, v.uncertainty_type, v.significant_figures, v.instrument_id, ?, ?
+		FROM (SELECT 1) LEFT JOIN sample_attribute_values v ON v.sample_id = ? AND v.attribute_id = ? AND ? IS NOT NULL
+	`
+	if _, err := q.Exec(query, sampleId, attributeId, value, flag, userId, time.Now().Unix(), sampleId, attributeId, value); err != nil {
+		return fmt.Errorf("recordValueVersion: %v", err)
+	}
+	return nil
+}
+
+// SQL condition for samples or attributes that existed at asOf, or that are
+// not in the trash if asOf is nil. The prefix is the table alias with its dot.
+func existedAtCondition(prefix string, asOf *int64) (string, []any) {
+	if asOf == nil {
+		return prefix + "deleted_at IS NULL", nil
+	}
+	condition := fmt.Sprintf("(%[1]sdeleted_at IS NULL OR %[1]sdeleted_at > ?) AND (%[1]sinserted_at IS NULL OR %[1]sinserted_at <= ?)", prefix)
+	return condition, []any{*asOf, *asOf}
+}
+
+// SQL expression for the workflow state of the sample in the samples table at
+// asOf. Before its first transition a sample is in the state it started in.
+func statusAtExpression(asOf *int64) (string, []any) {
+	if asOf == nil {
+		return "status_id", nil
+	}
+	expression := `COALESCE(
+		(SELECT h.to_state_id FROM sample_status_history h WHERE h.sample_id = samples.id AND h.created_at <= ? ORDER BY h.created_at DESC, h.id DESC LIMIT 1),
+		(SELECT h.from_state_id FROM sample_status_history h WHERE h.sample_id = samples.id ORDER BY h.created_at, h.id LIMIT 1),
+		status_id
+	)`
+	return expression, []any{*asOf}
+}
+
+// Query for the values of a sample with attribute_id, value, flag, censor, qualifier,
+// uncertainty, uncertainty_type, significant_figures and instrument_id columns.
+// At asOf the values are the newest versions written until then.
+func sampleValuesQuery(sampleId int, asOf *int64) (string, []any) {
+	attributeCondition, attributeArgs := existedAtCondition("", asOf)
+	if asOf == nil {
+		query := "SELECT attribute_id, value, flag, censor, qualifier, uncertainty, uncertainty_type, significant_figures, instrument_id FROM sample_attribute_values WHERE sample_id = ? AND attribute_id IN (SELECT id FROM sample_attributes WHERE " + attributeCondition + ")"
+		return query, append([]any{sampleId}, attributeArgs...)
+	}
+	query := `
+		SELECT attribute_id, value, flag, censor, qualifier, uncertainty, uncertainty_type, significant_figures, instrument_id FROM sample_value_history
+		WHERE id IN (
+			SELECT MAX(id) FROM sample_value_history WHERE sample_id = ? AND created_at <= ? GROUP BY attribute_id
+		)
+		AND value IS NOT NULL
+		AND attribute_id IN (SELECT id FROM sample_attributes WHERE ` + attributeCondition + `)
+	`
+	return query, append([]any{sampleId, *asOf}, attributeArgs...)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Longest identifier pattern accepted
+const maxIdentifierPatternLength = 64
+
+/*
+Identifier patterns give the samples of a collection human-readable
+identifiers, e.g. "WQ-{YYYY}-{seq:0000}" gives WQ-2025-0001, WQ-2025-0002...
+Placeholders:
+
+	{YYYY}, {YY}, {MM}, {DD}  Creation date of the sample (UTC)
+	{seq}                     Sequence number
+	{seq:0000}                Sequence number padded with zeros to the given width
+
+A pattern holds exactly one sequence. Every distinct text around it, e.g.
+every year above, has its own sequence starting at 1. Sequence numbers are
+taken in the transaction creating the sample, so they have no gaps.
+*/
+type identifierPattern struct {
+	parts []identifierPart
+}
+
+type identifierPart struct {
+	literal     string // Set for text between placeholders
+	placeholder string // "YYYY", "YY", "MM", "DD" or "seq"
+	width       int    // Zero padding of the sequence
+}
+
+// Parses and validates an identifier pattern
+func parseIdentifierPattern(pattern string) (identifierPattern, error) {
+	var parsed identifierPattern
+	if len(pattern) > maxIdentifierPatternLength {
+		return parsed, fmt.Errorf("identifier_pattern must be at most %d characters", maxIdentifierPatternLength)
+	}
+
+	sequences := 0
+	rest := pattern
+	for rest != "" {
+		open := strings.IndexAny(rest, "{}")
+		if open < 0 {
+			parsed.parts = append(parsed.parts, identifierPart{literal: rest})
+			break
+		}
+		if rest[open] == '}' {
+			return parsed, fmt.Errorf("identifier_pattern has an unmatched }")
+		}
+		if open > 0 {
+			parsed.parts = append(parsed.parts, identifierPart{literal: rest[:open]})
+		}
+		close := strings.IndexByte(rest[open:], '}')
+		if close < 0 {
+			return parsed, fmt.Errorf("identifier_pattern has an unmatched {")
+		}
+		placeholder := rest[open+1 : open+close]
+		rest = rest[open+close+1:]
+
+		part := identifierPart{placeholder: placeholder}
+		switch {
+		case placeholder == "YYYY" || placeholder == "YY" || placeholder == "MM" || placeholder == "DD":
+		case placeholder == "seq":
+			sequences++
+		case strings.HasPrefix(placeholder, "seq:"):
+			zeros := strings.TrimPrefix(placeholder, "seq:")
+			if zeros == "" || strings.Trim(zeros, "0") != "" || len(zeros) > 12 {
+				return parsed, fmt.Errorf("sequence width must be written as zeros, e.g. {seq:0000}")
+			}
+			part.placeholder = "seq"
+			part.width = len(zeros)
+			sequences++
+		default:
+			return parsed, fmt.Errorf("unknown placeholder {%s}, use {YYYY}, {YY}, {MM}, {DD} or {seq}", placeholder)
+		}
+		parsed.parts = append(parsed.parts, part)
+	}
+	if sequences != 1 {
+		return parsed, fmt.Errorf("identifier_pattern must contain exactly one {seq}")
+	}
+	return parsed, nil
+}
+
+// Renders the identifier of a sample. The scope of the sequence is the identifier
+// rendered with seq < 0, which leaves the sequence out.
+func (pattern identifierPattern) render(createdAt int64, seq int) string {
+	date := time.Unix(createdAt, 0).UTC()
+	var b strings.Builder
+	for _, part := range pattern.parts {
+		switch part.placeholder {
+		case "":
+			b.WriteString(part.literal)
+		case "YYYY":
+			fmt.Fprintf(&b, "%04d", date.Year())
+		case "YY":
+			fmt.Fprintf(&b, "%02d", date.Year()%100)
+		case "MM":
+			fmt.Fprintf(&b, "%02d", int(date.Month()))
+		case "DD":
+			fmt.Fprintf(&b, "%02d", date.Day())
+		case "seq":
+			if seq < 0 {
+				b.WriteString("{seq}")
+			} else {
+				fmt.Fprintf(&b, "%0*d", part.width, seq)
+			}
+		}
+	}
+	return b.String()
+}
+
+// Gives a sample the next identifier of its collection's pattern. Returns nil
+// if the collection has no pattern. Must run in the transaction creating the
+// sample for the sequence to stay gap-free.
+func assignSampleIdentifier(tx sqlExecutor, sampleId int) (*string, error) {
+	var collectionId int
+	var createdAt int64
+	var _pattern *string
+	query := "SELECT s.collection_id, s.created_at, c.identifier_pattern FROM samples s JOIN collections c ON c.id = s.collection_id WHERE s.id = ?"
+	if err := tx.QueryRow(query, sampleId).Scan(&collectionId, &createdAt, &_pattern); err != nil {
+		return nil, fmt.Errorf("assignSampleIdentifier: %v", err)
+	}
+	if _pattern == nil {
+		return nil, nil
+	}
+	pattern, err := parseIdentifierPattern(*_pattern)
+	if err != nil {
+		return nil, fmt.Errorf("assignSampleIdentifier: %v", err)
+	}
+
+	scope := pattern.render(createdAt, -1)
+	query = `
+		INSERT INTO identifier_sequences (collection_id, scope, last_value) VALUES (?, ?, 1)
+		ON CONFLICT (collection_id, scope) DO UPDATE SET last_value = last_value + 1
+	`
+	if _, err := tx.Exec(query, collectionId, scope); err != nil {
+		return nil, fmt.Errorf("assignSampleIdentifier: %v", err)
+	}
+	var seq int
+	if err := tx.QueryRow("SELECT last_value FROM identifier_sequences WHERE collection_id = ? AND scope = ?", collectionId, scope).Scan(&seq); err != nil {
+		return nil, fmt.Errorf("assignSampleIdentifier: %v", err)
+	}
+
+	identifier := pattern.render(createdAt, seq)
+	if _, err := tx.Exec("UPDATE samples SET identifier = ? WHERE id = ?", identifier, sampleId); err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed:") {
+			return nil, identifierInUseError{identifier}
+		}
+		return nil, fmt.Errorf("assignSampleIdentifier: %v", err)
+	}
+	return &identifier, nil
+}
+
+// Returned when a pattern renders an identifier another sample already has,
+// e.g. when two collections share a pattern
+type identifierInUseError struct {
+	identifier string
+}
+
+func (err identifierInUseError) Error() string {
+	return "identifier " + err.identifier + " is already used by another sample, the identifier pattern of the collection must be unique"
+}
+
+// Gives identifiers to the samples of a collection that have none, oldest first
+func backfillSampleIdentifiers(tx sqlExecutor, collectionId int) error {
+	rows, err := tx.Query("SELECT id FROM samples WHERE collection_id = ? AND identifier IS NULL ORDER BY created_at, id", collectionId)
+	if err != nil {
+		return fmt.Errorf("backfillSampleIdentifiers: %v", err)
+	}
+	var sampleIds []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return fmt.Errorf("backfillSampleIdentifiers: %v", err)
+		}
+		sampleIds = append(sampleIds, id)
+	}
+	rows.Close()
+
+	for _, id := range sampleIds {
+		if _, err := assignSampleIdentifier(tx, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Gets a sample by its identifier, e.g. from a scanned barcode. The result
+is the same as fetchSamplesHandler for a single sample.
+
+Query params:
+
+	identifier: string
+*/
+func fetchSampleByIdentifierHandler(w http.ResponseWriter, r *http.Request) {
+	identifier := strings.TrimSpace(r.FormValue("identifier"))
+	if identifier == "" {
+		http.Error(w, "identifier is required", http.StatusBadRequest)
+		return
+	}
+
+	var sampleId, collectionId int
+	query := `
+		SELECT s.id, s.collection_id FROM samples s JOIN collections c ON c.id = s.collection_id
+		WHERE s.identifier = ? AND s.deleted_at IS NULL AND c.deleted_at IS NULL
+	`
+	err := DB.QueryRow(query, identifier).Scan(&sampleId, &collectionId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "sample not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+
+	r.Form.Set("sample_id", strconv.Itoa(sampleId))
+	r.Form.Set("collection_id", strconv.Itoa(collectionId))
+	fetchSamplesHandler(w, r)
+}
@@ -0,0 +1,654 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Statuses of an instrument. Only active instruments can produce values.
+var instrumentStatuses = []string{"active", "out_of_service", "retired"}
+
+// What happens to values entered from an instrument whose calibration is overdue
+const (
+	overdueWarn  = "warn"
+	overdueBlock = "block"
+)
+
+// Days ahead calibrations-due looks when the request does not say
+const defaultCalibrationLookahead = 30
+
+const instrumentColumns = `
+	id, asset_id, model, serial_number, location, calibration_interval_days,
+	last_calibrated_at, next_calibration_at, status, overdue_policy, created_at
+`
+
+/*
+Gets the instruments, by asset id
+
+Query params:
+
+	instrument_id?: int, // Only this instrument
+	status?: string // Only instruments with this status
+
+Result:
+
+	[{
+		id: int,
+		asset_id: string,
+		model: string,
+		serial_number: string,
+		location: string,
+		calibration_interval_days: int, // Omitted if not calibrated on a schedule
+		last_calibrated_at: int, // UNIX timestamp in seconds
+		next_calibration_at: int, // UNIX timestamp in seconds
+		status: string, // "active", "out_of_service" or "retired"
+		overdue_policy: string, // "warn" or "block"
+		overdue: bool, // The next calibration is in the past
+		created_at: int
+	}]
+*/
+func fetchInstrumentsHandler(w http.ResponseWriter, r *http.Request) {
+	var filters []string
+	var args []any
+	if _instrumentId := r.FormValue("instrument_id"); _instrumentId != "" {
+		instrumentId, err := strconv.Atoi(_instrumentId)
+		if err != nil {
+			http.Error(w, "instrument_id must be a positive int", http.StatusBadRequest)
+			return
+		}
+		filters = append(filters, "id = ?")
+		args = append(args, instrumentId)
+	}
+	if status := r.FormValue("status"); status != "" {
+		if !isInstrumentStatus(status) {
+			http.Error(w, "status must be one of: "+strings.Join(instrumentStatuses, ", "), http.StatusBadRequest)
+			return
+		}
+		filters = append(filters, "status = ?")
+		args = append(args, status)
+	}
+	query := "SELECT " + instrumentColumns + " FROM instruments "
+	if len(filters) > 0 {
+		query += "WHERE " + strings.Join(filters, " AND ") + " "
+	}
+	query += "ORDER BY asset_id"
+
+	instruments, err := readInstruments(query, args...)
+	if err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(instruments)
+}
+
+/*
+Gets the active instruments whose calibration is due within the given
+number of days, overdue ones included, the soonest due first
+
+Query params:
+
+	days?: int // 30 if not set
+
+Result:
+
+	[{
+		...instrument, see GET instruments
+		days_until_due: int // Negative when overdue
+	}]
+*/
+func fetchCalibrationsDueHandler(w http.ResponseWriter, r *http.Request) {
+	days := defaultCalibrationLookahead
+	if _days := r.FormValue("days"); _days != "" {
+		var err error
+		days, err = strconv.Atoi(_days)
+		if err != nil || days < 0 {
+			http.Error(w, "days must be a non-negative int", http.StatusBadRequest)
+			return
+		}
+	}
+
+	now := time.Now().Unix()
+	query := "SELECT " + instrumentColumns + " FROM instruments WHERE status = 'active' AND next_calibration_at <= ? ORDER BY next_calibration_at, asset_id"
+	instruments, err := readInstruments(query, now+int64(days)*86400)
+	if err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+
+	due := []CalibrationDue{}
+	for _, instrument := range instruments {
+		untilDue := *instrument.NextCalibrationAt - now
+		// Round towards the past, so an instrument due later today has 0 days left
+		daysUntilDue := untilDue / 86400
+		if untilDue < 0 && untilDue%86400 != 0 {
+			daysUntilDue--
+		}
+		due = append(due, CalibrationDue{Instrument: instrument, DaysUntilDue: int(daysUntilDue)})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(due)
+}
+
+/*
+Adds an instrument. The next calibration is due calibration_interval_days
+after the last one unless it is given.
+
+Query params:
+
+	asset_id: string,
+	model?: string,
+	serial_number?: string,
+	location?: string,
+	calibration_interval_days?: int,
+	last_calibrated_at?: int, // UNIX timestamp in seconds
+	next_calibration_at?: int, // UNIX timestamp in seconds
+	status?: string, // "active" (default), "out_of_service" or "retired"
+	overdue_policy?: string // "warn" (default) or "block" values entered after the calibration is due
+*/
+func insertInstrumentHandler(w http.ResponseWriter, r *http.Request) {
+	assetId := strings.TrimSpace(r.FormValue("asset_id"))
+	if assetId == "" {
+		http.Error(w, "asset_id is required", http.StatusBadRequest)
+		return
+	}
+	if len(assetId) > 64 {
+		http.Error(w, "asset_id must be at most 64 characters", http.StatusBadRequest)
+		return
+	}
+
+	instrument := Instrument{AssetId: assetId, Status: "active", OverduePolicy: overdueWarn}
+	for name, field := range map[string]**string{"model": &instrument.Model, "serial_number": &instrument.SerialNumber, "location": &instrument.Location} {
+		if value := strings.TrimSpace(r.FormValue(name)); value != "" {
+			*field = &value
+		}
+	}
+	var err error
+	if instrument.CalibrationInterval, err = parseCalibrationInterval(r.FormValue("calibration_interval_days")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if instrument.LastCalibratedAt, err = parseInstrumentTime("last_calibrated_at", r.FormValue("last_calibrated_at")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if instrument.NextCalibrationAt, err = parseInstrumentTime("next_calibration_at", r.FormValue("next_calibration_at")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if instrument.NextCalibrationAt == nil {
+		instrument.NextCalibrationAt = nextCalibration(instrument.LastCalibratedAt, instrument.CalibrationInterval)
+	}
+	if status := r.FormValue("status"); status != "" {
+		if !isInstrumentStatus(status) {
+			http.Error(w, "status must be one of: "+strings.Join(instrumentStatuses, ", "), http.StatusBadRequest)
+			return
+		}
+		instrument.Status = status
+	}
+	if policy := r.FormValue("overdue_policy"); policy != "" {
+		if policy != overdueWarn && policy != overdueBlock {
+			http.Error(w, "overdue_policy must be warn or block", http.StatusBadRequest)
+			return
+		}
+		instrument.OverduePolicy = policy
+	}
+
+	query := `
+		INSERT INTO instruments (asset_id, model, serial_number, location, calibration_interval_days, last_calibrated_at, next_calibration_at, status, overdue_policy, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	result, err := DB.Exec(query, instrument.AssetId, instrument.Model, instrument.SerialNumber, instrument.Location, instrument.CalibrationInterval,
+		instrument.LastCalibratedAt, instrument.NextCalibrationAt, instrument.Status, instrument.OverduePolicy, time.Now().Unix())
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed:") {
+			http.Error(w, "an instrument with this asset_id already exists", http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "failed to insert instrument", http.StatusInternalServerError)
+		return
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		fmt.Fprintln(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, "{\"id\":  %d}", id)
+}
+
+/*
+Updates an instrument. Changing the calibration interval moves the next
+calibration unless next_calibration_at is given too.
+
+Query params:
+
+	instrument_id: int,
+	asset_id?: string,
+	model?: string, // Empty to clear, like serial_number and location
+	serial_number?: string,
+	location?: string,
+	calibration_interval_days?: int, // Empty to stop calibrating on a schedule
+	next_calibration_at?: int, // Empty if no calibration is due
+	status?: string,
+	overdue_policy?: string
+*/
+func updateInstrumentHandler(w http.ResponseWriter, r *http.Request) {
+	instrumentId, err := strconv.Atoi(r.FormValue("instrument_id"))
+	if err != nil {
+		http.Error(w, "instrument_id must be a positive int", http.StatusBadRequest)
+		return
+	}
+	var lastCalibratedAt *int64
+	err = DB.QueryRow("SELECT last_calibrated_at FROM instruments WHERE id = ?", instrumentId).Scan(&lastCalibratedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "instrument not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+
+	query := []string{}
+	args := []any{}
+	if r.Form.Has("asset_id") {
+		assetId := strings.TrimSpace(r.FormValue("asset_id"))
+		if assetId == "" || len(assetId) > 64 {
+			http.Error(w, "asset_id must be 1 to 64 characters", http.StatusBadRequest)
+			return
+		}
+		query = append(query, "asset_id = ?")
+		args = append(args, assetId)
+	}
+	for _, name := range []string{"model", "serial_number", "location"} {
+		if !r.Form.Has(name) {
+			continue
+		}
+		var value *string
+		if _value := strings.TrimSpace(r.FormValue(name)); _value != "" {
+			value = &_value
+		}
+		query = append(query, name+" = ?")
+		args = append(args, value)
+	}
+	if r.Form.Has("calibration_interval_days") {
+		interval, err := parseCalibrationInterval(r.FormValue("calibration_interval_days"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		query = append(query, "calibration_interval_days = ?")
+		args = append(args, interval)
+		if !r.Form.Has("next_calibration_at") {
+			query = append(query, "next_calibration_at = ?")
+			args = append(args, nextCalibration(lastCalibratedAt, interval))
+		}
+	}
+	if r.Form.Has("next_calibration_at") {
+		next, err := parseInstrumentTime("next_calibration_at", r.FormValue("next_calibration_at"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		query = append(query, "next_calibration_at = ?")
+		args = append(args, next)
+	}
+	if r.Form.Has("status") {
+		status := r.FormValue("status")
+		if !isInstrumentStatus(status) {
+			http.Error(w, "status must be one of: "+strings.Join(instrumentStatuses, ", "), http.StatusBadRequest)
+			return
+		}
+		query = append(query, "status = ?")
+		args = append(args, status)
+	}
+	if r.Form.Has("overdue_policy") {
+		policy := r.FormValue("overdue_policy")
+		if policy != overdueWarn && policy != overdueBlock {
+			http.Error(w, "overdue_policy must be warn or block", http.StatusBadRequest)
+			return
+		}
+		query = append(query, "overdue_policy = ?")
+		args = append(args, policy)
+	}
+	if len(query) == 0 {
+		http.Error(w, "asset_id, model, serial_number, location, calibration_interval_days, next_calibration_at, status or overdue_policy is required", http.StatusBadRequest)
+		return
+	}
+	args = append(args, instrumentId)
+
+	_, err = DB.Exec("UPDATE instruments SET "+strings.Join(query, ", ")+" WHERE id = ?", args...)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed:") {
+			http.Error(w, "an instrument with this asset_id already exists", http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "failed to update instrument", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+/*
+Deletes an instrument that has not produced any values. Instruments that
+have should be retired instead, so the values keep their instrument.
+
+Query params:
+
+	instrument_id: int
+*/
+func deleteInstrumentHandler(w http.ResponseWriter, r *http.Request) {
+	instrumentId, err := strconv.Atoi(r.FormValue("instrument_id"))
+	if err != nil {
+		http.Error(w, "instrument_id must be a positive int", http.StatusBadRequest)
+		return
+	}
+
+	var inUse bool
+	query := `
+		SELECT EXISTS(SELECT 1 FROM sample_attribute_values WHERE instrument_id = ?)
+			OR EXISTS(SELECT 1 FROM sample_value_history WHERE instrument_id = ?)
+	`
+	if err := DB.QueryRow(query, instrumentId, instrumentId).Scan(&inUse); err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	if inUse {
+		http.Error(w, "the instrument has produced values, retire it instead", http.StatusConflict)
+		return
+	}
+
+	result, err := DB.Exec("DELETE FROM instruments WHERE id = ?", instrumentId)
+	if err != nil {
+		http.Error(w, "failed to delete instrument", http.StatusInternalServerError)
+		return
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil || rowsAffected == 0 {
+		http.Error(w, "instrument not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+/*
+Gets the calibrations of an instrument, newest first
+
+Query params:
+
+	instrument_id: int
+
+Result:
+
+	[{
+		id: int,
+		calibrated_at: int, // UNIX timestamp in seconds
+		next_calibration_at: int, // Omitted if the instrument had no calibration interval
+		certificate: string,
+		note: string,
+		user_id: int,
+		username: string,
+		created_at: int
+	}]
+*/
+func fetchInstrumentCalibrationsHandler(w http.ResponseWriter, r *http.Request) {
+	instrumentId, err := strconv.Atoi(r.FormValue("instrument_id"))
+	if err != nil {
+		http.Error(w, "instrument_id must be a positive int", http.StatusBadRequest)
+		return
+	}
+
+	query := `
+		SELECT c.id, c.calibrated_at, c.next_calibration_at, c.certificate, c.note, c.user_id, u.username, c.created_at
+		FROM instrument_calibrations c LEFT JOIN users u ON u.id = c.user_id
+		WHERE c.instrument_id = ?
+		ORDER BY c.calibrated_at DESC, c.id DESC
+	`
+	rows, err := DB.Query(query, instrumentId)
+	if err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	calibrations := []InstrumentCalibration{}
+	for rows.Next() {
+		var calibration InstrumentCalibration
+		if err := rows.Scan(&calibration.Id, &calibration.CalibratedAt, &calibration.NextCalibrationAt, &calibration.Certificate, &calibration.Note,
+			&calibration.UserId, &calibration.Username, &calibration.CreatedAt); err != nil {
+			http.Error(w, "error when reading from database", http.StatusInternalServerError)
+			return
+		}
+		calibrations = append(calibrations, calibration)
+	}
+	if err = rows.Err(); err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(calibrations)
+}
+
+/*
+Records a calibration of an instrument. If it is the newest calibration the
+instrument was last calibrated then, and its next calibration is due
+calibration_interval_days later.
+
+Query params:
+
+	instrument_id: int,
+	calibrated_at?: int, // UNIX timestamp in seconds, now if not set
+	certificate?: string,
+	note?: string
+*/
+func insertInstrumentCalibrationHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(User)
+
+	instrumentId, err := strconv.Atoi(r.FormValue("instrument_id"))
+	if err != nil {
+		http.Error(w, "instrument_id must be a positive int", http.StatusBadRequest)
+		return
+	}
+	now := time.Now().Unix()
+	calibratedAt := &now
+	if _calibratedAt := r.FormValue("calibrated_at"); _calibratedAt != "" {
+		if calibratedAt, err = parseInstrumentTime("calibrated_at", _calibratedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if *calibratedAt > now {
+			http.Error(w, "calibrated_at cannot be in the future", http.StatusBadRequest)
+			return
+		}
+	}
+	var certificate, note *string
+	if _certificate := strings.TrimSpace(r.FormValue("certificate")); _certificate != "" {
+		certificate = &_certificate
+	}
+	if _note := strings.TrimSpace(r.FormValue("note")); _note != "" {
+		note = &_note
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		http.Error(w, "failed to insert calibration", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var interval *int
+	var lastCalibratedAt *int64
+	err = tx.QueryRow("SELECT calibration_interval_days, last_calibrated_at FROM instruments WHERE id = ?", instrumentId).Scan(&interval, &lastCalibratedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "instrument not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	next := nextCalibration(calibratedAt, interval)
+
+	query := `
+		INSERT INTO instrument_calibrations (instrument_id, calibrated_at, next_calibration_at, certificate, note, user_id, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`
+	result, err := tx.Exec(query, instrumentId, *calibratedAt, next, certificate, note, user.Id, now)
+	if err != nil {
+		http.Error(w, "failed to insert calibration", http.StatusInternalServerError)
+		return
+	}
+	// Calibrations recorded late do not move the schedule back
+	if lastCalibratedAt == nil || *calibratedAt >= *lastCalibratedAt {
+		if _, err := tx.Exec("UPDATE instruments SET last_calibrated_at = ?, next_calibration_at = ? WHERE id = ?", *calibratedAt, next, instrumentId); err != nil {
+			http.Error(w, "failed to insert calibration", http.StatusInternalServerError)
+			return
+		}
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		http.Error(w, "failed to insert calibration", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "failed to insert calibration", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, "{\"id\":  %d}", id)
+}
+
+type Instrument struct {
+	Id                  int     `json:"id"`
+	AssetId             string  `json:"asset_id"`
+	Model               *string `json:"model,omitempty"`
+	SerialNumber        *string `json:"serial_number,omitempty"`
+	Location            *string `json:"location,omitempty"`
+	CalibrationInterval *int    `json:"calibration_interval_days,omitempty"`
+	LastCalibratedAt    *int64  `json:"last_calibrated_at,omitempty"`  // UNIX timestamp
+	NextCalibrationAt   *int64  `json:"next_calibration_at,omitempty"` // UNIX timestamp
+	Status              string  `json:"status"`
+	OverduePolicy       string  `json:"overdue_policy"`
+	Overdue             bool    `json:"overdue"`
+	CreatedAt           int64   `json:"created_at"`
+}
+
+type CalibrationDue struct {
+	Instrument
+	DaysUntilDue int `json:"days_until_due"`
+}
+
+type InstrumentCalibration struct {
+	Id                int     `json:"id"`
+	CalibratedAt      int64   `json:"calibrated_at"`
+	NextCalibrationAt *int64  `json:"next_calibration_at,omitempty"`
+	Certificate       *string `json:"certificate,omitempty"`
+	Note              *string `json:"note,omitempty"`
+	UserId            int     `json:"user_id"`
+	Username          *string `json:"username,omitempty"`
+	CreatedAt         int64   `json:"created_at"`
+}
+
+// Reads instruments with a query selecting instrumentColumns
+func readInstruments(query string, args ...any) ([]Instrument, error) {
+	rows, err := DB.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("readInstruments: %v", err)
+	}
+	defer rows.Close()
+
+	now := time.Now().Unix()
+	instruments := []Instrument{}
+	for rows.Next() {
+		var instrument Instrument
+		if err := rows.Scan(&instrument.Id, &instrument.AssetId, &instrument.Model, &instrument.SerialNumber, &instrument.Location, &instrument.CalibrationInterval,
+			&instrument.LastCalibratedAt, &instrument.NextCalibrationAt, &instrument.Status, &instrument.OverduePolicy, &instrument.CreatedAt); err != nil {
+			return nil, fmt.Errorf("readInstruments: %v", err)
+		}
+		instrument.Overdue = instrument.NextCalibrationAt != nil && *instrument.NextCalibrationAt < now
+		instruments = append(instruments, instrument)
+	}
+	return instruments, rows.Err()
+}
+
+// Checks that values can be entered from an instrument. Instruments that are
+// not active are refused, and so are overdue ones with the block policy.
+// Overdue instruments with the warn policy return a warning for the response.
+func checkInstrument(q queryRower, instrumentId int) (warning string, status int, err error) {
+	var assetId, instrumentStatus, policy string
+	var next *int64
+	err = q.QueryRow("SELECT asset_id, status, overdue_policy, next_calibration_at FROM instruments WHERE id = ?", instrumentId).Scan(&assetId, &instrumentStatus, &policy, &next)
+	if err == sql.ErrNoRows {
+		return "", http.StatusBadRequest, fmt.Errorf("instrument %d not found", instrumentId)
+	} else if err != nil {
+		return "", http.StatusInternalServerError, fmt.Errorf("error when reading from database")
+	}
+	if instrumentStatus != "active" {
+		return "", http.StatusConflict, fmt.Errorf("instrument %s is %s", assetId, strings.ReplaceAll(instrumentStatus, "_", " "))
+	}
+	if next == nil || *next >= time.Now().Unix() {
+		return "", 0, nil
+	}
+	message := fmt.Sprintf("calibration of instrument %s was due %s", assetId, time.Unix(*next, 0).UTC().Format(time.DateOnly))
+	if policy == overdueBlock {
+		return "", http.StatusConflict, fmt.Errorf("%s", message)
+	}
+	return message, 0, nil
+}
+
+func isInstrumentStatus(status string) bool {
+	for _, known := range instrumentStatuses {
+		if status == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Parses a calibration interval in days, nil if it is empty
+func parseCalibrationInterval(_interval string) (*int, error) {
+	if _interval == "" {
+		return nil, nil
+	}
+	interval, err := strconv.Atoi(_interval)
+	if err != nil || interval < 1 {
+		return nil, fmt.Errorf("calibration_interval_days must be a positive int")
+	}
+	return &interval, nil
+}
+
+// Parses an optional UNIX timestamp param, nil if it is empty
+func parseInstrumentTime(name string, _value string) (*int64, error) {
+	if _value == "" {
+		return nil, nil
+	}
+	value, err := strconv.ParseInt(_value, 10, 64)
+	if err != nil || value <= 0 {
+		return nil, fmt.Errorf("%s must be a positive integer", name)
+	}
+	return &value, nil
+}
+
+// The next calibration is due an interval after the last one, nil if either is not known
+func nextCalibration(last *int64, interval *int) *int64 {
+	if last == nil || interval == nil {
+		return nil
+	}
+	next := *last + int64(*interval)*86400
+	return &next
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Most labels printed at once
+const maxLabels = 1000
+
+// A sheet of labels, in points
+type labelSheetLayout struct {
+	pageWidth   float64
+	pageHeight  float64
+	columns     int
+	rows        int
+	labelWidth  float64
+	labelHeight float64
+	left        float64 // Page edge to the first label
+	top         float64
+	pitchX      float64 // Start of one label to the start of the next
+	pitchY      float64
+}
+
+const mmToPoints = 72 / 25.4
+
+// Avery layouts for US letter and A4 sheets
+var labelSheetLayouts = map[string]labelSheetLayout{
+	// 30 address labels, 2 5/8" x 1"
+	"avery-5160": {612, 792, 3, 10, 189, 72, 13.5, 36, 198, 72},
+	// 80 return address labels, 1 3/4" x 1/2"
+	"avery-5167": {612, 792, 4, 20, 126, 36, 21.6, 36, 147.6, 36},
+	// 65 labels, 38.1 x 21.2 mm
+	"avery-l7651": {595.28, 841.89, 5, 13, 38.1 * mmToPoints, 21.2 * mmToPoints, 4.75 * mmToPoints, 10.7 * mmToPoints, 40.6 * mmToPoints, 21.2 * mmToPoints},
+	// 14 labels, 99.1 x 38.1 mm
+	"avery-l7163": {595.28, 841.89, 2, 7, 99.1 * mmToPoints, 38.1 * mmToPoints, 4.65 * mmToPoints, 15.15 * mmToPoints, 101.6 * mmToPoints, 38.1 * mmToPoints},
+}
+
+/*
+Gets printer-ready labels for samples, either as a PDF of label sheets or
+as ZPL for Zebra label printers. Every label shows the collection name, a
+barcode of the sample identifier, the identifier, the creation time and the
+values of the chosen attributes. Samples without an identifier get their
+sample id in the barcode.
+
+Query params:
+
+	collection_id: int,
+	sample_ids?: string, // Comma separated, defaults to every sample of the collection, oldest first
+	attribute_ids?: string, // Comma separated, values to print on the labels
+	format?: string, // "pdf" (default) or "zpl"
+	symbology?: string, // "code128" (default), "datamatrix" or "qr"
+	layout?: string, // PDF only: "avery-5160" (default), "avery-5167", "avery-l7651" or "avery-l7163"
+	skip?: int, // PDF only: labels already used on the first sheet
+	width?: float, // ZPL only: label width in mm, defaults to 50.8
+	height?: float, // ZPL only: label height in mm, defaults to 25.4
+	dpi?: int // ZPL only: 203 (default), 300 or 600
+*/
+func fetchLabelsHandler(w http.ResponseWriter, r *http.Request) {
+	collectionId, err := strconv.Atoi(r.FormValue("collection_id"))
+	if err != nil {
+		http.Error(w, "collection_id must be a positive int", http.StatusBadRequest)
+		return
+	}
+	sampleIds, err := parseIdList(r.FormValue("sample_ids"))
+	if err != nil {
+		http.Error(w, "sample_ids must be comma separated ints", http.StatusBadRequest)
+		return
+	}
+	if len(sampleIds) > maxLabels {
+		http.Error(w, fmt.Sprintf("at most %d labels can be printed at once", maxLabels), http.StatusBadRequest)
+		return
+	}
+	attributeIds, err := parseIdList(r.FormValue("attribute_ids"))
+	if err != nil {
+		http.Error(w, "attribute_ids must be comma separated ints", http.StatusBadRequest)
+		return
+	}
+	symbology := r.FormValue("symbology")
+	if symbology == "" {
+		symbology = "code128"
+	}
+	if _, ok := barcodeEncoders[symbology]; !ok {
+		http.Error(w, "symbology must be one of: code128, datamatrix, qr", http.StatusBadRequest)
+		return
+	}
+
+	format := r.FormValue("format")
+	if format == "" {
+		format = "pdf"
+	}
+	var layout labelSheetLayout
+	var skip int
+	var width, height float64 = 50.8, 25.4
+	dpi := 203
+	switch format {
+	case "pdf":
+		_layout := r.FormValue("layout")
+		if _layout == "" {
+			_layout = "avery-5160"
+		}
+		var ok bool
+		if layout, ok = labelSheetLayouts[_layout]; !ok {
+			http.Error(w, "layout must be one of: avery-5160, avery-5167, avery-l7651, avery-l7163", http.StatusBadRequest)
+			return
+		}
+		if _skip := r.FormValue("skip"); _skip != "" {
+			skip, err = strconv.Atoi(_skip)
+			if err != nil || skip < 0 || skip >= layout.columns*layout.rows {
+				http.Error(w, fmt.Sprintf("skip must be an int from 0 to %d", layout.columns*layout.rows-1), http.StatusBadRequest)
+				return
+			}
+		}
+	case "zpl":
+		for _, param := range []struct {
+			name  string
+			value *float64
+		}{{"width", &width}, {"height", &height}} {
+			if _value := r.FormValue(param.name); _value != "" {
+				*param.value, err = strconv.ParseFloat(_value, 64)
+				if err != nil || *param.value < 5 || *param.value > 300 {
+					http.Error(w, param.name+" must be a number of mm from 5 to 300", http.StatusBadRequest)
+					return
+				}
+			}
+		}
+		if _dpi := r.FormValue("dpi"); _dpi != "" {
+			dpi, err = strconv.Atoi(_dpi)
+			if err != nil || (dpi != 203 && dpi != 300 && dpi != 600) {
+				http.Error(w, "dpi must be one of: 203, 300, 600", http.StatusBadRequest)
+				return
+			}
+		}
+	default:
+		http.Error(w, "format must be one of: pdf, zpl", http.StatusBadRequest)
+		return
+	}
+
+	labels, err := readLabelContents(collectionId, sampleIds, attributeIds)
+	if err != nil {
+		if err, ok := err.(labelError); ok {
+			http.Error(w, err.message, err.status)
+			return
+		}
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+
+	if format == "zpl" {
+		zpl, err := renderZPLLabels(labels, symbology, width, height, dpi)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Disposition", "attachment; filename=\"labels.zpl\"")
+		w.Write(zpl)
+		return
+	}
+	pdf, err := renderLabelSheets(labels, symbology, layout, skip)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"labels.pdf\"")
+	w.Write(pdf)
+}
+
+// The text and barcode of one label
+type labelContent struct {
+	Collection string
+	Barcode    string
+	Title      string
+	CreatedAt  string
+	Lines      []string // "name: value unit" of the chosen attributes
+}
+
+// Returned by readLabelContents for bad input
+type labelError struct {
+	status  int
+	message string
+}
+
+func (err labelError) Error() string {
+	return err.message
+}
+
+// Reads what goes on the labels of samples of a collection, in the order of
+// sampleIds, or every sample of the collection if sampleIds is empty
+func readLabelContents(collectionId int, sampleIds []int, attributeIds []int) ([]labelContent, error) {
+	var collection string
+	err := DB.QueryRow("SELECT name FROM collections WHERE id = ? AND deleted_at IS NULL", collectionId).Scan(&collection)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, labelError{http.StatusNotFound, "collection not found"}
+		}
+		return nil, fmt.Errorf("readLabelContents: %v", err)
+	}
+
+	// Names and units of the chosen attributes
+	type labelAttribute struct {
+		name string
+		unit string
+	}
+	attributes := make([]labelAttribute, len(attributeIds))
+	for i, id := range attributeIds {
+		var unit *string
+		query := `
+			SELECT a.name, COALESCE(u.symbol, u.name) FROM sample_attributes a LEFT JOIN units u ON u.id = a.unit_id
+			WHERE a.id = ? AND a.collection_id = ? AND a.deleted_at IS NULL
+		`
+		err := DB.QueryRow(query, id, collectionId).Scan(&attributes[i].name, &unit)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return nil, labelError{http.StatusBadRequest, fmt.Sprintf("attribute %d is not part of the collection", id)}
+			}
+			return nil, fmt.Errorf("readLabelContents: %v", err)
+		}
+		if unit != nil {
+			attributes[i].unit = *unit
+		}
+	}
+
+	if len(sampleIds) == 0 {
+		rows, err := DB.Query("SELECT id FROM samples WHERE collection_id = ? AND deleted_at IS NULL ORDER BY created_at, id LIMIT ?", collectionId, maxLabels+1)
+		if err != nil {
+			return nil, fmt.Errorf("readLabelContents: %v", err)
+		}
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("readLabelContents: %v", err)
+			}
+			sampleIds = append(sampleIds, id)
+		}
+		rows.Close()
+		if len(sampleIds) > maxLabels {
+			return nil, labelError{http.StatusBadRequest, fmt.Sprintf("the collection has more than %d samples, choose them with sample_ids", maxLabels)}
+		}
+	}
+
+	labels := make([]labelContent, 0, len(sampleIds))
+	for _, sampleId := range sampleIds {
+		var identifier *string
+		var createdAt int64
+		query := "SELECT identifier, created_at FROM samples WHERE id = ? AND collection_id = ? AND deleted_at IS NULL"
+		err := DB.QueryRow(query, sampleId, collectionId).Scan(&identifier, &createdAt)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return nil, labelError{http.StatusBadRequest, fmt.Sprintf("sample %d is not part of the collection", sampleId)}
+			}
+			return nil, fmt.Errorf("readLabelContents: %v", err)
+		}
+
+		label := labelContent{
+			Collection: collection,
+			Barcode:    strconv.Itoa(sampleId),
+			Title:      fmt.Sprintf("Sample %d", sampleId),
+			CreatedAt:  time.Unix(createdAt, 0).UTC().Format("2006-01-02 15:04"),
+		}
+		if identifier != nil {
+			label.Barcode = *identifier
+			label.Title = *identifier
+		}
+		for i, id := range attributeIds {
+			var value, censor, qualifier *string
+			query := "SELECT value, censor, qualifier FROM sample_attribute_values WHERE sample_id = ? AND attribute_id = ?"
+			err := DB.QueryRow(query, sampleId, id).Scan(&value, &censor, &qualifier)
+			if err != nil && err != sql.ErrNoRows {
+				return nil, fmt.Errorf("readLabelContents: %v", err)
+			}
+			if err == sql.ErrNoRows || value == nil || *value == "" {
+				continue
+			}
+			// Censored values are printed with their censor, e.g. "<0.5"
+			line := attributes[i].name + ": " + formatCensoredValue(*value, censor)
+			if attributes[i].unit != "" {
+				line += " " + attributes[i].unit
+			}
+			if qualifier != nil {
+				line += " " + *qualifier
+			}
+			label.Lines = append(label.Lines, line)
+		}
+		labels = append(labels, label)
+	}
+	return labels, nil
+}
+
+// Where the parts of a label go. Units are points for PDF and dots for ZPL.
+type labelPlan struct {
+	barcode   *barcodeMatrix
+	barcodeX  float64
+	barcodeY  float64
+	barcodeW  float64
+	barcodeH  float64
+	textX     float64
+	textY     float64
+	textWidth float64
+	fontSize  float64
+	lines     []labelLine
+}
+
+type labelLine struct {
+	text string
+	bold bool
+}
+
+// Lays out a label: square barcodes on the right with the text beside them,
+// Code 128 along the bottom below the text
+func planLabel(label labelContent, symbology string, width float64, height float64) (labelPlan, error) {
+	matrix, err := barcodeEncoders[symbology](label.Barcode)
+	if err != nil {
+		return labelPlan{}, fmt.Errorf("cannot encode %s: %v", label.Barcode, err)
+	}
+
+	padding := math.Min(width, height) * 0.06
+	plan := labelPlan{barcode: matrix, textX: padding, textY: padding}
+	textHeight := height - 2*padding
+	if symbology == "code128" {
+		plan.barcodeW = width - 2*padding
+		plan.barcodeH = textHeight * 0.38
+		plan.barcodeX = padding
+		plan.barcodeY = height - padding - plan.barcodeH
+		plan.textWidth = width - 2*padding
+		textHeight -= plan.barcodeH + padding
+	} else {
+		side := math.Min(textHeight, width*0.35)
+		plan.barcodeW, plan.barcodeH = side, side
+		plan.barcodeX = width - padding - side
+		plan.barcodeY = padding
+		plan.textWidth = width - 3*padding - side
+	}
+
+	plan.lines = []labelLine{{label.Collection, true}, {label.Title, false}, {label.CreatedAt, false}}
+	for _, line := range label.Lines {
+		plan.lines = append(plan.lines, labelLine{line, false})
+	}
+	plan.fontSize = math.Min(textHeight/(float64(len(plan.lines))*1.2), height/7)
+	for i, line := range plan.lines {
+		plan.lines[i].text = fitText(line.text, plan.fontSize, line.bold, plan.textWidth)
+	}
+	return plan, nil
+}
+
+// Draws labels on as many sheets as they need, starting after the skipped labels
+func renderLabelSheets(labels []labelContent, symbology string, layout labelSheetLayout, skip int) ([]byte, error) {
+	document := newPDFDocument(layout.pageWidth, layout.pageHeight)
+	perPage := layout.columns * layout.rows
+	var page *pdfPage
+	for i, label := range labels {
+		slot := (skip + i) % perPage
+		if page == nil || slot == 0 {
+			page = document.addPage()
+		}
+		plan, err := planLabel(label, symbology, layout.labelWidth, layout.labelHeight)
+		if err != nil {
+			return nil, err
+		}
+
+		x := layout.left + float64(slot%layout.columns)*layout.pitchX
+		y := layout.top + float64(slot/layout.columns)*layout.pitchY
+		for j, line := range plan.lines {
+			page.text(x+plan.textX, y+plan.textY+float64(j)*plan.fontSize*1.2, plan.fontSize, line.bold, line.text)
+		}
+		page.barcode(plan.barcode, x+plan.barcodeX, y+plan.barcodeY, plan.barcodeW, plan.barcodeH)
+	}
+	if len(labels) == 0 {
+		document.addPage()
+	}
+	return document.bytes(), nil
+}
+
+// Writes one ZPL label format per sample, using the printer's own barcode commands
+func renderZPLLabels(labels []labelContent, symbology string, widthMm float64, heightMm float64, dpi int) ([]byte, error) {
+	dotsPerMm := float64(dpi) / 25.4
+	width, height := widthMm*dotsPerMm, heightMm*dotsPerMm
+
+	var b strings.Builder
+	for _, label := range labels {
+		plan, err := planLabel(label, symbology, width, height)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&b, "^XA\n^CI28\n^PW%d\n^LL%d\n", int(width), int(height))
+		// Font 0 is bold already, so every line uses it
+		size := int(plan.fontSize)
+		for i, line := range plan.lines {
+			y := int(plan.textY + float64(i)*plan.fontSize*1.2)
+			fmt.Fprintf(&b, "^FO%d,%d^A0N,%d,%d^FH\\^FD%s^FS\n", int(plan.textX), y, size, size, zplEscape(line.text))
+		}
+
+		// Module size in dots, the barcode keeps its quiet zone inside the planned area
+		matrix := plan.barcode
+		module := int(math.Max(1, math.Floor(plan.barcodeW/float64(matrix.width+2*matrix.quietZone))))
+		x := int(plan.barcodeX) + module*matrix.quietZone
+		y := int(plan.barcodeY) + module*matrix.quietZone
+		switch symbology {
+		case "code128":
+			y = int(plan.barcodeY)
+			fmt.Fprintf(&b, "^FO%d,%d^BY%d^BCN,%d,N,N,N,A^FH\\^FD%s^FS\n", x, y, module, int(plan.barcodeH), zplEscape(label.Barcode))
+		case "datamatrix":
+			fmt.Fprintf(&b, "^FO%d,%d^BXN,%d,200^FH\\^FD%s^FS\n", x, y, module, zplEscape(label.Barcode))
+		case "qr":
+			fmt.Fprintf(&b, "^FO%d,%d^BQN,2,%d^FH\\^FDMA,%s^FS\n", x, y, min(module, 10), zplEscape(label.Barcode))
+		}
+		b.WriteString("^XZ\n")
+	}
+	return []byte(b.String()), nil
+}
+
+// Escapes the characters ZPL reads as commands, for fields with ^FH\
+func zplEscape(text string) string {
+	return strings.NewReplacer("\\", "\\5C", "^", "\\5E", "~", "\\7E").Replace(text)
+}
+
+// Parses a comma separated list of ids, empty for an empty string
+func parseIdList(list string) ([]int, error) {
+	var ids []int
+	if strings.TrimSpace(list) == "" {
+		return ids, nil
+	}
+	for _, _id := range strings.Split(list, ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(_id))
+		if err != nil || id < 1 {
+			return nil, fmt.Errorf("invalid id %q", _id)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Flags given to numeric values evaluated against the limits of their attribute
+const (
+	flagOk   = "ok"
+	flagWarn = "warn"
+	flagFail = "fail"
+)
+
+/*
+Gets the specification limits of an attribute, newest version first
+
+Query params:
+
+	attribute_id: int
+
+Result:
+
+	[{
+		id: int,
+		attribute_id: int,
+		lower_spec: float,
+		upper_spec: float,
+		lower_warn: float,
+		upper_warn: float,
+		valid_from: int, // UNIX timestamp in seconds
+		created_at: int
+	}]
+*/
+func fetchAttributeLimitsHandler(w http.ResponseWriter, r *http.Request) {
+	attributeId, err := strconv.Atoi(r.FormValue("attribute_id"))
+	if err != nil {
+		http.Error(w, "attribute_id must be a positive int", http.StatusBadRequest)
+		return
+	}
+
+	query := `
+		SELECT id, attribute_id, lower_spec, upper_spec, lower_warn, upper_warn, valid_from, created_at
+		FROM attribute_limits
+		WHERE attribute_id = ?
+		ORDER BY valid_from DESC
+	`
+	rows, err := DB.Query(query, attributeId)
+	if err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var limits = []AttributeLimit{}
+	for rows.Next() {
+		var limit AttributeLimit
+		if err := rows.Scan(&limit.Id, &limit.AttributeId, &limit.LowerSpec, &limit.UpperSpec, &limit.LowerWarn, &limit.UpperWarn, &limit.ValidFrom, &limit.CreatedAt); err != nil {
+			http.Error(w, "error when reading from database", http.StatusInternalServerError)
+			return
+		}
+		limits = append(limits, limit)
+	}
+	if err = rows.Err(); err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(limits)
+}
+
+/*
+Adds a version of the specification limits of an attribute. The version
+applies to samples created at or after valid_from, until a newer version
+takes over. Existing values of the attribute are evaluated again.
+
+Query params:
+
+	attribute_id: int,
+	lower_spec?: float,
+	upper_spec?: float,
+	lower_warn?: float,
+	upper_warn?: float,
+	valid_from?: int // UNIX timestamp in seconds, defaults to 0 (all samples)
+*/
+func insertAttributeLimitHandler(w http.ResponseWriter, r *http.Request) {
+	var limit AttributeLimit
+	var err error
+	limit.AttributeId, err = strconv.Atoi(r.FormValue("attribute_id"))
+	if err != nil {
+		http.Error(w, "attribute_id must be a positive int", http.StatusBadRequest)
+		return
+	}
+
+	// Parse the optional limits
+	bounds := map[string]**float64{
+		"lower_spec": &limit.LowerSpec,
+		"upper_spec": &limit.UpperSpec,
+		"lower_warn": &limit.LowerWarn,
+		"upper_warn": &limit.UpperWarn,
+	}
+	for name, bound := range bounds {
+		_value := r.FormValue(name)
+		if _value == "" {
+			continue
+		}
+		value, err := strconv.ParseFloat(_value, 64)
+		if err != nil {
+			http.Error(w, name+" must be a number", http.StatusBadRequest)
+			return
+		}
+		*bound = &value
+	}
+	if limit.LowerSpec == nil && limit.UpperSpec == nil && limit.LowerWarn == nil && limit.UpperWarn == nil {
+		http.Error(w, "at least one limit is required", http.StatusBadRequest)
+		return
+	}
+	if err := limit.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if _validFrom := r.FormValue("valid_from"); _validFrom != "" {
+		limit.ValidFrom, err = strconv.ParseInt(_validFrom, 10, 64)
+		if err != nil || limit.ValidFrom < 0 {
+			http.Error(w, "valid_from must be a positive int", http.StatusBadRequest)
+			return
+		}
+	}
+	limit.CreatedAt = time.Now().Unix()
+
+	query := "INSERT INTO attribute_limits (attribute_id, lower_spec, upper_spec, lower_warn, upper_warn, valid_from, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)"
+	result, err := DB.Exec(query, limit.AttributeId, limit.LowerSpec, limit.UpperSpec, limit.LowerWarn, limit.UpperWarn, limit.ValidFrom, limit.CreatedAt)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed:") {
+			http.Error(w, "limits already exist for this attribute at valid_from", http.StatusBadRequest)
+			return
+		}
+		if strings.Contains(err.Error(), "FOREIGN KEY constraint failed") {
+			http.Error(w, "attribute not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "error inserting to database", http.StatusInternalServerError)
+		return
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		http.Error(w, "error inserting to database", http.StatusInternalServerError)
+		return
+	}
+
+	if err := reevaluateAttributeFlags(limit.AttributeId); err != nil {
+		http.Error(w, "error when evaluating values", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, "{\"id\":  %d}", id)
+}
+
+/*
+Deletes a version of the specification limits of an attribute
+
+Query params:
+
+	limit_id: int
+*/
+func deleteAttributeLimitHandler(w http.ResponseWriter, r *http.Request) {
+	limitId, err := strconv.Atoi(r.FormValue("limit_id"))
+	if err != nil {
+		http.Error(w, "limit_id must be a positive int", http.StatusBadRequest)
+		return
+	}
+
+	var attributeId int
+	err = DB.QueryRow("SELECT attribute_id FROM attribute_limits WHERE id = ?", limitId).Scan(&attributeId)
+	if err != nil {
+		http.Error(w, "limit not found", http.StatusNotFound)
+		return
+	}
+
+	if _, err := DB.Exec("DELETE FROM attribute_limits WHERE id = ?", limitId); err != nil {
+		http.Error(w, "failed to delete limit", http.StatusInternalServerError)
+		return
+	}
+
+	if err := reevaluateAttributeFlags(attributeId); err != nil {
+		http.Error(w, "error when evaluating values", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// AttributeLimit is one version of the specification and warning limits of an attribute
+type AttributeLimit struct {
+	Id          int      `json:"id"`
+	AttributeId int      `json:"attribute_id"`
+	LowerSpec   *float64 `json:"lower_spec,omitempty"`
+	UpperSpec   *float64 `json:"upper_spec,omitempty"`
+	LowerWarn   *float64 `json:"lower_warn,omitempty"`
+	UpperWarn   *float64 `json:"upper_warn,omitempty"`
+	ValidFrom   int64    `json:"valid_from"` // UNIX timestamp
+	CreatedAt   int64    `json:"created_at"` // UNIX timestamp
+}
+
+// Checks that the limits are ordered lower_spec <= lower_warn <= upper_warn <= upper_spec
+func (limit AttributeLimit) validate() error {
+	ordered := []*float64{limit.LowerSpec, limit.LowerWarn, limit.UpperWarn, limit.UpperSpec}
+	var previous *float64
+	for _, bound := range ordered {
+		if bound == nil {
+			continue
+		}
+		if previous != nil && *bound < *previous {
+			return fmt.Errorf("limits must be ordered lower_spec <= lower_warn <= upper_warn <= upper_spec")
+		}
+		previous = bound
+	}
+	return nil
+}
+
+// Returns the flag of a numeric value. Values outside the specification limits
+// fail, values outside the warning limits warn.
+func (limit AttributeLimit) evaluate(value float64) string {
+	if (limit.LowerSpec != nil && value < *limit.LowerSpec) || (limit.UpperSpec != nil && value > *limit.UpperSpec) {
+		return flagFail
+	}
+	if (limit.LowerWarn != nil && value < *limit.LowerWarn) || (limit.UpperWarn != nil && value > *limit.UpperWarn) {
+		return flagWarn
+	}
+	return flagOk
+}
+
+// Flags a censored value, which is only known to lie on one side of the number
+// it is censored at. Returns nil if a limit falls inside that range, so the
+// value may or may not meet it.
+func (limit AttributeLimit) evaluateCensored(value float64, censor string) *string {
+	lowers := []*float64{limit.LowerSpec, limit.LowerWarn}
+	uppers := []*float64{limit.UpperSpec, limit.UpperWarn}
+
+	var bound float64
+	var straddles func(threshold float64, lower bool) bool
+	switch censor {
+	case "<", "≤":
+		// The value is anywhere up to its number
+		bound = value
+		if censor == "<" {
+			bound = math.Nextafter(value, math.Inf(-1))
+		}
+		straddles = func(threshold float64, lower bool) bool {
+			return threshold < bound || (lower && threshold == bound)
+		}
+	default:
+		// The value is anywhere from its number up
+		bound = value
+		if censor == ">" {
+			bound = math.Nextafter(value, math.Inf(1))
+		}
+		straddles = func(threshold float64, lower bool) bool {
+			return threshold > bound || (!lower && threshold == bound)
+		}
+	}
+
+	for i := range lowers {
+		if (lowers[i] != nil && straddles(*lowers[i], true)) || (uppers[i] != nil && straddles(*uppers[i], false)) {
+			return nil
+		}
+	}
+	flag := limit.evaluate(bound)
+	return &flag
+}
+
+// queryRower is implemented by both *sql.DB and *sql.Tx
+type queryRower interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// Returns the flag of a value of a sample, or nil if the value is not a finite number,
+// no limits apply to the sample or the value is censored across a limit
+func evaluateValueFlag(q queryRower, sampleId int, attributeId int, value string, censor *string) (*string, error) {
+	number, ok := parseFiniteNumber(value)
+	if !ok {
+		return nil, nil
+	}
+
+	var limit AttributeLimit
+	query := `
+		SELECT l.lower_spec, l.upper_spec, l.lower_warn, l.upper_warn
+		FROM attribute_limits l, samples s
+		WHERE l.attribute_id = ? AND s.id = ? AND l.valid_from <= s.created_at
+		ORDER BY l.valid_from DESC
+		LIMIT 1
+	`
+	err := q.QueryRow(query, attributeId, sampleId).Scan(&limit.LowerSpec, &limit.UpperSpec, &limit.LowerWarn, &limit.UpperWarn)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("evaluateValueFlag: %v", err)
+	}
+
+	if censor != nil {
+		return limit.evaluateCensored(number, *censor), nil
+	}
+	flag := limit.evaluate(number)
+	return &flag, nil
+}
+
+// Evaluates every value of a sample again, after its creation time changed.
+// Values of a sample in a locked workflow state keep their flags.
+func reevaluateSampleFlags(sampleId int) error {
+	query := `
+		SELECT v.attribute_id, v.value, v.censor FROM sample_attribute_values v
+		JOIN samples s ON s.id = v.sample_id
+		LEFT JOIN workflow_states ws ON ws.id = s.status_id
+		WHERE v.sample_id = ? AND COALESCE(ws.is_locked, 0) = 0
+	`
+	rows, err := DB.Query(query, sampleId)
+	if err != nil {
+		return fmt.Errorf("reevaluateSampleFlags: %v", err)
+	}
+	var attributeIds []int
+	var values, censors []*string
+	for rows.Next() {
+		var attributeId int
+		var value, censor *string
+		if err := rows.Scan(&attributeId, &value, &censor); err != nil {
+			rows.Close()
+			return fmt.Errorf("reevaluateSampleFlags: %v", err)
+		}
+		attributeIds = append(attributeIds, attributeId)
+		values = append(values, value)
+		censors = append(censors, censor)
+	}
+	rows.Close()
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return fmt.Errorf("reevaluateSampleFlags: %v", err)
+	}
+	defer tx.Rollback()
+
+	for i, value := range values {
+		var flag *string
+		if value != nil {
+			if flag, err = evaluateValueFlag(tx, sampleId, attributeIds[i], *value, censors[i]); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec("UPDATE sample_attribute_values SET flag = ? WHERE sample_id = ? AND attribute_id = ?", flag, sampleId, attributeIds[i]); err != nil {
+			return fmt.Errorf("reevaluateSampleFlags: %v", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// Evaluates every value of an attribute again, after its limits changed.
+// Values of samples in a locked workflow state keep their flags.
+func reevaluateAttributeFlags(attributeId int) error {
+	query := `
+		SELECT v.sample_id, v.value, v.censor FROM sample_attribute_values v
+		JOIN samples s ON s.id = v.sample_id
+		LEFT JOIN workflow_states ws ON ws.id = s.status_id
+		WHERE v.attribute_id = ? AND COALESCE(ws.is_locked, 0) = 0
+	`
+	rows, err := DB.Query(query, attributeId)
+	if err != nil {
+		return fmt.Errorf("reevaluateAttributeFlags: %v", err)
+	}
+	var sampleIds []int
+	var values, censors []*string
+	for rows.Next() {
+		var sampleId int
+		var value, censor *string
+		if err := rows.Scan(&sampleId, &value, &censor); err != nil {
+			rows.Close()
+			return fmt.Errorf("reevaluateAttributeFlags: %v", err)
+		}
+		sampleIds = append(sampleIds, sampleId)
+		values = append(values, value)
+		censors = append(censors, censor)
+	}
+	rows.Close()
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return fmt.Errorf("reevaluateAttributeFlags: %v", err)
+	}
+	defer tx.Rollback()
+
+	for i, value := range values {
+		var flag *string
+		if value != nil {
+			if flag, err = evaluateValueFlag(tx, sampleIds[i], attributeId, *value, censors[i]); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec("UPDATE sample_attribute_values SET flag = ? WHERE sample_id = ? AND attribute_id = ?", flag, sampleIds[i], attributeId); err != nil {
+			return fmt.Errorf("reevaluateAttributeFlags: %v", err)
+		}
+	}
+	return tx.Commit()
+}
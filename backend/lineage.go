@@ -0,0 +1,448 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Ways a child sample can come from its parent
+var sampleRelationTypes = map[string]bool{
+	"aliquot":  true,
+	"dilution": true,
+	"derived":  true,
+}
+
+// Most aliquots created in one call
+const maxAliquots = 500
+
+/*
+Links two samples as parent and child. The samples may belong to different
+collections, but a sample cannot become its own ancestor.
+
+Query params:
+
+	parent_id: int,
+	child_id: int,
+	relation: string // "aliquot", "dilution" or "derived"
+*/
+func insertSampleRelationHandler(w http.ResponseWriter, r *http.Request) {
+	parentId, err := strconv.Atoi(r.FormValue("parent_id"))
+	if err != nil {
+		http.Error(w, "parent_id must be a positive int", http.StatusBadRequest)
+		return
+	}
+	childId, err := strconv.Atoi(r.FormValue("child_id"))
+	if err != nil {
+		http.Error(w, "child_id must be a positive int", http.StatusBadRequest)
+		return
+	}
+	relation := r.FormValue("relation")
+	if !sampleRelationTypes[relation] {
+		http.Error(w, "relation must be one of: aliquot, dilution, derived", http.StatusBadRequest)
+		return
+	}
+	if parentId == childId {
+		http.Error(w, "a sample cannot be its own parent", http.StatusBadRequest)
+		return
+	}
+
+	for _, id := range []int{parentId, childId} {
+		trashed, err := isSampleTrashed(id)
+		if err != nil {
+			http.Error(w, "error when reading from database", http.StatusInternalServerError)
+			return
+		}
+		if trashed {
+			http.Error(w, "sample not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	// The parent must not descend from the child
+	var cycle bool
+	query := `
+		WITH RECURSIVE descendants(id) AS (
+			SELECT ?
+			UNION
+			SELECT r.child_id FROM sample_relations r JOIN descendants d ON r.parent_id = d.id
+		)
+		SELECT EXISTS(SELECT 1 FROM descendants WHERE id = ?)
+	`
+	if err := DB.QueryRow(query, childId, parentId).Scan(&cycle); err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	if cycle {
+		http.Error(w, "the parent already descends from the child", http.StatusBadRequest)
+		return
+	}
+
+	user := r.Context().Value("user").(User)
+	id, err := createSampleRelation(DB, parentId, childId, relation, user.Id)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed:") {
+			http.Error(w, "samples are already related", http.StatusBadRequest)
+			return
+		}
+		if strings.Contains(err.Error(), "FOREIGN KEY constraint failed") {
+			http.Error(w, "sample not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "error inserting to database", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, "{\"id\":  %d}", id)
+}
+
+/*
+Removes the link between two samples
+
+Query params:
+
+	relation_id: int
+*/
+func deleteSampleRelationHandler(w http.ResponseWriter, r *http.Request) {
+	relationId, err := strconv.Atoi(r.FormValue("relation_id"))
+	if err != nil {
+		http.Error(w, "relation_id must be a positive int", http.StatusBadRequest)
+		return
+	}
+
+	result, err := DB.Exec("DELETE FROM sample_relations WHERE id = ?", relationId)
+	if err != nil {
+		http.Error(w, "failed to delete relation", http.StatusInternalServerError)
+		return
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil || rowsAffected == 0 {
+		http.Error(w, "relation not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+/*
+Gets the lineage graph of a sample: every sample it descends from and/or
+every sample descending from it, across collections. Samples in the trash
+are left out, together with the relations through them.
+
+Query params:
+
+	sample_id: int,
+	direction?: string // "ancestors", "descendants" or "both" (default)
+
+Result:
+
+	{
+		sample_id: int,
+		samples: [
+			{
+				sample_id: int,
+				collection_id: int,
+				identifier: string, // Omitted if the sample has none
+				created_at: int,
+				note: string,
+				depth: int // Generations from the sample, negative for ancestors
+			}
+			...
+		],
+		relations: [
+			{
+				id: int,
+				parent_id: int,
+				child_id: int,
+				relation: string,
+				created_at: int
+			}
+			...
+		]
+	}
+*/
+func fetchSampleLineageHandler(w http.ResponseWriter, r *http.Request) {
+	sampleId, err := strconv.Atoi(r.FormValue("sample_id"))
+	if err != nil {
+		http.Error(w, "sample_id must be a positive int", http.StatusBadRequest)
+		return
+	}
+	direction := r.FormValue("direction")
+	if direction == "" {
+		direction = "both"
+	}
+	if direction != "ancestors" && direction != "descendants" && direction != "both" {
+		http.Error(w, "direction must be one of: ancestors, descendants, both", http.StatusBadRequest)
+		return
+	}
+
+	trashed, err := isSampleTrashed(sampleId)
+	if err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	if trashed {
+		http.Error(w, "sample not found", http.StatusNotFound)
+		return
+	}
+
+	// Walk the relations up and down, only through samples that are not in the trash.
+	// Relations are kept acyclic, so the recursion ends. A sample reached along paths
+	// of different lengths is placed at its nearest generation.
+	query := `
+		WITH RECURSIVE
+		active(id) AS (
+			SELECT s.id FROM samples s JOIN collections c ON c.id = s.collection_id
+			WHERE s.deleted_at IS NULL AND c.deleted_at IS NULL
+		),
+		ancestors(id, depth) AS (
+			SELECT ?, 0
+			UNION
+			SELECT r.parent_id, a.depth - 1 FROM sample_relations r
+			JOIN ancestors a ON r.child_id = a.id
+			WHERE ? AND r.parent_id IN active
+		),
+		descendants(id, depth) AS (
+			SELECT ?, 0
+			UNION
+			SELECT r.child_id, d.depth + 1 FROM sample_relations r
+			JOIN descendants d ON r.parent_id = d.id
+			WHERE ? AND r.child_id IN active
+		),
+		lineage(id, depth) AS (
+			SELECT id, MAX(depth) FROM ancestors GROUP BY id
+			UNION ALL
+			SELECT id, MIN(depth) FROM descendants WHERE id NOT IN (SELECT id FROM ancestors) GROUP BY id
+		)
+		SELECT s.id, s.collection_id, s.identifier, s.created_at, s.note, l.depth
+		FROM lineage l JOIN samples s ON s.id = l.id
+		WHERE s.id IN active
+		ORDER BY l.depth, s.id
+	`
+	withAncestors := direction != "descendants"
+	withDescendants := direction != "ancestors"
+	rows, err := DB.Query(query, sampleId, withAncestors, sampleId, withDescendants)
+	if err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	lineage := SampleLineage{
+		SampleId:  sampleId,
+		Samples:   []LineageSample{},
+		Relations: []SampleRelation{},
+	}
+	inLineage := make(map[int]bool)
+	for rows.Next() {
+		var sample LineageSample
+		if err := rows.Scan(&sample.SampleId, &sample.CollectionId, &sample.Identifier, &sample.CreatedAt, &sample.Note, &sample.Depth); err != nil {
+			http.Error(w, "error when reading from database", http.StatusInternalServerError)
+			return
+		}
+		inLineage[sample.SampleId] = true
+		lineage.Samples = append(lineage.Samples, sample)
+	}
+	if err = rows.Err(); err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	if len(lineage.Samples) == 0 {
+		http.Error(w, "sample not found", http.StatusNotFound)
+		return
+	}
+
+	// Relations between samples of the graph. With one direction only, relations
+	// of siblings to other parents are not part of it.
+	ids := make([]string, 0, len(inLineage))
+	for id := range inLineage {
+		ids = append(ids, strconv.Itoa(id))
+	}
+	query = fmt.Sprintf(`
+		SELECT id, parent_id, child_id, relation, created_at FROM sample_relations
+		WHERE parent_id IN (%s) AND child_id IN (%s)
+		ORDER BY id
+	`, strings.Join(ids, ","), strings.Join(ids, ","))
+	relationRows, err := DB.Query(query)
+	if err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	defer relationRows.Close()
+	for relationRows.Next() {
+		var relation SampleRelation
+		if err := relationRows.Scan(&relation.Id, &relation.ParentId, &relation.ChildId, &relation.Relation, &relation.CreatedAt); err != nil {
+			http.Error(w, "error when reading from database", http.StatusInternalServerError)
+			return
+		}
+		lineage.Relations = append(lineage.Relations, relation)
+	}
+	if err = relationRows.Err(); err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lineage)
+}
+
+/*
+Creates aliquots of a sample: new samples linked to it as children. They
+are created in the collection of the parent unless another is given, and
+start in the initial workflow state of their collection.
+
+Query params:
+
+	sample_id: int,
+	count: int,
+	collection_id?: int,
+	relation?: string, // "aliquot" (default), "dilution" or "derived"
+	note?: string // Defaults to "Aliquot i of n"
+
+Result:
+
+	{
+		ids: [int]
+	}
+*/
+func insertAliquotsHandler(w http.ResponseWriter, r *http.Request) {
+	parentId, err := strconv.Atoi(r.FormValue("sample_id"))
+	if err != nil {
+		http.Error(w, "sample_id must be a positive int", http.StatusBadRequest)
+		return
+	}
+	count, err := strconv.Atoi(r.FormValue("count"))
+	if err != nil || count < 1 || count > maxAliquots {
+		http.Error(w, fmt.Sprintf("count must be an int between 1 and %d", maxAliquots), http.StatusBadRequest)
+		return
+	}
+	relation := r.FormValue("relation")
+	if relation == "" {
+		relation = "aliquot"
+	}
+	if !sampleRelationTypes[relation] {
+		http.Error(w, "relation must be one of: aliquot, dilution, derived", http.StatusBadRequest)
+		return
+	}
+
+	trashed, err := isSampleTrashed(parentId)
+	if err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	parentCollectionId, err := readSampleCollectionId(parentId)
+	if err != nil || trashed {
+		http.Error(w, "sample not found", http.StatusNotFound)
+		return
+	}
+	collectionId := parentCollectionId
+	if _collectionId := r.FormValue("collection_id"); _collectionId != "" {
+		collectionId, err = strconv.Atoi(_collectionId)
+		if err != nil {
+			http.Error(w, "collection_id must be a positive int", http.StatusBadRequest)
+			return
+		}
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		http.Error(w, "error inserting to database", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM collections WHERE id = ? AND deleted_at IS NULL)", collectionId).Scan(&exists)
+	if err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "collection not found", http.StatusNotFound)
+		return
+	}
+
+	user := r.Context().Value("user").(User)
+	createdAt := time.Now().Unix()
+	ids := make([]int, 0, count)
+	for i := 1; i <= count; i++ {
+		note := r.FormValue("note")
+		if !r.Form.Has("note") {
+			note = fmt.Sprintf("Aliquot %d of %d", i, count)
+		}
+		query := "INSERT INTO samples (collection_id, created_at, inserted_at, note, status_id) VALUES (?, ?, ?, ?, (SELECT id FROM workflow_states WHERE collection_id = ? AND is_initial = 1))"
+		result, err := tx.Exec(query, collectionId, createdAt, createdAt, note, collectionId)
+		if err != nil {
+			http.Error(w, "error inserting to database", http.StatusInternalServerError)
+			return
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			http.Error(w, "error inserting to database", http.StatusInternalServerError)
+			return
+		}
+		if _, err := assignSampleIdentifier(tx, int(id)); err != nil {
+			if _, ok := err.(identifierInUseError); ok {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			http.Error(w, "error inserting to database", http.StatusInternalServerError)
+			return
+		}
+		if _, err := createSampleRelation(tx, parentId, int(id), relation, user.Id); err != nil {
+			http.Error(w, "error inserting to database", http.StatusInternalServerError)
+			return
+		}
+		ids = append(ids, int(id))
+	}
+	if err = tx.Commit(); err != nil {
+		http.Error(w, "error inserting to database", http.StatusInternalServerError)
+		return
+	}
+	for _, id := range ids {
+		emitWebhookEvent(collectionId, "sample.created", map[string]any{"sample_id": id, "parent_id": parentId, "relation": relation})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string][]int{"ids": ids})
+}
+
+// SampleLineage is the result of fetchSampleLineageHandler
+type SampleLineage struct {
+	SampleId  int              `json:"sample_id"`
+	Samples   []LineageSample  `json:"samples"`
+	Relations []SampleRelation `json:"relations"`
+}
+
+type LineageSample struct {
+	SampleId     int     `json:"sample_id"`
+	CollectionId int     `json:"collection_id"`
+	Identifier   *string `json:"identifier,omitempty"`
+	CreatedAt    int64   `json:"created_at"`
+	Note         string  `json:"note"`
+	Depth        int     `json:"depth"` // Negative for ancestors
+}
+
+// SampleRelation links a child sample to the sample it came from
+type SampleRelation struct {
+	Id        int    `json:"id"`
+	ParentId  int    `json:"parent_id"`
+	ChildId   int    `json:"child_id"`
+	Relation  string `json:"relation"`
+	CreatedAt int64  `json:"created_at"` // UNIX timestamp
+}
+
+func createSampleRelation(q sqlExecutor, parentId int, childId int, relation string, userId int) (int64, error) {
+	query := "INSERT INTO sample_relations (parent_id, child_id, relation, created_at, created_by) VALUES (?, ?, ?, ?, ?)"
+	result, err := q.Exec(query, parentId, childId, relation, time.Now().Unix(), userId)
+	if err != nil {
+		return 0, fmt.Errorf("createSampleRelation: %v", err)
+	}
+	return result.LastInsertId()
+}
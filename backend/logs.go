@@ -25,9 +25,13 @@ func dbLoggerMiddleware(next http.Handler) http.Handler {
 			user = _user.(User)
 		}
 
-		// Save the raw body bytes before decoding
-		bodyBytes, err := io.ReadAll(r.Body)
-		if err != nil {
+		// Save the raw body bytes before decoding. File uploads are streamed to
+		// the handler and not logged.
+		var bodyBytes []byte
+		var err error
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+			bodyBytes = []byte("<multipart>")
+		} else if bodyBytes, err = io.ReadAll(r.Body); err != nil {
 			log.Println("failed to read request body", err.Error())
 		} else if len(bodyBytes) == 0 {
 			bodyBytes = []byte("")
@@ -66,6 +70,35 @@ func dbLoggerMiddleware(next http.Handler) http.Handler {
 				}
 			}
 		}
+		if strings.HasSuffix(r.URL.Path, "/custody-transfers") {
+			var body CustodyTransferBody
+			err = json.Unmarshal(bodyBytes, &body)
+			if err != nil {
+				bodyBytes = []byte("")
+			} else {
+				// Hide the passwords both parties signed with
+				body.Password = "****"
+				body.ToPassword = "****"
+				bodyBytes, err = json.Marshal(body)
+				if err != nil {
+					log.Println("failed to marshal request body", err.Error())
+				}
+			}
+		}
+		if strings.HasSuffix(r.URL.Path, "/webhooks") && r.Method == http.MethodPost {
+			var body Webhook
+			err = json.Unmarshal(bodyBytes, &body)
+			if err != nil {
+				bodyBytes = []byte("")
+			} else if body.Secret != "" {
+				// Hide the secret payloads are signed with
+				body.Secret = "****"
+				bodyBytes, err = json.Marshal(body)
+				if err != nil {
+					log.Println("failed to marshal request body", err.Error())
+				}
+			}
+		}
 
 		// Remove all whitespace from the body
 		var b strings.Builder
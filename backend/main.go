@@ -36,6 +36,11 @@ func main() {
 	}
 	defer DB.Close()
 
+	// Add columns introduced after the database was created
+	if err := migrateColumns(); err != nil {
+		log.Fatal(err)
+	}
+
 	// Run init.sql to setup schemas if not exists
 	file, err := os.Open(db_files + "init.sql")
 	if err != nil {
@@ -50,6 +55,16 @@ func main() {
 		log.Fatal(err)
 	}
 
+	// Parse the names of units created before they were UCUM expressions
+	if err := backfillUnitCanonicals(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Pick up webhook deliveries that were interrupted by a restart
+	if err := resumeWebhookDeliveries(); err != nil {
+		log.Fatal(err)
+	}
+
 	// // Setup API functions
 	r := chi.NewRouter()
 	r.Use(middleware.Logger)
@@ -70,19 +85,94 @@ func main() {
 
 		r.Get(baseApirUrl+"units", fetchUnitsHandler)
 		r.Post(baseApirUrl+"units", insertUnitHandler)
+		r.Put(baseApirUrl+"units", updateUnitHandler)
+		r.Get(baseApirUrl+"units/parse", parseUnitHandler)
+		r.Get(baseApirUrl+"units/commensurable", fetchUnitsCommensurableHandler)
 
 		r.Get(baseApirUrl+"collections", fetchCollectionsHandler)
 		r.Post(baseApirUrl+"collections", insertCollectionHandler)
 		r.Delete(baseApirUrl+"collections", deleteCollectionHandler)
+		r.Put(baseApirUrl+"collections", updateCollectionHandler)
+		r.Post(baseApirUrl+"collections/clone", cloneCollectionHandler)
+		r.Post(baseApirUrl+"collections/from-template", insertCollectionFromTemplateHandler)
+
+		r.Get(baseApirUrl+"templates", fetchTemplatesHandler)
+		r.Post(baseApirUrl+"templates", insertTemplateHandler)
+		r.Delete(baseApirUrl+"templates", deleteTemplateHandler)
 
 		r.Post(baseApirUrl+"attributes", insertAttributesHandler)
 		r.Delete(baseApirUrl+"attributes", deleteAttributesHandler)
+		r.Put(baseApirUrl+"attributes", updateAttributeHandler)
+		r.Put(baseApirUrl+"attributes/order", reorderAttributesHandler)
+
+		r.Get(baseApirUrl+"attribute-limits", fetchAttributeLimitsHandler)
+		r.Post(baseApirUrl+"attribute-limits", insertAttributeLimitHandler)
+		r.Delete(baseApirUrl+"attribute-limits", deleteAttributeLimitHandler)
 
 		r.Get(baseApirUrl+"samples", fetchSamplesHandler)
 		r.Post(baseApirUrl+"samples", insertSampleHandler)
 		r.Delete(baseApirUrl+"samples", deleteSampleHandler)
 		r.Put(baseApirUrl+"samples", updateSampleHandler)
+		r.Get(baseApirUrl+"samples/export", exportSamplesHandler)
+		r.Post(baseApirUrl+"samples/aliquots", insertAliquotsHandler)
+		r.Get(baseApirUrl+"samples/lookup", fetchSampleByIdentifierHandler)
+		r.Get(baseApirUrl+"sample-barcode", fetchSampleBarcodeHandler)
+		r.Get(baseApirUrl+"labels", fetchLabelsHandler)
+		r.Put(baseApirUrl+"sample-location", moveSampleHandler)
+		r.Get(baseApirUrl+"sample-location-history", fetchSampleLocationHistoryHandler)
+		r.Post(baseApirUrl+"custody-transfers", insertCustodyTransferHandler)
+		r.Get(baseApirUrl+"custody-report", fetchCustodyReportHandler)
+
+		r.Get(baseApirUrl+"attachments", fetchAttachmentsHandler)
+		r.Post(baseApirUrl+"attachments", insertAttachmentHandler)
+		r.Delete(baseApirUrl+"attachments", deleteAttachmentHandler)
+		r.Get(baseApirUrl+"attachments/download", downloadAttachmentHandler)
+
+		r.Get(baseApirUrl+"comments", fetchCommentsHandler)
+		r.Post(baseApirUrl+"comments", insertCommentHandler)
+		r.Put(baseApirUrl+"comments", updateCommentHandler)
+		r.Get(baseApirUrl+"comments/history", fetchCommentHistoryHandler)
+		r.Put(baseApirUrl+"comments/resolve", resolveCommentHandler)
+
+		r.Get(baseApirUrl+"notifications", fetchNotificationsHandler)
+		r.Put(baseApirUrl+"notifications/read", updateNotificationsReadHandler)
+		r.Get(baseApirUrl+"notification-preferences", fetchNotificationPreferencesHandler)
+		r.Put(baseApirUrl+"notification-preferences", updateNotificationPreferencesHandler)
+		r.Post(baseApirUrl+"notification-preferences/test-email", sendTestEmailHandler)
+
+		r.Get(baseApirUrl+"storage-locations", fetchStorageLocationsHandler)
+		r.Post(baseApirUrl+"storage-locations", insertStorageLocationHandler)
+		r.Put(baseApirUrl+"storage-locations", updateStorageLocationHandler)
+		r.Delete(baseApirUrl+"storage-locations", deleteStorageLocationHandler)
+		r.Get(baseApirUrl+"storage-locations/free-slots", fetchFreeStorageSlotsHandler)
+		r.Get(baseApirUrl+"storage-locations/box-map", fetchBoxMapHandler)
+
+		r.Get(baseApirUrl+"instruments", fetchInstrumentsHandler)
+		r.Post(baseApirUrl+"instruments", insertInstrumentHandler)
+		r.Put(baseApirUrl+"instruments", updateInstrumentHandler)
+		r.Delete(baseApirUrl+"instruments", deleteInstrumentHandler)
+		r.Get(baseApirUrl+"instruments/calibrations-due", fetchCalibrationsDueHandler)
+		r.Get(baseApirUrl+"instrument-calibrations", fetchInstrumentCalibrationsHandler)
+		r.Post(baseApirUrl+"instrument-calibrations", insertInstrumentCalibrationHandler)
+
+		r.Get(baseApirUrl+"sample-lineage", fetchSampleLineageHandler)
+		r.Post(baseApirUrl+"sample-relations", insertSampleRelationHandler)
+		r.Delete(baseApirUrl+"sample-relations", deleteSampleRelationHandler)
+		r.Get(baseApirUrl+"stats", fetchStatsHandler)
+		r.Get(baseApirUrl+"control-chart", fetchControlChartHandler)
 		r.Post(baseApirUrl+"sample-values", insertOrUpdateSampleValueHandler)
+		r.Get(baseApirUrl+"sample-value-history", fetchSampleValueHistoryHandler)
+		r.Post(baseApirUrl+"replicate-values", insertOrUpdateReplicateValueHandler)
+		r.Delete(baseApirUrl+"replicate-values", deleteReplicateValueHandler)
+		r.Put(baseApirUrl+"replicate-values/exclude", updateReplicateExclusionHandler)
+		r.Get(baseApirUrl+"qualifier-codes", fetchQualifierCodesHandler)
+
+		r.Get(baseApirUrl+"workflow", fetchWorkflowHandler)
+		r.Post(baseApirUrl+"sample-status", updateSampleStatusHandler)
+		r.Get(baseApirUrl+"sample-status", fetchSampleStatusHistoryHandler)
+
+		r.Get(baseApirUrl+"trash", fetchTrashHandler)
+		r.Post(baseApirUrl+"trash/restore", restoreFromTrashHandler)
 	})
 
 	// Admin routes (requires admin role)
@@ -96,6 +186,24 @@ func main() {
 		r.Put(baseApirUrl+"users", updateUserHandler)
 
 		r.Get(baseApirUrl+"roles", fetchRolesHandler)
+
+		r.Post(baseApirUrl+"units/merge", mergeUnitsHandler)
+
+		r.Post(baseApirUrl+"qualifier-codes", insertQualifierCodeHandler)
+		r.Delete(baseApirUrl+"qualifier-codes", deleteQualifierCodeHandler)
+
+		r.Delete(baseApirUrl+"trash", purgeTrashHandler)
+
+		r.Post(baseApirUrl+"workflow-states", insertWorkflowStateHandler)
+		r.Delete(baseApirUrl+"workflow-states", deleteWorkflowStateHandler)
+		r.Post(baseApirUrl+"workflow-transitions", insertWorkflowTransitionHandler)
+		r.Delete(baseApirUrl+"workflow-transitions", deleteWorkflowTransitionHandler)
+
+		r.Get(baseApirUrl+"webhooks", fetchWebhooksHandler)
+		r.Post(baseApirUrl+"webhooks", insertWebhookHandler)
+		r.Delete(baseApirUrl+"webhooks", deleteWebhookHandler)
+		r.Get(baseApirUrl+"webhook-deliveries", fetchWebhookDeliveriesHandler)
+		r.Post(baseApirUrl+"webhook-deliveries/redeliver", redeliverWebhookHandler)
 	})
 
 	// Init admin user if not exists
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// Columns added to existing tables after their first release. init.sql only
+// creates missing tables, so databases created by an older version get the
+// new columns from here. Fresh databases get them from init.sql.
+var columnMigrations = []columnMigration{
+	{"samples", "status_id", "INTEGER REFERENCES workflow_states (id)"},
+	{"sample_attribute_values", "flag", "TEXT"},
+	{"units", "dimension", "TEXT"},
+	{"units", "factor", "REAL"},
+	{"units", "offset", "REAL"},
+	{"units", "canonical", "TEXT"},
+	{"units", "symbol", "TEXT"},
+	{"collections", "deleted_at", "INTEGER"},
+	{"sample_attributes", "deleted_at", "INTEGER"},
+	{"samples", "deleted_at", "INTEGER"},
+	{"sample_attributes", "position", "INTEGER NOT NULL DEFAULT 0"},
+	{"sample_attributes", "group_label", "TEXT"},
+	{"sample_attributes", "description", "TEXT"},
+	{"sample_attributes", "decimals", "INTEGER"},
+	{"sample_attributes", "formula", "TEXT"},
+	{"collections", "identifier_pattern", "TEXT"},
+	{"samples", "identifier", "TEXT"},
+	{"samples", "location_id", "INTEGER REFERENCES storage_locations (id)"},
+	{"samples", "location_row", "INTEGER"},
+	{"samples", "location_column", "INTEGER"},
+	{"samples", "custodian_id", "INTEGER"},
+	{"users", "email", "TEXT"},
+	{"samples", "inserted_at", "INTEGER"},
+	{"sample_attributes", "inserted_at", "INTEGER"},
+	{"sample_attributes", "replicates", "INTEGER"},
+	{"sample_attributes", "lod", "REAL"},
+	{"sample_attributes", "loq", "REAL"},
+	{"sample_attributes", "uloq", "REAL"},
+	{"sample_attributes", "substitution", "TEXT"},
+	{"sample_attribute_values", "censor", "TEXT"},
+	{"sample_attribute_values", "qualifier", "TEXT REFERENCES qualifier_codes (code)"},
+	{"sample_value_history", "censor", "TEXT"},
+	{"sample_value_history", "qualifier", "TEXT"},
+	{"sample_attribute_values", "uncertainty", "TEXT"},
+	{"sample_attribute_values", "uncertainty_type", "TEXT"},
+	{"sample_attribute_values", "significant_figures", "INTEGER"},
+	{"sample_value_history", "uncertainty", "TEXT"},
+	{"sample_value_history", "uncertainty_type", "TEXT"},
+	{"sample_value_history", "significant_figures", "INTEGER"},
+	{"sample_attribute_values", "instrument_id", "INTEGER REFERENCES instruments (id)"},
+	{"sample_value_history", "instrument_id", "INTEGER"},
+}
+
+type columnMigration struct {
+	Table      string
+	Column     string
+	Definition string
+}
+
+// Adds every missing column from columnMigrations. Must run before init.sql,
+// since init.sql may create indexes on the new columns.
+func migrateColumns() error {
+	for _, migration := range columnMigrations {
+		columns, err := readTableColumns(migration.Table)
+		if err != nil {
+			return err
+		}
+		// The table does not exist yet, init.sql creates it with all columns
+		if len(columns) == 0 || columns[migration.Column] {
+			continue
+		}
+
+		query := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", migration.Table, migration.Column, migration.Definition)
+		if _, err := DB.Exec(query); err != nil {
+			return fmt.Errorf("migrateColumns: %v", err)
+		}
+	}
+	return nil
+}
+
+// Returns the set of column names of a table, empty if the table does not exist
+func readTableColumns(table string) (map[string]bool, error) {
+	rows, err := DB.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return nil, fmt.Errorf("readTableColumns: %v", err)
+	}
+	defer rows.Close()
+
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, columnType string
+		var defaultValue any
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &pk); err != nil {
+			return nil, fmt.Errorf("readTableColumns: %v", err)
+		}
+		columns[name] = true
+	}
+	return columns, rows.Err()
+}
+
+// Fills in the UCUM columns of units created before names were parsed as UCUM,
+// so they convert like new units. Names that do not parse, and spellings of a
+// unit that already has the canonical form, are left without one and logged.
+// Arbitrary units are parsed again, their dimension once left out the rest of
+// the expression.
+func backfillUnitCanonicals() error {
+	rows, err := DB.Query("SELECT id, name FROM units WHERE canonical IS NULL OR dimension LIKE 'arbitrary:%' ORDER BY id")
+	if err != nil {
+		return fmt.Errorf("backfillUnitCanonicals: %v", err)
+	}
+	units := make(map[int]string)
+	var ids []int
+	for rows.Next() {
+		var id int
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			rows.Close()
+			return fmt.Errorf("backfillUnitCanonicals: %v", err)
+		}
+		units[id] = name
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("backfillUnitCanonicals: %v", err)
+	}
+
+	for _, id := range ids {
+		parsed, err := parseUcum(units[id])
+		if err != nil {
+			log.Printf("unit %d %q is not a UCUM expression and cannot be converted: %v", id, units[id], err)
+			continue
+		}
+
+		var existing string
+		err = DB.QueryRow("SELECT name FROM units WHERE canonical = ? AND id != ?", parsed.Canonical, id).Scan(&existing)
+		if err == nil {
+			log.Printf("unit %d %q is the same unit as %q, merge them with units/merge", id, units[id], existing)
+			continue
+		} else if err != sql.ErrNoRows {
+			return fmt.Errorf("backfillUnitCanonicals: %v", err)
+		}
+
+		query := "UPDATE units SET canonical = ?, symbol = ?, dimension = ?, factor = ?, offset = ? WHERE id = ?"
+		if _, err := DB.Exec(query, parsed.Canonical, parsed.Symbol, parsed.Dimension, parsed.Factor, parsed.Offset, id); err != nil {
+			return fmt.Errorf("backfillUnitCanonicals: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,633 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kinds of notifications
+const (
+	notifyMention       = "mention"
+	notifyStatusChanged = "status_changed"
+	notifyOutOfSpec     = "out_of_spec"
+	notifyWebhookFailed = "webhook_failed"
+)
+
+var notificationKinds = []string{notifyMention, notifyStatusChanged, notifyOutOfSpec, notifyWebhookFailed}
+
+// Most notifications returned at once
+const maxNotifications = 200
+
+/*
+Gets the notifications of the logged in user, newest first
+
+Query params:
+
+	unread?: bool, // Only unread notifications
+	limit?: int, // Defaults to 50
+	offset?: int
+
+Result:
+
+	{
+		unread_count: int,
+		notifications: [{
+			id: int,
+			kind: string, // "mention", "status_changed", "out_of_spec" or "webhook_failed"
+			title: string,
+			body: string,
+			collection_id: int, // Omitted if not about a collection
+			sample_id: int, // Omitted if not about a sample
+			comment_id: int, // Omitted if not about a comment
+			read: bool,
+			created_at: int
+		}]
+	}
+*/
+func fetchNotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(User)
+
+	limit := 50
+	if _limit := r.FormValue("limit"); _limit != "" {
+		var err error
+		limit, err = strconv.Atoi(_limit)
+		if err != nil || limit < 1 || limit > maxNotifications {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxNotifications), http.StatusBadRequest)
+			return
+		}
+	}
+	offset := 0
+	if _offset := r.FormValue("offset"); _offset != "" {
+		var err error
+		offset, err = strconv.Atoi(_offset)
+		if err != nil || offset < 0 {
+			http.Error(w, "offset must be a positive int", http.StatusBadRequest)
+			return
+		}
+	}
+
+	result := Notifications{Notifications: []Notification{}}
+	err := DB.QueryRow("SELECT COUNT(*) FROM notifications WHERE user_id = ? AND read_at IS NULL", user.Id).Scan(&result.UnreadCount)
+	if err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+
+	query := "SELECT id, kind, title, body, collection_id, sample_id, comment_id, read_at IS NOT NULL, created_at FROM notifications WHERE user_id = ?"
+	if r.FormValue("unread") == "true" {
+		query += " AND read_at IS NULL"
+	}
+	query += " ORDER BY created_at DESC, id DESC LIMIT ? OFFSET ?"
+	rows, err := DB.Query(query, user.Id, limit, offset)
+	if err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var n Notification
+		if err := rows.Scan(&n.Id, &n.Kind, &n.Title, &n.Body, &n.CollectionId, &n.SampleId, &n.CommentId, &n.Read, &n.CreatedAt); err != nil {
+			http.Error(w, "error when reading from database", http.StatusInternalServerError)
+			return
+		}
+		result.Notifications = append(result.Notifications, n)
+	}
+	if err = rows.Err(); err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+/*
+Marks notifications of the logged in user as read or unread
+
+Query params:
+
+	notification_id?: int, // All notifications if not set
+	read: bool
+*/
+func updateNotificationsReadHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(User)
+	read, err := strconv.ParseBool(r.FormValue("read"))
+	if err != nil {
+		http.Error(w, "read must be true or false", http.StatusBadRequest)
+		return
+	}
+	var readAt *int64
+	if read {
+		now := time.Now().Unix()
+		readAt = &now
+	}
+
+	if _notificationId := r.FormValue("notification_id"); _notificationId != "" {
+		notificationId, err := strconv.Atoi(_notificationId)
+		if err != nil {
+			http.Error(w, "notification_id must be a positive int", http.StatusBadRequest)
+			return
+		}
+		// Keep the time it was first read
+		result, err := DB.Exec("UPDATE notifications SET read_at = CASE WHEN ? IS NULL THEN NULL ELSE COALESCE(read_at, ?) END WHERE id = ? AND user_id = ?", readAt, readAt, notificationId, user.Id)
+		if err != nil {
+			http.Error(w, "failed to update notification", http.StatusInternalServerError)
+			return
+		}
+		if rowsAffected, err := result.RowsAffected(); err != nil || rowsAffected == 0 {
+			http.Error(w, "notification not found", http.StatusNotFound)
+			return
+		}
+	} else if read {
+		if _, err := DB.Exec("UPDATE notifications SET read_at = ? WHERE user_id = ? AND read_at IS NULL", readAt, user.Id); err != nil {
+			http.Error(w, "failed to update notifications", http.StatusInternalServerError)
+			return
+		}
+	} else {
+		if _, err := DB.Exec("UPDATE notifications SET read_at = NULL WHERE user_id = ?", user.Id); err != nil {
+			http.Error(w, "failed to update notifications", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+/*
+Gets the email address and the kinds of notifications the logged in user
+wants emailed
+
+Result:
+
+	{
+		email: string, // Omitted if not set
+		email_enabled: bool, // An SMTP server is configured
+		kinds: { mention: bool, status_changed: bool, out_of_spec: bool, webhook_failed: bool }
+	}
+*/
+func fetchNotificationPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(User)
+	preferences, err := readNotificationPreferences(user.Id)
+	if err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(preferences)
+}
+
+/*
+Updates the email address and the kinds of notifications the logged in user
+wants emailed. Only the params given are changed.
+
+Query params:
+
+	email?: string, // Empty to remove the address
+	mention?: bool,
+	status_changed?: bool,
+	out_of_spec?: bool,
+	webhook_failed?: bool
+*/
+func updateNotificationPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(User)
+	r.ParseForm()
+
+	tx, err := DB.Begin()
+	if err != nil {
+		http.Error(w, "failed to update preferences", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if r.Form.Has("email") {
+		var email *string
+		if _email := strings.TrimSpace(r.FormValue("email")); _email != "" {
+			address, err := mail.ParseAddress(_email)
+			if err != nil || address.Name != "" {
+				http.Error(w, "email must be a valid email address", http.StatusBadRequest)
+				return
+			}
+			email = &address.Address
+		}
+		if _, err := tx.Exec("UPDATE users SET email = ? WHERE id = ?", email, user.Id); err != nil {
+			http.Error(w, "failed to update preferences", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	for _, kind := range notificationKinds {
+		if !r.Form.Has(kind) {
+			continue
+		}
+		enabled, err := strconv.ParseBool(r.FormValue(kind))
+		if err != nil {
+			http.Error(w, kind+" must be true or false", http.StatusBadRequest)
+			return
+		}
+		query := `
+			INSERT INTO notification_preferences (user_id, kind, email) VALUES (?, ?, ?)
+			ON CONFLICT (user_id, kind) DO UPDATE SET email = excluded.email
+		`
+		if _, err := tx.Exec(query, user.Id, kind, enabled); err != nil {
+			http.Error(w, "failed to update preferences", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		http.Error(w, "failed to update preferences", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+/*
+Sends a test email to the logged in user, to check the SMTP settings
+*/
+func sendTestEmailHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(User)
+	config, ok := readSMTPConfig()
+	if !ok {
+		http.Error(w, "email is not configured, set SMTP_HOST", http.StatusConflict)
+		return
+	}
+	preferences, err := readNotificationPreferences(user.Id)
+	if err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	if preferences.Email == nil {
+		http.Error(w, "you have no email address", http.StatusConflict)
+		return
+	}
+
+	err = sendEmail(config, *preferences.Email, "Test email from Pithos", "Email notifications are working.")
+	if err != nil {
+		http.Error(w, "failed to send email: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+type Notification struct {
+	Id           int     `json:"id"`
+	Kind         string  `json:"kind"`
+	Title        string  `json:"title"`
+	Body         *string `json:"body,omitempty"`
+	CollectionId *int    `json:"collection_id,omitempty"`
+	SampleId     *int    `json:"sample_id,omitempty"`
+	CommentId    *int    `json:"comment_id,omitempty"`
+	Read         bool    `json:"read"`
+	CreatedAt    int64   `json:"created_at"`
+}
+
+// Notifications is the result of fetchNotificationsHandler
+type Notifications struct {
+	UnreadCount   int            `json:"unread_count"`
+	Notifications []Notification `json:"notifications"`
+}
+
+type NotificationPreferences struct {
+	Email        *string         `json:"email,omitempty"`
+	EmailEnabled bool            `json:"email_enabled"`
+	Kinds        map[string]bool `json:"kinds"`
+}
+
+func readNotificationPreferences(userId int) (NotificationPreferences, error) {
+	preferences := NotificationPreferences{Kinds: make(map[string]bool)}
+	_, preferences.EmailEnabled = readSMTPConfig()
+	if err := DB.QueryRow("SELECT email FROM users WHERE id = ?", userId).Scan(&preferences.Email); err != nil {
+		return NotificationPreferences{}, fmt.Errorf("readNotificationPreferences: %v", err)
+	}
+	for _, kind := range notificationKinds {
+		preferences.Kinds[kind] = false
+	}
+
+	rows, err := DB.Query("SELECT kind, email FROM notification_preferences WHERE user_id = ?", userId)
+	if err != nil {
+		return NotificationPreferences{}, fmt.Errorf("readNotificationPreferences: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var kind string
+		var email bool
+		if err := rows.Scan(&kind, &email); err != nil {
+			return NotificationPreferences{}, fmt.Errorf("readNotificationPreferences: %v", err)
+		}
+		preferences.Kinds[kind] = email
+	}
+	if err := rows.Err(); err != nil {
+		return NotificationPreferences{}, fmt.Errorf("readNotificationPreferences: %v", err)
+	}
+	return preferences, nil
+}
+
+// NotificationEvent is something users are notified about. Who is notified
+// depends on the kind:
+//
+//   - mention: the users in UserIds
+//   - status_changed: the users involved with the sample
+//   - out_of_spec: the users involved with the sample and the admins
+//   - webhook_failed: the admins
+//
+// The user who caused the event is never notified.
+type NotificationEvent struct {
+	Kind         string
+	ActorId      int
+	UserIds      []int
+	Title        string
+	Body         *string
+	CollectionId *int
+	SampleId     *int
+	CommentId    *int
+}
+
+var notificationChannel = make(chan NotificationEvent, 1000) // buffered
+
+func init() {
+	go notificationDispatcher()
+}
+
+// Queues a notification without blocking the request
+func emitNotification(event NotificationEvent) {
+	select {
+	case notificationChannel <- event:
+		// sent successfully
+	default:
+		// channel is full, drop notification to avoid blocking
+		log.Println("notificationChannel full, dropping notification", event.Kind)
+	}
+}
+
+func notificationDispatcher() {
+	for event := range notificationChannel {
+		if err := dispatchNotification(event); err != nil {
+			log.Println("failed to dispatch notification: ", err.Error())
+		}
+	}
+}
+
+// Stores the notification for every recipient and emails the ones who want it
+func dispatchNotification(event NotificationEvent) error {
+	recipients, err := readNotificationRecipients(event)
+	if err != nil {
+		return err
+	}
+	if len(recipients) == 0 {
+		return nil
+	}
+
+	now := time.Now().Unix()
+	for _, userId := range recipients {
+		query := `
+			INSERT INTO notifications (user_id, kind, title, body, collection_id, sample_id, comment_id, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		`
+		_, err := DB.Exec(query, userId, event.Kind, event.Title, event.Body, event.CollectionId, event.SampleId, event.CommentId, now)
+		if err != nil {
+			return fmt.Errorf("dispatchNotification: %v", err)
+		}
+	}
+
+	config, ok := readSMTPConfig()
+	if !ok {
+		return nil
+	}
+	query := `
+		SELECT u.email FROM users u
+		JOIN notification_preferences p ON p.user_id = u.id
+		WHERE u.id IN (` + strings.Repeat("?,", len(recipients)-1) + `?)
+			AND p.kind = ? AND p.email = 1 AND u.email IS NOT NULL
+	`
+	args := make([]any, 0, len(recipients)+1)
+	for _, userId := range recipients {
+		args = append(args, userId)
+	}
+	args = append(args, event.Kind)
+	rows, err := DB.Query(query, args...)
+	if err != nil {
+		return fmt.Errorf("dispatchNotification: %v", err)
+	}
+	var addresses []string
+	for rows.Next() {
+		var address string
+		if err := rows.Scan(&address); err != nil {
+			rows.Close()
+			return fmt.Errorf("dispatchNotification: %v", err)
+		}
+		addresses = append(addresses, address)
+	}
+	rows.Close()
+
+	body := ""
+	if event.Body != nil {
+		body = *event.Body
+	}
+	for _, address := range addresses {
+		go func(address string) {
+			if err := sendEmail(config, address, event.Title, body); err != nil {
+				log.Println("failed to email notification to", address, err.Error())
+			}
+		}(address)
+	}
+	return nil
+}
+
+// Finds who to notify about an event, see NotificationEvent
+func readNotificationRecipients(event NotificationEvent) ([]int, error) {
+	var queries []string
+	var args []any
+	if len(event.UserIds) > 0 {
+		queries = append(queries, "SELECT id FROM users WHERE id IN ("+strings.Repeat("?,", len(event.UserIds)-1)+"?)")
+		for _, id := range event.UserIds {
+			args = append(args, id)
+		}
+	}
+	if (event.Kind == notifyStatusChanged || event.Kind == notifyOutOfSpec) && event.SampleId != nil {
+		// Users who worked on the sample, discussed it or hold it
+		queries = append(queries,
+			"SELECT user_id FROM sample_status_history WHERE sample_id = ?",
+			"SELECT user_id FROM sample_location_history WHERE sample_id = ?",
+			"SELECT user_id FROM comments WHERE sample_id = ?",
+			"SELECT custodian_id FROM samples WHERE id = ?",
+		)
+		args = append(args, *event.SampleId, *event.SampleId, *event.SampleId, *event.SampleId)
+	}
+	if event.Kind == notifyOutOfSpec || event.Kind == notifyWebhookFailed {
+		queries = append(queries, "SELECT id FROM users WHERE role_id = 1")
+	}
+	if len(queries) == 0 {
+		return nil, nil
+	}
+
+	// Only users that still exist
+	query := "SELECT id FROM users WHERE id != ? AND id IN (" + strings.Join(queries, " UNION ") + ") ORDER BY id"
+	rows, err := DB.Query(query, append([]any{event.ActorId}, args...)...)
+	if err != nil {
+		return nil, fmt.Errorf("readNotificationRecipients: %v", err)
+	}
+	defer rows.Close()
+
+	var recipients []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("readNotificationRecipients: %v", err)
+		}
+		recipients = append(recipients, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("readNotificationRecipients: %v", err)
+	}
+	return recipients, nil
+}
+
+// Notifies users that were mentioned in a comment
+func notifyCommentMentions(author User, sampleId int, commentId int, userIds []int, body string) {
+	if len(userIds) == 0 {
+		return
+	}
+	emitNotification(NotificationEvent{
+		Kind:      notifyMention,
+		ActorId:   author.Id,
+		UserIds:   userIds,
+		Title:     fmt.Sprintf("%s mentioned you on sample %s", author.Username, readSampleLabel(sampleId)),
+		Body:      &body,
+		SampleId:  &sampleId,
+		CommentId: &commentId,
+	})
+}
+
+// Notifies the users involved with a sample that it moved to another workflow state
+func notifySampleStatusChanged(actor User, collectionId int, sampleId int, stateId int, comment string) {
+	var state string
+	if err := DB.QueryRow("SELECT name FROM workflow_states WHERE id = ?", stateId).Scan(&state); err != nil {
+		state = strconv.Itoa(stateId)
+	}
+	event := NotificationEvent{
+		Kind:         notifyStatusChanged,
+		ActorId:      actor.Id,
+		Title:        fmt.Sprintf("Sample %s is now %s", readSampleLabel(sampleId), state),
+		CollectionId: &collectionId,
+		SampleId:     &sampleId,
+	}
+	if comment != "" {
+		event.Body = &comment
+	}
+	emitNotification(event)
+}
+
+// Notifies the users involved with a sample and the admins that a value failed its specification
+func notifyValueOutOfSpec(actorId int, sampleId int, attributeId int, value string, censor *string) {
+	var attribute string
+	var collectionId int
+	err := DB.QueryRow("SELECT name, collection_id FROM sample_attributes WHERE id = ?", attributeId).Scan(&attribute, &collectionId)
+	if err != nil {
+		log.Println("failed to read attribute", attributeId, err.Error())
+		return
+	}
+	body := fmt.Sprintf("%s is %s, outside its specification limits.", attribute, formatCensoredValue(value, censor))
+	emitNotification(NotificationEvent{
+		Kind:         notifyOutOfSpec,
+		ActorId:      actorId,
+		Title:        fmt.Sprintf("Sample %s: %s is out of specification", readSampleLabel(sampleId), attribute),
+		Body:         &body,
+		CollectionId: &collectionId,
+		SampleId:     &sampleId,
+	})
+}
+
+// Notifies about a value that fails its specification, unless it already did before it changed
+func notifyIfNewlyOutOfSpec(actorId int, sampleId int, attributeId int, value string, censor *string, flag *string, previousFlag *string) {
+	if flag == nil || *flag != flagFail || (previousFlag != nil && *previousFlag == flagFail) {
+		return
+	}
+	notifyValueOutOfSpec(actorId, sampleId, attributeId, value, censor)
+}
+
+// Notifies the admins that a webhook delivery gave up
+func notifyWebhookDeliveryFailed(delivery WebhookDelivery, target string, collectionId int, deliveryErr string) {
+	body := fmt.Sprintf("The %s event could not be delivered to %s after %d attempts: %s", delivery.Event, target, webhookMaxAttempts, deliveryErr)
+	emitNotification(NotificationEvent{
+		Kind:         notifyWebhookFailed,
+		ActorId:      0,
+		Title:        "Webhook delivery failed",
+		Body:         &body,
+		CollectionId: &collectionId,
+	})
+}
+
+// The identifier of a sample, or its id if it has none
+func readSampleLabel(sampleId int) string {
+	var identifier sql.NullString
+	DB.QueryRow("SELECT identifier FROM samples WHERE id = ?", sampleId).Scan(&identifier)
+	if identifier.Valid {
+		return identifier.String
+	}
+	return strconv.Itoa(sampleId)
+}
+
+type smtpConfig struct {
+	host     string
+	port     string
+	username string
+	password string
+	from     string
+}
+
+// Reads the SMTP server from the environment. Email is disabled when
+// SMTP_HOST is not set.
+func readSMTPConfig() (smtpConfig, bool) {
+	config := smtpConfig{
+		host:     os.Getenv("SMTP_HOST"),
+		port:     os.Getenv("SMTP_PORT"),
+		username: os.Getenv("SMTP_USERNAME"),
+		password: os.Getenv("SMTP_PASSWORD"),
+		from:     os.Getenv("SMTP_FROM"),
+	}
+	if config.port == "" {
+		config.port = "25"
+	}
+	if config.from == "" {
+		config.from = "pithos@" + config.host
+	}
+	return config, config.host != ""
+}
+
+// Sends a plain text email. STARTTLS is used when the server offers it,
+// credentials are only sent over TLS or to localhost.
+func sendEmail(config smtpConfig, to string, subject string, body string) error {
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", config.from)
+	fmt.Fprintf(&message, "To: %s\r\n", to)
+	fmt.Fprintf(&message, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	message.WriteString("MIME-Version: 1.0\r\n")
+	message.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	message.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	writer := quotedprintable.NewWriter(&message)
+	writer.Write([]byte(strings.ReplaceAll(body, "\n", "\r\n")))
+	writer.Close()
+
+	var auth smtp.Auth
+	if config.username != "" {
+		auth = smtp.PlainAuth("", config.username, config.password, config.host)
+	}
+	return smtp.SendMail(net.JoinHostPort(config.host, config.port), auth, config.from, []string{to}, message.Bytes())
+}
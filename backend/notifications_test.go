@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// smtpSink is a local SMTP server that accepts one message and keeps it
+type smtpSink struct {
+	listener net.Listener
+	done     chan struct{}
+	from     string
+	to       []string
+	auth     string // Decoded AUTH PLAIN response, if the client logged in
+	data     string
+}
+
+func startSMTPSink(t *testing.T) *smtpSink {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &smtpSink{listener: listener, done: make(chan struct{})}
+	go sink.serve()
+	t.Cleanup(func() { listener.Close() })
+	return sink
+}
+
+func (sink *smtpSink) serve() {
+	defer close(sink.done)
+	conn, err := sink.listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+
+	text.PrintfLine("220 localhost sink")
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch command {
+		case "EHLO", "HELO":
+			text.PrintfLine("250-localhost")
+			text.PrintfLine("250 AUTH PLAIN")
+		case "AUTH":
+			fields := strings.Fields(line)
+			decoded, _ := base64.StdEncoding.DecodeString(fields[len(fields)-1])
+			sink.auth = string(decoded)
+			text.PrintfLine("235 authenticated")
+		case "MAIL":
+			sink.from = line
+			text.PrintfLine("250 ok")
+		case "RCPT":
+			sink.to = append(sink.to, line)
+			text.PrintfLine("250 ok")
+		case "DATA":
+			text.PrintfLine("354 go ahead")
+			data, err := text.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			sink.data = string(data)
+			text.PrintfLine("250 queued")
+		case "QUIT":
+			text.PrintfLine("221 bye")
+			return
+		default:
+			text.PrintfLine("250 ok")
+		}
+	}
+}
+
+func (sink *smtpSink) config() smtpConfig {
+	host, port, _ := net.SplitHostPort(sink.listener.Addr().String())
+	return smtpConfig{host: host, port: port, from: "lab@example.org"}
+}
+
+func TestSendEmailDeliversToSMTPServer(t *testing.T) {
+	sink := startSMTPSink(t)
+
+	subject := "Sample WQ-1: pH is out of specification"
+	body := "pH is 9.5, outside its specification limits.\nÆøå"
+	if err := sendEmail(sink.config(), "analyst@example.org", subject, body); err != nil {
+		t.Fatal(err)
+	}
+	<-sink.done
+
+	if sink.from != "MAIL FROM:<lab@example.org>" {
+		t.Errorf("MAIL = %q", sink.from)
+	}
+	if len(sink.to) != 1 || sink.to[0] != "RCPT TO:<analyst@example.org>" {
+		t.Errorf("RCPT = %q", sink.to)
+	}
+	if sink.auth != "" {
+		t.Errorf("logged in as %q without credentials", sink.auth)
+	}
+
+	message, err := mail.ReadMessage(bufio.NewReader(strings.NewReader(sink.data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if to := message.Header.Get("To"); to != "analyst@example.org" {
+		t.Errorf("To = %q", to)
+	}
+	decoded, err := new(mime.WordDecoder).DecodeHeader(message.Header.Get("Subject"))
+	if err != nil || decoded != subject {
+		t.Errorf("Subject = %q, want %q", decoded, subject)
+	}
+	text, err := io.ReadAll(quotedprintable.NewReader(message.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The sink reads lines without their CRLF, and the message ends with one
+	if got := strings.TrimSuffix(string(text), "\n"); got != body {
+		t.Errorf("body = %q, want %q", got, body)
+	}
+}
+
+func TestSendEmailLogsInOnLocalhost(t *testing.T) {
+	sink := startSMTPSink(t)
+
+	config := sink.config()
+	config.host = "localhost"
+	config.username, config.password = "lab", "secret"
+	if err := sendEmail(config, "analyst@example.org", "Test", "Test"); err != nil {
+		t.Fatal(err)
+	}
+	<-sink.done
+
+	if sink.auth != "\x00lab\x00secret" {
+		t.Errorf("AUTH PLAIN = %q, want the configured credentials", sink.auth)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Widths of the printable ASCII characters in Helvetica, per 1000 units of font size
+var helveticaWidths = [95]int{
+	278, 278, 355, 556, 556, 889, 667, 191, 333, 333, 389, 584, 278, 333, 278, 278,
+	556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 278, 278, 584, 584, 584, 556,
+	1015, 667, 667, 722, 722, 667, 611, 778, 722, 278, 500, 667, 556, 833, 722, 778,
+	667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 278, 278, 278, 469, 556,
+	333, 556, 556, 500, 556, 556, 278, 556, 556, 222, 222, 500, 222, 833, 556, 556,
+	556, 556, 333, 500, 278, 556, 500, 722, 500, 500, 500, 334, 260, 334, 584,
+}
+
+// A PDF of equally sized pages drawn with text in Helvetica and filled rectangles.
+// Coordinates are in points from the top left corner of the page.
+type pdfDocument struct {
+	width  float64
+	height float64
+	pages  []*pdfPage
+}
+
+type pdfPage struct {
+	height  float64
+	content bytes.Buffer
+}
+
+func newPDFDocument(width float64, height float64) *pdfDocument {
+	return &pdfDocument{width: width, height: height}
+}
+
+func (d *pdfDocument) addPage() *pdfPage {
+	page := &pdfPage{height: d.height}
+	d.pages = append(d.pages, page)
+	return page
+}
+
+// Draws a line of text with its top left corner at x, y
+func (p *pdfPage) text(x float64, y float64, size float64, bold bool, text string) {
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	baseline := p.height - y - size*0.8
+	fmt.Fprintf(&p.content, "BT /%s %s Tf %s %s Td (%s) Tj ET\n", font, pdfNumber(size), pdfNumber(x), pdfNumber(baseline), pdfString(text))
+}
+
+// Fills a black rectangle with its top left corner at x, y
+func (p *pdfPage) rect(x float64, y float64, width float64, height float64) {
+	fmt.Fprintf(&p.content, "%s %s %s %s re f\n", pdfNumber(x), pdfNumber(p.height-y-height), pdfNumber(width), pdfNumber(height))
+}
+
+// Draws a barcode stretched over a rectangle, quiet zone included. Identical
+// rows are drawn together, so the bars of a linear barcode are single rectangles.
+func (p *pdfPage) barcode(matrix *barcodeMatrix, x float64, y float64, width float64, height float64) {
+	moduleWidth := width / float64(matrix.width+2*matrix.quietZone)
+	moduleHeight := height / float64(matrix.height+2*matrix.quietZone)
+	x += float64(matrix.quietZone) * moduleWidth
+	y += float64(matrix.quietZone) * moduleHeight
+	for row := 0; row < matrix.height; {
+		rows := 1
+		for row+rows < matrix.height && matrix.sameRows(row, row+rows) {
+			rows++
+		}
+		for col := 0; col < matrix.width; {
+			if !matrix.get(col, row) {
+				col++
+				continue
+			}
+			run := 1
+			for col+run < matrix.width && matrix.get(col+run, row) {
+				run++
+			}
+			p.rect(x+float64(col)*moduleWidth, y+float64(row)*moduleHeight, float64(run)*moduleWidth, float64(rows)*moduleHeight)
+			col += run
+		}
+		row += rows
+	}
+}
+
+// Writes the document. Objects 1 to 4 are the catalog, the page tree and the
+// two fonts, every page is followed by its content stream.
+func (d *pdfDocument) bytes() []byte {
+	var objects []string
+	kids := make([]string, len(d.pages))
+	for i := range d.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 5+2*i)
+	}
+	objects = append(objects,
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>",
+	)
+	for i, page := range d.pages {
+		objects = append(objects,
+			fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %s %s] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>", pdfNumber(d.width), pdfNumber(d.height), 6+2*i),
+			fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", page.content.Len(), page.content.String()),
+		)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return buf.Bytes()
+}
+
+// Formats a coordinate with at most two decimals
+func pdfNumber(f float64) string {
+	s := strings.TrimRight(strconv.FormatFloat(f, 'f', 2, 64), "0")
+	s = strings.TrimSuffix(s, ".")
+	if s == "-0" {
+		return "0"
+	}
+	return s
+}
+
+// Escapes text as a PDF string in WinAnsiEncoding, characters outside Latin-1 become ?
+func pdfString(text string) string {
+	var b strings.Builder
+	for _, c := range text {
+		switch {
+		case c == '(' || c == ')' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(c)
+		case c < 32:
+			b.WriteByte(' ')
+		case c < 127:
+			b.WriteRune(c)
+		case c >= 160 && c < 256:
+			fmt.Fprintf(&b, "\\%03o", c)
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
+
+// Estimates the width of text in Helvetica, bold text is taken to be 10% wider
+func helveticaWidth(text string, size float64, bold bool) float64 {
+	units := 0
+	for _, c := range text {
+		if c >= 32 && c < 127 {
+			units += helveticaWidths[c-32]
+		} else {
+			units += 556
+		}
+	}
+	width := float64(units) * size / 1000
+	if bold {
+		width *= 1.1
+	}
+	return width
+}
+
+// Shortens text with "..." until it fits in a width
+func fitText(text string, size float64, bold bool, width float64) string {
+	if helveticaWidth(text, size, bold) <= width {
+		return text
+	}
+	runes := []rune(text)
+	for len(runes) > 0 {
+		runes = runes[:len(runes)-1]
+		if shortened := string(runes) + "..."; helveticaWidth(shortened, size, bold) <= width {
+			return shortened
+		}
+	}
+	return ""
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"fmt"
+)
+
+// QR codes use GF(256) with the polynomial x^8 + x^4 + x^3 + x^2 + 1
+var qrField = newGaloisField(0x11D)
+
+// Error correction blocks of QR code versions 1 to 10 at level M
+type qrVersion struct {
+	ecPerBlock int
+	blocks     []int // Data codewords of each block
+	alignment  []int // Centers of the alignment patterns
+}
+
+var qrVersions = []qrVersion{
+	1:  {10, []int{16}, nil},
+	2:  {16, []int{28}, []int{6, 18}},
+	3:  {26, []int{44}, []int{6, 22}},
+	4:  {18, []int{32, 32}, []int{6, 26}},
+	5:  {24, []int{43, 43}, []int{6, 30}},
+	6:  {16, []int{27, 27, 27, 27}, []int{6, 34}},
+	7:  {18, []int{31, 31, 31, 31}, []int{6, 22, 38}},
+	8:  {22, []int{38, 38, 39, 39}, []int{6, 24, 42}},
+	9:  {22, []int{36, 36, 36, 37, 37}, []int{6, 26, 46}},
+	10: {26, []int{43, 43, 43, 43, 44}, []int{6, 28, 50}},
+}
+
+// Encodes text as a QR code in byte mode at error correction level M,
+// using the smallest version from 1 to 10 it fits in
+func encodeQRCode(text string) (*barcodeMatrix, error) {
+	version := 0
+	for v := 1; v < len(qrVersions); v++ {
+		countBits := 8
+		if v >= 10 {
+			countBits = 16
+		}
+		if 4+countBits+8*len(text) <= 8*qrDataCodewords(v) {
+			version = v
+			break
+		}
+	}
+	if version == 0 || text == "" {
+		return nil, fmt.Errorf("qr codes hold 1 to 213 characters")
+	}
+
+	// Mode, character count and data, then the terminator and padding
+	capacity := qrDataCodewords(version)
+	var bits qrBitBuffer
+	bits.append(0b0100, 4)
+	if version >= 10 {
+		bits.append(len(text), 16)
+	} else {
+		bits.append(len(text), 8)
+	}
+	for i := 0; i < len(text); i++ {
+		bits.append(int(text[i]), 8)
+	}
+	bits.append(0, min(4, capacity*8-len(bits)))
+	bits.append(0, (8-len(bits)%8)%8)
+	data := bits.bytes()
+	for pad := byte(0xEC); len(data) < capacity; pad ^= 0xEC ^ 0x11 {
+		data = append(data, pad)
+	}
+
+	codewords := qrInterleave(version, data)
+
+	q := newQRSymbol(version)
+	q.drawCodewords(codewords)
+
+	// Use the mask with the lowest penalty
+	bestMask, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(mask)
+		q.drawFormatBits(mask)
+		if penalty := q.penalty(); bestPenalty < 0 || penalty < bestPenalty {
+			bestMask, bestPenalty = mask, penalty
+		}
+		q.applyMask(mask)
+	}
+	q.applyMask(bestMask)
+	q.drawFormatBits(bestMask)
+
+	const quietZone = 4
+	matrix := newBarcodeMatrix(q.size, q.size, quietZone)
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			matrix.set(x, y, q.modules[y][x])
+		}
+	}
+	return matrix, nil
+}
+
+func qrDataCodewords(version int) int {
+	total := 0
+	for _, n := range qrVersions[version].blocks {
+		total += n
+	}
+	return total
+}
+
+// Splits the data into blocks, adds their error correction and interleaves them
+func qrInterleave(version int, data []byte) []byte {
+	info := qrVersions[version]
+	var blocks, ecBlocks [][]byte
+	for _, n := range info.blocks {
+		blocks = append(blocks, data[:n])
+		ecBlocks = append(ecBlocks, qrField.reedSolomon(data[:n], info.ecPerBlock, 0))
+		data = data[n:]
+	}
+
+	var result []byte
+	for i := 0; i < info.blocks[len(info.blocks)-1]; i++ {
+		for _, block := range blocks {
+			if i < len(block) {
+				result = append(result, block[i])
+			}
+		}
+	}
+	for i := 0; i < info.ecPerBlock; i++ {
+		for _, block := range ecBlocks {
+			result = append(result, block[i])
+		}
+	}
+	return result
+}
+
+// A bit sequence, most significant bit first
+type qrBitBuffer []bool
+
+func (b *qrBitBuffer) append(value int, length int) {
+	for i := length - 1; i >= 0; i-- {
+		*b = append(*b, (value>>i)&1 == 1)
+	}
+}
+
+func (b qrBitBuffer) bytes() []byte {
+	result := make([]byte, len(b)/8)
+	for i, bit := range b {
+		if bit {
+			result[i/8] |= 0x80 >> (i % 8)
+		}
+	}
+	return result
+}
+
+// The modules of a QR code while it is drawn, indexed [y][x]
+type qrSymbol struct {
+	version    int
+	size       int
+	modules    [][]bool
+	isFunction [][]bool // Finder, timing, alignment, format and version modules
+}
+
+// Creates a symbol with its function patterns drawn
+func newQRSymbol(version int) *qrSymbol {
+	size := 17 + 4*version
+	q := &qrSymbol{version: version, size: size}
+	q.modules = make([][]bool, size)
+	q.isFunction = make([][]bool, size)
+	for y := range q.modules {
+		q.modules[y] = make([]bool, size)
+		q.isFunction[y] = make([]bool, size)
+	}
+
+	// Timing patterns
+	for i := 0; i < size; i++ {
+		q.setFunction(6, i, i%2 == 0)
+		q.setFunction(i, 6, i%2 == 0)
+	}
+
+	// Finder patterns with their separators
+	for _, center := range [][2]int{{3, 3}, {size - 4, 3}, {3, size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := center[0]+dx, center[1]+dy
+				if x < 0 || x >= size || y < 0 || y >= size {
+					continue
+				}
+				distance := max(abs(dx), abs(dy))
+				q.setFunction(x, y, distance != 2 && distance != 4)
+			}
+		}
+	}
+
+	// Alignment patterns, except where they would overlap the finder patterns
+	alignment := qrVersions[version].alignment
+	last := len(alignment) - 1
+	for i, cy := range alignment {
+		for j, cx := range alignment {
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					q.setFunction(cx+dx, cy+dy, max(abs(dx), abs(dy)) != 1)
+				}
+			}
+		}
+	}
+
+	// Reserve the format modules, they are drawn with the mask
+	q.drawFormatBits(0)
+
+	// Version information
+	if version >= 7 {
+		remainder := version
+		for i := 0; i < 12; i++ {
+			remainder = (remainder << 1) ^ ((remainder >> 11) * 0x1F25)
+		}
+		bits := version<<12 | remainder
+		for i := 0; i < 18; i++ {
+			dark := (bits>>i)&1 == 1
+			a, b := size-11+i%3, i/3
+			q.setFunction(a, b, dark)
+			q.setFunction(b, a, dark)
+		}
+	}
+	return q
+}
+
+func (q *qrSymbol) setFunction(x int, y int, dark bool) {
+	q.modules[y][x] = dark
+	q.isFunction[y][x] = true
+}
+
+// Draws both copies of the format information for level M and a mask
+func (q *qrSymbol) drawFormatBits(mask int) {
+	const levelM = 0b00
+	data := levelM<<3 | mask
+	remainder := data
+	for i := 0; i < 10; i++ {
+		remainder = (remainder << 1) ^ ((remainder >> 9) * 0x537)
+	}
+	bits := (data<<10 | remainder) ^ 0x5412
+	bit := func(i int) bool { return (bits>>i)&1 == 1 }
+
+	// Around the top left finder pattern
+	for i := 0; i <= 5; i++ {
+		q.setFunction(8, i, bit(i))
+	}
+	q.setFunction(8, 7, bit(6))
+	q.setFunction(8, 8, bit(7))
+	q.setFunction(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.setFunction(14-i, 8, bit(i))
+	}
+
+	// Split between the other two finder patterns
+	for i := 0; i < 8; i++ {
+		q.setFunction(q.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.setFunction(8, q.size-15+i, bit(i))
+	}
+	q.setFunction(8, q.size-8, true)
+}
+
+// Places the codewords in two module wide columns zigzagging up and down from
+// the bottom right, skipping the vertical timing pattern
+func (q *qrSymbol) drawCodewords(codewords []byte) {
+	i := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vertical := 0; vertical < q.size; vertical++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vertical
+				if (right+1)&2 == 0 {
+					y = q.size - 1 - vertical
+				}
+				if q.isFunction[y][x] || i >= len(codewords)*8 {
+					continue
+				}
+				q.modules[y][x] = (codewords[i/8]>>(7-i%8))&1 == 1
+				i++
+			}
+		}
+	}
+}
+
+// Flips the data modules selected by a mask pattern. Applying it twice undoes it.
+func (q *qrSymbol) applyMask(mask int) {
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if q.isFunction[y][x] {
+				continue
+			}
+			var flip bool
+			switch mask {
+			case 0:
+				flip = (x+y)%2 == 0
+			case 1:
+				flip = y%2 == 0
+			case 2:
+				flip = x%3 == 0
+			case 3:
+				flip = (x+y)%3 == 0
+			case 4:
+				flip = (x/3+y/2)%2 == 0
+			case 5:
+				flip = x*y%2+x*y%3 == 0
+			case 6:
+				flip = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				flip = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if flip {
+				q.modules[y][x] = !q.modules[y][x]
+			}
+		}
+	}
+}
+
+// Scores how hard the symbol is to read, lower is better
+func (q *qrSymbol) penalty() int {
+	penalty := 0
+	at := func(x, y int, vertical bool) bool {
+		if vertical {
+			return q.modules[x][y]
+		}
+		return q.modules[y][x]
+	}
+
+	for _, vertical := range []bool{false, true} {
+		for y := 0; y < q.size; y++ {
+			// Runs of five or more modules of the same color
+			run := 1
+			for x := 1; x <= q.size; x++ {
+				if x < q.size && at(x, y, vertical) == at(x-1, y, vertical) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					penalty += 3 + run - 5
+				}
+				run = 1
+			}
+
+			// Patterns that look like a finder pattern
+			for x := 0; x+11 <= q.size; x++ {
+				var pattern int
+				for i := 0; i < 11; i++ {
+					pattern <<= 1
+					if at(x+i, y, vertical) {
+						pattern |= 1
+					}
+				}
+				if pattern == 0b10111010000 || pattern == 0b00001011101 {
+					penalty += 40
+				}
+			}
+		}
+	}
+
+	// 2x2 blocks of the same color
+	dark := 0
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if q.modules[y][x] {
+				dark++
+			}
+			if x > 0 && y > 0 {
+				c := q.modules[y][x]
+				if c == q.modules[y-1][x] && c == q.modules[y][x-1] && c == q.modules[y-1][x-1] {
+					penalty += 3
+				}
+			}
+		}
+	}
+
+	// Balance of dark and light modules
+	total := q.size * q.size
+	k := (abs(dark*20-total*10)+total-1)/total - 1
+	penalty += k * 10
+	return penalty
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
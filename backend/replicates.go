@@ -0,0 +1,535 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Sets one replicate value of an attribute that takes replicates. The value of
+the attribute becomes the mean of the replicates that are not excluded, and
+is flagged against the specification limits like any other value. Setting a
+replicate again replaces it and clears its exclusion.
+
+Query params:
+
+	sample_id: int,
+	attribute_id: int,
+	replicate: int, // 1 up to the replicates of the attribute
+	value: string, // A number
+	unit_id?: int // Unit of the value, converted to the unit of the attribute
+
+Result:
+
+	{
+		attribute_id: int,
+		value: string, // Mean, empty if every replicate is excluded
+		flag: string, // "ok", "warn", "fail" or null
+		replicates: [{ replicate: int, value: string, user_id: int, created_at: int, excluded_reason?: string, excluded_by?: int, excluded_at?: int }],
+		aggregates: { n: int, mean?: float, sd?: float, cv?: float }
+	}
+*/
+func insertOrUpdateReplicateValueHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(User)
+
+	sampleId, attributeId, replicate, err := parseReplicateParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	value := strings.TrimSpace(r.FormValue("value"))
+	if len(value) > 32 {
+		http.Error(w, "value must be at most 32 characters", http.StatusBadRequest)
+		return
+	}
+	if _, ok := parseFiniteNumber(value); !ok {
+		http.Error(w, "replicate values must be finite numbers", http.StatusBadRequest)
+		return
+	}
+	if status, err := checkReplicateTarget(sampleId, attributeId, replicate); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	// Values may be sent in any unit compatible with the unit of the attribute
+	if _unitId := r.FormValue("unit_id"); _unitId != "" {
+		unitId, err := strconv.Atoi(_unitId)
+		if err != nil {
+			http.Error(w, "unit_id must be a positive int", http.StatusBadRequest)
+			return
+		}
+		value, err = convertToAttributeUnit(DB, attributeId, unitId, value)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, ok := parseFiniteNumber(value); !ok {
+			http.Error(w, "replicate value is out of range in the unit of the attribute", http.StatusBadRequest)
+			return
+		}
+	}
+
+	result, status, err := saveReplicateChange(user.Id, sampleId, attributeId, func(tx *sql.Tx) (int, error) {
+		query := `
+			INSERT INTO sample_replicate_values (sample_id, attribute_id, replicate, value, user_id, created_at) VALUES (?, ?, ?, ?, ?, ?)
+			ON CONFLICT (sample_id, attribute_id, replicate) DO UPDATE SET
+				value = excluded.value, user_id = excluded.user_id, created_at = excluded.created_at,
+				excluded_reason = NULL, excluded_by = NULL, excluded_at = NULL
+		`
+		if _, err := tx.Exec(query, sampleId, attributeId, replicate, value, user.Id, time.Now().Unix()); err != nil {
+			return http.StatusInternalServerError, fmt.Errorf("error when inserting replicate value to database")
+		}
+		return 0, nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+/*
+Excludes a replicate from the mean as an outlier, or includes it again. The
+replicate is kept with the reason it was excluded for.
+
+Query params:
+
+	sample_id: int,
+	attribute_id: int,
+	replicate: int,
+	excluded: bool,
+	reason?: string // Required when excluding
+
+Result:
+
+	Same as POST replicate-values
+*/
+func updateReplicateExclusionHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(User)
+
+	sampleId, attributeId, replicate, err := parseReplicateParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	excluded, err := strconv.ParseBool(r.FormValue("excluded"))
+	if err != nil {
+		http.Error(w, "excluded must be a bool", http.StatusBadRequest)
+		return
+	}
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	if excluded && reason == "" {
+		http.Error(w, "reason is required to exclude a replicate", http.StatusBadRequest)
+		return
+	}
+	if len(reason) > 1000 {
+		http.Error(w, "reason must be at most 1000 characters", http.StatusBadRequest)
+		return
+	}
+	if status, err := checkReplicateTarget(sampleId, attributeId, replicate); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	result, status, err := saveReplicateChange(user.Id, sampleId, attributeId, func(tx *sql.Tx) (int, error) {
+		query := "UPDATE sample_replicate_values SET excluded_reason = NULL, excluded_by = NULL, excluded_at = NULL WHERE sample_id = ? AND attribute_id = ? AND replicate = ?"
+		args := []any{sampleId, attributeId, replicate}
+		if excluded {
+			query = "UPDATE sample_replicate_values SET excluded_reason = ?, excluded_by = ?, excluded_at = ? WHERE sample_id = ? AND attribute_id = ? AND replicate = ?"
+			args = append([]any{reason, user.Id, time.Now().Unix()}, args...)
+		}
+		updated, err := tx.Exec(query, args...)
+		if err != nil {
+			return http.StatusInternalServerError, fmt.Errorf("error when updating replicate value in database")
+		}
+		if rowsAffected, err := updated.RowsAffected(); err != nil || rowsAffected == 0 {
+			return http.StatusNotFound, fmt.Errorf("replicate not found")
+		}
+		return 0, nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+/*
+Removes a replicate value. The value of the attribute is removed with the
+last replicate.
+
+Query params:
+
+	sample_id: int,
+	attribute_id: int,
+	replicate: int
+
+Result:
+
+	Same as POST replicate-values
+*/
+func deleteReplicateValueHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(User)
+
+	sampleId, attributeId, replicate, err := parseReplicateParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if status, err := checkReplicateTarget(sampleId, attributeId, replicate); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	result, status, err := saveReplicateChange(user.Id, sampleId, attributeId, func(tx *sql.Tx) (int, error) {
+		deleted, err := tx.Exec("DELETE FROM sample_replicate_values WHERE sample_id = ? AND attribute_id = ? AND replicate = ?", sampleId, attributeId, replicate)
+		if err != nil {
+			return http.StatusInternalServerError, fmt.Errorf("error when deleting replicate value from database")
+		}
+		if rowsAffected, err := deleted.RowsAffected(); err != nil || rowsAffected == 0 {
+			return http.StatusNotFound, fmt.Errorf("replicate not found")
+		}
+		return 0, nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// A replicate value of an attribute that takes replicates
+type Replicate struct {
+	Replicate      int     `json:"replicate"`
+	Value          string  `json:"value"`
+	UserId         int     `json:"user_id"`
+	CreatedAt      int64   `json:"created_at"`                // UNIX timestamp
+	ExcludedReason *string `json:"excluded_reason,omitempty"` // Nullable, set for outliers left out of the mean
+	ExcludedBy     *int    `json:"excluded_by,omitempty"`
+	ExcludedAt     *int64  `json:"excluded_at,omitempty"`
+}
+
+// Statistics of the replicates that are not excluded
+type ReplicateAggregates struct {
+	N    int      `json:"n"`
+	Mean *float64 `json:"mean,omitempty"`
+	SD   *float64 `json:"sd,omitempty"` // Sample standard deviation, needs two replicates
+	CV   *float64 `json:"cv,omitempty"` // Coefficient of variation in percent, not set for a mean of 0
+}
+
+// Parses sample_id, attribute_id and replicate
+func parseReplicateParams(r *http.Request) (sampleId int, attributeId int, replicate int, err error) {
+	if sampleId, err = strconv.Atoi(r.FormValue("sample_id")); err != nil {
+		return 0, 0, 0, fmt.Errorf("sample_id must be a positive int")
+	}
+	if attributeId, err = strconv.Atoi(r.FormValue("attribute_id")); err != nil {
+		return 0, 0, 0, fmt.Errorf("attribute_id must be a positive int")
+	}
+	if replicate, err = strconv.Atoi(r.FormValue("replicate")); err != nil {
+		return 0, 0, 0, fmt.Errorf("replicate must be a positive int")
+	}
+	return sampleId, attributeId, replicate, nil
+}
+
+// Checks that a replicate can be written: the sample and attribute are not in
+// the trash and belong together, the attribute takes that many replicates and
+// the sample is not locked
+func checkReplicateTarget(sampleId int, attributeId int, replicate int) (int, error) {
+	var sameCollection bool
+	var replicates *int
+	query := `
+		SELECT a.collection_id = s.collection_id, a.replicates
+		FROM samples s JOIN collections c ON c.id = s.collection_id, sample_attributes a
+		WHERE s.id = ? AND a.id = ? AND s.deleted_at IS NULL AND c.deleted_at IS NULL AND a.deleted_at IS NULL
+	`
+	err := DB.QueryRow(query, sampleId, attributeId).Scan(&sameCollection, &replicates)
+	if err == sql.ErrNoRows {
+		return http.StatusNotFound, fmt.Errorf("sample or attribute not found")
+	} else if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("error when reading from database")
+	}
+	if !sameCollection {
+		return http.StatusBadRequest, fmt.Errorf("attribute is not part of the collection of the sample")
+	}
+	if replicates == nil {
+		return http.StatusBadRequest, fmt.Errorf("attribute does not take replicate values")
+	}
+	if replicate < 1 || replicate > *replicates {
+		return http.StatusBadRequest, fmt.Errorf("replicate must be between 1 and %d", *replicates)
+	}
+	return checkSampleWritable(sampleId)
+}
+
+// Applies a change to the replicates of a value and updates the mean, the
+// calculated values and the webhooks and notifications that depend on it
+func saveReplicateChange(userId int, sampleId int, attributeId int, change func(tx *sql.Tx) (int, error)) (SampleValue, int, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return SampleValue{}, http.StatusInternalServerError, fmt.Errorf("error when updating sample value in database")
+	}
+	defer tx.Rollback()
+
+	if status, err := change(tx); err != nil {
+		return SampleValue{}, status, err
+	}
+	value, flag, previousFlag, err := updateReplicateMean(tx, sampleId, attributeId, &userId)
+	if err != nil {
+		return SampleValue{}, http.StatusInternalServerError, fmt.Errorf("error when updating sample value in database")
+	}
+	if err := recomputeSampleFormulas(tx, sampleId); err != nil {
+		return SampleValue{}, http.StatusInternalServerError, fmt.Errorf("error when calculating values")
+	}
+	if err := tx.Commit(); err != nil {
+		return SampleValue{}, http.StatusInternalServerError, fmt.Errorf("error when updating sample value in database")
+	}
+	if value != nil {
+		emitSampleValueEvent(sampleId, attributeId, *value)
+		notifyIfNewlyOutOfSpec(userId, sampleId, attributeId, *value, nil, flag, previousFlag)
+	}
+
+	result := SampleValue{AttributeId: attributeId, Flag: flag}
+	if value != nil {
+		result.Value = *value
+	}
+	replicates, err := readSampleReplicates(sampleId)
+	if err != nil {
+		return SampleValue{}, http.StatusInternalServerError, fmt.Errorf("error when reading from database")
+	}
+	result.Replicates = replicates[attributeId]
+	result.Aggregates = aggregateReplicates(result.Replicates)
+	return result, 0, nil
+}
+
+// Stores the mean of the replicates that are not excluded as the value of
+// the attribute, or removes the value if there are none. A new version of the
+// value is kept when it changes.
+func updateReplicateMean(tx *sql.Tx, sampleId int, attributeId int, userId *int) (value *string, flag *string, previousFlag *string, err error) {
+	rows, err := tx.Query("SELECT value FROM sample_replicate_values WHERE sample_id = ? AND attribute_id = ? AND excluded_reason IS NULL", sampleId, attributeId)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("updateReplicateMean: %v", err)
+	}
+	var numbers []float64
+	for rows.Next() {
+		var replicate string
+		if err := rows.Scan(&replicate); err != nil {
+			rows.Close()
+			return nil, nil, nil, fmt.Errorf("updateReplicateMean: %v", err)
+		}
+		if number, ok := parseFiniteNumber(replicate); ok {
+			numbers = append(numbers, number)
+		}
+	}
+	rows.Close()
+
+	var previous *string
+	err = tx.QueryRow("SELECT value, flag FROM sample_attribute_values WHERE sample_id = ? AND attribute_id = ?", sampleId, attributeId).Scan(&previous, &previousFlag)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, nil, nil, fmt.Errorf("updateReplicateMean: %v", err)
+	}
+	found := err == nil
+
+	if len(numbers) == 0 {
+		if !found {
+			return nil, nil, nil, nil
+		}
+		if _, err := tx.Exec("DELETE FROM sample_attribute_values WHERE sample_id = ? AND attribute_id = ?", sampleId, attributeId); err != nil {
+			return nil, nil, nil, fmt.Errorf("updateReplicateMean: %v", err)
+		}
+		return nil, nil, previousFlag, recordValueVersion(tx, sampleId, attributeId, nil, nil, userId)
+	}
+
+	average := strconv.FormatFloat(mean(numbers), 'g', 10, 64)
+	flag, err = evaluateValueFlag(tx, sampleId, attributeId, average, nil)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	query := `
+		INSERT INTO sample_attribute_values (sample_id, attribute_id, value, flag) VALUES (?, ?, ?, ?)
+		ON CONFLICT (sample_id, attribute_id) DO UPDATE SET value = excluded.value, flag = excluded.flag
+	`
+	if _, err := tx.Exec(query, sampleId, attributeId, average, flag); err != nil {
+		return nil, nil, nil, fmt.Errorf("updateReplicateMean: %v", err)
+	}
+	if previous == nil || *previous != average {
+		if err := recordValueVersion(tx, sampleId, attributeId, &average, flag, userId); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	return &average, flag, previousFlag, nil
+}
+
+// Reads the replicates of a sample by attribute, in replicate order
+func readSampleReplicates(sampleId int) (map[int][]Replicate, error) {
+	query := `
+		SELECT attribute_id, replicate, value, user_id, created_at, excluded_reason, excluded_by, excluded_at
+		FROM sample_replicate_values
+		WHERE sample_id = ? AND attribute_id IN (SELECT id FROM sample_attributes WHERE deleted_at IS NULL)
+		ORDER BY attribute_id, replicate
+	`
+	rows, err := DB.Query(query, sampleId)
+	if err != nil {
+		return nil, fmt.Errorf("readSampleReplicates: %v", err)
+	}
+	defer rows.Close()
+
+	replicates := make(map[int][]Replicate)
+	for rows.Next() {
+		var attributeId int
+		var rep Replicate
+		if err := rows.Scan(&attributeId, &rep.Replicate, &rep.Value, &rep.UserId, &rep.CreatedAt, &rep.ExcludedReason, &rep.ExcludedBy, &rep.ExcludedAt); err != nil {
+			return nil, fmt.Errorf("readSampleReplicates: %v", err)
+		}
+		replicates[attributeId] = append(replicates[attributeId], rep)
+	}
+	return replicates, rows.Err()
+}
+
+// Mean, standard deviation and coefficient of variation of the replicates that are not excluded
+func aggregateReplicates(replicates []Replicate) *ReplicateAggregates {
+	if len(replicates) == 0 {
+		return nil
+	}
+	var numbers []float64
+	for _, rep := range replicates {
+		if rep.ExcludedReason != nil {
+			continue
+		}
+		if number, ok := parseFiniteNumber(rep.Value); ok {
+			numbers = append(numbers, number)
+		}
+	}
+
+	aggregates := &ReplicateAggregates{N: len(numbers)}
+	if len(numbers) == 0 {
+		return aggregates
+	}
+	m := mean(numbers)
+	aggregates.Mean = &m
+	if len(numbers) > 1 {
+		sd := standardDeviation(numbers)
+		aggregates.SD = &sd
+		if m != 0 {
+			cv := sd / math.Abs(m) * 100
+			aggregates.CV = &cv
+		}
+	}
+	return aggregates
+}
+
+// Adds the replicates and their aggregates to the values of a sample, in the
+// units the values were converted to. A value whose replicates are all
+// excluded is added with an empty value.
+func addSampleReplicates(sample *Sample, attributes []Attribute, conversions map[int][2]Unit) error {
+	replicates, err := readSampleReplicates(sample.SampleId)
+	if err != nil {
+		return err
+	}
+	for _, attr := range attributes {
+		reps, ok := replicates[attr.AttributeId]
+		if !ok {
+			continue
+		}
+		if units, ok := conversions[attr.AttributeId]; ok {
+			for j := range reps {
+				if converted, err := convertValueString(reps[j].Value, units[0], units[1]); err == nil {
+					reps[j].Value = converted
+				}
+			}
+		}
+
+		index := -1
+		for j, val := range sample.Values {
+			if val.AttributeId == attr.AttributeId {
+				index = j
+				break
+			}
+		}
+		if index == -1 {
+			sample.Values = append(sample.Values, SampleValue{AttributeId: attr.AttributeId})
+			index = len(sample.Values) - 1
+		}
+		sample.Values[index].Replicates = reps
+		sample.Values[index].Aggregates = aggregateReplicates(reps)
+	}
+	return nil
+}
+
+// Returns the number of replicates an attribute takes, nil if it takes a single value
+func readAttributeReplicates(q queryRower, attributeId int) (*int, error) {
+	var replicates *int
+	err := q.QueryRow("SELECT replicates FROM sample_attributes WHERE id = ?", attributeId).Scan(&replicates)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("readAttributeReplicates: %v", err)
+	}
+	return replicates, nil
+}
+
+// Changes the number of replicates an attribute takes. Single values become
+// the first replicate when the attribute starts taking replicates, and an
+// attribute only takes single values again once its replicates are deleted.
+func changeAttributeReplicates(tx *sql.Tx, attributeId int, from *int, to *int, userId int) (int, error) {
+	if to == nil && from != nil {
+		var found bool
+		if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM sample_replicate_values WHERE attribute_id = ?)", attributeId).Scan(&found); err != nil {
+			return http.StatusInternalServerError, fmt.Errorf("error when reading from database")
+		}
+		if found {
+			return http.StatusConflict, fmt.Errorf("attribute has replicate values, delete them before taking single values")
+		}
+	}
+	if to != nil && from != nil {
+		var sampleId int
+		err := tx.QueryRow("SELECT sample_id FROM sample_replicate_values WHERE attribute_id = ? AND replicate > ? LIMIT 1", attributeId, *to).Scan(&sampleId)
+		if err == nil {
+			return http.StatusConflict, fmt.Errorf("sample %d has more than %d replicates", sampleId, *to)
+		} else if err != sql.ErrNoRows {
+			return http.StatusInternalServerError, fmt.Errorf("error when reading from database")
+		}
+	}
+	if to != nil && from == nil {
+		rows, err := tx.Query("SELECT sample_id, value FROM sample_attribute_values WHERE attribute_id = ? AND value IS NOT NULL AND value != ''", attributeId)
+		if err != nil {
+			return http.StatusInternalServerError, fmt.Errorf("error when reading from database")
+		}
+		values := make(map[int]string)
+		for rows.Next() {
+			var sampleId int
+			var value string
+			if err := rows.Scan(&sampleId, &value); err != nil {
+				rows.Close()
+				return http.StatusInternalServerError, fmt.Errorf("error when reading from database")
+			}
+			if _, ok := parseFiniteNumber(value); !ok {
+				rows.Close()
+				return http.StatusBadRequest, fmt.Errorf("value %q of sample %d is not a finite number and cannot be a replicate", value, sampleId)
+			}
+			values[sampleId] = strings.TrimSpace(value)
+		}
+		rows.Close()
+
+		now := time.Now().Unix()
+		for sampleId, value := range values {
+			query := "INSERT INTO sample_replicate_values (sample_id, attribute_id, replicate, value, user_id, created_at) VALUES (?, ?, 1, ?, ?, ?)"
+			if _, err := tx.Exec(query, sampleId, attributeId, value, userId, now); err != nil {
+				return http.StatusInternalServerError, fmt.Errorf("failed to update attribute")
+			}
+		}
+	}
+
+	if _, err := tx.Exec("UPDATE sample_attributes SET replicates = ? WHERE id = ?", to, attributeId); err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("failed to update attribute")
+	}
+	return 0, nil
+}
@@ -12,15 +12,36 @@ import (
 )
 
 /*
-Updates a single value in a sample
+Updates a single value in a sample. Numeric values are flagged against the
+specification limits of the attribute, censored values by the number they
+are censored at. Values with declared significant figures are stored written
+with them, e.g. "1.20". Values from an instrument that is not active, or whose
+calibration is overdue and its policy is to block, are refused.
 
 Query params:
 
 	sample_id: int,
 	attribute_id: int,
-	value: string
+	value: string, // May start with a censor, e.g. "<0.5", or be "<LOD", "<LOQ", ">ULOQ" or "ND"
+	censor?: string, // "<", ">", "<=", ">=", "≤" or "≥", instead of a censor in the value
+	qualifier?: string, // One of the qualifier codes
+	uncertainty?: string, // Standard uncertainty, e.g. "0.05"
+	uncertainty_type?: string, // "absolute" (default) in the unit of the value, or "relative" in percent
+	significant_figures?: int, // 1 to 15
+	instrument_id?: int, // The instrument that produced the value
+	unit_id?: int // Unit of the value, converted to the unit of the attribute
+
+Result:
+
+	{
+		status: string,
+		flag: string, // "ok", "warn", "fail" or null
+		warning?: string // e.g. the calibration of the instrument is overdue
+	}
 */
 func insertOrUpdateSampleValueHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(User)
+
 	// Get data from query parameters
 	_attributeId := r.FormValue("attribute_id")
 	_sampleId := r.FormValue("sample_id")
@@ -47,42 +68,186 @@ func insertOrUpdateSampleValueHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	queryInsert := "INSERT INTO sample_attribute_values (sample_id, attribute_id, value) VALUES (?, ?, ?)"
-	result, err := DB.Exec(queryInsert, sampleId, attributeId, value)
+	// Values of samples and attributes in the trash cannot change
+	sampleTrashed, err := isSampleTrashed(sampleId)
 	if err != nil {
-		if strings.Contains(err.Error(), "UNIQUE constraint failed:") {
-			// If the sample already exists, update it instead
-			query := "UPDATE sample_attribute_values SET value = ? WHERE sample_id = ? AND attribute_id = ?"
-			update_result, err := DB.Exec(query, value, sampleId, attributeId)
-			if err != nil {
-				http.Error(w, "error when updating sample value in database", http.StatusInternalServerError)
-				return
-			}
-			rowsAffected, err := update_result.RowsAffected()
-			if err != nil || rowsAffected == 0 {
-				http.Error(w, "sample not found or no changes made", http.StatusNotFound)
-				return
-			}
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	attributeTrashed, err := isAttributeTrashed(attributeId)
+	if err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	if sampleTrashed || attributeTrashed {
+		http.Error(w, "sample or attribute not found", http.StatusNotFound)
+		return
+	}
+
+	calculated, err := isCalculatedAttribute(DB, attributeId)
+	if err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	if calculated {
+		http.Error(w, "attribute is calculated from a formula and cannot be set", http.StatusBadRequest)
+		return
+	}
+	replicates, err := readAttributeReplicates(DB, attributeId)
+	if err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	if replicates != nil {
+		http.Error(w, "attribute takes replicate values, set them with replicate-values", http.StatusBadRequest)
+		return
+	}
+
+	// Censored values are stored as the number they are censored at
+	value, censor, err := parseCensoredValue(DB, attributeId, value, r.FormValue("censor"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var qualifier *string
+	if _qualifier := r.FormValue("qualifier"); _qualifier != "" {
+		if status, err := checkQualifierCode(DB, _qualifier); err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		qualifier = &_qualifier
+	}
+	precision, err := parseMeasurementPrecision(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var instrumentId *int
+	var warning string
+	if _instrumentId := r.FormValue("instrument_id"); _instrumentId != "" {
+		id, err := strconv.Atoi(_instrumentId)
+		if err != nil {
+			http.Error(w, "instrument_id must be a positive int", http.StatusBadRequest)
+			return
+		}
+		var status int
+		if warning, status, err = checkInstrument(DB, id); err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		instrumentId = &id
+	}
 
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusOK)
-			fmt.Fprintln(w, "{\"status\": \"success\"}")
+	// Samples in a locked workflow state are read-only
+	locked, err := isSampleLocked(sampleId)
+	if err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	if locked {
+		http.Error(w, "sample is locked by its workflow state", http.StatusConflict)
+		return
+	}
+
+	// Values may be sent in any unit compatible with the unit of the attribute
+	if _unitId := r.FormValue("unit_id"); _unitId != "" {
+		unitId, err := strconv.Atoi(_unitId)
+		if err != nil {
+			http.Error(w, "unit_id must be a positive int", http.StatusBadRequest)
 			return
+		}
+		value, err = convertToAttributeUnit(DB, attributeId, unitId, value)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		precision, err = convertUncertaintyToAttributeUnit(DB, attributeId, unitId, precision)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	value, err = applySignificantFigures(value, precision.SignificantFigures)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Evaluate against the specification limits
+	flag, err := evaluateValueFlag(DB, sampleId, attributeId, value, censor)
+	if err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	// The value, its version and the values calculated from it are saved together
+	tx, err := DB.Begin()
+	if err != nil {
+		http.Error(w, "error when writing to database", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
 
-		} else {
+	var previousFlag *string
+	err = tx.QueryRow("SELECT flag FROM sample_attribute_values WHERE sample_id = ? AND attribute_id = ?", sampleId, attributeId).Scan(&previousFlag)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+
+	queryInsert := `
+		INSERT INTO sample_attribute_values (sample_id, attribute_id, value, flag, censor, qualifier, uncertainty, uncertainty_type, significant_figures, instrument_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	result, err := tx.Exec(queryInsert, sampleId, attributeId, value, flag, censor, qualifier, precision.Uncertainty, precision.UncertaintyType, precision.SignificantFigures, instrumentId)
+	if err != nil {
+		if !strings.Contains(err.Error(), "UNIQUE constraint failed:") {
 			http.Error(w, "error when inserting sample value to database", http.StatusInternalServerError)
 			return
 		}
+		// If the sample already exists, update it instead
+		query := `
+			UPDATE sample_attribute_values
+			SET value = ?, flag = ?, censor = ?, qualifier = ?, uncertainty = ?, uncertainty_type = ?, significant_figures = ?, instrument_id = ?
+			WHERE sample_id = ? AND attribute_id = ?
+		`
+		result, err = tx.Exec(query, value, flag, censor, qualifier, precision.Uncertainty, precision.UncertaintyType, precision.SignificantFigures, instrumentId, sampleId, attributeId)
+		if err != nil {
+			http.Error(w, "error when updating sample value in database", http.StatusInternalServerError)
+			return
+		}
 	}
 	rowsAffected, err := result.RowsAffected()
 	if err != nil || rowsAffected == 0 {
 		http.Error(w, "sample not found or no changes made", http.StatusNotFound)
 		return
 	}
+	if err := recordValueVersion(tx, sampleId, attributeId, &value, flag, &user.Id); err != nil {
+		http.Error(w, "error when writing to database", http.StatusInternalServerError)
+		return
+	}
+	if err := recomputeSampleFormulas(tx, sampleId); err != nil {
+		http.Error(w, "error when calculating values", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "error when writing to database", http.StatusInternalServerError)
+		return
+	}
+	emitSampleValueEvent(sampleId, attributeId, value)
+	notifyIfNewlyOutOfSpec(user.Id, sampleId, attributeId, value, censor, flag, previousFlag)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	fmt.Fprintln(w, "{\"status\": \"success\"}")
+	json.NewEncoder(w).Encode(sampleValueResponse(flag, warning))
+}
+
+// Result of a value that was saved, with the warning it was saved with if any
+func sampleValueResponse(flag *string, warning string) map[string]any {
+	response := map[string]any{"status": "success", "flag": flag}
+	if warning != "" {
+		response["warning"] = warning
+	}
+	return response
 }
 
 /*
@@ -134,6 +299,27 @@ func updateSampleHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	args = append(args, sampleId)
 
+	trashed, err := isSampleTrashed(sampleId)
+	if err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	if trashed {
+		http.Error(w, "sample not found", http.StatusNotFound)
+		return
+	}
+
+	// Samples in a locked workflow state are read-only
+	locked, err := isSampleLocked(sampleId)
+	if err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	if locked {
+		http.Error(w, "sample is locked by its workflow state", http.StatusConflict)
+		return
+	}
+
 	// Update sample in the database
 	query = strings.TrimSuffix(query, ",") + " WHERE id = ?"
 	result, err := DB.Exec(query, args...)
@@ -148,13 +334,24 @@ func updateSampleHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Another limit version may apply at the new creation time
+	if _createdAt != "" {
+		if err := reevaluateSampleFlags(sampleId); err != nil {
+			http.Error(w, "error when evaluating values", http.StatusInternalServerError)
+			return
+		}
+	}
+	if collectionId, err := readSampleCollectionId(sampleId); err == nil {
+		emitWebhookEvent(collectionId, "sample.updated", map[string]any{"sample_id": sampleId})
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprintln(w, "{\"status\": \"success\"}")
 }
 
 /*
-Deletes a sample from the db
+Moves a sample to the trash
 
 Query params:
 
@@ -175,8 +372,26 @@ func deleteSampleHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	query := "DELETE FROM samples WHERE id = ?"
-	result, err := DB.Exec(query, sampleId)
+	// Samples in a locked workflow state are read-only
+	locked, err := isSampleLocked(sampleId)
+	if err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	if locked {
+		http.Error(w, "sample is locked by its workflow state", http.StatusConflict)
+		return
+	}
+
+	// Read the collection before the sample is gone, so webhooks can be notified
+	collectionId, err := readSampleCollectionId(sampleId)
+	if err != nil {
+		http.Error(w, "sample not found", http.StatusNotFound)
+		return
+	}
+
+	query := "UPDATE samples SET deleted_at = ? WHERE id = ? AND deleted_at IS NULL"
+	result, err := DB.Exec(query, time.Now().Unix(), sampleId)
 	if err != nil {
 		http.Error(w, "error when deleting sample from database", http.StatusInternalServerError)
 		return
@@ -187,6 +402,7 @@ func deleteSampleHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "sample not found", http.StatusNotFound)
 		return
 	}
+	emitWebhookEvent(collectionId, "sample.deleted", map[string]any{"sample_id": sampleId})
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -203,7 +419,13 @@ Query params:
 	page_size: int,
 	page: int,
 	before: int, // UNIX timestamp in seconds
-	after: int // UNIX timestamp in seconds
+	after: int, // UNIX timestamp in seconds
+	status_id: int, // Only samples in this workflow state
+	out_of_spec: bool, // Only samples with at least one failing value
+	convert: string, // Comma separated attribute_id:unit_id pairs, e.g. "3:7,4:7"
+	as_of: int // UNIX timestamp in seconds. Returns the samples, attributes, values and
+	           // workflow states as they were at that time. Notes, names and units are current,
+	           // replicates are left out.
 
 Result:
 
@@ -212,19 +434,46 @@ Result:
 			{
 				attribute_id: int,
 				name: string
-				unit_id: int
+				unit_id: int,
+				position: int,
+				group: string,
+				description: string,
+				decimals: int,
+				formula: string, // Set if the values are calculated
+				replicates: int, // Set if the attribute takes replicate values
+				lod: float, loq: float, uloq: float, // Detection limits
+				substitution: string // How censored values enter statistics
 			}
 			...
 		],
 		samples: [
 			{
 				sample_id: int,
+				identifier: string, // Omitted if the sample has none
 				note: string,
 				created_at: int,
+				status_id: int,
+				location: { // Omitted if the sample is not in storage
+					location_id: int,
+					path: string, // e.g. "Lab 1 / Freezer A / Box 3"
+					row: int,
+					column: int,
+					position: string // e.g. "B7", omitted outside grids
+				},
+				custodian_id: int, // Omitted before the first custody transfer
 				values: [
 					{
 						attribute_id: int,
-						value: string
+						value: string,
+						flag: string, // "ok", "warn" or "fail", omitted if not evaluated
+						censor: string, // "<", ">", "≤" or "≥" if the value is censored at its number
+						qualifier: string, // One of the qualifier codes
+						uncertainty: string, // Standard uncertainty, as it was written or calculated
+						uncertainty_type: string, // "absolute" or "relative" (percent)
+						significant_figures: int, // Declared, the value is written with them
+						instrument_id: int, // The instrument that produced the value
+						replicates: [{ replicate: int, value: string, user_id: int, created_at: int, excluded_reason?: string, ... }],
+						aggregates: { n: int, mean: float, sd: float, cv: float } // Of the replicates that are not excluded
 					}
 					...
 				]
@@ -270,7 +519,7 @@ func fetchSamplesHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Check if collectionId is valid
 	var exists bool
-	query := `SELECT EXISTS(SELECT 1 FROM collections WHERE id = ?)`
+	query := `SELECT EXISTS(SELECT 1 FROM collections WHERE id = ? AND deleted_at IS NULL)`
 	err := DB.QueryRow(query, collectionId).Scan(&exists)
 	if err != nil {
 		log.Println("DB error:", err)
@@ -332,41 +581,112 @@ func fetchSamplesHandler(w http.ResponseWriter, r *http.Request) {
 		after = o
 	}
 
+	// Parse workflow filter
+	_statusId := r.FormValue("status_id")
+	statusId := 0
+	if _statusId != "" {
+		s, err := strconv.Atoi(_statusId)
+		if err != nil || s <= 0 {
+			http.Error(w, "status_id must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		statusId = s
+	}
+
+	// Parse specification filter
+	outOfSpec := false
+	if _outOfSpec := r.FormValue("out_of_spec"); _outOfSpec != "" {
+		b, err := strconv.ParseBool(_outOfSpec)
+		if err != nil {
+			http.Error(w, "out_of_spec must be a bool", http.StatusBadRequest)
+			return
+		}
+		outOfSpec = b
+	}
+
+	// Parse point in time
+	var asOf *int64
+	if _asOf := r.FormValue("as_of"); _asOf != "" {
+		t, err := strconv.ParseInt(_asOf, 10, 64)
+		if err != nil || t < 0 {
+			http.Error(w, "as_of must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		asOf = &t
+	}
+	sampleCondition, sampleConditionArgs := existedAtCondition("", asOf)
+	statusExpression, statusArgs := statusAtExpression(asOf)
+	sampleColumns := "id, identifier, created_at, note, " + statusExpression + ", location_id, location_row, location_column, custodian_id"
+
 	// Fetch attributes related to this collection
-	attributeQuery := "SELECT id, name, unit_id FROM sample_attributes WHERE collection_id = ? ORDER BY id"
-	attrRows, err := DB.Query(attributeQuery, collectionId)
+	attributes, err := readCollectionAttributesAt(collectionId, asOf)
 	if err != nil {
 		log.Println("DB Fetch Error:", err)
 		http.Error(w, "Failed to fetch attributes", http.StatusInternalServerError)
 		return
 	}
-	defer attrRows.Close()
 
-	var attributes = make([]Attribute, 0)
-	for attrRows.Next() {
-		var attr = Attribute{}
-		if err := attrRows.Scan(&attr.AttributeId, &attr.Name, &attr.UnitId); err != nil {
-			http.Error(w, "Error reading attributes", http.StatusInternalServerError)
-			return
+	// Parse unit conversions, attributes report the unit their values are converted to
+	conversions := make(map[int][2]Unit)
+	if _convert := r.FormValue("convert"); _convert != "" {
+		for _, pair := range strings.Split(_convert, ",") {
+			ids := strings.Split(pair, ":")
+			if len(ids) != 2 {
+				http.Error(w, "convert must be comma separated attribute_id:unit_id pairs", http.StatusBadRequest)
+				return
+			}
+			attributeId, err1 := strconv.Atoi(ids[0])
+			unitId, err2 := strconv.Atoi(ids[1])
+			if err1 != nil || err2 != nil {
+				http.Error(w, "convert must be comma separated attribute_id:unit_id pairs", http.StatusBadRequest)
+				return
+			}
+			found := false
+			for i, attr := range attributes {
+				if attr.AttributeId != attributeId {
+					continue
+				}
+				found = true
+				if attr.UnitId == nil {
+					http.Error(w, "attribute "+ids[0]+" has no unit to convert from", http.StatusBadRequest)
+					return
+				}
+				from, err := readUnit(DB, *attr.UnitId)
+				if err != nil {
+					http.Error(w, "error when reading from database", http.StatusInternalServerError)
+					return
+				}
+				to, err := readUnit(DB, unitId)
+				if err != nil {
+					http.Error(w, "unit "+ids[1]+" not found", http.StatusBadRequest)
+					return
+				}
+				if !from.convertibleTo(to) {
+					http.Error(w, "cannot convert "+from.Name+" to "+to.Name, http.StatusBadRequest)
+					return
+				}
+				conversions[attributeId] = [2]Unit{from, to}
+				attributes[i].UnitId = &to.Id
+			}
+			if !found {
+				http.Error(w, "attribute "+ids[0]+" is not part of the collection", http.StatusBadRequest)
+				return
+			}
 		}
-		attributes = append(attributes, attr)
-	}
-	// Check for row iteration errors
-	if err = attrRows.Err(); err != nil {
-		http.Error(w, "Error iterating attribute rows", http.StatusInternalServerError)
-		return
 	}
 
 	var samples = make([]Sample, 0)
 	var totalCount int
+	var locationPaths map[int]string
 
 	if singleSample {
 		var sample = Sample{
 			SampleId: sampleId,
 		}
 		// Fetch sample
-		sampleQuery := "SELECT created_at, note FROM samples WHERE id = ?"
-		err := DB.QueryRow(sampleQuery, sampleId).Scan(&sample.CreatedAt, &sample.Note)
+		sampleQuery := "SELECT " + sampleColumns + " FROM samples WHERE id = ? AND " + sampleCondition
+		args := append(append(statusArgs, sampleId), sampleConditionArgs...)
+		err := DB.QueryRow(sampleQuery, args...).Scan(&sample.SampleId, &sample.Identifier, &sample.CreatedAt, &sample.Note, &sample.StatusId, &sample.locationId, &sample.locationRow, &sample.locationColumn, &sample.CustodianId)
 		if err != nil {
 			if err == sql.ErrNoRows {
 				w.WriteHeader(http.StatusNoContent)
@@ -378,8 +698,8 @@ func fetchSamplesHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// Fetch values associated with this sample
-		valueQuery := "SELECT attribute_id, value FROM sample_attribute_values WHERE sample_id = ?"
-		valueRows, err := DB.Query(valueQuery, sample.SampleId)
+		valueQuery, valueArgs := sampleValuesQuery(sample.SampleId, asOf)
+		valueRows, err := DB.Query(valueQuery, valueArgs...)
 		if err != nil {
 			http.Error(w, "Failed to fetch sample values", http.StatusInternalServerError)
 			return
@@ -389,7 +709,7 @@ func fetchSamplesHandler(w http.ResponseWriter, r *http.Request) {
 		var values = make([]SampleValue, 0)
 		for valueRows.Next() {
 			var val SampleValue
-			if err := valueRows.Scan(&val.AttributeId, &val.Value); err != nil {
+			if err := valueRows.Scan(&val.AttributeId, &val.Value, &val.Flag, &val.Censor, &val.Qualifier, &val.Uncertainty, &val.UncertaintyType, &val.SignificantFigures, &val.InstrumentId); err != nil {
 				http.Error(w, "Error reading values", http.StatusInternalServerError)
 				return
 			}
@@ -407,7 +727,8 @@ func fetchSamplesHandler(w http.ResponseWriter, r *http.Request) {
 	} else {
 		// Fetch samples related to this collection
 
-		sampleQuery := "SELECT id, created_at, note FROM samples WHERE collection_id = ?"
+		sampleQuery := "SELECT " + sampleColumns + " FROM samples WHERE collection_id = ? AND " + sampleCondition
+		sampleArgs = append(sampleArgs, sampleConditionArgs...)
 
 		// If filtering, add args
 		if before != 0 {
@@ -418,6 +739,16 @@ func fetchSamplesHandler(w http.ResponseWriter, r *http.Request) {
 			sampleQuery += " AND created_at > ?"
 			sampleArgs = append(sampleArgs, after)
 		}
+		if statusId != 0 {
+			sampleQuery += " AND " + statusExpression + " = ?"
+			sampleArgs = append(append(sampleArgs, statusArgs...), statusId)
+		}
+		if outOfSpec && asOf != nil {
+			sampleQuery += " AND EXISTS (SELECT 1 FROM sample_value_history v WHERE v.id IN (SELECT MAX(id) FROM sample_value_history WHERE sample_id = samples.id AND created_at <= ? GROUP BY attribute_id) AND v.flag = 'fail')"
+			sampleArgs = append(sampleArgs, *asOf)
+		} else if outOfSpec {
+			sampleQuery += " AND EXISTS (SELECT 1 FROM sample_attribute_values v WHERE v.sample_id = samples.id AND v.flag = 'fail')"
+		}
 
 		// If paging, add args
 		sampleQuery += " ORDER BY created_at DESC"
@@ -426,7 +757,7 @@ func fetchSamplesHandler(w http.ResponseWriter, r *http.Request) {
 			sampleArgs = append(sampleArgs, pageSize, offset)
 		}
 		// Do the query
-		sampleRows, err := DB.Query(sampleQuery, sampleArgs...)
+		sampleRows, err := DB.Query(sampleQuery, append(statusArgs, sampleArgs...)...)
 		if err != nil {
 			http.Error(w, "Failed to fetch samples", http.StatusInternalServerError)
 			log.Println("DB Fetch Error (Samples):", err)
@@ -436,14 +767,14 @@ func fetchSamplesHandler(w http.ResponseWriter, r *http.Request) {
 
 		for sampleRows.Next() {
 			var sample Sample
-			if err := sampleRows.Scan(&sample.SampleId, &sample.CreatedAt, &sample.Note); err != nil {
+			if err := sampleRows.Scan(&sample.SampleId, &sample.Identifier, &sample.CreatedAt, &sample.Note, &sample.StatusId, &sample.locationId, &sample.locationRow, &sample.locationColumn, &sample.CustodianId); err != nil {
 				http.Error(w, "Error reading samples", http.StatusInternalServerError)
 				return
 			}
 
 			// Fetch values associated with each sample
-			valueQuery := "SELECT attribute_id, value FROM sample_attribute_values WHERE sample_id = ?"
-			valueRows, err := DB.Query(valueQuery, sample.SampleId)
+			valueQuery, valueArgs := sampleValuesQuery(sample.SampleId, asOf)
+			valueRows, err := DB.Query(valueQuery, valueArgs...)
 			if err != nil {
 				http.Error(w, "Failed to fetch sample values", http.StatusInternalServerError)
 				log.Println("DB Fetch Error (Values):", err)
@@ -453,7 +784,7 @@ func fetchSamplesHandler(w http.ResponseWriter, r *http.Request) {
 			var values = make([]SampleValue, 0)
 			for valueRows.Next() {
 				var val SampleValue
-				if err := valueRows.Scan(&val.AttributeId, &val.Value); err != nil {
+				if err := valueRows.Scan(&val.AttributeId, &val.Value, &val.Flag, &val.Censor, &val.Qualifier, &val.Uncertainty, &val.UncertaintyType, &val.SignificantFigures, &val.InstrumentId); err != nil {
 					http.Error(w, "Error reading values", http.StatusInternalServerError)
 					return
 				}
@@ -472,7 +803,7 @@ func fetchSamplesHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// Count total samples for pagination metadata
-		countQuery := strings.Replace(sampleQuery, "SELECT id, created_at, note FROM", "SELECT COUNT(*) FROM", 1)
+		countQuery := strings.Replace(sampleQuery, "SELECT "+sampleColumns+" FROM", "SELECT COUNT(*) FROM", 1)
 		if strings.Contains(countQuery, " LIMIT ? OFFSET ?") {
 			countQuery = strings.TrimSuffix(countQuery, " LIMIT ? OFFSET ?")
 			sampleArgs = sampleArgs[:len(sampleArgs)-2]
@@ -485,6 +816,60 @@ func fetchSamplesHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Storage locations of the samples
+	for i := range samples {
+		if samples[i].locationId == nil {
+			continue
+		}
+		if locationPaths == nil {
+			locationPaths, err = readStorageLocationPaths()
+			if err != nil {
+				http.Error(w, "error when reading from database", http.StatusInternalServerError)
+				return
+			}
+		}
+		location := &SampleLocation{
+			LocationId: *samples[i].locationId,
+			Path:       locationPaths[*samples[i].locationId],
+			Row:        samples[i].locationRow,
+			Column:     samples[i].locationColumn,
+		}
+		if location.Row != nil && location.Column != nil {
+			position := storagePositionLabel(*location.Row, *location.Column)
+			location.Position = &position
+		}
+		samples[i].Location = location
+	}
+
+	// Convert the requested values, values that are not numbers are returned as stored
+	for i := range samples {
+		for j, val := range samples[i].Values {
+			units, ok := conversions[val.AttributeId]
+			if !ok {
+				continue
+			}
+			if converted, err := convertValueString(val.Value, units[0], units[1]); err == nil {
+				samples[i].Values[j].Value = converted
+			}
+		}
+	}
+
+	// Replicates are listed with the values they are the mean of, converted like them
+	if asOf == nil {
+		for _, attr := range attributes {
+			if attr.Replicates == nil {
+				continue
+			}
+			for i := range samples {
+				if err := addSampleReplicates(&samples[i], attributes, conversions); err != nil {
+					http.Error(w, "error when reading from database", http.StatusInternalServerError)
+					return
+				}
+			}
+			break
+		}
+	}
+
 	// Return JSON response
 	response := FetchSamplesResponse{
 		Attributes: attributes,
@@ -503,17 +888,38 @@ func fetchSamplesHandler(w http.ResponseWriter, r *http.Request) {
 
 // Attribute represents an attribute of a sample
 type Attribute struct {
-	AttributeId int    `json:"attribute_id"`
-	Name        string `json:"name"`
-	UnitId      *int   `json:"unit_id,omitempty"`
+	AttributeId int     `json:"attribute_id"`
+	Name        string  `json:"name"`
+	UnitId      *int    `json:"unit_id,omitempty"`
+	Position    int     `json:"position"`
+	Formula     *string `json:"formula,omitempty"`    // Values are calculated, not entered
+	Replicates  *int    `json:"replicates,omitempty"` // Number of replicate values per sample
+	DetectionLimits
+	Substitution *string `json:"substitution,omitempty"` // Rule for censored values in statistics, see censored.go
+	AttributeDisplay
+}
+
+// AttributeDisplay holds the hints for showing an attribute, all nullable
+type AttributeDisplay struct {
+	Group       *string `json:"group,omitempty"`       // Section label
+	Description *string `json:"description,omitempty"` // Help text
+	Decimals    *int    `json:"decimals,omitempty"`    // Decimal places
 }
 
 // Sample represents a sample entry in the response
 type Sample struct {
-	SampleId  int           `json:"sample_id"`
-	Note      string        `json:"note"`
-	CreatedAt int64         `json:"created_at"`
-	Values    []SampleValue `json:"values"`
+	SampleId    int             `json:"sample_id"`
+	Identifier  *string         `json:"identifier,omitempty"` // Nullable, from the identifier pattern of the collection
+	Note        string          `json:"note"`
+	CreatedAt   int64           `json:"created_at"`
+	StatusId    *int            `json:"status_id,omitempty"`    // Nullable, workflow state
+	Location    *SampleLocation `json:"location,omitempty"`     // Nullable, where the sample is stored
+	CustodianId *int            `json:"custodian_id,omitempty"` // Nullable, who holds the sample after the last custody transfer
+	Values      []SampleValue   `json:"values"`
+
+	locationId     *int
+	locationRow    *int
+	locationColumn *int
 }
 
 // FetchSamplesResponse represents the full response
@@ -542,13 +948,29 @@ Body:
 		values: [
 			{
 				attribute_id: int,
-				value: string
+				value: string, // May be censored, see POST sample-values
+				censor?: string,
+				qualifier?: string,
+				uncertainty?: string, // See POST sample-values
+				uncertainty_type?: string,
+				significant_figures?: int,
+				instrument_id?: int, // Checked like in POST sample-values
+				unit_id?: int // Unit of the value, converted to the unit of the attribute
 			}
 			...
 		]
 	}
+
+Result:
+
+	{
+		id: int,
+		warnings?: [string] // e.g. calibrations of instruments that are overdue
+	}
 */
 func insertSampleHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(User)
+
 	// Parse JSON request
 	var sample InsertSampleBody
 	if err := json.NewDecoder(r.Body).Decode(&sample); err != nil {
@@ -577,8 +999,23 @@ func insertSampleHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Samples cannot be added to a collection in the trash
+	var exists bool
+	err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM collections WHERE id = ? AND deleted_at IS NULL)", sample.CollectionId).Scan(&exists)
+	if err != nil || !exists {
+		tx.Rollback()
+		if err != nil {
+			http.Error(w, "error inserting to database", http.StatusInternalServerError)
+			return
+		}
+		http.Error(w, "collection not found", http.StatusNotFound)
+		return
+	}
+
 	// Attempt insert of sample
-	result, err := tx.Exec("INSERT INTO samples (collection_id, created_at, note) VALUES (?, ?, ?)", sample.CollectionId, sample.CreatedAt, *sample.Note)
+	// New samples start in the initial workflow state of the collection, if any
+	query := "INSERT INTO samples (collection_id, created_at, inserted_at, note, status_id) VALUES (?, ?, ?, ?, (SELECT id FROM workflow_states WHERE collection_id = ? AND is_initial = 1))"
+	result, err := tx.Exec(query, sample.CollectionId, sample.CreatedAt, time.Now().Unix(), *sample.Note, sample.CollectionId)
 	if err != nil {
 		if rollbackErr := tx.Rollback(); rollbackErr != nil {
 			http.Error(w, "error inserting to database", http.StatusInternalServerError)
@@ -602,14 +1039,128 @@ func insertSampleHandler(w http.ResponseWriter, r *http.Request) {
 	_id := int(sample_id)
 	sample.SampleId = &_id
 
+	// Take the next identifier of the collection, in this transaction so the sequence has no gaps
+	sample.Identifier, err = assignSampleIdentifier(tx, _id)
+	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			http.Error(w, "error inserting to database", http.StatusInternalServerError)
+			log.Panic(err, rollbackErr)
+			return
+		}
+		if _, ok := err.(identifierInUseError); ok {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		http.Error(w, "error inserting to database", http.StatusInternalServerError)
+		return
+	}
+
+	// Values that failed their specification, users are notified once the sample is saved
+	var outOfSpec []SampleValue
+	// Values from instruments with overdue calibrations are saved with a warning
+	var warnings []string
 	if len(sample.Values) != 0 {
 		// Generate insert query and array of values
-		query := "INSERT INTO sample_attribute_values (sample_id, attribute_id, value) VALUES "
+		query := "INSERT INTO sample_attribute_values (sample_id, attribute_id, value, flag, censor, qualifier, uncertainty, uncertainty_type, significant_figures, instrument_id) VALUES "
 		vals := []interface{}{}
 
-		for _, row := range sample.Values {
-			query += "(?, ?, ?),"
-			vals = append(vals, *sample.SampleId, row.AttributeId, row.Value)
+		for i, row := range sample.Values {
+			// Values can only be given for attributes of the collection that are not in the trash,
+			// not calculated and do not take replicates
+			var valid bool
+			err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM sample_attributes WHERE id = ? AND collection_id = ? AND deleted_at IS NULL AND formula IS NULL AND replicates IS NULL)", row.AttributeId, sample.CollectionId).Scan(&valid)
+			if err != nil || !valid {
+				if rollbackErr := tx.Rollback(); rollbackErr != nil {
+					http.Error(w, "error inserting to database", http.StatusInternalServerError)
+					log.Panic(err, rollbackErr)
+					return
+				}
+				if err != nil {
+					http.Error(w, "error inserting to database", http.StatusInternalServerError)
+					return
+				}
+				http.Error(w, fmt.Sprintf("attribute %d is not part of the collection, is calculated or takes replicates", row.AttributeId), http.StatusBadRequest)
+				return
+			}
+
+			// Censored values are stored as the number they are censored at
+			censor := ""
+			if row.Censor != nil {
+				censor = *row.Censor
+			}
+			status := http.StatusBadRequest
+			row.Value, row.Censor, err = parseCensoredValue(tx, row.AttributeId, row.Value, censor)
+			if err == nil && row.Qualifier != nil {
+				status, err = checkQualifierCode(tx, *row.Qualifier)
+			}
+			if err == nil {
+				err = row.MeasurementPrecision.normalize()
+			}
+			if err == nil && row.InstrumentId != nil {
+				var warning string
+				warning, status, err = checkInstrument(tx, *row.InstrumentId)
+				if warning != "" {
+					warnings = append(warnings, warning)
+				}
+			}
+			if err != nil {
+				if rollbackErr := tx.Rollback(); rollbackErr != nil {
+					http.Error(w, "error inserting to database", http.StatusInternalServerError)
+					log.Panic(err, rollbackErr)
+					return
+				}
+				http.Error(w, err.Error(), status)
+				return
+			}
+			sample.Values[i] = row
+
+			// Convert values sent in another unit than the one of the attribute
+			if row.UnitId != nil {
+				converted, err := convertToAttributeUnit(tx, row.AttributeId, *row.UnitId, row.Value)
+				if err == nil {
+					row.MeasurementPrecision, err = convertUncertaintyToAttributeUnit(tx, row.AttributeId, *row.UnitId, row.MeasurementPrecision)
+				}
+				if err != nil {
+					if rollbackErr := tx.Rollback(); rollbackErr != nil {
+						http.Error(w, "error inserting to database", http.StatusInternalServerError)
+						log.Panic(err, rollbackErr)
+						return
+					}
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				row.Value = converted
+				row.UnitId = nil
+				sample.Values[i] = row
+			}
+			row.Value, err = applySignificantFigures(row.Value, row.SignificantFigures)
+			if err != nil {
+				if rollbackErr := tx.Rollback(); rollbackErr != nil {
+					http.Error(w, "error inserting to database", http.StatusInternalServerError)
+					log.Panic(err, rollbackErr)
+					return
+				}
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			sample.Values[i] = row
+
+			// Evaluate against the specification limits
+			flag, err := evaluateValueFlag(tx, *sample.SampleId, row.AttributeId, row.Value, row.Censor)
+			if err != nil {
+				if rollbackErr := tx.Rollback(); rollbackErr != nil {
+					http.Error(w, "error inserting to database", http.StatusInternalServerError)
+					log.Panic(err, rollbackErr)
+					return
+				}
+				http.Error(w, "error inserting to database", http.StatusInternalServerError)
+				return
+			}
+			if flag != nil && *flag == flagFail {
+				outOfSpec = append(outOfSpec, row)
+			}
+			query += "(?, ?, ?, ?, ?, ?, ?, ?, ?, ?),"
+			vals = append(vals, *sample.SampleId, row.AttributeId, row.Value, flag, row.Censor, row.Qualifier, row.Uncertainty, row.UncertaintyType, row.SignificantFigures, row.InstrumentId)
 		}
 		query = strings.TrimSuffix(query, ",")
 
@@ -628,6 +1179,31 @@ func insertSampleHandler(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "error inserting to database", http.StatusInternalServerError)
 			return
 		}
+
+		// Keep the first version of each value
+		for i := 0; i < len(vals); i += 10 {
+			value := vals[i+2].(string)
+			if err = recordValueVersion(tx, *sample.SampleId, vals[i+1].(int), &value, vals[i+3].(*string), &user.Id); err != nil {
+				if rollbackErr := tx.Rollback(); rollbackErr != nil {
+					http.Error(w, "error inserting to database", http.StatusInternalServerError)
+					log.Panic(err, rollbackErr)
+					return
+				}
+				http.Error(w, "error inserting to database", http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	// Calculate the values of calculated attributes
+	if err = recomputeSampleFormulas(tx, *sample.SampleId); err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			http.Error(w, "error inserting to database", http.StatusInternalServerError)
+			log.Panic(err, rollbackErr)
+			return
+		}
+		http.Error(w, "error when calculating values", http.StatusInternalServerError)
+		return
 	}
 
 	// Commit the insert
@@ -636,15 +1212,24 @@ func insertSampleHandler(w http.ResponseWriter, r *http.Request) {
 		log.Panic(err)
 		return
 	}
+	emitWebhookEvent(sample.CollectionId, "sample.created", sample)
+	for _, row := range outOfSpec {
+		notifyValueOutOfSpec(user.Id, *sample.SampleId, row.AttributeId, row.Value, row.Censor)
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
+	if len(warnings) > 0 {
+		json.NewEncoder(w).Encode(map[string]any{"id": sample_id, "warnings": warnings})
+		return
+	}
 	fmt.Fprintf(w, "{\"id\":  %d}", sample_id)
 }
 
 // Sample represents a sample entry in the database
 type InsertSampleBody struct {
 	SampleId     *int          `json:"sample_id,omitempty"`
+	Identifier   *string       `json:"identifier,omitempty"` // Set on insert from the identifier pattern
 	CollectionId int           `json:"collection_id,omitempty"`
 	CreatedAt    int64         `json:"created_at,omitempty"` // UNIX timestamp
 	Note         *string       `json:"note,omitempty"`
@@ -652,6 +1237,67 @@ type InsertSampleBody struct {
 }
 
 type SampleValue struct {
-	AttributeId int    `json:"attribute_id"`
-	Value       string `json:"value"`
+	AttributeId int     `json:"attribute_id"`
+	Value       string  `json:"value"`
+	Flag        *string `json:"flag,omitempty"`      // Nullable, set by the specification limits
+	Censor      *string `json:"censor,omitempty"`    // Nullable, "<", ">", "≤" or "≥", the value is the number it is censored at
+	Qualifier   *string `json:"qualifier,omitempty"` // Nullable, one of the qualifier codes
+	UnitId      *int    `json:"unit_id,omitempty"`   // Only on insert, unit the value is given in
+	MeasurementPrecision
+	InstrumentId *int `json:"instrument_id,omitempty"` // Nullable, the instrument that produced the value
+
+	// Only for attributes that take replicates, the value is their mean
+	Replicates []Replicate          `json:"replicates,omitempty"`
+	Aggregates *ReplicateAggregates `json:"aggregates,omitempty"`
+}
+
+// Returns the attributes of a collection in display order
+func readCollectionAttributes(collectionId int) ([]Attribute, error) {
+	return readCollectionAttributesAt(collectionId, nil)
+}
+
+// Reads the attributes a collection had at asOf, or has now if asOf is nil
+func readCollectionAttributesAt(collectionId int, asOf *int64) ([]Attribute, error) {
+	condition, args := existedAtCondition("", asOf)
+	query := `
+		SELECT id, name, unit_id, position, group_label, description, decimals, formula, replicates, lod, loq, uloq, substitution
+		FROM sample_attributes
+		WHERE collection_id = ? AND ` + condition + `
+		ORDER BY position, id
+	`
+	rows, err := DB.Query(query, append([]any{collectionId}, args...)...)
+	if err != nil {
+		return nil, fmt.Errorf("readCollectionAttributes: %v", err)
+	}
+	defer rows.Close()
+
+	var attributes = make([]Attribute, 0)
+	for rows.Next() {
+		var attr = Attribute{}
+		if err := rows.Scan(&attr.AttributeId, &attr.Name, &attr.UnitId, &attr.Position, &attr.Group, &attr.Description, &attr.Decimals, &attr.Formula, &attr.Replicates, &attr.LOD, &attr.LOQ, &attr.ULOQ, &attr.Substitution); err != nil {
+			return nil, fmt.Errorf("readCollectionAttributes: %v", err)
+		}
+		attributes = append(attributes, attr)
+	}
+	return attributes, rows.Err()
+}
+
+// Returns the id of the collection a sample belongs to
+func readSampleCollectionId(sampleId int) (int, error) {
+	var collectionId int
+	err := DB.QueryRow("SELECT collection_id FROM samples WHERE id = ?", sampleId).Scan(&collectionId)
+	if err != nil {
+		return 0, fmt.Errorf("readSampleCollectionId: %v", err)
+	}
+	return collectionId, nil
+}
+
+// Notifies the webhooks of the sample's collection that one of its values changed
+func emitSampleValueEvent(sampleId int, attributeId int, value string) {
+	collectionId, err := readSampleCollectionId(sampleId)
+	if err != nil {
+		log.Println("failed to emit value event:", err)
+		return
+	}
+	emitWebhookEvent(collectionId, "value.updated", map[string]any{"sample_id": sampleId, "attribute_id": attributeId, "value": value})
 }
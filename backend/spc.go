@@ -0,0 +1,328 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+/*
+Gets control chart data for a numeric attribute. The center line and
+standard deviation come from the values in the baseline period, which
+defaults to the whole series. Every point is annotated with the Westgard
+and Nelson rules it violates.
+
+Query params:
+
+	attribute_id: int,
+	before: int, // UNIX timestamp in seconds
+	after: int, // UNIX timestamp in seconds
+	baseline_before: int, // UNIX timestamp in seconds
+	baseline_after: int, // UNIX timestamp in seconds
+	substitution?: string // Overrides how censored values enter: "half", "sqrt2", "limit", "zero" or "exclude"
+
+Result:
+
+	{
+		attribute_id: int,
+		center: float,
+		sd: float,
+		limits: {
+			lower_1s: float, upper_1s: float,
+			lower_2s: float, upper_2s: float,
+			lower_3s: float, upper_3s: float
+		},
+		baseline_count: int,
+		points: [
+			{
+				sample_id: int,
+				created_at: int,
+				value: float, // The substituted number for censored values
+				censor: string, // Omitted if the value is not censored
+				z: float, // Distance from the center line in standard deviations
+				violations: [string] // e.g. "1-3s", "2-2s", "nelson-3"
+			}
+			...
+		]
+	}
+*/
+func fetchControlChartHandler(w http.ResponseWriter, r *http.Request) {
+	attributeId, err := strconv.Atoi(r.FormValue("attribute_id"))
+	if err != nil || attributeId < 1 {
+		http.Error(w, "attribute_id must be a positive int", http.StatusBadRequest)
+		return
+	}
+
+	before, after, err := parseTimeWindow(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The baseline window uses the same semantics as before and after
+	var baselineBefore, baselineAfter int64
+	if _baselineBefore := r.FormValue("baseline_before"); _baselineBefore != "" {
+		baselineBefore, err = strconv.ParseInt(_baselineBefore, 10, 64)
+		if err != nil || baselineBefore <= 0 {
+			http.Error(w, "baseline_before must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+	if _baselineAfter := r.FormValue("baseline_after"); _baselineAfter != "" {
+		baselineAfter, err = strconv.ParseInt(_baselineAfter, 10, 64)
+		if err != nil || baselineAfter <= 0 {
+			http.Error(w, "baseline_after must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+
+	substitution, err := parseSubstitution(r.FormValue("substitution"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var collectionId int
+	var rule *string
+	err = DB.QueryRow("SELECT collection_id, substitution FROM sample_attributes WHERE id = ? AND deleted_at IS NULL", attributeId).Scan(&collectionId, &rule)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "attribute not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	if substitution != nil {
+		rule = substitution
+	}
+
+	// Read the whole series, the baseline may lie outside the charted window
+	query := `
+		SELECT s.id, s.created_at, v.value, v.censor
+		FROM samples s
+		JOIN sample_attribute_values v ON v.sample_id = s.id
+		WHERE s.collection_id = ? AND v.attribute_id = ? AND s.deleted_at IS NULL
+		ORDER BY s.created_at, s.id
+	`
+	rows, err := DB.Query(query, collectionId, attributeId)
+	if err != nil {
+		http.Error(w, "Failed to fetch sample values", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var series []ControlChartPoint
+	for rows.Next() {
+		var point ControlChartPoint
+		var value *string
+		if err := rows.Scan(&point.SampleId, &point.CreatedAt, &value, &point.Censor); err != nil {
+			http.Error(w, "Error reading values", http.StatusInternalServerError)
+			return
+		}
+		if value == nil {
+			continue
+		}
+		number, ok := parseFiniteNumber(*value)
+		if !ok {
+			continue
+		}
+		if point.Value, ok = substituteCensored(number, point.Censor, rule); !ok {
+			continue
+		}
+		series = append(series, point)
+	}
+	if err = rows.Err(); err != nil {
+		http.Error(w, "Error iterating sample rows", http.StatusInternalServerError)
+		return
+	}
+
+	var baseline []float64
+	for _, point := range series {
+		if baselineBefore != 0 && point.CreatedAt >= baselineBefore {
+			continue
+		}
+		if baselineAfter != 0 && point.CreatedAt <= baselineAfter {
+			continue
+		}
+		baseline = append(baseline, point.Value)
+	}
+	if len(baseline) < 2 {
+		http.Error(w, "baseline needs at least two numeric values", http.StatusUnprocessableEntity)
+		return
+	}
+
+	chart := ControlChart{
+		AttributeId:   attributeId,
+		Center:        mean(baseline),
+		SD:            standardDeviation(baseline),
+		BaselineCount: len(baseline),
+		Points:        []ControlChartPoint{},
+	}
+	chart.Limits = ControlLimits{
+		Lower1s: chart.Center - chart.SD, Upper1s: chart.Center + chart.SD,
+		Lower2s: chart.Center - 2*chart.SD, Upper2s: chart.Center + 2*chart.SD,
+		Lower3s: chart.Center - 3*chart.SD, Upper3s: chart.Center + 3*chart.SD,
+	}
+
+	// Rules look back over earlier points, so evaluate the whole series before windowing
+	for i := range series {
+		if chart.SD > 0 {
+			series[i].Z = (series[i].Value - chart.Center) / chart.SD
+		}
+	}
+	for i := range series {
+		series[i].Violations = evaluateControlRules(series, i)
+	}
+	for _, point := range series {
+		if before != 0 && point.CreatedAt >= int64(before) {
+			continue
+		}
+		if after != 0 && point.CreatedAt <= int64(after) {
+			continue
+		}
+		chart.Points = append(chart.Points, point)
+	}
+
+	result, err := json.Marshal(chart)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintln(w, string(result))
+}
+
+// ControlChart is the result of fetchControlChartHandler
+type ControlChart struct {
+	AttributeId   int                 `json:"attribute_id"`
+	Center        float64             `json:"center"`
+	SD            float64             `json:"sd"`
+	Limits        ControlLimits       `json:"limits"`
+	BaselineCount int                 `json:"baseline_count"`
+	Points        []ControlChartPoint `json:"points"`
+}
+
+type ControlLimits struct {
+	Lower1s float64 `json:"lower_1s"`
+	Upper1s float64 `json:"upper_1s"`
+	Lower2s float64 `json:"lower_2s"`
+	Upper2s float64 `json:"upper_2s"`
+	Lower3s float64 `json:"lower_3s"`
+	Upper3s float64 `json:"upper_3s"`
+}
+
+type ControlChartPoint struct {
+	SampleId   int      `json:"sample_id"`
+	CreatedAt  int64    `json:"created_at"`
+	Value      float64  `json:"value"`
+	Censor     *string  `json:"censor,omitempty"`
+	Z          float64  `json:"z"`
+	Violations []string `json:"violations"`
+}
+
+// Returns the Westgard and Nelson rules violated by the i'th point of a series.
+// A rule is reported on the point that completes the violating run.
+func evaluateControlRules(series []ControlChartPoint, i int) []string {
+	violations := []string{}
+	z := func(back int) float64 { return series[i-back].Z }
+	// Whether the last n points (including this one) all satisfy the check
+	run := func(n int, check func(z float64) bool) bool {
+		if i+1 < n {
+			return false
+		}
+		for back := 0; back < n; back++ {
+			if !check(z(back)) {
+				return false
+			}
+		}
+		return true
+	}
+	// Whether at least m of the last n points satisfy the check, on one side of the center
+	mOfN := func(m int, n int, limit float64) bool {
+		if i+1 < n {
+			return false
+		}
+		above, below := 0, 0
+		for back := 0; back < n; back++ {
+			if z(back) > limit {
+				above++
+			} else if z(back) < -limit {
+				below++
+			}
+		}
+		return above >= m || below >= m
+	}
+	above := func(limit float64) func(z float64) bool { return func(z float64) bool { return z > limit } }
+	below := func(limit float64) func(z float64) bool { return func(z float64) bool { return z < -limit } }
+
+	// Westgard rules
+	if math.Abs(z(0)) > 3 {
+		violations = append(violations, "1-3s")
+	}
+	if run(2, above(2)) || run(2, below(2)) {
+		violations = append(violations, "2-2s")
+	}
+	if i >= 1 && ((z(0) > 2 && z(1) < -2) || (z(0) < -2 && z(1) > 2)) {
+		violations = append(violations, "R-4s")
+	}
+	if run(4, above(1)) || run(4, below(1)) {
+		violations = append(violations, "4-1s")
+	}
+	if run(10, above(0)) || run(10, below(0)) {
+		violations = append(violations, "10x")
+	}
+
+	// Nelson rules
+	if math.Abs(z(0)) > 3 {
+		violations = append(violations, "nelson-1")
+	}
+	if run(9, above(0)) || run(9, below(0)) {
+		violations = append(violations, "nelson-2")
+	}
+	if i >= 5 {
+		increasing, decreasing := true, true
+		for back := 0; back < 5; back++ {
+			if series[i-back].Value <= series[i-back-1].Value {
+				increasing = false
+			}
+			if series[i-back].Value >= series[i-back-1].Value {
+				decreasing = false
+			}
+		}
+		if increasing || decreasing {
+			violations = append(violations, "nelson-3")
+		}
+	}
+	if i >= 13 {
+		alternating := true
+		for back := 0; back < 12; back++ {
+			d1 := series[i-back].Value - series[i-back-1].Value
+			d2 := series[i-back-1].Value - series[i-back-2].Value
+			if d1*d2 >= 0 {
+				alternating = false
+				break
+			}
+		}
+		if alternating {
+			violations = append(violations, "nelson-4")
+		}
+	}
+	if mOfN(2, 3, 2) {
+		violations = append(violations, "nelson-5")
+	}
+	if mOfN(4, 5, 1) {
+		violations = append(violations, "nelson-6")
+	}
+	if run(15, func(z float64) bool { return math.Abs(z) < 1 }) {
+		violations = append(violations, "nelson-7")
+	}
+	if run(8, func(z float64) bool { return math.Abs(z) > 1 }) && !run(8, above(1)) && !run(8, below(1)) {
+		violations = append(violations, "nelson-8")
+	}
+	return violations
+}
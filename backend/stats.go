@@ -0,0 +1,360 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Percentiles reported when the request does not ask for specific ones
+var defaultPercentiles = []float64{5, 25, 75, 95}
+
+/*
+Gets summary statistics for every numeric attribute of a collection.
+An attribute is numeric when at least one of its values is a number,
+values that are not numbers are ignored.
+
+Query params:
+
+	collection_id: int,
+	before: int, // UNIX timestamp in seconds
+	after: int, // UNIX timestamp in seconds
+	group_by: string, // "day", "week" or "month" (UTC), not grouped if not set
+	percentiles: string, // Comma separated, e.g. "5,25,75,95" (default)
+	substitution?: string // Overrides how censored values enter: "half", "sqrt2", "limit", "zero" or "exclude"
+
+Result:
+
+	{
+		collection_id: int,
+		group_by: string,
+		groups: [
+			{
+				period_start: int, // UNIX timestamp, omitted if not grouped
+				attributes: [
+					{
+						attribute_id: int,
+						name: string,
+						unit_id: int,
+						count: int,
+						censored: int, // Censored values, substituted or left out
+						mean: float,
+						sd: float, // Sample standard deviation, omitted if count < 2
+						min: float,
+						max: float,
+						median: float,
+						percentiles: { "5": float, ... }
+					}
+					...
+				]
+			}
+			...
+		]
+	}
+*/
+func fetchStatsHandler(w http.ResponseWriter, r *http.Request) {
+	collectionId, err := strconv.Atoi(r.FormValue("collection_id"))
+	if err != nil || collectionId < 1 {
+		http.Error(w, "collection_id must be a positive int", http.StatusBadRequest)
+		return
+	}
+
+	before, after, err := parseTimeWindow(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	groupBy := r.FormValue("group_by")
+	if groupBy != "" && groupBy != "day" && groupBy != "week" && groupBy != "month" {
+		http.Error(w, "group_by must be one of: day, week, month", http.StatusBadRequest)
+		return
+	}
+
+	percentiles := defaultPercentiles
+	if _percentiles := r.FormValue("percentiles"); _percentiles != "" {
+		percentiles = nil
+		for _, _p := range strings.Split(_percentiles, ",") {
+			p, err := strconv.ParseFloat(strings.TrimSpace(_p), 64)
+			if err != nil || p < 0 || p > 100 {
+				http.Error(w, "percentiles must be numbers between 0 and 100", http.StatusBadRequest)
+				return
+			}
+			percentiles = append(percentiles, p)
+		}
+	}
+
+	substitution, err := parseSubstitution(r.FormValue("substitution"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Check if collectionId is valid
+	var exists bool
+	err = DB.QueryRow("SELECT EXISTS(SELECT 1 FROM collections WHERE id = ? AND deleted_at IS NULL)", collectionId).Scan(&exists)
+	if err != nil {
+		log.Println("DB error:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Collection not found", http.StatusNotFound)
+		return
+	}
+
+	// Fetch attributes related to this collection
+	attributes, err := readCollectionAttributes(collectionId)
+	if err != nil {
+		http.Error(w, "Failed to fetch attributes", http.StatusInternalServerError)
+		return
+	}
+	rules := make(map[int]*string)
+	for _, attr := range attributes {
+		rules[attr.AttributeId] = attr.Substitution
+		if substitution != nil {
+			rules[attr.AttributeId] = substitution
+		}
+	}
+
+	// Fetch every value in the time window
+	query := `
+		SELECT s.created_at, v.attribute_id, v.value, v.censor
+		FROM samples s
+		JOIN sample_attribute_values v ON v.sample_id = s.id
+		WHERE s.collection_id = ? AND s.deleted_at IS NULL
+	`
+	args := []interface{}{collectionId}
+	if before != 0 {
+		query += " AND s.created_at < ?"
+		args = append(args, before)
+	}
+	if after != 0 {
+		query += " AND s.created_at > ?"
+		args = append(args, after)
+	}
+	rows, err := DB.Query(query, args...)
+	if err != nil {
+		http.Error(w, "Failed to fetch sample values", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	// Numbers per period per attribute
+	grouped := make(map[int64]map[int][]float64)
+	censored := make(map[int64]map[int]int)
+	for rows.Next() {
+		var createdAt int64
+		var attributeId int
+		var value, censor *string
+		if err := rows.Scan(&createdAt, &attributeId, &value, &censor); err != nil {
+			http.Error(w, "Error reading values", http.StatusInternalServerError)
+			return
+		}
+		if value == nil {
+			continue
+		}
+		number, ok := parseFiniteNumber(*value)
+		if !ok {
+			continue
+		}
+
+		period := periodStart(createdAt, groupBy)
+		if grouped[period] == nil {
+			grouped[period] = make(map[int][]float64)
+			censored[period] = make(map[int]int)
+		}
+		if censor != nil {
+			censored[period][attributeId]++
+		}
+		number, ok = substituteCensored(number, censor, rules[attributeId])
+		if !ok {
+			continue
+		}
+		grouped[period][attributeId] = append(grouped[period][attributeId], number)
+	}
+	if err = rows.Err(); err != nil {
+		http.Error(w, "Error iterating sample rows", http.StatusInternalServerError)
+		return
+	}
+
+	periods := make([]int64, 0, len(grouped))
+	for period := range grouped {
+		periods = append(periods, period)
+	}
+	sort.Slice(periods, func(i, j int) bool { return periods[i] < periods[j] })
+
+	response := StatsResponse{
+		CollectionId: collectionId,
+		GroupBy:      groupBy,
+		Groups:       []StatsGroup{},
+	}
+	for _, period := range periods {
+		group := StatsGroup{Attributes: []AttributeStats{}}
+		if groupBy != "" {
+			start := period
+			group.PeriodStart = &start
+		}
+		for _, attr := range attributes {
+			numbers := grouped[period][attr.AttributeId]
+			if len(numbers) == 0 {
+				continue
+			}
+			group.Attributes = append(group.Attributes, AttributeStats{
+				AttributeId: attr.AttributeId,
+				Name:        attr.Name,
+				UnitId:      attr.UnitId,
+				Censored:    censored[period][attr.AttributeId],
+				Summary:     summarize(numbers, percentiles),
+			})
+		}
+		response.Groups = append(response.Groups, group)
+	}
+
+	result, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintln(w, string(result))
+}
+
+// StatsResponse is the result of fetchStatsHandler
+type StatsResponse struct {
+	CollectionId int          `json:"collection_id"`
+	GroupBy      string       `json:"group_by,omitempty"`
+	Groups       []StatsGroup `json:"groups"`
+}
+
+type StatsGroup struct {
+	PeriodStart *int64           `json:"period_start,omitempty"` // UNIX timestamp
+	Attributes  []AttributeStats `json:"attributes"`
+}
+
+type AttributeStats struct {
+	AttributeId int    `json:"attribute_id"`
+	Name        string `json:"name"`
+	UnitId      *int   `json:"unit_id,omitempty"`
+	Censored    int    `json:"censored,omitempty"`
+	Summary
+}
+
+// Summary holds the descriptive statistics of a set of numbers
+type Summary struct {
+	Count       int                `json:"count"`
+	Mean        float64            `json:"mean"`
+	SD          *float64           `json:"sd,omitempty"` // Nil with less than two numbers
+	Min         float64            `json:"min"`
+	Max         float64            `json:"max"`
+	Median      float64            `json:"median"`
+	Percentiles map[string]float64 `json:"percentiles,omitempty"`
+}
+
+// Computes the summary statistics of a non-empty set of numbers
+func summarize(numbers []float64, percentiles []float64) Summary {
+	sorted := append([]float64(nil), numbers...)
+	sort.Float64s(sorted)
+
+	summary := Summary{
+		Count:  len(sorted),
+		Mean:   mean(sorted),
+		Min:    sorted[0],
+		Max:    sorted[len(sorted)-1],
+		Median: percentile(sorted, 50),
+	}
+	if len(sorted) > 1 {
+		sd := standardDeviation(sorted)
+		summary.SD = &sd
+	}
+	if len(percentiles) > 0 {
+		summary.Percentiles = make(map[string]float64, len(percentiles))
+		for _, p := range percentiles {
+			summary.Percentiles[strconv.FormatFloat(p, 'f', -1, 64)] = percentile(sorted, p)
+		}
+	}
+	return summary
+}
+
+// Parses a number that statistics can use, leaving out NaN and infinities,
+// which ParseFloat accepts
+func parseFiniteNumber(value string) (float64, bool) {
+	number, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || math.IsNaN(number) || math.IsInf(number, 0) {
+		return 0, false
+	}
+	return number, true
+}
+
+func mean(numbers []float64) float64 {
+	sum := 0.0
+	for _, n := range numbers {
+		sum += n
+	}
+	return sum / float64(len(numbers))
+}
+
+// Sample standard deviation (n - 1 in the denominator)
+func standardDeviation(numbers []float64) float64 {
+	if len(numbers) < 2 {
+		return 0
+	}
+	m := mean(numbers)
+	sum := 0.0
+	for _, n := range numbers {
+		sum += (n - m) * (n - m)
+	}
+	return math.Sqrt(sum / float64(len(numbers)-1))
+}
+
+// Returns the p'th percentile of sorted numbers, interpolating linearly between closest ranks
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 1 {
+		return sorted[0]
+	}
+	rank := p / 100 * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	return sorted[lower] + (rank-float64(lower))*(sorted[upper]-sorted[lower])
+}
+
+// Returns the UNIX time of the start (UTC) of the day, week (monday) or month containing t.
+// Without a grouping every time belongs to the same period.
+func periodStart(t int64, groupBy string) int64 {
+	date := time.Unix(t, 0).UTC()
+	switch groupBy {
+	case "day":
+		return time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC).Unix()
+	case "week":
+		daysSinceMonday := (int(date.Weekday()) + 6) % 7
+		return time.Date(date.Year(), date.Month(), date.Day()-daysSinceMonday, 0, 0, 0, 0, time.UTC).Unix()
+	case "month":
+		return time.Date(date.Year(), date.Month(), 1, 0, 0, 0, 0, time.UTC).Unix()
+	}
+	return 0
+}
+
+// Parses the before and after query params used to filter samples by created_at.
+// Zero means the bound is not set.
+func parseTimeWindow(r *http.Request) (before int, after int, err error) {
+	if _before := r.FormValue("before"); _before != "" {
+		before, err = strconv.Atoi(_before)
+		if err != nil || before <= 0 {
+			return 0, 0, fmt.Errorf("before must be a positive integer")
+		}
+	}
+	if _after := r.FormValue("after"); _after != "" {
+		after, err = strconv.Atoi(_after)
+		if err != nil || after <= 0 {
+			return 0, 0, fmt.Errorf("after must be a positive integer")
+		}
+	}
+	return before, after, nil
+}
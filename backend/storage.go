@@ -0,0 +1,932 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kinds of storage locations from the outermost in. A location can only be
+// inside a location of an earlier kind, levels may be skipped.
+var storageKinds = []string{"site", "freezer", "shelf", "rack", "box"}
+
+// Largest number of rows or columns of a storage grid
+const maxStorageGridSize = 100
+
+// Most free slots returned at once
+const maxFreeSlots = 1000
+
+/*
+Gets storage locations. Without params the top level locations are returned.
+
+Query params:
+
+	location_id?: int, // Only this location
+	parent_id?: int // The locations directly inside this one
+
+Result:
+
+	[{
+		id: int,
+		parent_id: int, // Omitted for top level locations
+		name: string,
+		kind: string,
+		path: string, // e.g. "Lab 1 / Freezer A / Box 3"
+		rows: int, // Omitted if samples are not stored in a grid
+		columns: int,
+		capacity: int, // Most samples, omitted if unlimited
+		samples: int, // Samples stored directly in the location
+		children: int // Locations directly inside this one
+	}]
+*/
+func fetchStorageLocationsHandler(w http.ResponseWriter, r *http.Request) {
+	query := `
+		SELECT l.id, l.parent_id, l.name, l.kind, l.grid_rows, l.grid_columns, l.capacity,
+			(SELECT COUNT(*) FROM samples s WHERE s.location_id = l.id),
+			(SELECT COUNT(*) FROM storage_locations c WHERE c.parent_id = l.id)
+		FROM storage_locations l
+	`
+	var args []any
+	switch {
+	case r.FormValue("location_id") != "":
+		id, err := strconv.Atoi(r.FormValue("location_id"))
+		if err != nil {
+			http.Error(w, "location_id must be a positive int", http.StatusBadRequest)
+			return
+		}
+		query += " WHERE l.id = ?"
+		args = append(args, id)
+	case r.FormValue("parent_id") != "":
+		id, err := strconv.Atoi(r.FormValue("parent_id"))
+		if err != nil {
+			http.Error(w, "parent_id must be a positive int", http.StatusBadRequest)
+			return
+		}
+		query += " WHERE l.parent_id = ?"
+		args = append(args, id)
+	default:
+		query += " WHERE l.parent_id IS NULL"
+	}
+	query += " ORDER BY l.name, l.id"
+
+	paths, err := readStorageLocationPaths()
+	if err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	rows, err := DB.Query(query, args...)
+	if err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	locations := []StorageLocation{}
+	for rows.Next() {
+		var location StorageLocation
+		if err := rows.Scan(&location.Id, &location.ParentId, &location.Name, &location.Kind, &location.Rows, &location.Columns, &location.Capacity, &location.Samples, &location.Children); err != nil {
+			http.Error(w, "error when reading from database", http.StatusInternalServerError)
+			return
+		}
+		location.Path = paths[location.Id]
+		locations = append(locations, location)
+	}
+	if err = rows.Err(); err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(locations)
+}
+
+/*
+Creates a storage location. Samples are stored in a grid of positions if
+rows and columns are given, e.g. a 9x9 box, otherwise capacity optionally
+limits how many samples the location holds.
+
+Query params:
+
+	parent_id?: int, // Location it is inside, top level if not set
+	name: string,
+	kind: string, // "site", "freezer", "shelf", "rack" or "box"
+	rows?: int,
+	columns?: int,
+	capacity?: int
+*/
+func insertStorageLocationHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	kind := r.FormValue("kind")
+	depth := storageKindDepth(kind)
+	if depth < 0 {
+		http.Error(w, "kind must be one of: "+strings.Join(storageKinds, ", "), http.StatusBadRequest)
+		return
+	}
+
+	var parentId *int
+	if _parentId := r.FormValue("parent_id"); _parentId != "" {
+		id, err := strconv.Atoi(_parentId)
+		if err != nil {
+			http.Error(w, "parent_id must be a positive int", http.StatusBadRequest)
+			return
+		}
+		var parentKind string
+		err = DB.QueryRow("SELECT kind FROM storage_locations WHERE id = ?", id).Scan(&parentKind)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "parent location not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, "error when reading from database", http.StatusInternalServerError)
+			return
+		}
+		if storageKindDepth(parentKind) >= depth {
+			http.Error(w, fmt.Sprintf("a %s cannot be inside a %s", kind, parentKind), http.StatusBadRequest)
+			return
+		}
+		parentId = &id
+	}
+
+	var gridRows, gridColumns, capacity *int
+	for _, param := range []struct {
+		name  string
+		value **int
+		max   int
+	}{{"rows", &gridRows, maxStorageGridSize}, {"columns", &gridColumns, maxStorageGridSize}, {"capacity", &capacity, 1000000}} {
+		_value := r.FormValue(param.name)
+		if _value == "" {
+			continue
+		}
+		value, err := strconv.Atoi(_value)
+		if err != nil || value < 1 || value > param.max {
+			http.Error(w, fmt.Sprintf("%s must be an int from 1 to %d", param.name, param.max), http.StatusBadRequest)
+			return
+		}
+		*param.value = &value
+	}
+	if (gridRows == nil) != (gridColumns == nil) {
+		http.Error(w, "rows and columns must be given together", http.StatusBadRequest)
+		return
+	}
+	if gridRows != nil && capacity != nil {
+		http.Error(w, "capacity cannot be set for a grid, it holds rows * columns samples", http.StatusBadRequest)
+		return
+	}
+
+	query := "INSERT INTO storage_locations (parent_id, name, kind, grid_rows, grid_columns, capacity, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)"
+	result, err := DB.Exec(query, parentId, name, kind, gridRows, gridColumns, capacity, time.Now().Unix())
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed:") {
+			http.Error(w, "a location with this name already exists here", http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "failed to insert location", http.StatusInternalServerError)
+		return
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		fmt.Fprintln(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, "{\"id\":  %d}", id)
+}
+
+/*
+Renames a storage location, moves it into another location, e.g. a rack to
+another freezer, or changes its capacity
+
+Query params:
+
+	location_id: int,
+	name?: string,
+	parent_id?: int, // Empty to make it a top level location
+	capacity?: int // Empty for unlimited
+*/
+func updateStorageLocationHandler(w http.ResponseWriter, r *http.Request) {
+	locationId, err := strconv.Atoi(r.FormValue("location_id"))
+	if err != nil {
+		http.Error(w, "location_id must be a positive int", http.StatusBadRequest)
+		return
+	}
+	var kind string
+	var gridRows *int
+	err = DB.QueryRow("SELECT kind, grid_rows FROM storage_locations WHERE id = ?", locationId).Scan(&kind, &gridRows)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "location not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+
+	query := []string{}
+	args := []any{}
+	if r.Form.Has("name") {
+		name := strings.TrimSpace(r.FormValue("name"))
+		if name == "" {
+			http.Error(w, "name cannot be empty", http.StatusBadRequest)
+			return
+		}
+		query = append(query, "name = ?")
+		args = append(args, name)
+	}
+	if r.Form.Has("parent_id") {
+		var parentId *int
+		if _parentId := r.FormValue("parent_id"); _parentId != "" {
+			id, err := strconv.Atoi(_parentId)
+			if err != nil {
+				http.Error(w, "parent_id must be a positive int", http.StatusBadRequest)
+				return
+			}
+			var parentKind string
+			err = DB.QueryRow("SELECT kind FROM storage_locations WHERE id = ?", id).Scan(&parentKind)
+			if err != nil {
+				if err == sql.ErrNoRows {
+					http.Error(w, "parent location not found", http.StatusNotFound)
+					return
+				}
+				http.Error(w, "error when reading from database", http.StatusInternalServerError)
+				return
+			}
+			// Kinds only nest outwards in, so a location cannot end up inside itself
+			if storageKindDepth(parentKind) >= storageKindDepth(kind) {
+				http.Error(w, fmt.Sprintf("a %s cannot be inside a %s", kind, parentKind), http.StatusBadRequest)
+				return
+			}
+			parentId = &id
+		}
+		query = append(query, "parent_id = ?")
+		args = append(args, parentId)
+	}
+	if r.Form.Has("capacity") {
+		var capacity *int
+		if _capacity := r.FormValue("capacity"); _capacity != "" {
+			value, err := strconv.Atoi(_capacity)
+			if err != nil || value < 1 {
+				http.Error(w, "capacity must be a positive int", http.StatusBadRequest)
+				return
+			}
+			if gridRows != nil {
+				http.Error(w, "capacity cannot be set for a grid, it holds rows * columns samples", http.StatusBadRequest)
+				return
+			}
+			var stored int
+			if err := DB.QueryRow("SELECT COUNT(*) FROM samples WHERE location_id = ?", locationId).Scan(&stored); err != nil {
+				http.Error(w, "error when reading from database", http.StatusInternalServerError)
+				return
+			}
+			if stored > value {
+				http.Error(w, fmt.Sprintf("the location holds %d samples, more than the new capacity", stored), http.StatusConflict)
+				return
+			}
+			capacity = &value
+		}
+		query = append(query, "capacity = ?")
+		args = append(args, capacity)
+	}
+	if len(query) == 0 {
+		http.Error(w, "name, parent_id or capacity is required", http.StatusBadRequest)
+		return
+	}
+	args = append(args, locationId)
+
+	_, err = DB.Exec("UPDATE storage_locations SET "+strings.Join(query, ", ")+" WHERE id = ?", args...)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed:") {
+			http.Error(w, "a location with this name already exists here", http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "failed to update location", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+/*
+Deletes an empty storage location. Locations that hold samples or other
+locations cannot be deleted. The move history of samples keeps the path
+of the location.
+
+Query params:
+
+	location_id: int
+*/
+func deleteStorageLocationHandler(w http.ResponseWriter, r *http.Request) {
+	locationId, err := strconv.Atoi(r.FormValue("location_id"))
+	if err != nil {
+		http.Error(w, "location_id must be a positive int", http.StatusBadRequest)
+		return
+	}
+
+	var samples, children int
+	query := `
+		SELECT (SELECT COUNT(*) FROM samples WHERE location_id = ?),
+			(SELECT COUNT(*) FROM storage_locations WHERE parent_id = ?)
+	`
+	if err := DB.QueryRow(query, locationId, locationId).Scan(&samples, &children); err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	if samples > 0 || children > 0 {
+		http.Error(w, fmt.Sprintf("the location holds %d samples and %d locations, move them first", samples, children), http.StatusConflict)
+		return
+	}
+
+	result, err := DB.Exec("DELETE FROM storage_locations WHERE id = ?", locationId)
+	if err != nil {
+		http.Error(w, "failed to delete location", http.StatusInternalServerError)
+		return
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil || rowsAffected == 0 {
+		http.Error(w, "location not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+/*
+Moves a sample to a storage location, or takes it out of storage. Grid
+locations need the position, either as row and column or as a label
+like "B7". Every move is kept in the history of the sample.
+
+Query params:
+
+	sample_id: int,
+	location_id?: int, // Takes the sample out of storage if not set
+	row?: int, // 1-based
+	column?: int, // 1-based
+	position?: string, // e.g. "B7", instead of row and column
+	comment?: string
+*/
+func moveSampleHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(User)
+	sampleId, err := strconv.Atoi(r.FormValue("sample_id"))
+	if err != nil {
+		http.Error(w, "sample_id must be a positive int", http.StatusBadRequest)
+		return
+	}
+	trashed, err := isSampleTrashed(sampleId)
+	if err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	if trashed {
+		http.Error(w, "sample not found", http.StatusNotFound)
+		return
+	}
+	var comment *string
+	if r.Form.Has("comment") {
+		_comment := r.FormValue("comment")
+		comment = &_comment
+	}
+
+	var locationId, row, column *int
+	var path *string
+	if _locationId := r.FormValue("location_id"); _locationId != "" {
+		id, err := strconv.Atoi(_locationId)
+		if err != nil {
+			http.Error(w, "location_id must be a positive int", http.StatusBadRequest)
+			return
+		}
+		locationId = &id
+
+		var gridRows, gridColumns, capacity *int
+		err = DB.QueryRow("SELECT grid_rows, grid_columns, capacity FROM storage_locations WHERE id = ?", id).Scan(&gridRows, &gridColumns, &capacity)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "location not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, "error when reading from database", http.StatusInternalServerError)
+			return
+		}
+
+		if gridRows != nil {
+			row, column, err = parseStoragePosition(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if row == nil {
+				http.Error(w, "the location is a grid, row and column or position is required", http.StatusBadRequest)
+				return
+			}
+			if *row > *gridRows || *column > *gridColumns {
+				http.Error(w, fmt.Sprintf("position is outside the %dx%d grid", *gridRows, *gridColumns), http.StatusBadRequest)
+				return
+			}
+		} else {
+			if r.FormValue("row") != "" || r.FormValue("column") != "" || r.FormValue("position") != "" {
+				http.Error(w, "the location has no grid positions", http.StatusBadRequest)
+				return
+			}
+			if capacity != nil {
+				var stored int
+				err := DB.QueryRow("SELECT COUNT(*) FROM samples WHERE location_id = ? AND id != ?", id, sampleId).Scan(&stored)
+				if err != nil {
+					http.Error(w, "error when reading from database", http.StatusInternalServerError)
+					return
+				}
+				if stored >= *capacity {
+					http.Error(w, "the location is full", http.StatusConflict)
+					return
+				}
+			}
+		}
+
+		paths, err := readStorageLocationPaths()
+		if err != nil {
+			http.Error(w, "error when reading from database", http.StatusInternalServerError)
+			return
+		}
+		_path := paths[id]
+		path = &_path
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		http.Error(w, "failed to move sample", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("UPDATE samples SET location_id = ?, location_row = ?, location_column = ? WHERE id = ?", locationId, row, column, sampleId)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed:") {
+			var other int
+			tx.QueryRow("SELECT id FROM samples WHERE location_id = ? AND location_row = ? AND location_column = ?", locationId, row, column).Scan(&other)
+			http.Error(w, fmt.Sprintf("position %s is taken by sample %d", storagePositionLabel(*row, *column), other), http.StatusConflict)
+			return
+		}
+		http.Error(w, "failed to move sample", http.StatusInternalServerError)
+		return
+	}
+	query := `
+		INSERT INTO sample_location_history (sample_id, location_id, location_path, location_row, location_column, user_id, comment, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	_, err = tx.Exec(query, sampleId, locationId, path, row, column, user.Id, comment, time.Now().Unix())
+	if err != nil {
+		http.Error(w, "failed to move sample", http.StatusInternalServerError)
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		http.Error(w, "failed to move sample", http.StatusInternalServerError)
+		return
+	}
+
+	if collectionId, err := readSampleCollectionId(sampleId); err == nil {
+		emitWebhookEvent(collectionId, "sample.moved", map[string]any{"sample_id": sampleId, "location_id": locationId, "row": row, "column": column})
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+/*
+Gets the moves of a sample between storage locations, oldest first
+
+Query params:
+
+	sample_id: int
+
+Result:
+
+	[{
+		id: int,
+		location_id: int, // Omitted when the sample was taken out of storage or the location deleted
+		path: string, // Path of the location at the time of the move
+		row: int,
+		column: int,
+		position: string, // e.g. "B7", omitted outside grids
+		user_id: int,
+		comment: string,
+		created_at: int
+	}]
+*/
+func fetchSampleLocationHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	sampleId, err := strconv.Atoi(r.FormValue("sample_id"))
+	if err != nil {
+		http.Error(w, "sample_id must be a positive int", http.StatusBadRequest)
+		return
+	}
+
+	query := `
+		SELECT id, location_id, location_path, location_row, location_column, user_id, comment, created_at
+		FROM sample_location_history WHERE sample_id = ? ORDER BY created_at, id
+	`
+	rows, err := DB.Query(query, sampleId)
+	if err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	history := []SampleMove{}
+	for rows.Next() {
+		var move SampleMove
+		if err := rows.Scan(&move.Id, &move.LocationId, &move.Path, &move.Row, &move.Column, &move.UserId, &move.Comment, &move.CreatedAt); err != nil {
+			http.Error(w, "error when reading from database", http.StatusInternalServerError)
+			return
+		}
+		if move.Row != nil && move.Column != nil {
+			position := storagePositionLabel(*move.Row, *move.Column)
+			move.Position = &position
+		}
+		history = append(history, move)
+	}
+	if err = rows.Err(); err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history)
+}
+
+/*
+Finds free grid positions in a storage location and every location inside
+it, box by box in row order
+
+Query params:
+
+	location_id: int,
+	limit?: int // Most slots returned, defaults to 10
+
+Result:
+
+	{
+		total_free: int, // Free positions in all grids, not only the ones returned
+		slots: [{ location_id: int, path: string, row: int, column: int, position: string }]
+	}
+*/
+func fetchFreeStorageSlotsHandler(w http.ResponseWriter, r *http.Request) {
+	locationId, err := strconv.Atoi(r.FormValue("location_id"))
+	if err != nil {
+		http.Error(w, "location_id must be a positive int", http.StatusBadRequest)
+		return
+	}
+	limit := 10
+	if _limit := r.FormValue("limit"); _limit != "" {
+		limit, err = strconv.Atoi(_limit)
+		if err != nil || limit < 1 || limit > maxFreeSlots {
+			http.Error(w, fmt.Sprintf("limit must be an int from 1 to %d", maxFreeSlots), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var exists bool
+	if err := DB.QueryRow("SELECT EXISTS(SELECT 1 FROM storage_locations WHERE id = ?)", locationId).Scan(&exists); err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "location not found", http.StatusNotFound)
+		return
+	}
+
+	// Grids in the location and below it
+	query := `
+		WITH RECURSIVE subtree(id) AS (
+			SELECT id FROM storage_locations WHERE id = ?
+			UNION
+			SELECT l.id FROM storage_locations l JOIN subtree t ON l.parent_id = t.id
+		)
+		SELECT l.id, l.grid_rows, l.grid_columns FROM storage_locations l
+		WHERE l.id IN subtree AND l.grid_rows IS NOT NULL
+		ORDER BY l.id
+	`
+	rows, err := DB.Query(query, locationId)
+	if err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	type grid struct{ id, rows, columns int }
+	var grids []grid
+	for rows.Next() {
+		var g grid
+		if err := rows.Scan(&g.id, &g.rows, &g.columns); err != nil {
+			rows.Close()
+			http.Error(w, "error when reading from database", http.StatusInternalServerError)
+			return
+		}
+		grids = append(grids, g)
+	}
+	rows.Close()
+
+	paths, err := readStorageLocationPaths()
+	if err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	result := FreeStorageSlots{Slots: []StorageSlot{}}
+	for _, g := range grids {
+		occupied, err := readOccupiedPositions(g.id)
+		if err != nil {
+			http.Error(w, "error when reading from database", http.StatusInternalServerError)
+			return
+		}
+		result.TotalFree += g.rows*g.columns - len(occupied)
+		for row := 1; row <= g.rows && len(result.Slots) < limit; row++ {
+			for column := 1; column <= g.columns && len(result.Slots) < limit; column++ {
+				if _, taken := occupied[[2]int{row, column}]; taken {
+					continue
+				}
+				result.Slots = append(result.Slots, StorageSlot{
+					LocationId: g.id,
+					Path:       paths[g.id],
+					Row:        row,
+					Column:     column,
+					Position:   storagePositionLabel(row, column),
+				})
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+/*
+Gets the map of a grid location, e.g. a box, with the sample at every position
+
+Query params:
+
+	location_id: int
+
+Result:
+
+	{
+		location_id: int,
+		path: string,
+		rows: int,
+		columns: int,
+		free: int,
+		grid: [ // One list per row, null for free positions
+			[{ sample_id: int, collection_id: int, identifier: string, position: string, in_trash: bool } | null]
+		]
+	}
+*/
+func fetchBoxMapHandler(w http.ResponseWriter, r *http.Request) {
+	locationId, err := strconv.Atoi(r.FormValue("location_id"))
+	if err != nil {
+		http.Error(w, "location_id must be a positive int", http.StatusBadRequest)
+		return
+	}
+	var gridRows, gridColumns *int
+	err = DB.QueryRow("SELECT grid_rows, grid_columns FROM storage_locations WHERE id = ?", locationId).Scan(&gridRows, &gridColumns)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "location not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	if gridRows == nil {
+		http.Error(w, "the location has no grid positions", http.StatusBadRequest)
+		return
+	}
+
+	paths, err := readStorageLocationPaths()
+	if err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	occupied, err := readOccupiedPositions(locationId)
+	if err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+
+	boxMap := BoxMap{
+		LocationId: locationId,
+		Path:       paths[locationId],
+		Rows:       *gridRows,
+		Columns:    *gridColumns,
+		Free:       *gridRows**gridColumns - len(occupied),
+		Grid:       make([][]*BoxMapSample, *gridRows),
+	}
+	for row := range boxMap.Grid {
+		boxMap.Grid[row] = make([]*BoxMapSample, *gridColumns)
+		for column := range boxMap.Grid[row] {
+			if sample, ok := occupied[[2]int{row + 1, column + 1}]; ok {
+				boxMap.Grid[row][column] = &sample
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(boxMap)
+}
+
+// StorageLocation is a site, freezer, shelf, rack or box
+type StorageLocation struct {
+	Id       int    `json:"id"`
+	ParentId *int   `json:"parent_id,omitempty"`
+	Name     string `json:"name"`
+	Kind     string `json:"kind"`
+	Path     string `json:"path"`
+	Rows     *int   `json:"rows,omitempty"`
+	Columns  *int   `json:"columns,omitempty"`
+	Capacity *int   `json:"capacity,omitempty"`
+	Samples  int    `json:"samples"`
+	Children int    `json:"children"`
+}
+
+// SampleLocation is where a sample is stored, part of Sample
+type SampleLocation struct {
+	LocationId int     `json:"location_id"`
+	Path       string  `json:"path"`
+	Row        *int    `json:"row,omitempty"`
+	Column     *int    `json:"column,omitempty"`
+	Position   *string `json:"position,omitempty"` // e.g. "B7"
+}
+
+// SampleMove is an entry in the location history of a sample
+type SampleMove struct {
+	Id         int     `json:"id"`
+	LocationId *int    `json:"location_id,omitempty"`
+	Path       *string `json:"path,omitempty"`
+	Row        *int    `json:"row,omitempty"`
+	Column     *int    `json:"column,omitempty"`
+	Position   *string `json:"position,omitempty"`
+	UserId     *int    `json:"user_id,omitempty"`
+	Comment    *string `json:"comment,omitempty"`
+	CreatedAt  int64   `json:"created_at"` // UNIX timestamp
+}
+
+// FreeStorageSlots is the result of fetchFreeStorageSlotsHandler
+type FreeStorageSlots struct {
+	TotalFree int           `json:"total_free"`
+	Slots     []StorageSlot `json:"slots"`
+}
+
+type StorageSlot struct {
+	LocationId int    `json:"location_id"`
+	Path       string `json:"path"`
+	Row        int    `json:"row"`
+	Column     int    `json:"column"`
+	Position   string `json:"position"`
+}
+
+// BoxMap is the result of fetchBoxMapHandler
+type BoxMap struct {
+	LocationId int               `json:"location_id"`
+	Path       string            `json:"path"`
+	Rows       int               `json:"rows"`
+	Columns    int               `json:"columns"`
+	Free       int               `json:"free"`
+	Grid       [][]*BoxMapSample `json:"grid"`
+}
+
+type BoxMapSample struct {
+	SampleId     int     `json:"sample_id"`
+	CollectionId int     `json:"collection_id"`
+	Identifier   *string `json:"identifier,omitempty"`
+	Position     string  `json:"position"`
+	InTrash      bool    `json:"in_trash"` // The tube still takes up the position
+}
+
+// Index of a storage kind in storageKinds, -1 if it is not one
+func storageKindDepth(kind string) int {
+	for i, k := range storageKinds {
+		if k == kind {
+			return i
+		}
+	}
+	return -1
+}
+
+// Returns the path of every storage location by id, e.g. "Lab 1 / Freezer A / Box 3"
+func readStorageLocationPaths() (map[int]string, error) {
+	rows, err := DB.Query("SELECT id, parent_id, name FROM storage_locations")
+	if err != nil {
+		return nil, fmt.Errorf("readStorageLocationPaths: %v", err)
+	}
+	defer rows.Close()
+
+	type node struct {
+		parentId *int
+		name     string
+	}
+	nodes := make(map[int]node)
+	for rows.Next() {
+		var id int
+		var n node
+		if err := rows.Scan(&id, &n.parentId, &n.name); err != nil {
+			return nil, fmt.Errorf("readStorageLocationPaths: %v", err)
+		}
+		nodes[id] = n
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("readStorageLocationPaths: %v", err)
+	}
+
+	paths := make(map[int]string, len(nodes))
+	var pathOf func(id int) string
+	pathOf = func(id int) string {
+		if path, ok := paths[id]; ok {
+			return path
+		}
+		n := nodes[id]
+		path := n.name
+		if n.parentId != nil {
+			path = pathOf(*n.parentId) + " / " + n.name
+		}
+		paths[id] = path
+		return path
+	}
+	for id := range nodes {
+		pathOf(id)
+	}
+	return paths, nil
+}
+
+// Returns the samples at the grid positions of a location by [row, column]
+func readOccupiedPositions(locationId int) (map[[2]int]BoxMapSample, error) {
+	query := `
+		SELECT id, collection_id, identifier, location_row, location_column, deleted_at IS NOT NULL
+		FROM samples WHERE location_id = ? AND location_row IS NOT NULL
+	`
+	rows, err := DB.Query(query, locationId)
+	if err != nil {
+		return nil, fmt.Errorf("readOccupiedPositions: %v", err)
+	}
+	defer rows.Close()
+
+	occupied := make(map[[2]int]BoxMapSample)
+	for rows.Next() {
+		var sample BoxMapSample
+		var row, column int
+		if err := rows.Scan(&sample.SampleId, &sample.CollectionId, &sample.Identifier, &row, &column, &sample.InTrash); err != nil {
+			return nil, fmt.Errorf("readOccupiedPositions: %v", err)
+		}
+		sample.Position = storagePositionLabel(row, column)
+		occupied[[2]int{row, column}] = sample
+	}
+	return occupied, rows.Err()
+}
+
+// Reads the row and column of a grid position from either row and column
+// or position. Both are nil if none is given.
+func parseStoragePosition(r *http.Request) (row *int, column *int, err error) {
+	if position := strings.ToUpper(strings.TrimSpace(r.FormValue("position"))); position != "" {
+		letters := strings.TrimRight(position, "0123456789")
+		_row := 0
+		if len(letters) > 2 {
+			return nil, nil, fmt.Errorf("position must be a row letter and a column number, e.g. B7")
+		}
+		for _, c := range letters {
+			if c < 'A' || c > 'Z' {
+				return nil, nil, fmt.Errorf("position must be a row letter and a column number, e.g. B7")
+			}
+			_row = _row*26 + int(c-'A'+1)
+		}
+		_column, err := strconv.Atoi(position[len(letters):])
+		if letters == "" || err != nil || _column < 1 {
+			return nil, nil, fmt.Errorf("position must be a row letter and a column number, e.g. B7")
+		}
+		return &_row, &_column, nil
+	}
+
+	_row, _column := r.FormValue("row"), r.FormValue("column")
+	if _row == "" && _column == "" {
+		return nil, nil, nil
+	}
+	rowValue, err := strconv.Atoi(_row)
+	if err != nil || rowValue < 1 {
+		return nil, nil, fmt.Errorf("row must be a positive int")
+	}
+	columnValue, err := strconv.Atoi(_column)
+	if err != nil || columnValue < 1 {
+		return nil, nil, fmt.Errorf("column must be a positive int")
+	}
+	return &rowValue, &columnValue, nil
+}
+
+// Labels a grid position with letters for the row and a number for the column,
+// e.g. row 2, column 7 is "B7" and row 27 is "AA"
+func storagePositionLabel(row int, column int) string {
+	letters := ""
+	for row > 0 {
+		row--
+		letters = string(rune('A'+row%26)) + letters
+		row /= 26
+	}
+	return letters + strconv.Itoa(column)
+}
@@ -0,0 +1,722 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Gets the collection templates
+
+Result:
+
+	[{
+		id: int,
+		name: string,
+		description: string,
+		created_at: int, // UNIX timestamp in seconds
+		created_by: int, // User id
+		schema: {
+			attributes: [{
+				name: string,
+				unit_id: int,
+				unit: string, // Name of the unit, used if unit_id no longer exists
+				position: int,
+				group: string,
+				description: string,
+				decimals: int,
+				formula: string,
+				replicates: int,
+				lod: float, loq: float, uloq: float,
+				substitution: string,
+				limits: [{ lower_spec: float, upper_spec: float, lower_warn: float, upper_warn: float, valid_from: int }]
+			}],
+			workflow_states: [{ name: string, is_initial: bool, is_locked: bool }],
+			workflow_transitions: [{ from: string, to: string, role_id: int }] // States by name
+		}
+	}]
+*/
+func fetchTemplatesHandler(w http.ResponseWriter, r *http.Request) {
+	rows, err := DB.Query("SELECT id, name, description, schema, created_at, created_by FROM collection_templates ORDER BY name")
+	if err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var templates = []CollectionTemplate{}
+	for rows.Next() {
+		var template CollectionTemplate
+		var schema string
+		if err := rows.Scan(&template.Id, &template.Name, &template.Description, &schema, &template.CreatedAt, &template.CreatedBy); err != nil {
+			http.Error(w, "error when reading from database", http.StatusInternalServerError)
+			return
+		}
+		if err := json.Unmarshal([]byte(schema), &template.Schema); err != nil {
+			http.Error(w, "error when reading from database", http.StatusInternalServerError)
+			return
+		}
+		templates = append(templates, template)
+	}
+	if err = rows.Err(); err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(templates)
+}
+
+/*
+Saves the schema of a collection as a template: its attributes with their
+units, display metadata, formulas and limits, and its workflow.
+
+Query params:
+
+	collection_id: int,
+	name: string,
+	description?: string
+*/
+func insertTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	collectionId, err := strconv.Atoi(r.FormValue("collection_id"))
+	if err != nil {
+		http.Error(w, "collection_id must be a positive int", http.StatusBadRequest)
+		return
+	}
+	name := r.FormValue("name")
+	if name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	description := r.FormValue("description")
+
+	var exists bool
+	err = DB.QueryRow("SELECT EXISTS(SELECT 1 FROM collections WHERE id = ? AND deleted_at IS NULL)", collectionId).Scan(&exists)
+	if err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "collection not found", http.StatusNotFound)
+		return
+	}
+
+	schema, err := readCollectionSchema(collectionId)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	encoded, err := json.Marshal(schema)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	user := r.Context().Value("user").(User)
+	query := "INSERT INTO collection_templates (name, description, schema, created_at, created_by) VALUES (?, ?, ?, ?, ?)"
+	result, err := DB.Exec(query, name, description, string(encoded), time.Now().Unix(), user.Id)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed:") {
+			http.Error(w, "template already exists", http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "error inserting to database", http.StatusInternalServerError)
+		return
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		http.Error(w, "error inserting to database", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, "{\"id\":  %d}", id)
+}
+
+/*
+Deletes a collection template. Collections created from it are not affected.
+
+Query params:
+
+	template_id: int
+*/
+func deleteTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	templateId, err := strconv.Atoi(r.FormValue("template_id"))
+	if err != nil {
+		http.Error(w, "template_id must be a positive int", http.StatusBadRequest)
+		return
+	}
+
+	result, err := DB.Exec("DELETE FROM collection_templates WHERE id = ?", templateId)
+	if err != nil {
+		http.Error(w, "failed to delete template", http.StatusInternalServerError)
+		return
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil || rowsAffected == 0 {
+		http.Error(w, "template not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+/*
+Creates a collection with the schema of a template
+
+Query params:
+
+	template_id: int,
+	name: string,
+	description?: string
+*/
+func insertCollectionFromTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	templateId, err := strconv.Atoi(r.FormValue("template_id"))
+	if err != nil {
+		http.Error(w, "template_id must be a positive int", http.StatusBadRequest)
+		return
+	}
+	name := r.FormValue("name")
+	if name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+
+	var encoded string
+	err = DB.QueryRow("SELECT schema FROM collection_templates WHERE id = ?", templateId).Scan(&encoded)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "template not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	var schema CollectionSchema
+	if err := json.Unmarshal([]byte(encoded), &schema); err != nil {
+		http.Error(w, "template is not valid", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		http.Error(w, "error inserting to database", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	collectionId, _, _, err := createCollectionFromSchema(tx, name, r.FormValue("description"), schema)
+	if err != nil {
+		tx.Rollback()
+		writeCreateCollectionError(w, name, err)
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		http.Error(w, "error inserting to database", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, "{\"id\":  %d}", collectionId)
+}
+
+/*
+Creates a copy of a collection with the same schema, and optionally its
+samples and their values. Samples in the trash are not copied. Identifiers
+are unique, so the copy has no identifier pattern and its samples get
+identifiers once one is set.
+
+Query params:
+
+	collection_id: int,
+	name: string,
+	description?: string,
+	with_samples?: bool
+*/
+func cloneCollectionHandler(w http.ResponseWriter, r *http.Request) {
+	sourceId, err := strconv.Atoi(r.FormValue("collection_id"))
+	if err != nil {
+		http.Error(w, "collection_id must be a positive int", http.StatusBadRequest)
+		return
+	}
+	name := r.FormValue("name")
+	if name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	withSamples := false
+	if _withSamples := r.FormValue("with_samples"); _withSamples != "" {
+		withSamples, err = strconv.ParseBool(_withSamples)
+		if err != nil {
+			http.Error(w, "with_samples must be a bool", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var description *string
+	err = DB.QueryRow("SELECT description FROM collections WHERE id = ? AND deleted_at IS NULL", sourceId).Scan(&description)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "collection not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	if r.Form.Has("description") {
+		_description := r.FormValue("description")
+		description = &_description
+	}
+	if description == nil {
+		description = new(string)
+	}
+
+	schema, err := readCollectionSchema(sourceId)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		http.Error(w, "error inserting to database", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	collectionId, attributeIds, stateIds, err := createCollectionFromSchema(tx, name, *description, schema)
+	if err != nil {
+		tx.Rollback()
+		writeCreateCollectionError(w, name, err)
+		return
+	}
+	if withSamples {
+		if err := cloneSamples(tx, sourceId, collectionId, attributeIds, stateIds); err != nil {
+			log.Println(err)
+			http.Error(w, "error when copying samples", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		http.Error(w, "error inserting to database", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, "{\"id\":  %d}", collectionId)
+}
+
+// CollectionTemplate is a saved collection schema
+type CollectionTemplate struct {
+	Id          int              `json:"id"`
+	Name        string           `json:"name"`
+	Description string           `json:"description"`
+	CreatedAt   int64            `json:"created_at"` // UNIX timestamp
+	CreatedBy   *int             `json:"created_by,omitempty"`
+	Schema      CollectionSchema `json:"schema"`
+}
+
+// CollectionSchema describes everything about a collection but its samples.
+// Attributes and workflow states refer to each other by name.
+type CollectionSchema struct {
+	Attributes          []SchemaAttribute          `json:"attributes"`
+	WorkflowStates      []SchemaWorkflowState      `json:"workflow_states"`
+	WorkflowTransitions []SchemaWorkflowTransition `json:"workflow_transitions"`
+}
+
+type SchemaAttribute struct {
+	Name     string  `json:"name"`
+	UnitId   *int    `json:"unit_id,omitempty"`
+	Unit     *string `json:"unit,omitempty"`
+	Position int     `json:"position"`
+	AttributeDisplay
+	Formula    *string `json:"formula,omitempty"`
+	Replicates *int    `json:"replicates,omitempty"`
+	DetectionLimits
+	Substitution *string       `json:"substitution,omitempty"`
+	Limits       []SchemaLimit `json:"limits,omitempty"`
+}
+
+type SchemaLimit struct {
+	LowerSpec *float64 `json:"lower_spec,omitempty"`
+	UpperSpec *float64 `json:"upper_spec,omitempty"`
+	LowerWarn *float64 `json:"lower_warn,omitempty"`
+	UpperWarn *float64 `json:"upper_warn,omitempty"`
+	ValidFrom int64    `json:"valid_from"`
+}
+
+type SchemaWorkflowState struct {
+	Name      string `json:"name"`
+	IsInitial bool   `json:"is_initial"`
+	IsLocked  bool   `json:"is_locked"`
+}
+
+type SchemaWorkflowTransition struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	RoleId *int   `json:"role_id,omitempty"`
+}
+
+// Reads the schema of a collection
+func readCollectionSchema(collectionId int) (CollectionSchema, error) {
+	schema := CollectionSchema{
+		Attributes:          []SchemaAttribute{},
+		WorkflowStates:      []SchemaWorkflowState{},
+		WorkflowTransitions: []SchemaWorkflowTransition{},
+	}
+
+	query := `
+		SELECT a.id, a.name, a.unit_id, u.name, a.position, a.group_label, a.description, a.decimals, a.formula, a.replicates,
+			a.lod, a.loq, a.uloq, a.substitution
+		FROM sample_attributes a LEFT JOIN units u ON u.id = a.unit_id
+		WHERE a.collection_id = ? AND a.deleted_at IS NULL
+		ORDER BY a.position, a.id
+	`
+	rows, err := DB.Query(query, collectionId)
+	if err != nil {
+		return schema, fmt.Errorf("readCollectionSchema: %v", err)
+	}
+	var attributeIds []int
+	for rows.Next() {
+		var id int
+		var attr SchemaAttribute
+		if err := rows.Scan(&id, &attr.Name, &attr.UnitId, &attr.Unit, &attr.Position, &attr.Group, &attr.Description, &attr.Decimals, &attr.Formula, &attr.Replicates, &attr.LOD, &attr.LOQ, &attr.ULOQ, &attr.Substitution); err != nil {
+			rows.Close()
+			return schema, fmt.Errorf("readCollectionSchema: %v", err)
+		}
+		attributeIds = append(attributeIds, id)
+		schema.Attributes = append(schema.Attributes, attr)
+	}
+	rows.Close()
+
+	for i, id := range attributeIds {
+		rows, err := DB.Query("SELECT lower_spec, upper_spec, lower_warn, upper_warn, valid_from FROM attribute_limits WHERE attribute_id = ? ORDER BY valid_from", id)
+		if err != nil {
+			return schema, fmt.Errorf("readCollectionSchema: %v", err)
+		}
+		for rows.Next() {
+			var limit SchemaLimit
+			if err := rows.Scan(&limit.LowerSpec, &limit.UpperSpec, &limit.LowerWarn, &limit.UpperWarn, &limit.ValidFrom); err != nil {
+				rows.Close()
+				return schema, fmt.Errorf("readCollectionSchema: %v", err)
+			}
+			schema.Attributes[i].Limits = append(schema.Attributes[i].Limits, limit)
+		}
+		rows.Close()
+	}
+
+	rows, err = DB.Query("SELECT name, is_initial, is_locked FROM workflow_states WHERE collection_id = ? ORDER BY id", collectionId)
+	if err != nil {
+		return schema, fmt.Errorf("readCollectionSchema: %v", err)
+	}
+	for rows.Next() {
+		var state SchemaWorkflowState
+		if err := rows.Scan(&state.Name, &state.IsInitial, &state.IsLocked); err != nil {
+			rows.Close()
+			return schema, fmt.Errorf("readCollectionSchema: %v", err)
+		}
+		schema.WorkflowStates = append(schema.WorkflowStates, state)
+	}
+	rows.Close()
+
+	query = `
+		SELECT f.name, t.name, wt.role_id
+		FROM workflow_transitions wt
+		JOIN workflow_states f ON f.id = wt.from_state_id
+		JOIN workflow_states t ON t.id = wt.to_state_id
+		WHERE f.collection_id = ?
+		ORDER BY wt.id
+	`
+	rows, err = DB.Query(query, collectionId)
+	if err != nil {
+		return schema, fmt.Errorf("readCollectionSchema: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var transition SchemaWorkflowTransition
+		if err := rows.Scan(&transition.From, &transition.To, &transition.RoleId); err != nil {
+			return schema, fmt.Errorf("readCollectionSchema: %v", err)
+		}
+		schema.WorkflowTransitions = append(schema.WorkflowTransitions, transition)
+	}
+	return schema, rows.Err()
+}
+
+// Errors from createCollectionFromSchema that are the fault of the request
+type schemaError struct {
+	message string
+}
+
+func (err schemaError) Error() string {
+	return err.message
+}
+
+// Creates a collection with the attributes, limits and workflow of a schema.
+// Returns the id of the collection and the ids of its attributes and workflow states by name.
+func createCollectionFromSchema(tx *sql.Tx, name string, description string, schema CollectionSchema) (int, map[string]int, map[string]int, error) {
+	result, err := tx.Exec("INSERT INTO collections (name, description) VALUES (?, ?)", name, description)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	collectionId := int(id)
+
+	// Formulas must only reference attributes of the schema, without cycles
+	names := make(map[string]bool, len(schema.Attributes))
+	for _, attr := range schema.Attributes {
+		names[attr.Name] = true
+	}
+	var calculated []calculatedAttribute
+	for _, attr := range schema.Attributes {
+		if attr.Formula == nil {
+			continue
+		}
+		formula, err := parseFormula(*attr.Formula)
+		if err != nil {
+			return 0, nil, nil, schemaError{fmt.Sprintf("formula of %s is not valid: %v", attr.Name, err)}
+		}
+		for _, reference := range formula.References {
+			if !names[reference] || reference == attr.Name {
+				return 0, nil, nil, schemaError{fmt.Sprintf("formula of %s references unknown attribute %q", attr.Name, reference)}
+			}
+		}
+		calculated = append(calculated, calculatedAttribute{Name: attr.Name, Formula: formula})
+	}
+	if _, err := orderFormulas(calculated); err != nil {
+		return 0, nil, nil, schemaError{err.Error()}
+	}
+
+	attributeIds := make(map[string]int, len(schema.Attributes))
+	for _, attr := range schema.Attributes {
+		if attr.Replicates != nil && (*attr.Replicates < 2 || *attr.Replicates > 100) {
+			return 0, nil, nil, schemaError{fmt.Sprintf("replicates of %s must be between 2 and 100", attr.Name)}
+		}
+		if attr.Replicates != nil && attr.Formula != nil {
+			return 0, nil, nil, schemaError{fmt.Sprintf("%s is calculated and cannot take replicates", attr.Name)}
+		}
+		if err := attr.DetectionLimits.validate(); err != nil {
+			return 0, nil, nil, schemaError{fmt.Sprintf("%s: %v", attr.Name, err)}
+		}
+		if attr.Substitution != nil {
+			if _, err := parseSubstitution(*attr.Substitution); err != nil {
+				return 0, nil, nil, schemaError{fmt.Sprintf("%s: %v", attr.Name, err)}
+			}
+		}
+		unitId, err := resolveSchemaUnit(tx, attr)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		query := `
+			INSERT INTO sample_attributes (collection_id, name, unit_id, position, group_label, description, decimals, formula, replicates, lod, loq, uloq, substitution, inserted_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`
+		result, err := tx.Exec(query, collectionId, attr.Name, unitId, attr.Position, attr.Group, attr.Description, attr.Decimals, attr.Formula, attr.Replicates,
+			attr.LOD, attr.LOQ, attr.ULOQ, attr.Substitution, time.Now().Unix())
+		if err != nil {
+			if strings.Contains(err.Error(), "UNIQUE constraint failed:") {
+				return 0, nil, nil, schemaError{"attribute " + attr.Name + " appears twice"}
+			}
+			return 0, nil, nil, err
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		attributeIds[attr.Name] = int(id)
+
+		for _, limit := range attr.Limits {
+			query := "INSERT INTO attribute_limits (attribute_id, lower_spec, upper_spec, lower_warn, upper_warn, valid_from, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)"
+			if _, err := tx.Exec(query, id, limit.LowerSpec, limit.UpperSpec, limit.LowerWarn, limit.UpperWarn, limit.ValidFrom, time.Now().Unix()); err != nil {
+				return 0, nil, nil, err
+			}
+		}
+	}
+
+	stateIds := make(map[string]int, len(schema.WorkflowStates))
+	for _, state := range schema.WorkflowStates {
+		query := "INSERT INTO workflow_states (collection_id, name, is_initial, is_locked) VALUES (?, ?, ?, ?)"
+		result, err := tx.Exec(query, collectionId, state.Name, state.IsInitial, state.IsLocked)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		stateIds[state.Name] = int(id)
+	}
+	for _, transition := range schema.WorkflowTransitions {
+		from, ok1 := stateIds[transition.From]
+		to, ok2 := stateIds[transition.To]
+		if !ok1 || !ok2 {
+			return 0, nil, nil, schemaError{fmt.Sprintf("transition from %s to %s references an unknown state", transition.From, transition.To)}
+		}
+		query := "INSERT INTO workflow_transitions (from_state_id, to_state_id, role_id) VALUES (?, ?, ?)"
+		if _, err := tx.Exec(query, from, to, transition.RoleId); err != nil {
+			return 0, nil, nil, err
+		}
+	}
+
+	return collectionId, attributeIds, stateIds, nil
+}
+
+// Finds the unit of a schema attribute, by id if it still has the same name, otherwise by name
+func resolveSchemaUnit(tx *sql.Tx, attr SchemaAttribute) (*int, error) {
+	if attr.UnitId == nil && attr.Unit == nil {
+		return nil, nil
+	}
+	var id int
+	err := tx.QueryRow("SELECT id FROM units WHERE id = ? AND name = ?", attr.UnitId, attr.Unit).Scan(&id)
+	if err == sql.ErrNoRows && attr.Unit != nil {
+		err = tx.QueryRow("SELECT id FROM units WHERE name = ?", *attr.Unit).Scan(&id)
+	}
+	if err == sql.ErrNoRows {
+		return nil, schemaError{"unit of attribute " + attr.Name + " no longer exists"}
+	} else if err != nil {
+		return nil, err
+	}
+	return &id, nil
+}
+
+// Copies the samples of a collection, and their values and workflow states, into a clone of it
+func cloneSamples(tx *sql.Tx, sourceId int, collectionId int, attributeIds map[string]int, stateIds map[string]int) error {
+	query := `
+		SELECT s.id, s.created_at, s.note, ws.name
+		FROM samples s LEFT JOIN workflow_states ws ON ws.id = s.status_id
+		WHERE s.collection_id = ? AND s.deleted_at IS NULL
+		ORDER BY s.id
+	`
+	rows, err := tx.Query(query, sourceId)
+	if err != nil {
+		return fmt.Errorf("cloneSamples: %v", err)
+	}
+	type sourceSample struct {
+		id        int
+		createdAt int64
+		note      *string
+		state     *string
+	}
+	var samples []sourceSample
+	for rows.Next() {
+		var sample sourceSample
+		if err := rows.Scan(&sample.id, &sample.createdAt, &sample.note, &sample.state); err != nil {
+			rows.Close()
+			return fmt.Errorf("cloneSamples: %v", err)
+		}
+		samples = append(samples, sample)
+	}
+	rows.Close()
+
+	for _, sample := range samples {
+		var statusId *int
+		if sample.state != nil {
+			if id, ok := stateIds[*sample.state]; ok {
+				statusId = &id
+			}
+		}
+		result, err := tx.Exec("INSERT INTO samples (collection_id, created_at, inserted_at, note, status_id) VALUES (?, ?, ?, ?, ?)", collectionId, sample.createdAt, time.Now().Unix(), sample.note, statusId)
+		if err != nil {
+			return fmt.Errorf("cloneSamples: %v", err)
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return fmt.Errorf("cloneSamples: %v", err)
+		}
+		cloneId := int(id)
+
+		// Calculated values are calculated again below
+		query := `
+			SELECT a.name, v.value, v.censor, v.qualifier, v.uncertainty, v.uncertainty_type, v.significant_figures, v.instrument_id
+			FROM sample_attribute_values v JOIN sample_attributes a ON a.id = v.attribute_id
+			WHERE v.sample_id = ? AND a.deleted_at IS NULL AND a.formula IS NULL
+		`
+		rows, err := tx.Query(query, sample.id)
+		if err != nil {
+			return fmt.Errorf("cloneSamples: %v", err)
+		}
+		type clonedValue struct {
+			value, censor, qualifier *string
+			precision                MeasurementPrecision
+			instrumentId             *int
+		}
+		values := make(map[int]clonedValue)
+		for rows.Next() {
+			var name string
+			var cloned clonedValue
+			if err := rows.Scan(&name, &cloned.value, &cloned.censor, &cloned.qualifier,
+				&cloned.precision.Uncertainty, &cloned.precision.UncertaintyType, &cloned.precision.SignificantFigures, &cloned.instrumentId); err != nil {
+				rows.Close()
+				return fmt.Errorf("cloneSamples: %v", err)
+			}
+			values[attributeIds[name]] = cloned
+		}
+		rows.Close()
+
+		for attributeId, cloned := range values {
+			value := cloned.value
+			var flag *string
+			if value != nil {
+				flag, err = evaluateValueFlag(tx, cloneId, attributeId, *value, cloned.censor)
+				if err != nil {
+					return err
+				}
+			}
+			query := `
+				INSERT INTO sample_attribute_values (sample_id, attribute_id, value, flag, censor, qualifier, uncertainty, uncertainty_type, significant_figures, instrument_id)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			`
+			precision := cloned.precision
+			if _, err := tx.Exec(query, cloneId, attributeId, value, flag, cloned.censor, cloned.qualifier, precision.Uncertainty, precision.UncertaintyType, precision.SignificantFigures, cloned.instrumentId); err != nil {
+				return fmt.Errorf("cloneSamples: %v", err)
+			}
+			if err := recordValueVersion(tx, cloneId, attributeId, value, flag, nil); err != nil {
+				return err
+			}
+		}
+
+		// Replicates are copied with who entered them and why they were excluded
+		query = `
+			INSERT INTO sample_replicate_values (sample_id, attribute_id, replicate, value, user_id, created_at, excluded_reason, excluded_by, excluded_at)
+			SELECT ?, c.id, r.replicate, r.value, r.user_id, r.created_at, r.excluded_reason, r.excluded_by, r.excluded_at
+			FROM sample_replicate_values r
+			JOIN sample_attributes a ON a.id = r.attribute_id
+			JOIN sample_attributes c ON c.collection_id = ? AND c.name = a.name AND c.replicates IS NOT NULL
+			WHERE r.sample_id = ? AND a.deleted_at IS NULL
+		`
+		if _, err := tx.Exec(query, cloneId, collectionId, sample.id); err != nil {
+			return fmt.Errorf("cloneSamples: %v", err)
+		}
+		if err := recomputeSampleFormulas(tx, cloneId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Responds to a failure of createCollectionFromSchema
+func writeCreateCollectionError(w http.ResponseWriter, name string, err error) {
+	if schemaErr, ok := err.(schemaError); ok {
+		http.Error(w, schemaErr.message, http.StatusBadRequest)
+		return
+	}
+	if strings.Contains(err.Error(), "UNIQUE constraint failed: collections.name") {
+		http.Error(w, collectionExistsMessage(name), http.StatusBadRequest)
+		return
+	}
+	log.Println(err)
+	http.Error(w, "error inserting to database", http.StatusInternalServerError)
+}
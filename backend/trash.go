@@ -0,0 +1,312 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Days items stay in the trash before they may be purged, unless TRASH_RETENTION_DAYS is set
+const defaultTrashRetentionDays = 30
+
+/*
+Gets the collections, attributes and samples in the trash, most recently
+deleted first. Attributes and samples of a collection in the trash are
+not listed on their own, they are restored with the collection.
+
+Query params:
+
+	collection_id?: int // Only items of this collection
+
+Result:
+
+	{
+		collections: [{ id: int, name: string, deleted_at: int }],
+		attributes: [{ id: int, collection_id: int, name: string, deleted_at: int }],
+		samples: [{ id: int, collection_id: int, created_at: int, note: string, deleted_at: int }]
+	}
+*/
+func fetchTrashHandler(w http.ResponseWriter, r *http.Request) {
+	collectionId := 0
+	if _collectionId := r.FormValue("collection_id"); _collectionId != "" {
+		id, err := strconv.Atoi(_collectionId)
+		if err != nil || id < 1 {
+			http.Error(w, "collection_id must be a positive int", http.StatusBadRequest)
+			return
+		}
+		collectionId = id
+	}
+
+	trash := Trash{
+		Collections: []TrashedItem{},
+		Attributes:  []TrashedItem{},
+		Samples:     []TrashedItem{},
+	}
+
+	queries := []struct {
+		query string
+		items *[]TrashedItem
+		scan  func(rows *sql.Rows, item *TrashedItem) error
+	}{
+		{
+			"SELECT id, name, deleted_at FROM collections WHERE deleted_at IS NOT NULL AND (? = 0 OR id = ?) ORDER BY deleted_at DESC",
+			&trash.Collections,
+			func(rows *sql.Rows, item *TrashedItem) error {
+				return rows.Scan(&item.Id, &item.Name, &item.DeletedAt)
+			},
+		},
+		{
+			`SELECT a.id, a.collection_id, a.name, a.deleted_at
+			FROM sample_attributes a JOIN collections c ON c.id = a.collection_id
+			WHERE a.deleted_at IS NOT NULL AND c.deleted_at IS NULL AND (? = 0 OR a.collection_id = ?)
+			ORDER BY a.deleted_at DESC`,
+			&trash.Attributes,
+			func(rows *sql.Rows, item *TrashedItem) error {
+				return rows.Scan(&item.Id, &item.CollectionId, &item.Name, &item.DeletedAt)
+			},
+		},
+		{
+			`SELECT s.id, s.collection_id, s.created_at, s.note, s.deleted_at
+			FROM samples s JOIN collections c ON c.id = s.collection_id
+			WHERE s.deleted_at IS NOT NULL AND c.deleted_at IS NULL AND (? = 0 OR s.collection_id = ?)
+			ORDER BY s.deleted_at DESC`,
+			&trash.Samples,
+			func(rows *sql.Rows, item *TrashedItem) error {
+				return rows.Scan(&item.Id, &item.CollectionId, &item.CreatedAt, &item.Note, &item.DeletedAt)
+			},
+		},
+	}
+	for _, q := range queries {
+		rows, err := DB.Query(q.query, collectionId, collectionId)
+		if err != nil {
+			http.Error(w, "error when reading from database", http.StatusInternalServerError)
+			return
+		}
+		for rows.Next() {
+			var item TrashedItem
+			if err := q.scan(rows, &item); err != nil {
+				rows.Close()
+				http.Error(w, "error when reading from database", http.StatusInternalServerError)
+				return
+			}
+			*q.items = append(*q.items, item)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			http.Error(w, "error when reading from database", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(trash)
+}
+
+/*
+Restores a collection, attribute or sample from the trash. Attributes and
+samples of a collection in the trash can only be restored with it.
+
+Query params:
+
+	type: string, // "collection", "attribute" or "sample"
+	id: int
+*/
+func restoreFromTrashHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, "id must be a positive int", http.StatusBadRequest)
+		return
+	}
+
+	var table, event string
+	switch r.FormValue("type") {
+	case "collection":
+		table = "collections"
+	case "attribute":
+		table, event = "sample_attributes", "attribute.restored"
+	case "sample":
+		table, event = "samples", "sample.restored"
+	default:
+		http.Error(w, "type must be one of: collection, attribute, sample", http.StatusBadRequest)
+		return
+	}
+
+	// The collection of an attribute or sample must be restored first
+	var collectionId int
+	if table != "collections" {
+		var collectionDeleted bool
+		query := fmt.Sprintf("SELECT t.collection_id, c.deleted_at IS NOT NULL FROM %s t JOIN collections c ON c.id = t.collection_id WHERE t.id = ?", table)
+		err = DB.QueryRow(query, id).Scan(&collectionId, &collectionDeleted)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, r.FormValue("type")+" not found in the trash", http.StatusNotFound)
+				return
+			}
+			http.Error(w, "error when reading from database", http.StatusInternalServerError)
+			return
+		}
+		if collectionDeleted {
+			http.Error(w, "the collection is in the trash, restore it first", http.StatusConflict)
+			return
+		}
+	}
+
+	result, err := DB.Exec(fmt.Sprintf("UPDATE %s SET deleted_at = NULL WHERE id = ? AND deleted_at IS NOT NULL", table), id)
+	if err != nil {
+		http.Error(w, "failed to restore "+r.FormValue("type"), http.StatusInternalServerError)
+		return
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil || rowsAffected == 0 {
+		http.Error(w, r.FormValue("type")+" not found in the trash", http.StatusNotFound)
+		return
+	}
+	// A restored calculated attribute has missed the changes of its inputs
+	if table == "sample_attributes" {
+		if err := recomputeCollectionFormulas(collectionId); err != nil {
+			http.Error(w, "error when calculating values", http.StatusInternalServerError)
+			return
+		}
+	}
+	if event != "" {
+		emitWebhookEvent(collectionId, event, map[string]any{r.FormValue("type") + "_id": id})
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+/*
+Permanently deletes everything that has been in the trash longer than the
+retention period. The retention period defaults to TRASH_RETENTION_DAYS,
+or 30 days when that is not set. Samples with a chain of custody, and their
+collections, are kept since custody transfers can not be deleted.
+
+Query params:
+
+	older_than_days?: int // Overrides the retention period
+
+Result:
+
+	{
+		collections: int,
+		attributes: int,
+		samples: int
+	}
+*/
+func purgeTrashHandler(w http.ResponseWriter, r *http.Request) {
+	days, err := trashRetentionDays()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _days := r.FormValue("older_than_days"); _days != "" {
+		days, err = strconv.Atoi(_days)
+		if err != nil || days < 0 {
+			http.Error(w, "older_than_days must be a positive int", http.StatusBadRequest)
+			return
+		}
+	}
+	cutoff := time.Now().AddDate(0, 0, -days).Unix()
+
+	tx, err := DB.Begin()
+	if err != nil {
+		http.Error(w, "failed to purge trash", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Values, history and everything else below cascade with their parents
+	kept := map[string]string{
+		"samples":     " AND id NOT IN (SELECT sample_id FROM custody_transfers)",
+		"collections": " AND id NOT IN (SELECT s.collection_id FROM samples s JOIN custody_transfers t ON t.sample_id = s.id)",
+	}
+	purged := make(map[string]int64)
+	for _, table := range []string{"samples", "sample_attributes", "collections"} {
+		result, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE deleted_at IS NOT NULL AND deleted_at <= ?%s", table, kept[table]), cutoff)
+		if err != nil {
+			http.Error(w, "failed to purge trash", http.StatusInternalServerError)
+			return
+		}
+		purged[table], _ = result.RowsAffected()
+	}
+	if err = tx.Commit(); err != nil {
+		http.Error(w, "failed to purge trash", http.StatusInternalServerError)
+		return
+	}
+	// The attachments of purged records are gone, so are their files
+	if err = removeUnusedAttachmentFiles(); err != nil {
+		http.Error(w, "failed to remove attachment files", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int64{
+		"collections": purged["collections"],
+		"attributes":  purged["sample_attributes"],
+		"samples":     purged["samples"],
+	})
+}
+
+// Trash is the result of fetchTrashHandler
+type Trash struct {
+	Collections []TrashedItem `json:"collections"`
+	Attributes  []TrashedItem `json:"attributes"`
+	Samples     []TrashedItem `json:"samples"`
+}
+
+// TrashedItem is a collection, attribute or sample in the trash
+type TrashedItem struct {
+	Id           int     `json:"id"`
+	CollectionId *int    `json:"collection_id,omitempty"`
+	Name         *string `json:"name,omitempty"`
+	CreatedAt    *int64  `json:"created_at,omitempty"` // UNIX timestamp, samples only
+	Note         *string `json:"note,omitempty"`
+	DeletedAt    int64   `json:"deleted_at"` // UNIX timestamp
+}
+
+// Reads the retention period of the trash from the environment
+func trashRetentionDays() (int, error) {
+	_days := os.Getenv("TRASH_RETENTION_DAYS")
+	if _days == "" {
+		return defaultTrashRetentionDays, nil
+	}
+	days, err := strconv.Atoi(_days)
+	if err != nil || days < 0 {
+		return 0, fmt.Errorf("TRASH_RETENTION_DAYS must be a positive int")
+	}
+	return days, nil
+}
+
+// Whether a sample or its collection is in the trash. False if the sample does not exist.
+func isSampleTrashed(sampleId int) (bool, error) {
+	var trashed bool
+	query := `
+		SELECT s.deleted_at IS NOT NULL OR c.deleted_at IS NOT NULL
+		FROM samples s JOIN collections c ON c.id = s.collection_id
+		WHERE s.id = ?
+	`
+	err := DB.QueryRow(query, sampleId).Scan(&trashed)
+	if err != nil && err != sql.ErrNoRows {
+		return false, fmt.Errorf("isSampleTrashed: %v", err)
+	}
+	return trashed, nil
+}
+
+// Whether an attribute or its collection is in the trash. False if the attribute does not exist.
+func isAttributeTrashed(attributeId int) (bool, error) {
+	var trashed bool
+	query := `
+		SELECT a.deleted_at IS NOT NULL OR c.deleted_at IS NOT NULL
+		FROM sample_attributes a JOIN collections c ON c.id = a.collection_id
+		WHERE a.id = ?
+	`
+	err := DB.QueryRow(query, attributeId).Scan(&trashed)
+	if err != nil && err != sql.ErrNoRows {
+		return false, fmt.Errorf("isAttributeTrashed: %v", err)
+	}
+	return trashed, nil
+}
@@ -0,0 +1,621 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Parsing of unit expressions in the case sensitive Unified Code for Units of
+// Measure (UCUM, https://ucum.org). Only the atoms commonly seen in the lab
+// are known, see ucumAtoms.
+
+// ucumDimension holds the exponents of the UCUM base units
+// m (L), g (M), s (T), rad (A), K (K), C (Q) and cd (F)
+type ucumDimension [7]int
+
+var ucumDimensionSymbols = [7]string{"L", "M", "T", "A", "K", "Q", "F"}
+
+func (d ucumDimension) String() string {
+	parts := []string{}
+	for i, exponent := range d {
+		if exponent == 0 {
+			continue
+		}
+		if exponent == 1 {
+			parts = append(parts, ucumDimensionSymbols[i])
+		} else {
+			parts = append(parts, ucumDimensionSymbols[i]+strconv.Itoa(exponent))
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+// Names of common dimensions. Other dimensions are named by their exponents, e.g. "L2.T-1".
+var ucumDimensionNames = map[string]string{
+	"":          "dimensionless",
+	"L":         "length",
+	"M":         "mass",
+	"T":         "time",
+	"A":         "plane_angle",
+	"K":         "temperature",
+	"Q":         "charge",
+	"F":         "luminous_intensity",
+	"L2":        "area",
+	"L3":        "volume",
+	"L-3":       "amount_concentration", // The mole is dimensionless in UCUM
+	"L-3.M":     "mass_concentration",
+	"L-3.T-1":   "catalytic_concentration",
+	"T-1":       "frequency",
+	"L.T-1":     "velocity",
+	"L.T-2":     "acceleration",
+	"L.M.T-2":   "force",
+	"L-1.M.T-2": "pressure",
+	"L2.M.T-2":  "energy",
+	"L2.M.T-3":  "power",
+	"T-1.Q":     "current",
+}
+
+// ucumAtom is a unit symbol that may be combined into expressions
+type ucumAtom struct {
+	definition string        // UCUM expression the atom is defined by, empty for base units
+	value      float64       // Multiplier of the definition
+	dimension  ucumDimension // Base units only
+	metric     bool          // Whether the atom accepts prefixes
+	special    *ucumSpecial  // Units on a scale with an offset, e.g. degrees Celsius
+	arbitrary  bool          // Arbitrary units are only commensurable with themselves
+	print      string        // Printable symbol, the atom itself if empty
+}
+
+// ucumSpecial describes a unit on an offset scale: base = value * factor + offset
+type ucumSpecial struct {
+	factor float64
+	offset float64
+}
+
+var ucumAtoms = map[string]ucumAtom{
+	// Base units
+	"m":   {dimension: ucumDimension{1, 0, 0, 0, 0, 0, 0}, value: 1, metric: true},
+	"g":   {dimension: ucumDimension{0, 1, 0, 0, 0, 0, 0}, value: 1, metric: true},
+	"s":   {dimension: ucumDimension{0, 0, 1, 0, 0, 0, 0}, value: 1, metric: true},
+	"rad": {dimension: ucumDimension{0, 0, 0, 1, 0, 0, 0}, value: 1, metric: true},
+	"K":   {dimension: ucumDimension{0, 0, 0, 0, 1, 0, 0}, value: 1, metric: true},
+	"C":   {dimension: ucumDimension{0, 0, 0, 0, 0, 1, 0}, value: 1, metric: true},
+	"cd":  {dimension: ucumDimension{0, 0, 0, 0, 0, 0, 1}, value: 1, metric: true},
+
+	// Dimensionless
+	"10*":    {definition: "1", value: 10},
+	"10^":    {definition: "1", value: 10},
+	"[pi]":   {definition: "1", value: math.Pi, print: "π"},
+	"%":      {definition: "1", value: 1e-2},
+	"[ppth]": {definition: "1", value: 1e-3, print: "‰"},
+	"[ppm]":  {definition: "1", value: 1e-6, print: "ppm"},
+	"[ppb]":  {definition: "1", value: 1e-9, print: "ppb"},
+	"[pptr]": {definition: "1", value: 1e-12, print: "ppt"},
+	"mol":    {definition: "1", value: 6.0221367e23, metric: true},
+	"eq":     {definition: "mol", value: 1, metric: true},
+	"osm":    {definition: "mol", value: 1, metric: true},
+	"sr":     {definition: "rad2", value: 1, metric: true},
+	"deg":    {definition: "rad", value: math.Pi / 180, print: "°"},
+
+	// SI derived units
+	"Hz":  {definition: "s-1", value: 1, metric: true},
+	"N":   {definition: "kg.m/s2", value: 1, metric: true},
+	"Pa":  {definition: "N/m2", value: 1, metric: true},
+	"J":   {definition: "N.m", value: 1, metric: true},
+	"W":   {definition: "J/s", value: 1, metric: true},
+	"A":   {definition: "C/s", value: 1, metric: true},
+	"V":   {definition: "J/C", value: 1, metric: true},
+	"F":   {definition: "C/V", value: 1, metric: true},
+	"Ohm": {definition: "V/A", value: 1, metric: true, print: "Ω"},
+	"S":   {definition: "Ohm-1", value: 1, metric: true},
+	"Wb":  {definition: "V.s", value: 1, metric: true},
+	"T":   {definition: "Wb/m2", value: 1, metric: true},
+	"H":   {definition: "Wb/A", value: 1, metric: true},
+	"lm":  {definition: "cd.sr", value: 1, metric: true},
+	"lx":  {definition: "lm/m2", value: 1, metric: true},
+	"Bq":  {definition: "s-1", value: 1, metric: true},
+	"Gy":  {definition: "J/kg", value: 1, metric: true},
+	"Sv":  {definition: "J/kg", value: 1, metric: true},
+	"kat": {definition: "mol/s", value: 1, metric: true},
+	"U":   {definition: "umol/min", value: 1, metric: true},
+	"Cel": {definition: "K", value: 1, special: &ucumSpecial{factor: 1, offset: 273.15}, print: "°C"},
+
+	// Other metric units
+	"L":       {definition: "dm3", value: 1, metric: true},
+	"t":       {definition: "kg", value: 1e3, metric: true},
+	"bar":     {definition: "Pa", value: 1e5, metric: true},
+	"cal":     {definition: "J", value: 4.184, metric: true},
+	"eV":      {definition: "J", value: 1.60217733e-19, metric: true},
+	"m[Hg]":   {definition: "kPa", value: 133.322, metric: true, print: "mHg"},
+	"m[H2O]":  {definition: "kPa", value: 9.80665, metric: true, print: "mH₂O"},
+	"[iU]":    {definition: "1", value: 1, metric: true, arbitrary: true, print: "IU"},
+	"[arb'U]": {definition: "1", value: 1, arbitrary: true, print: "arb. U"},
+
+	// Time
+	"min": {definition: "s", value: 60},
+	"h":   {definition: "min", value: 60},
+	"d":   {definition: "h", value: 24},
+	"wk":  {definition: "d", value: 7},
+	"a":   {definition: "d", value: 365.25},
+	"mo":  {definition: "a", value: 1.0 / 12},
+
+	// Customary units
+	"atm":      {definition: "Pa", value: 101325},
+	"[g]":      {definition: "m/s2", value: 9.80665, print: "gₙ"},
+	"[in_i]":   {definition: "cm", value: 2.54, print: "in"},
+	"[ft_i]":   {definition: "[in_i]", value: 12, print: "ft"},
+	"[lb_av]":  {definition: "g", value: 453.59237, print: "lb"},
+	"[oz_av]":  {definition: "[lb_av]", value: 1.0 / 16, print: "oz"},
+	"[lbf_av]": {definition: "[lb_av].[g]", value: 1, print: "lbf"},
+	"[psi]":    {definition: "[lbf_av]/[in_i]2", value: 1, print: "psi"},
+	"[gal_us]": {definition: "[in_i]3", value: 231, print: "gal"},
+	"[degF]":   {definition: "K", value: 1, special: &ucumSpecial{factor: 5.0 / 9, offset: 459.67 * 5 / 9}, print: "°F"},
+}
+
+// Alternative spellings of atoms, mapped to the atom used in the canonical form
+var ucumAliases = map[string]string{
+	"l":    "L",
+	"[IU]": "[iU]",
+}
+
+// Metric prefixes and their factors
+var ucumPrefixes = map[string]float64{
+	"Y": 1e24, "Z": 1e21, "E": 1e18, "P": 1e15, "T": 1e12, "G": 1e9, "M": 1e6, "k": 1e3, "h": 1e2, "da": 1e1,
+	"d": 1e-1, "c": 1e-2, "m": 1e-3, "u": 1e-6, "n": 1e-9, "p": 1e-12, "f": 1e-15, "a": 1e-18, "z": 1e-21, "y": 1e-24,
+}
+
+// ucumUnit is a parsed UCUM expression
+type ucumUnit struct {
+	Canonical string // Normalized expression, equal for equivalent spellings
+	Symbol    string // Printable symbol, e.g. "µmol/L"
+	Dimension string // Name of the dimension, units of the same dimension are commensurable
+	Factor    float64
+	Offset    float64 // Only set for special units, e.g. Cel
+}
+
+// Parses a UCUM expression, e.g. "mg/dL", "umol/L", "Cel" or "m2.s-1"
+func parseUcum(expression string) (ucumUnit, error) {
+	// µ is a common way to write the micro prefix, UCUM uses u
+	expression = strings.ReplaceAll(strings.TrimSpace(expression), "µ", "u")
+	if expression == "" {
+		return ucumUnit{}, fmt.Errorf("empty unit expression")
+	}
+
+	p := ucumParser{input: []rune(expression)}
+	value, err := p.parseTerm()
+	if err != nil {
+		return ucumUnit{}, err
+	}
+	if p.pos < len(p.input) {
+		return ucumUnit{}, fmt.Errorf("unexpected %q at position %d", string(p.input[p.pos]), p.pos+1)
+	}
+
+	unit := ucumUnit{
+		Canonical: value.canonical(),
+		Symbol:    value.symbol(),
+		Factor:    roundSignificant(value.factor, 15),
+	}
+
+	dimension := value.dimension.String()
+	if name, ok := ucumDimensionNames[dimension]; ok {
+		unit.Dimension = name
+	} else {
+		unit.Dimension = dimension
+	}
+	// Arbitrary units are only commensurable with the same arbitrary units in
+	// the same dimension, e.g. [iU]/L with [iU]/mL but not with [iU]
+	if arbitrary := value.arbitraryAtoms(); arbitrary != "" {
+		unit.Dimension = "arbitrary:" + arbitrary
+		if dimension != "" {
+			unit.Dimension += "." + dimension
+		}
+	}
+
+	if value.special != nil {
+		// Special units cannot be part of a larger expression
+		if len(value.terms) != 1 || value.terms[0].exponent != 1 {
+			return ucumUnit{}, fmt.Errorf("units on an offset scale like Cel cannot be combined with other units")
+		}
+		unit.Factor = value.special.factor
+		unit.Offset = value.special.offset
+	}
+	return unit, nil
+}
+
+// Reports whether values in one unit can be converted to the other
+func (u ucumUnit) commensurableWith(other ucumUnit) bool {
+	return u.Dimension == other.Dimension
+}
+
+// ucumValue is the meaning of a (partial) expression
+type ucumValue struct {
+	factor    float64
+	dimension ucumDimension
+	terms     []ucumTerm // The symbols the expression was written with
+	special   *ucumSpecial
+}
+
+// ucumTerm is a prefixed atom, number or annotation with an exponent
+type ucumTerm struct {
+	prefix   string
+	atom     string
+	exponent int
+}
+
+func (t ucumTerm) key() string { return t.prefix + t.atom }
+
+func (v ucumValue) multiply(other ucumValue) ucumValue {
+	result := ucumValue{
+		factor:  v.factor * other.factor,
+		terms:   append(append([]ucumTerm{}, v.terms...), other.terms...),
+		special: v.special,
+	}
+	for i := range result.dimension {
+		result.dimension[i] = v.dimension[i] + other.dimension[i]
+	}
+	if other.special != nil {
+		result.special = other.special
+	}
+	return result
+}
+
+func (v ucumValue) power(exponent int) ucumValue {
+	result := ucumValue{
+		factor:  math.Pow(v.factor, float64(exponent)),
+		special: v.special,
+	}
+	for i := range result.dimension {
+		result.dimension[i] = v.dimension[i] * exponent
+	}
+	for _, term := range v.terms {
+		term.exponent *= exponent
+		result.terms = append(result.terms, term)
+	}
+	return result
+}
+
+// Combines equal terms and orders them, numerator first
+func (v ucumValue) normalizedTerms() []ucumTerm {
+	exponents := make(map[string]int)
+	byKey := make(map[string]ucumTerm)
+	for _, term := range v.terms {
+		exponents[term.key()] += term.exponent
+		byKey[term.key()] = term
+	}
+
+	terms := []ucumTerm{}
+	for key, exponent := range exponents {
+		if exponent == 0 {
+			continue
+		}
+		term := byKey[key]
+		term.exponent = exponent
+		terms = append(terms, term)
+	}
+	sort.Slice(terms, func(i, j int) bool {
+		if (terms[i].exponent > 0) != (terms[j].exponent > 0) {
+			return terms[i].exponent > 0
+		}
+		return terms[i].key() < terms[j].key()
+	})
+	return terms
+}
+
+// Returns the expression in a normal form, e.g. "mg/dL", "mg.dL-1" and "dL-1.mg" all give "mg.dL-1"
+func (v ucumValue) canonical() string {
+	parts := []string{}
+	for _, term := range v.normalizedTerms() {
+		if term.exponent == 1 {
+			parts = append(parts, term.key())
+		} else {
+			parts = append(parts, term.key()+strconv.Itoa(term.exponent))
+		}
+	}
+	if len(parts) == 0 {
+		return "1"
+	}
+	return strings.Join(parts, ".")
+}
+
+// Returns the arbitrary atoms of the expression with their exponents, e.g.
+// "[iU]" or "[arb'U].[iU]-1". Prefixes are left out, they only scale the value.
+func (v ucumValue) arbitraryAtoms() string {
+	exponents := make(map[string]int)
+	for _, term := range v.terms {
+		if ucumAtoms[term.atom].arbitrary {
+			exponents[term.atom] += term.exponent
+		}
+	}
+
+	atoms := []string{}
+	for atom, exponent := range exponents {
+		if exponent == 0 {
+			continue
+		}
+		if exponent == 1 {
+			atoms = append(atoms, atom)
+		} else {
+			atoms = append(atoms, atom+strconv.Itoa(exponent))
+		}
+	}
+	sort.Strings(atoms)
+	return strings.Join(atoms, ".")
+}
+
+// Returns a printable symbol, e.g. "µmol/L" or "m²/s"
+func (v ucumValue) symbol() string {
+	var numerator, denominator []string
+	for _, term := range v.normalizedTerms() {
+		text := term.prefix
+		if text == "u" {
+			text = "µ"
+		}
+		if atom, ok := ucumAtoms[term.atom]; ok && atom.print != "" {
+			text += atom.print
+		} else {
+			text += strings.Trim(term.atom, "{}")
+		}
+
+		exponent := term.exponent
+		if exponent < 0 {
+			exponent = -exponent
+		}
+		if term.atom == "10*" || term.atom == "10^" {
+			text = "10" + superscript(exponent)
+		} else if exponent != 1 {
+			text += superscript(exponent)
+		}
+
+		if term.exponent > 0 {
+			numerator = append(numerator, text)
+		} else {
+			denominator = append(denominator, text)
+		}
+	}
+
+	symbol := strings.Join(numerator, "·")
+	if len(numerator) == 0 {
+		symbol = "1"
+	}
+	if len(denominator) == 1 {
+		symbol += "/" + denominator[0]
+	} else if len(denominator) > 1 {
+		symbol += "/(" + strings.Join(denominator, "·") + ")"
+	}
+	return symbol
+}
+
+// Rounds away the floating point noise left by chains of prefix and definition factors
+func roundSignificant(x float64, digits int) float64 {
+	rounded, err := strconv.ParseFloat(strconv.FormatFloat(x, 'g', digits, 64), 64)
+	if err != nil {
+		return x
+	}
+	return rounded
+}
+
+func superscript(n int) string {
+	digits := []rune("⁰¹²³⁴⁵⁶⁷⁸⁹")
+	var b strings.Builder
+	for _, c := range strconv.Itoa(n) {
+		b.WriteRune(digits[c-'0'])
+	}
+	return b.String()
+}
+
+type ucumParser struct {
+	input []rune
+	pos   int
+}
+
+func (p *ucumParser) peek() rune {
+	if p.pos >= len(p.input) {
+		return 0
+	}
+	return p.input[p.pos]
+}
+
+// term := ["/"] component (("." | "/") component)*
+func (p *ucumParser) parseTerm() (ucumValue, error) {
+	value := ucumValue{factor: 1}
+	divide := false
+	if p.peek() == '/' {
+		p.pos++
+		divide = true
+	}
+	for {
+		component, err := p.parseComponent()
+		if err != nil {
+			return ucumValue{}, err
+		}
+		if divide {
+			component = component.power(-1)
+		}
+		value = value.multiply(component)
+
+		switch p.peek() {
+		case '.':
+			divide = false
+		case '/':
+			divide = true
+		default:
+			return value, nil
+		}
+		p.pos++
+	}
+}
+
+// component := "(" term ")" | annotation | factor | simple-unit [exponent] [annotation]
+func (p *ucumParser) parseComponent() (ucumValue, error) {
+	switch c := p.peek(); {
+	case c == 0:
+		return ucumValue{}, fmt.Errorf("unexpected end of unit expression")
+	case c == '(':
+		p.pos++
+		value, err := p.parseTerm()
+		if err != nil {
+			return ucumValue{}, err
+		}
+		if p.peek() != ')' {
+			return ucumValue{}, fmt.Errorf("missing closing parenthesis")
+		}
+		p.pos++
+		return value, nil
+	case c == '{':
+		annotation, err := p.parseAnnotation()
+		if err != nil {
+			return ucumValue{}, err
+		}
+		return ucumValue{factor: 1, terms: []ucumTerm{{atom: annotation, exponent: 1}}}, nil
+	case unicode.IsDigit(c) && !p.hasPrefix("10*") && !p.hasPrefix("10^"):
+		start := p.pos
+		for unicode.IsDigit(p.peek()) {
+			p.pos++
+		}
+		digits := string(p.input[start:p.pos])
+		factor, err := strconv.ParseFloat(digits, 64)
+		if err != nil || factor == 0 {
+			return ucumValue{}, fmt.Errorf("invalid factor %q", digits)
+		}
+		return ucumValue{factor: factor, terms: []ucumTerm{{atom: digits, exponent: 1}}}, nil
+	}
+
+	symbol := p.readSymbol()
+	if symbol == "" {
+		return ucumValue{}, fmt.Errorf("unexpected %q at position %d", string(p.peek()), p.pos+1)
+	}
+	value, err := resolveUcumSymbol(symbol)
+	if err != nil {
+		return ucumValue{}, err
+	}
+
+	exponent, err := p.parseExponent()
+	if err != nil {
+		return ucumValue{}, err
+	}
+	value = value.power(exponent)
+
+	// An annotation on a unit does not change its meaning, but is kept in the canonical form
+	if p.peek() == '{' {
+		annotation, err := p.parseAnnotation()
+		if err != nil {
+			return ucumValue{}, err
+		}
+		value.terms = append(value.terms, ucumTerm{atom: annotation, exponent: 1})
+	}
+	return value, nil
+}
+
+func (p *ucumParser) hasPrefix(prefix string) bool {
+	return strings.HasPrefix(string(p.input[p.pos:]), prefix)
+}
+
+// Reads the symbol of a unit, including bracketed parts like [in_i] or m[Hg]
+func (p *ucumParser) readSymbol() string {
+	start := p.pos
+	if p.hasPrefix("10*") || p.hasPrefix("10^") {
+		p.pos += 3
+		return string(p.input[start:p.pos])
+	}
+	for p.pos < len(p.input) {
+		c := p.input[p.pos]
+		if c == '[' {
+			end := strings.IndexRune(string(p.input[p.pos:]), ']')
+			if end < 0 {
+				break
+			}
+			p.pos += len([]rune(string(p.input[p.pos:])[:end])) + 1
+			continue
+		}
+		if unicode.IsDigit(c) || strings.ContainsRune("+-./(){}", c) || unicode.IsSpace(c) {
+			break
+		}
+		p.pos++
+	}
+	return string(p.input[start:p.pos])
+}
+
+// exponent := ["+" | "-"] digits
+func (p *ucumParser) parseExponent() (int, error) {
+	start := p.pos
+	if p.peek() == '+' || p.peek() == '-' {
+		p.pos++
+	}
+	for unicode.IsDigit(p.peek()) {
+		p.pos++
+	}
+	text := string(p.input[start:p.pos])
+	if text == "" {
+		return 1, nil
+	}
+	exponent, err := strconv.Atoi(text)
+	if err != nil || exponent == 0 {
+		return 0, fmt.Errorf("invalid exponent %q", text)
+	}
+	return exponent, nil
+}
+
+func (p *ucumParser) parseAnnotation() (string, error) {
+	end := strings.IndexRune(string(p.input[p.pos:]), '}')
+	if end < 0 {
+		return "", fmt.Errorf("missing closing brace")
+	}
+	annotation := string(p.input[p.pos:])[:end+1]
+	p.pos += len([]rune(annotation))
+	return annotation, nil
+}
+
+// Finds the atom, and prefix if any, a symbol is written with
+func resolveUcumSymbol(symbol string) (ucumValue, error) {
+	if alias, ok := ucumAliases[symbol]; ok {
+		symbol = alias
+	}
+	if _, ok := ucumAtoms[symbol]; ok {
+		return ucumAtomValue("", symbol)
+	}
+
+	// Try the two letter prefix first, "da" would otherwise read as deci
+	prefixes := make([]string, 0, len(ucumPrefixes))
+	for prefix := range ucumPrefixes {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Slice(prefixes, func(i, j int) bool { return len(prefixes[i]) > len(prefixes[j]) })
+	for _, prefix := range prefixes {
+		if !strings.HasPrefix(symbol, prefix) {
+			continue
+		}
+		atom := strings.TrimPrefix(symbol, prefix)
+		if alias, ok := ucumAliases[atom]; ok {
+			atom = alias
+		}
+		if definition, ok := ucumAtoms[atom]; ok && definition.metric {
+			return ucumAtomValue(prefix, atom)
+		}
+	}
+	return ucumValue{}, fmt.Errorf("unknown unit %q", symbol)
+}
+
+// Returns the value of a prefixed atom in base units
+func ucumAtomValue(prefix string, atom string) (ucumValue, error) {
+	definition := ucumAtoms[atom]
+	value := ucumValue{factor: definition.value, dimension: definition.dimension}
+	if definition.definition != "" {
+		p := ucumParser{input: []rune(definition.definition)}
+		defined, err := p.parseTerm()
+		if err != nil {
+			return ucumValue{}, fmt.Errorf("invalid definition of %s: %v", atom, err)
+		}
+		value.factor *= defined.factor
+		value.dimension = defined.dimension
+	}
+	if prefix != "" {
+		value.factor *= ucumPrefixes[prefix]
+	}
+	value.terms = []ucumTerm{{prefix: prefix, atom: atom, exponent: 1}}
+	value.special = definition.special
+	return value, nil
+}
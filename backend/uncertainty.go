@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// A standard uncertainty is absolute, in the unit of the value, or relative,
+// in percent of the value
+const (
+	uncertaintyAbsolute = "absolute"
+	uncertaintyRelative = "relative"
+)
+
+// Uncertainties calculated by the system are rounded to this many significant figures
+const calculatedUncertaintyFigures = 2
+
+// The standard uncertainty and declared significant figures of a value, all nullable.
+// The uncertainty is kept as it was written, like values are.
+type MeasurementPrecision struct {
+	Uncertainty        *string `json:"uncertainty,omitempty"`
+	UncertaintyType    *string `json:"uncertainty_type,omitempty"` // "absolute" or "relative", set with the uncertainty
+	SignificantFigures *int    `json:"significant_figures,omitempty"`
+}
+
+// Checks the uncertainty and significant figures of a value. An uncertainty
+// without a type is absolute.
+func (precision *MeasurementPrecision) normalize() error {
+	if precision.Uncertainty != nil && strings.TrimSpace(*precision.Uncertainty) == "" {
+		precision.Uncertainty = nil
+	}
+	if precision.Uncertainty == nil {
+		if precision.UncertaintyType != nil {
+			return fmt.Errorf("uncertainty_type requires an uncertainty")
+		}
+	} else {
+		uncertainty := strings.TrimSpace(*precision.Uncertainty)
+		number, ok := parseFiniteNumber(uncertainty)
+		if !ok || number < 0 {
+			return fmt.Errorf("uncertainty must be a non-negative number")
+		}
+		precision.Uncertainty = &uncertainty
+		if precision.UncertaintyType == nil {
+			kind := uncertaintyAbsolute
+			precision.UncertaintyType = &kind
+		}
+		if *precision.UncertaintyType != uncertaintyAbsolute && *precision.UncertaintyType != uncertaintyRelative {
+			return fmt.Errorf("uncertainty_type must be absolute or relative")
+		}
+	}
+	if precision.SignificantFigures != nil && (*precision.SignificantFigures < 1 || *precision.SignificantFigures > 15) {
+		return fmt.Errorf("significant_figures must be between 1 and 15")
+	}
+	return nil
+}
+
+// Parses the optional uncertainty, uncertainty_type and significant_figures params of a value
+func parseMeasurementPrecision(r *http.Request) (MeasurementPrecision, error) {
+	var precision MeasurementPrecision
+	if uncertainty := r.FormValue("uncertainty"); uncertainty != "" {
+		precision.Uncertainty = &uncertainty
+	}
+	if kind := r.FormValue("uncertainty_type"); kind != "" {
+		precision.UncertaintyType = &kind
+	}
+	if _figures := r.FormValue("significant_figures"); _figures != "" {
+		figures, err := strconv.Atoi(_figures)
+		if err != nil {
+			return precision, fmt.Errorf("significant_figures must be an int")
+		}
+		precision.SignificantFigures = &figures
+	}
+	return precision, precision.normalize()
+}
+
+// Converts an absolute uncertainty given in some unit into the unit of the
+// attribute. Conversions are linear, so the uncertainty scales like the
+// difference between two values.
+func convertUncertaintyToAttributeUnit(q queryRower, attributeId int, unitId int, precision MeasurementPrecision) (MeasurementPrecision, error) {
+	if precision.Uncertainty == nil || *precision.UncertaintyType != uncertaintyAbsolute {
+		return precision, nil
+	}
+	upper, err := convertToAttributeUnit(q, attributeId, unitId, *precision.Uncertainty)
+	if err != nil {
+		return precision, err
+	}
+	lower, err := convertToAttributeUnit(q, attributeId, unitId, "0")
+	if err != nil {
+		return precision, err
+	}
+	a, _ := strconv.ParseFloat(upper, 64)
+	b, _ := strconv.ParseFloat(lower, 64)
+	uncertainty := strconv.FormatFloat(math.Abs(a-b), 'g', 10, 64)
+	precision.Uncertainty = &uncertainty
+	return precision, nil
+}
+
+// Writes a value with its declared significant figures, keeping trailing
+// zeros like "1.20". Values without declared figures are returned as they are.
+func applySignificantFigures(value string, figures *int) (string, error) {
+	if figures == nil {
+		return value, nil
+	}
+	number, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		return "", fmt.Errorf("values with significant_figures must be numbers")
+	}
+	return formatSignificantFigures(number, *figures), nil
+}
+
+// Formats a number with the given significant figures. Numbers that would need
+// zeros in front of the decimal point to be written out are written in
+// scientific notation, so no figures are implied that were not declared.
+func formatSignificantFigures(number float64, figures int) string {
+	scientific := strconv.FormatFloat(number, 'e', figures-1, 64)
+	exponent, err := strconv.Atoi(scientific[strings.IndexByte(scientific, 'e')+1:])
+	if err != nil || exponent < -4 || exponent >= figures {
+		return scientific
+	}
+	return strconv.FormatFloat(number, 'f', figures-1-exponent, 64)
+}
+
+// Returns the absolute standard uncertainty of a value, 0 if it has none
+func absoluteUncertainty(number float64, precision MeasurementPrecision) float64 {
+	if precision.Uncertainty == nil {
+		return 0
+	}
+	uncertainty, err := strconv.ParseFloat(*precision.Uncertainty, 64)
+	if err != nil {
+		return 0
+	}
+	if precision.UncertaintyType != nil && *precision.UncertaintyType == uncertaintyRelative {
+		return math.Abs(number) * uncertainty / 100
+	}
+	return uncertainty
+}
+
+// Propagates the standard uncertainties of the inputs of a formula to its
+// result, by Kragten's method: the formula is evaluated with each input moved
+// by its uncertainty, and the changes of the result are added in quadrature.
+// Inputs are taken as uncorrelated. Returns false if no input has an
+// uncertainty or the formula cannot be evaluated around the inputs.
+func propagateUncertainty(formula *Formula, values map[string]float64, uncertainties map[string]float64) (float64, bool) {
+	shifted := make(map[string]float64, len(values))
+	for name, number := range values {
+		shifted[name] = number
+	}
+
+	sum, propagated := 0.0, false
+	for _, name := range formula.References {
+		uncertainty := uncertainties[name]
+		if uncertainty == 0 {
+			continue
+		}
+		shifted[name] = values[name] + uncertainty
+		upper, err := formula.evaluate(shifted)
+		if err != nil {
+			return 0, false
+		}
+		shifted[name] = values[name] - uncertainty
+		lower, err := formula.evaluate(shifted)
+		if err != nil {
+			return 0, false
+		}
+		shifted[name] = values[name]
+
+		change := (upper - lower) / 2
+		sum += change * change
+		propagated = true
+	}
+	return math.Sqrt(sum), propagated
+}
+
+// Significant figures of a calculated value: the fewest of its inputs, if every
+// input declares them
+func propagateSignificantFigures(formula *Formula, figures map[string]int) *int {
+	var fewest *int
+	for _, name := range formula.References {
+		inputFigures, ok := figures[name]
+		if !ok {
+			return nil
+		}
+		if fewest == nil || inputFigures < *fewest {
+			fewest = &inputFigures
+		}
+	}
+	return fewest
+}
+
+// Writes an uncertainty for a CSV cell, relative uncertainties with a percent sign
+func formatUncertainty(precision MeasurementPrecision) string {
+	if precision.Uncertainty == nil {
+		return ""
+	}
+	if precision.UncertaintyType != nil && *precision.UncertaintyType == uncertaintyRelative {
+		return *precision.Uncertainty + "%"
+	}
+	return *precision.Uncertainty
+}
@@ -10,7 +10,11 @@ import (
 )
 
 /*
-Inserts a new unit into the units table
+Inserts a new unit into the units table. The name must be a UCUM
+expression, e.g. "mg/dL", "umol/L", "Cel" or "m2.s-1". Units that are
+spelled differently but mean the same, like "mg/L" and "mg/l", are
+rejected as duplicates. Units of the same dimension convert into each
+other through the base unit of the dimension: base = value * factor + offset
 
 Query params:
 
@@ -28,10 +32,36 @@ func insertUnitHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	query := "INSERT INTO units (name) VALUES (?)"
-	result, err := DB.Exec(query, name)
+	parsed, err := parseUcum(name)
 	if err != nil {
-		if strings.Contains(err.Error(), "UNIQUE constraint failed: units.name") {
+		http.Error(w, "name must be a UCUM expression: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Equivalent spellings have the same canonical form
+	var existing string
+	err = DB.QueryRow("SELECT name FROM units WHERE canonical = ?", parsed.Canonical).Scan(&existing)
+	if err == nil {
+		http.Error(w, "unit already exists as "+existing, http.StatusBadRequest)
+		return
+	} else if err != sql.ErrNoRows {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+
+	unit := Unit{
+		Name:      name,
+		Canonical: &parsed.Canonical,
+		Symbol:    &parsed.Symbol,
+		Dimension: &parsed.Dimension,
+		Factor:    &parsed.Factor,
+		Offset:    &parsed.Offset,
+	}
+
+	query := "INSERT INTO units (name, canonical, symbol, dimension, factor, offset) VALUES (?, ?, ?, ?, ?, ?)"
+	result, err := DB.Exec(query, unit.Name, unit.Canonical, unit.Symbol, unit.Dimension, unit.Factor, unit.Offset)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed: units.") {
 			http.Error(w, "unit already exists", http.StatusBadRequest)
 			return
 		}
@@ -61,7 +91,12 @@ Result:
 
 	[{
 		id: int,
-		name: string
+		name: string,
+		canonical: string,
+		symbol: string,
+		dimension: string,
+		factor: float,
+		offset: float
 	}]
 */
 func fetchUnitsHandler(w http.ResponseWriter, r *http.Request) {
@@ -70,7 +105,7 @@ func fetchUnitsHandler(w http.ResponseWriter, r *http.Request) {
 	_id := r.FormValue("id")
 	if _id == "" {
 		// No id, so get all
-		rows, err := DB.Query("SELECT id, name FROM units")
+		rows, err := DB.Query("SELECT id, name, canonical, symbol, dimension, factor, offset FROM units")
 		if err != nil {
 			http.Error(w, "error when reading from database", http.StatusInternalServerError)
 			return
@@ -79,7 +114,7 @@ func fetchUnitsHandler(w http.ResponseWriter, r *http.Request) {
 
 		for rows.Next() {
 			var unit Unit
-			if err := rows.Scan(&unit.Id, &unit.Name); err != nil {
+			if err := rows.Scan(&unit.Id, &unit.Name, &unit.Canonical, &unit.Symbol, &unit.Dimension, &unit.Factor, &unit.Offset); err != nil {
 				http.Error(w, "error when reading from database", http.StatusInternalServerError)
 				return
 			}
@@ -103,7 +138,7 @@ func fetchUnitsHandler(w http.ResponseWriter, r *http.Request) {
 		unit := Unit{
 			Id: id,
 		}
-		err = DB.QueryRow("SELECT name FROM units WHERE id = ?", id).Scan(&unit.Name)
+		err = DB.QueryRow("SELECT name, canonical, symbol, dimension, factor, offset FROM units WHERE id = ?", id).Scan(&unit.Name, &unit.Canonical, &unit.Symbol, &unit.Dimension, &unit.Factor, &unit.Offset)
 		if err != nil {
 			if err == sql.ErrNoRows {
 				w.WriteHeader(http.StatusNoContent)
@@ -125,7 +160,374 @@ func fetchUnitsHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintln(w, string(result))
 }
 
+/*
+Renames a unit. The new name must be a UCUM expression that is not
+already used by another unit, and must mean the same as the current
+name, e.g. "mg/l" for "mg/L". Stored values are not converted, so a
+unit cannot be renamed into another unit; merge it into that unit with
+convert_values instead.
+
+Query params:
+
+	unit_id: int,
+	name: string
+*/
+func updateUnitHandler(w http.ResponseWriter, r *http.Request) {
+	unitId, err := strconv.Atoi(r.FormValue("unit_id"))
+	if err != nil {
+		http.Error(w, "unit_id must be a positive int", http.StatusBadRequest)
+		return
+	}
+	name := r.FormValue("name")
+	if name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	} else if len(name) > 32 {
+		http.Error(w, "name must be at most 32 characters", http.StatusBadRequest)
+		return
+	}
+
+	parsed, err := parseUcum(name)
+	if err != nil {
+		http.Error(w, "name must be a UCUM expression: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Equivalent spellings have the same canonical form
+	var existing string
+	err = DB.QueryRow("SELECT name FROM units WHERE canonical = ? AND id != ?", parsed.Canonical, unitId).Scan(&existing)
+	if err == nil {
+		http.Error(w, "unit already exists as "+existing, http.StatusBadRequest)
+		return
+	} else if err != sql.ErrNoRows {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+
+	// Values are stored in the unit, so the new name must mean the same.
+	// Units that were never parsed have no meaning to keep yet.
+	var current Unit
+	err = DB.QueryRow("SELECT name, dimension, factor, offset FROM units WHERE id = ?", unitId).Scan(&current.Name, &current.Dimension, &current.Factor, &current.Offset)
+	if err == sql.ErrNoRows {
+		http.Error(w, "unit not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	if current.Dimension != nil && current.Factor != nil && current.Offset != nil &&
+		(*current.Dimension != parsed.Dimension || *current.Factor != parsed.Factor || *current.Offset != parsed.Offset) {
+		http.Error(w, name+" is not the same unit as "+current.Name+", merge into a unit with convert_values to change the unit of values", http.StatusBadRequest)
+		return
+	}
+
+	query := "UPDATE units SET name = ?, canonical = ?, symbol = ?, dimension = ?, factor = ?, offset = ? WHERE id = ?"
+	result, err := DB.Exec(query, name, parsed.Canonical, parsed.Symbol, parsed.Dimension, parsed.Factor, parsed.Offset, unitId)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed: units.") {
+			http.Error(w, "unit already exists", http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "error when updating unit in database", http.StatusInternalServerError)
+		return
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil || rowsAffected == 0 {
+		http.Error(w, "unit not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+/*
+Merges one unit into another. Attributes using the source unit are moved
+to the target unit and the source unit is deleted. With convert_values
+the stored values and limits are converted to the target unit, otherwise
+the units are assumed to mean the same. Units of attributes that samples in
+a locked workflow state have values for cannot be merged.
+
+Query params:
+
+	source_unit_id: int,
+	target_unit_id: int,
+	convert_values?: bool
+*/
+func mergeUnitsHandler(w http.ResponseWriter, r *http.Request) {
+	sourceId, err := strconv.Atoi(r.FormValue("source_unit_id"))
+	if err != nil {
+		http.Error(w, "source_unit_id must be a positive int", http.StatusBadRequest)
+		return
+	}
+	targetId, err := strconv.Atoi(r.FormValue("target_unit_id"))
+	if err != nil {
+		http.Error(w, "target_unit_id must be a positive int", http.StatusBadRequest)
+		return
+	}
+	if sourceId == targetId {
+		http.Error(w, "source_unit_id and target_unit_id must differ", http.StatusBadRequest)
+		return
+	}
+	convertValues := false
+	if _convertValues := r.FormValue("convert_values"); _convertValues != "" {
+		convertValues, err = strconv.ParseBool(_convertValues)
+		if err != nil {
+			http.Error(w, "convert_values must be a bool", http.StatusBadRequest)
+			return
+		}
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		http.Error(w, "error when updating units in database", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	source, err := readUnit(tx, sourceId)
+	if err != nil {
+		http.Error(w, "source unit not found", http.StatusNotFound)
+		return
+	}
+	target, err := readUnit(tx, targetId)
+	if err != nil {
+		http.Error(w, "target unit not found", http.StatusNotFound)
+		return
+	}
+
+	rows, err := tx.Query("SELECT id FROM sample_attributes WHERE unit_id = ?", sourceId)
+	if err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	var attributeIds []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			http.Error(w, "error when reading from database", http.StatusInternalServerError)
+			return
+		}
+		attributeIds = append(attributeIds, id)
+	}
+	rows.Close()
+
+	// Values of locked samples are read-only, also in which unit they are
+	for _, attributeId := range attributeIds {
+		if err := checkAttributeUnlocked(tx, attributeId); err != nil {
+			if _, ok := err.(lockedValuesError); ok {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			http.Error(w, "error when reading from database", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if convertValues {
+		for _, attributeId := range attributeIds {
+			if err := convertAttributeValues(tx, attributeId, source, target); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	if _, err := tx.Exec("UPDATE sample_attributes SET unit_id = ? WHERE unit_id = ?", targetId, sourceId); err != nil {
+		http.Error(w, "error when updating units in database", http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM units WHERE id = ?", sourceId); err != nil {
+		http.Error(w, "error when updating units in database", http.StatusInternalServerError)
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		http.Error(w, "error when updating units in database", http.StatusInternalServerError)
+		return
+	}
+	if convertValues {
+		for _, attributeId := range attributeIds {
+			if err := reevaluateAttributeFlags(attributeId); err != nil {
+				http.Error(w, "error when evaluating values", http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"attributes_moved": len(attributeIds)})
+}
+
+/*
+Parses a UCUM expression without storing it
+
+Query params:
+
+	expression: string
+
+Result:
+
+	{
+		canonical: string,
+		symbol: string,
+		dimension: string,
+		factor: float,
+		offset: float
+	}
+*/
+func parseUnitHandler(w http.ResponseWriter, r *http.Request) {
+	expression := r.FormValue("expression")
+	if expression == "" {
+		http.Error(w, "expression is required", http.StatusBadRequest)
+		return
+	}
+
+	parsed, err := parseUcum(expression)
+	if err != nil {
+		http.Error(w, "expression must be a UCUM expression: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"canonical": parsed.Canonical,
+		"symbol":    parsed.Symbol,
+		"dimension": parsed.Dimension,
+		"factor":    parsed.Factor,
+		"offset":    parsed.Offset,
+	})
+}
+
+/*
+Checks whether values in one unit can be converted to another. Units are
+given as UCUM expressions.
+
+Query params:
+
+	from: string,
+	to: string
+
+Result:
+
+	{
+		commensurable: bool,
+		factor: float, // to = from * factor, omitted for units on an offset scale
+		from_dimension: string,
+		to_dimension: string
+	}
+*/
+func fetchUnitsCommensurableHandler(w http.ResponseWriter, r *http.Request) {
+	from, err := parseUcum(r.FormValue("from"))
+	if err != nil {
+		http.Error(w, "from must be a UCUM expression: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := parseUcum(r.FormValue("to"))
+	if err != nil {
+		http.Error(w, "to must be a UCUM expression: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result := map[string]any{
+		"commensurable":  from.commensurableWith(to),
+		"from_dimension": from.Dimension,
+		"to_dimension":   to.Dimension,
+	}
+	if from.commensurableWith(to) && from.Offset == 0 && to.Offset == 0 {
+		result["factor"] = from.Factor / to.Factor
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
 type Unit struct {
-	Id   int    `json:"id"`
-	Name string `json:"name"`
+	Id        int      `json:"id"`
+	Name      string   `json:"name"`
+	Canonical *string  `json:"canonical,omitempty"` // Nullable, normalized UCUM expression
+	Symbol    *string  `json:"symbol,omitempty"`    // Nullable, printable symbol
+	Dimension *string  `json:"dimension,omitempty"` // Nullable, units without one cannot be converted
+	Factor    *float64 `json:"factor,omitempty"`    // base = value * factor + offset
+	Offset    *float64 `json:"offset,omitempty"`
+}
+
+// Reads a unit by its ID
+func readUnit(q queryRower, unitId int) (Unit, error) {
+	unit := Unit{Id: unitId}
+	err := q.QueryRow("SELECT name, canonical, symbol, dimension, factor, offset FROM units WHERE id = ?", unitId).Scan(&unit.Name, &unit.Canonical, &unit.Symbol, &unit.Dimension, &unit.Factor, &unit.Offset)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return Unit{}, fmt.Errorf("readUnit: no unit found with ID %d", unitId)
+		}
+		return Unit{}, fmt.Errorf("readUnit: %v", err)
+	}
+	return unit, nil
+}
+
+// Reports whether values can be converted between the two units
+func (from Unit) convertibleTo(to Unit) bool {
+	if from.Id == to.Id {
+		return true
+	}
+	return from.Dimension != nil && to.Dimension != nil && *from.Dimension == *to.Dimension && from.Factor != nil && to.Factor != nil
+}
+
+// Converts a number from one unit to another of the same dimension
+func (from Unit) convert(value float64, to Unit) (float64, error) {
+	if from.Id == to.Id {
+		return value, nil
+	}
+	if !from.convertibleTo(to) {
+		return 0, fmt.Errorf("cannot convert %s to %s", from.Name, to.Name)
+	}
+	base := value**from.Factor + from.offset()
+	return (base - to.offset()) / *to.Factor, nil
+}
+
+// The offset of the unit from the base unit. Only units on an offset scale,
+// like Cel, have one, so a missing offset is 0.
+func (unit Unit) offset() float64 {
+	if unit.Offset == nil {
+		return 0
+	}
+	return *unit.Offset
+}
+
+// Converts a stored value between units. Values that are not numbers cannot be converted.
+func convertValueString(value string, from Unit, to Unit) (string, error) {
+	if from.Id == to.Id {
+		return value, nil
+	}
+	number, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		return "", fmt.Errorf("value %q is not a number and cannot be converted", value)
+	}
+	converted, err := from.convert(number, to)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatFloat(converted, 'g', 10, 64), nil
+}
+
+// Converts a value given in some unit into the unit of the attribute it is stored under
+func convertToAttributeUnit(q queryRower, attributeId int, unitId int, value string) (string, error) {
+	var attributeUnitId *int
+	err := q.QueryRow("SELECT unit_id FROM sample_attributes WHERE id = ?", attributeId).Scan(&attributeUnitId)
+	if err != nil {
+		return "", fmt.Errorf("attribute not found")
+	}
+	if attributeUnitId == nil {
+		return "", fmt.Errorf("attribute has no unit to convert to")
+	}
+	from, err := readUnit(q, unitId)
+	if err != nil {
+		return "", fmt.Errorf("unit not found")
+	}
+	to, err := readUnit(q, *attributeUnitId)
+	if err != nil {
+		return "", fmt.Errorf("unit not found")
+	}
+	return convertValueString(value, from, to)
 }
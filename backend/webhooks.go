@@ -0,0 +1,533 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Events a webhook can subscribe to. "*" subscribes to all of them.
+var webhookEvents = map[string]bool{
+	"sample.created":        true,
+	"sample.updated":        true,
+	"sample.deleted":        true,
+	"sample.restored":       true,
+	"sample.status_changed": true,
+	"sample.moved":          true,
+	"sample.transferred":    true,
+	"value.updated":         true,
+	"attribute.created":     true,
+	"attribute.updated":     true,
+	"attribute.deleted":     true,
+	"attribute.restored":    true,
+	"collection.updated":    true,
+	"comment.created":       true,
+}
+
+// Delivery retry policy. The delay doubles after every failed attempt.
+const webhookMaxAttempts = 5
+
+var webhookInitialBackoff = 2 * time.Second
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+/*
+Gets the webhooks registered on a collection
+
+Query params:
+
+	collection_id: int
+
+Result:
+
+	[{
+		id: int,
+		collection_id: int,
+		url: string,
+		events: [string],
+		active: bool,
+		created_at: int
+	}]
+*/
+func fetchWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	_collectionId := r.FormValue("collection_id")
+	collectionId, err := strconv.Atoi(_collectionId)
+	if err != nil || collectionId < 1 {
+		http.Error(w, "collection_id must be a positive int", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := DB.Query("SELECT id, collection_id, url, events, active, created_at FROM webhooks WHERE collection_id = ? ORDER BY id", collectionId)
+	if err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var webhooks = []Webhook{}
+	for rows.Next() {
+		var webhook Webhook
+		var events string
+		if err := rows.Scan(&webhook.Id, &webhook.CollectionId, &webhook.Url, &events, &webhook.Active, &webhook.CreatedAt); err != nil {
+			http.Error(w, "error when reading from database", http.StatusInternalServerError)
+			return
+		}
+		webhook.Events = strings.Split(events, ",")
+		webhooks = append(webhooks, webhook)
+	}
+
+	// Check for errors from iterating over rows
+	if err = rows.Err(); err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(webhooks)
+}
+
+/*
+Registers a webhook on a collection. If no secret is given one is generated.
+The secret is only returned in this response.
+
+Body:
+
+	{
+		collection_id: int,
+		url: string,
+		events: [string], // e.g. "sample.created", "value.updated" or "*"
+		secret?: string
+	}
+
+Result:
+
+	{
+		id: int,
+		secret: string
+	}
+*/
+func insertWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse JSON request
+	var webhook Webhook
+	if err := json.NewDecoder(r.Body).Decode(&webhook); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	// Validate required fields
+	if webhook.CollectionId == 0 {
+		http.Error(w, "collection_id is required", http.StatusBadRequest)
+		return
+	}
+	target, err := url.Parse(webhook.Url)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		http.Error(w, "url must be an absolute http(s) url", http.StatusBadRequest)
+		return
+	}
+	if len(webhook.Events) == 0 {
+		http.Error(w, "at least one event is required", http.StatusBadRequest)
+		return
+	}
+	for _, event := range webhook.Events {
+		if event != "*" && !webhookEvents[event] {
+			http.Error(w, "unknown event: "+event, http.StatusBadRequest)
+			return
+		}
+	}
+	if webhook.Secret == "" {
+		webhook.Secret = generateNonce(32)
+	}
+
+	query := "INSERT INTO webhooks (collection_id, url, secret, events, active, created_at) VALUES (?, ?, ?, ?, 1, ?)"
+	result, err := DB.Exec(query, webhook.CollectionId, webhook.Url, webhook.Secret, strings.Join(webhook.Events, ","), time.Now().Unix())
+	if err != nil {
+		if strings.Contains(err.Error(), "FOREIGN KEY constraint failed") {
+			http.Error(w, "collection not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "failed to insert webhook", http.StatusInternalServerError)
+		return
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		// return only StatusOk
+		fmt.Fprintln(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{"id": id, "secret": webhook.Secret})
+}
+
+/*
+Deletes a webhook and its delivery log
+
+Query params:
+
+	webhook_id: int
+*/
+func deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	_webhookId := r.FormValue("webhook_id")
+	webhookId, err := strconv.Atoi(_webhookId)
+	if err != nil {
+		http.Error(w, "webhook_id must be a positive int", http.StatusBadRequest)
+		return
+	}
+
+	result, err := DB.Exec("DELETE FROM webhooks WHERE id = ?", webhookId)
+	if err != nil {
+		http.Error(w, "failed to delete webhook", http.StatusInternalServerError)
+		return
+	}
+
+	// Check if any rows were affected
+	rowsAffected, err := result.RowsAffected()
+	if err != nil || rowsAffected == 0 {
+		http.Error(w, "webhook not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+/*
+Gets the delivery log of a webhook, newest first
+
+Query params:
+
+	webhook_id: int
+
+Result:
+
+	[{
+		id: int,
+		webhook_id: int,
+		event: string,
+		payload: string,
+		status: string, // "pending", "succeeded" or "failed"
+		attempts: int,
+		response_code: int,
+		error: string,
+		created_at: int,
+		delivered_at: int
+	}]
+*/
+func fetchWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	_webhookId := r.FormValue("webhook_id")
+	webhookId, err := strconv.Atoi(_webhookId)
+	if err != nil {
+		http.Error(w, "webhook_id must be a positive int", http.StatusBadRequest)
+		return
+	}
+
+	query := `
+		SELECT id, webhook_id, event, payload, status, attempts, response_code, error, created_at, delivered_at
+		FROM webhook_deliveries
+		WHERE webhook_id = ?
+		ORDER BY id DESC
+	`
+	rows, err := DB.Query(query, webhookId)
+	if err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var deliveries = []WebhookDelivery{}
+	for rows.Next() {
+		var delivery WebhookDelivery
+		if err := rows.Scan(&delivery.Id, &delivery.WebhookId, &delivery.Event, &delivery.Payload, &delivery.Status, &delivery.Attempts,
+			&delivery.ResponseCode, &delivery.Error, &delivery.CreatedAt, &delivery.DeliveredAt); err != nil {
+			http.Error(w, "error when reading from database", http.StatusInternalServerError)
+			return
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	// Check for errors from iterating over rows
+	if err = rows.Err(); err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+/*
+Sends the payload of an earlier delivery again as a new delivery
+
+Query params:
+
+	delivery_id: int
+
+Result:
+
+	{
+		id: int // The new delivery
+	}
+*/
+func redeliverWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	_deliveryId := r.FormValue("delivery_id")
+	deliveryId, err := strconv.Atoi(_deliveryId)
+	if err != nil {
+		http.Error(w, "delivery_id must be a positive int", http.StatusBadRequest)
+		return
+	}
+
+	var delivery WebhookDelivery
+	err = DB.QueryRow("SELECT webhook_id, event, payload FROM webhook_deliveries WHERE id = ?", deliveryId).Scan(&delivery.WebhookId, &delivery.Event, &delivery.Payload)
+	if err != nil {
+		http.Error(w, "delivery not found", http.StatusNotFound)
+		return
+	}
+
+	delivery, err = createWebhookDelivery(delivery.WebhookId, delivery.Event, delivery.Payload)
+	if err != nil {
+		http.Error(w, "failed to create delivery", http.StatusInternalServerError)
+		return
+	}
+	go deliverWebhook(delivery)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, "{\"id\":  %d}", delivery.Id)
+}
+
+// Webhook represents a row of the webhooks table
+type Webhook struct {
+	Id           int      `json:"id"`
+	CollectionId int      `json:"collection_id"`
+	Url          string   `json:"url"`
+	Secret       string   `json:"secret,omitempty"` // Only accepted on insert
+	Events       []string `json:"events"`
+	Active       bool     `json:"active"`
+	CreatedAt    int64    `json:"created_at"`
+}
+
+// WebhookDelivery represents a row of the webhook_deliveries table
+type WebhookDelivery struct {
+	Id           int     `json:"id"`
+	WebhookId    int     `json:"webhook_id"`
+	Event        string  `json:"event"`
+	Payload      string  `json:"payload"`
+	Status       string  `json:"status"`
+	Attempts     int     `json:"attempts"`
+	ResponseCode *int    `json:"response_code,omitempty"`
+	Error        *string `json:"error,omitempty"`
+	CreatedAt    int64   `json:"created_at"`
+	DeliveredAt  *int64  `json:"delivered_at,omitempty"`
+}
+
+// WebhookEvent is a change in a collection that webhooks may subscribe to
+type WebhookEvent struct {
+	Event        string `json:"event"`
+	CollectionId int    `json:"collection_id"`
+	CreatedAt    int64  `json:"created_at"`
+	Data         any    `json:"data"`
+}
+
+var webhookChannel = make(chan WebhookEvent, 1000) // buffered
+
+func init() {
+	go webhookDispatcher()
+}
+
+// Queues an event for delivery to the webhooks of a collection without blocking the request
+func emitWebhookEvent(collectionId int, event string, data any) {
+	select {
+	case webhookChannel <- WebhookEvent{Event: event, CollectionId: collectionId, CreatedAt: time.Now().Unix(), Data: data}:
+		// sent successfully
+	default:
+		// channel is full, drop event to avoid blocking
+		log.Println("webhookChannel full, dropping event", event)
+	}
+}
+
+func webhookDispatcher() {
+	for event := range webhookChannel {
+		if err := dispatchWebhookEvent(event); err != nil {
+			log.Println("failed to dispatch webhook event: ", err.Error())
+		}
+	}
+}
+
+// Creates a delivery for every active webhook subscribed to the event and starts sending them
+func dispatchWebhookEvent(event WebhookEvent) error {
+	rows, err := DB.Query("SELECT id, events FROM webhooks WHERE collection_id = ? AND active = 1", event.CollectionId)
+	if err != nil {
+		return fmt.Errorf("dispatchWebhookEvent: %v", err)
+	}
+	var webhookIds []int
+	for rows.Next() {
+		var id int
+		var events string
+		if err := rows.Scan(&id, &events); err != nil {
+			rows.Close()
+			return fmt.Errorf("dispatchWebhookEvent: %v", err)
+		}
+		for _, e := range strings.Split(events, ",") {
+			if e == "*" || e == event.Event {
+				webhookIds = append(webhookIds, id)
+				break
+			}
+		}
+	}
+	rows.Close()
+	if len(webhookIds) == 0 {
+		return nil
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("dispatchWebhookEvent: %v", err)
+	}
+
+	for _, id := range webhookIds {
+		delivery, err := createWebhookDelivery(id, event.Event, string(payload))
+		if err != nil {
+			return err
+		}
+		go deliverWebhook(delivery)
+	}
+	return nil
+}
+
+func createWebhookDelivery(webhookId int, event string, payload string) (WebhookDelivery, error) {
+	delivery := WebhookDelivery{
+		WebhookId: webhookId,
+		Event:     event,
+		Payload:   payload,
+		Status:    "pending",
+		CreatedAt: time.Now().Unix(),
+	}
+	query := "INSERT INTO webhook_deliveries (webhook_id, event, payload, status, attempts, created_at) VALUES (?, ?, ?, ?, 0, ?)"
+	result, err := DB.Exec(query, delivery.WebhookId, delivery.Event, delivery.Payload, delivery.Status, delivery.CreatedAt)
+	if err != nil {
+		return WebhookDelivery{}, fmt.Errorf("createWebhookDelivery: %v", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return WebhookDelivery{}, fmt.Errorf("createWebhookDeliveryId: %v", err)
+	}
+	delivery.Id = int(id)
+	return delivery, nil
+}
+
+// Restarts the deliveries that were still pending when the server stopped. They
+// continue from the attempts already made, the first one right away.
+func resumeWebhookDeliveries() error {
+	rows, err := DB.Query("SELECT id, webhook_id, event, payload, status, attempts, created_at FROM webhook_deliveries WHERE status = 'pending'")
+	if err != nil {
+		return fmt.Errorf("resumeWebhookDeliveries: %v", err)
+	}
+	defer rows.Close()
+
+	var deliveries []WebhookDelivery
+	for rows.Next() {
+		var delivery WebhookDelivery
+		if err := rows.Scan(&delivery.Id, &delivery.WebhookId, &delivery.Event, &delivery.Payload, &delivery.Status, &delivery.Attempts, &delivery.CreatedAt); err != nil {
+			return fmt.Errorf("resumeWebhookDeliveries: %v", err)
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("resumeWebhookDeliveries: %v", err)
+	}
+
+	for _, delivery := range deliveries {
+		go deliverWebhook(delivery)
+	}
+	return nil
+}
+
+// Posts a delivery to its webhook, retrying with exponential backoff until it succeeds or runs out of attempts
+func deliverWebhook(delivery WebhookDelivery) {
+	var target, secret string
+	var collectionId int
+	err := DB.QueryRow("SELECT url, secret, collection_id FROM webhooks WHERE id = ?", delivery.WebhookId).Scan(&target, &secret, &collectionId)
+	if err != nil {
+		log.Println("failed to read webhook", delivery.WebhookId, err.Error())
+		return
+	}
+
+	backoff := webhookInitialBackoff << delivery.Attempts
+	for attempt := delivery.Attempts + 1; attempt <= webhookMaxAttempts; attempt++ {
+		statusCode, err := postWebhook(target, secret, delivery)
+
+		status := "pending"
+		var errMessage *string
+		var deliveredAt *int64
+		if err == nil {
+			status = "succeeded"
+			now := time.Now().Unix()
+			deliveredAt = &now
+		} else {
+			message := err.Error()
+			errMessage = &message
+			if attempt == webhookMaxAttempts {
+				status = "failed"
+			}
+		}
+		var responseCode *int
+		if statusCode != 0 {
+			responseCode = &statusCode
+		}
+
+		query := "UPDATE webhook_deliveries SET status = ?, attempts = ?, response_code = ?, error = ?, delivered_at = ? WHERE id = ?"
+		if _, err := DB.Exec(query, status, attempt, responseCode, errMessage, deliveredAt, delivery.Id); err != nil {
+			log.Println("failed to update webhook delivery", delivery.Id, err.Error())
+		}
+		if status == "failed" {
+			notifyWebhookDeliveryFailed(delivery, target, collectionId, *errMessage)
+		}
+		if status != "pending" {
+			return
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// Sends a single attempt of a delivery. Any non 2xx response is an error.
+func postWebhook(target string, secret string, delivery WebhookDelivery) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewBufferString(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Pithos-Event", delivery.Event)
+	req.Header.Set("X-Pithos-Delivery", strconv.Itoa(delivery.Id))
+	req.Header.Set("X-Pithos-Signature", "sha256="+signWebhookPayload(secret, delivery.Payload))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected response status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// Returns the hex encoded HMAC-SHA256 of the payload, keyed with the webhook secret
+func signWebhookPayload(secret string, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
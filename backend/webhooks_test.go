@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Opens a fresh database with the schema of init.sql as the global DB. It is
+// closed, not unset, after the test, so background workers that still run
+// get errors instead of a nil DB.
+func openTestDB(t *testing.T) {
+	t.Helper()
+	schema, err := os.ReadFile("../db/init.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", "file:"+filepath.Join(t.TempDir(), "data.db")+"?_foreign_keys=on&busy_timeout=5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(string(schema)); err != nil {
+		t.Fatal(err)
+	}
+
+	DB = db
+	t.Cleanup(func() { db.Close() })
+}
+
+// Registers a webhook on a new collection and returns its id
+func insertTestWebhook(t *testing.T, target string, secret string) int {
+	t.Helper()
+	result, err := DB.Exec("INSERT INTO collections (name) VALUES ('webhooks')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	collectionId, _ := result.LastInsertId()
+	result, err = DB.Exec("INSERT INTO webhooks (collection_id, url, secret, events, active, created_at) VALUES (?, ?, ?, '*', 1, 0)", collectionId, target, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := result.LastInsertId()
+	return int(id)
+}
+
+// Shortens the retry backoff for the duration of a test
+func shortenWebhookBackoff(t *testing.T) {
+	previous := webhookInitialBackoff
+	webhookInitialBackoff = time.Millisecond
+	t.Cleanup(func() { webhookInitialBackoff = previous })
+}
+
+// webhookReceiver records the requests posted to it and answers with a fixed status
+type webhookReceiver struct {
+	mu         sync.Mutex
+	status     int
+	signatures []string
+	bodies     []string
+}
+
+func (receiver *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	receiver.mu.Lock()
+	receiver.signatures = append(receiver.signatures, r.Header.Get("X-Pithos-Signature"))
+	receiver.bodies = append(receiver.bodies, string(body))
+	receiver.mu.Unlock()
+	w.WriteHeader(receiver.status)
+}
+
+func (receiver *webhookReceiver) count() int {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	return len(receiver.bodies)
+}
+
+func readTestDelivery(t *testing.T, id int) WebhookDelivery {
+	t.Helper()
+	delivery := WebhookDelivery{Id: id}
+	err := DB.QueryRow("SELECT status, attempts, response_code FROM webhook_deliveries WHERE id = ?", id).Scan(&delivery.Status, &delivery.Attempts, &delivery.ResponseCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return delivery
+}
+
+func TestDeliverWebhookSignsPayload(t *testing.T) {
+	openTestDB(t)
+	receiver := &webhookReceiver{status: http.StatusOK}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	secret := "shared secret"
+	webhookId := insertTestWebhook(t, server.URL, secret)
+	delivery, err := createWebhookDelivery(webhookId, "sample.created", `{"event":"sample.created"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deliverWebhook(delivery)
+
+	if receiver.count() != 1 {
+		t.Fatalf("receiver got %d requests, want 1", receiver.count())
+	}
+	if receiver.bodies[0] != delivery.Payload {
+		t.Errorf("body = %q, want %q", receiver.bodies[0], delivery.Payload)
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(delivery.Payload))
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); receiver.signatures[0] != want {
+		t.Errorf("signature = %q, want %q", receiver.signatures[0], want)
+	}
+
+	stored := readTestDelivery(t, delivery.Id)
+	if stored.Status != "succeeded" || stored.Attempts != 1 {
+		t.Errorf("delivery is %s after %d attempts, want succeeded after 1", stored.Status, stored.Attempts)
+	}
+}
+
+func TestDeliverWebhookRetriesUntilFailed(t *testing.T) {
+	openTestDB(t)
+	shortenWebhookBackoff(t)
+	receiver := &webhookReceiver{status: http.StatusInternalServerError}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	webhookId := insertTestWebhook(t, server.URL, "secret")
+	delivery, err := createWebhookDelivery(webhookId, "value.updated", `{}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deliverWebhook(delivery)
+
+	if receiver.count() != webhookMaxAttempts {
+		t.Errorf("receiver got %d requests, want %d", receiver.count(), webhookMaxAttempts)
+	}
+	stored := readTestDelivery(t, delivery.Id)
+	if stored.Status != "failed" || stored.Attempts != webhookMaxAttempts {
+		t.Errorf("delivery is %s after %d attempts, want failed after %d", stored.Status, stored.Attempts, webhookMaxAttempts)
+	}
+	if stored.ResponseCode == nil || *stored.ResponseCode != http.StatusInternalServerError {
+		t.Errorf("response_code = %v, want %d", stored.ResponseCode, http.StatusInternalServerError)
+	}
+}
+
+func TestResumeWebhookDeliveries(t *testing.T) {
+	openTestDB(t)
+	shortenWebhookBackoff(t)
+	receiver := &webhookReceiver{status: http.StatusBadGateway}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	// A delivery that was interrupted after two attempts
+	webhookId := insertTestWebhook(t, server.URL, "secret")
+	delivery, err := createWebhookDelivery(webhookId, "value.updated", `{}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DB.Exec("UPDATE webhook_deliveries SET attempts = 2 WHERE id = ?", delivery.Id); err != nil {
+		t.Fatal(err)
+	}
+	if err := resumeWebhookDeliveries(); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for readTestDelivery(t, delivery.Id).Status == "pending" {
+		if time.Now().After(deadline) {
+			t.Fatal("resumed delivery did not finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if receiver.count() != webhookMaxAttempts-2 {
+		t.Errorf("receiver got %d requests, want the %d attempts left", receiver.count(), webhookMaxAttempts-2)
+	}
+	if stored := readTestDelivery(t, delivery.Id); stored.Status != "failed" || stored.Attempts != webhookMaxAttempts {
+		t.Errorf("delivery is %s after %d attempts, want failed after %d", stored.Status, stored.Attempts, webhookMaxAttempts)
+	}
+}
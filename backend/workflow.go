@@ -0,0 +1,576 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Gets the workflow of a collection
+
+Query params:
+
+	collection_id: int
+
+Result:
+
+	{
+		states: [
+			{
+				id: int,
+				name: string,
+				is_initial: bool,
+				is_locked: bool
+			}
+			...
+		],
+		transitions: [
+			{
+				id: int,
+				from_state_id: int,
+				to_state_id: int,
+				role_id: int
+			}
+			...
+		]
+	}
+*/
+func fetchWorkflowHandler(w http.ResponseWriter, r *http.Request) {
+	_collectionId := r.FormValue("collection_id")
+	collectionId, err := strconv.Atoi(_collectionId)
+	if err != nil || collectionId < 1 {
+		http.Error(w, "collection_id must be a positive int", http.StatusBadRequest)
+		return
+	}
+
+	workflow := Workflow{
+		States:      []WorkflowState{},
+		Transitions: []WorkflowTransition{},
+	}
+
+	rows, err := DB.Query("SELECT id, collection_id, name, is_initial, is_locked FROM workflow_states WHERE collection_id = ? ORDER BY id", collectionId)
+	if err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var state WorkflowState
+		if err := rows.Scan(&state.Id, &state.CollectionId, &state.Name, &state.IsInitial, &state.IsLocked); err != nil {
+			http.Error(w, "error when reading from database", http.StatusInternalServerError)
+			return
+		}
+		workflow.States = append(workflow.States, state)
+	}
+	if err = rows.Err(); err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+
+	query := `
+		SELECT t.id, t.from_state_id, t.to_state_id, t.role_id
+		FROM workflow_transitions t
+		JOIN workflow_states s ON s.id = t.from_state_id
+		WHERE s.collection_id = ?
+		ORDER BY t.id
+	`
+	transitionRows, err := DB.Query(query, collectionId)
+	if err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	defer transitionRows.Close()
+
+	for transitionRows.Next() {
+		var transition WorkflowTransition
+		if err := transitionRows.Scan(&transition.Id, &transition.FromStateId, &transition.ToStateId, &transition.RoleId); err != nil {
+			http.Error(w, "error when reading from database", http.StatusInternalServerError)
+			return
+		}
+		workflow.Transitions = append(workflow.Transitions, transition)
+	}
+	if err = transitionRows.Err(); err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(workflow)
+}
+
+/*
+Adds a workflow state to a collection. Marking a state as initial moves
+samples without a state into it, and new samples start there.
+
+Query params:
+
+	collection_id: int,
+	name: string,
+	is_initial?: bool,
+	is_locked?: bool // Samples in a locked state are read-only
+*/
+func insertWorkflowStateHandler(w http.ResponseWriter, r *http.Request) {
+	var state WorkflowState
+	_collectionId := r.FormValue("collection_id")
+	state.Name = r.FormValue("name")
+
+	var err error
+	state.CollectionId, err = strconv.Atoi(_collectionId)
+	if err != nil || state.Name == "" {
+		http.Error(w, "collection_id and name are required", http.StatusBadRequest)
+		return
+	}
+	if len(state.Name) > 32 {
+		http.Error(w, "name must be at most 32 characters", http.StatusBadRequest)
+		return
+	}
+	if _isInitial := r.FormValue("is_initial"); _isInitial != "" {
+		state.IsInitial, err = strconv.ParseBool(_isInitial)
+		if err != nil {
+			http.Error(w, "is_initial must be a bool", http.StatusBadRequest)
+			return
+		}
+	}
+	if _isLocked := r.FormValue("is_locked"); _isLocked != "" {
+		state.IsLocked, err = strconv.ParseBool(_isLocked)
+		if err != nil {
+			http.Error(w, "is_locked must be a bool", http.StatusBadRequest)
+			return
+		}
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		http.Error(w, "error inserting to database", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Only one state can be the initial state of a collection
+	if state.IsInitial {
+		if _, err := tx.Exec("UPDATE workflow_states SET is_initial = 0 WHERE collection_id = ?", state.CollectionId); err != nil {
+			http.Error(w, "error inserting to database", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	query := "INSERT INTO workflow_states (collection_id, name, is_initial, is_locked) VALUES (?, ?, ?, ?)"
+	result, err := tx.Exec(query, state.CollectionId, state.Name, state.IsInitial, state.IsLocked)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed:") {
+			http.Error(w, "state already exists on this collection", http.StatusBadRequest)
+			return
+		}
+		if strings.Contains(err.Error(), "FOREIGN KEY constraint failed") {
+			http.Error(w, "collection not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "error inserting to database", http.StatusInternalServerError)
+		return
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		http.Error(w, "error inserting to database", http.StatusInternalServerError)
+		return
+	}
+
+	// Samples created before the workflow existed start in the initial state
+	if state.IsInitial {
+		if _, err := tx.Exec("UPDATE samples SET status_id = ? WHERE collection_id = ? AND status_id IS NULL", id, state.CollectionId); err != nil {
+			http.Error(w, "error inserting to database", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		http.Error(w, "error inserting to database", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, "{\"id\":  %d}", id)
+}
+
+/*
+Deletes a workflow state and its transitions. A state still held by samples, or
+that samples have passed through, cannot be deleted, so their status history stays complete.
+
+Query params:
+
+	state_id: int
+*/
+func deleteWorkflowStateHandler(w http.ResponseWriter, r *http.Request) {
+	_stateId := r.FormValue("state_id")
+	stateId, err := strconv.Atoi(_stateId)
+	if err != nil {
+		http.Error(w, "state_id must be a positive int", http.StatusBadRequest)
+		return
+	}
+
+	// Databases created before the history restricted deletes would lose it
+	var inHistory bool
+	err = DB.QueryRow("SELECT EXISTS (SELECT 1 FROM sample_status_history WHERE from_state_id = ? OR to_state_id = ?)", stateId, stateId).Scan(&inHistory)
+	if err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	if inHistory {
+		http.Error(w, "state is in the status history of samples", http.StatusConflict)
+		return
+	}
+
+	result, err := DB.Exec("DELETE FROM workflow_states WHERE id = ?", stateId)
+	if err != nil {
+		if strings.Contains(err.Error(), "FOREIGN KEY constraint failed") {
+			http.Error(w, "state is in use by samples", http.StatusConflict)
+			return
+		}
+		http.Error(w, "failed to delete state", http.StatusInternalServerError)
+		return
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil || rowsAffected == 0 {
+		http.Error(w, "state not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+/*
+Allows samples to move from one state to another
+
+Query params:
+
+	from_state_id: int,
+	to_state_id: int,
+	role_id?: int // Only users with this role may use the transition. Any role if not set
+*/
+func insertWorkflowTransitionHandler(w http.ResponseWriter, r *http.Request) {
+	var transition WorkflowTransition
+	var err error
+	transition.FromStateId, err = strconv.Atoi(r.FormValue("from_state_id"))
+	if err != nil {
+		http.Error(w, "from_state_id must be a positive int", http.StatusBadRequest)
+		return
+	}
+	transition.ToStateId, err = strconv.Atoi(r.FormValue("to_state_id"))
+	if err != nil {
+		http.Error(w, "to_state_id must be a positive int", http.StatusBadRequest)
+		return
+	}
+	if transition.FromStateId == transition.ToStateId {
+		http.Error(w, "from_state_id and to_state_id must differ", http.StatusBadRequest)
+		return
+	}
+	if _roleId := r.FormValue("role_id"); _roleId != "" {
+		roleId, err := strconv.Atoi(_roleId)
+		if err != nil {
+			http.Error(w, "role_id must be a positive int", http.StatusBadRequest)
+			return
+		}
+		transition.RoleId = &roleId
+	}
+
+	// Both states must belong to the same collection
+	var sameCollection bool
+	query := `
+		SELECT f.collection_id = t.collection_id
+		FROM workflow_states f, workflow_states t
+		WHERE f.id = ? AND t.id = ?
+	`
+	err = DB.QueryRow(query, transition.FromStateId, transition.ToStateId).Scan(&sameCollection)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "state not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	if !sameCollection {
+		http.Error(w, "states must belong to the same collection", http.StatusBadRequest)
+		return
+	}
+
+	result, err := DB.Exec("INSERT INTO workflow_transitions (from_state_id, to_state_id, role_id) VALUES (?, ?, ?)", transition.FromStateId, transition.ToStateId, transition.RoleId)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed:") {
+			http.Error(w, "transition already exists", http.StatusBadRequest)
+			return
+		}
+		if strings.Contains(err.Error(), "FOREIGN KEY constraint failed") {
+			http.Error(w, "role not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "error inserting to database", http.StatusInternalServerError)
+		return
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		// return only StatusOk
+		fmt.Fprintln(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, "{\"id\":  %d}", id)
+}
+
+/*
+Deletes a workflow transition
+
+Query params:
+
+	transition_id: int
+*/
+func deleteWorkflowTransitionHandler(w http.ResponseWriter, r *http.Request) {
+	_transitionId := r.FormValue("transition_id")
+	transitionId, err := strconv.Atoi(_transitionId)
+	if err != nil {
+		http.Error(w, "transition_id must be a positive int", http.StatusBadRequest)
+		return
+	}
+
+	result, err := DB.Exec("DELETE FROM workflow_transitions WHERE id = ?", transitionId)
+	if err != nil {
+		http.Error(w, "failed to delete transition", http.StatusInternalServerError)
+		return
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil || rowsAffected == 0 {
+		http.Error(w, "transition not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+/*
+Moves a sample to another workflow state. The transition must exist
+and be allowed for the role of the user.
+
+Query params:
+
+	sample_id: int,
+	state_id: int,
+	comment?: string
+*/
+func updateSampleStatusHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(User)
+
+	sampleId, err := strconv.Atoi(r.FormValue("sample_id"))
+	if err != nil {
+		http.Error(w, "sample_id must be a positive int", http.StatusBadRequest)
+		return
+	}
+	stateId, err := strconv.Atoi(r.FormValue("state_id"))
+	if err != nil {
+		http.Error(w, "state_id must be a positive int", http.StatusBadRequest)
+		return
+	}
+	comment := r.FormValue("comment")
+
+	tx, err := DB.Begin()
+	if err != nil {
+		http.Error(w, "error when updating sample in database", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var collectionId int
+	var fromStateId *int
+	err = tx.QueryRow("SELECT collection_id, status_id FROM samples WHERE id = ? AND deleted_at IS NULL", sampleId).Scan(&collectionId, &fromStateId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "sample not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	if fromStateId == nil {
+		http.Error(w, "sample has no workflow state", http.StatusConflict)
+		return
+	}
+
+	// Find a transition the user is allowed to make
+	var allowed bool
+	query := `
+		SELECT EXISTS(
+			SELECT 1 FROM workflow_transitions
+			WHERE from_state_id = ? AND to_state_id = ? AND (role_id IS NULL OR role_id = ?)
+		)
+	`
+	err = tx.QueryRow(query, *fromStateId, stateId, user.RoleId).Scan(&allowed)
+	if err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		http.Error(w, "transition not allowed", http.StatusForbidden)
+		return
+	}
+
+	if _, err := tx.Exec("UPDATE samples SET status_id = ? WHERE id = ?", stateId, sampleId); err != nil {
+		http.Error(w, "error when updating sample in database", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now().Unix()
+	query = "INSERT INTO sample_status_history (sample_id, from_state_id, to_state_id, user_id, comment, created_at) VALUES (?, ?, ?, ?, ?, ?)"
+	if _, err := tx.Exec(query, sampleId, *fromStateId, stateId, user.Id, comment, now); err != nil {
+		http.Error(w, "error when updating sample in database", http.StatusInternalServerError)
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		http.Error(w, "error when updating sample in database", http.StatusInternalServerError)
+		return
+	}
+	emitWebhookEvent(collectionId, "sample.status_changed", map[string]any{"sample_id": sampleId, "from_state_id": *fromStateId, "to_state_id": stateId})
+	notifySampleStatusChanged(user, collectionId, sampleId, stateId, comment)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "{\"status\": \"success\"}")
+}
+
+/*
+Gets the workflow state changes of a sample, oldest first
+
+Query params:
+
+	sample_id: int
+
+Result:
+
+	[{
+		id: int,
+		from_state_id: int,
+		to_state_id: int,
+		user_id: int,
+		comment: string,
+		created_at: int
+	}]
+*/
+func fetchSampleStatusHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	sampleId, err := strconv.Atoi(r.FormValue("sample_id"))
+	if err != nil {
+		http.Error(w, "sample_id must be a positive int", http.StatusBadRequest)
+		return
+	}
+
+	query := "SELECT id, from_state_id, to_state_id, user_id, comment, created_at FROM sample_status_history WHERE sample_id = ? ORDER BY created_at, id"
+	rows, err := DB.Query(query, sampleId)
+	if err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var history = []SampleStatusChange{}
+	for rows.Next() {
+		var change SampleStatusChange
+		if err := rows.Scan(&change.Id, &change.FromStateId, &change.ToStateId, &change.UserId, &change.Comment, &change.CreatedAt); err != nil {
+			http.Error(w, "error when reading from database", http.StatusInternalServerError)
+			return
+		}
+		history = append(history, change)
+	}
+	if err = rows.Err(); err != nil {
+		http.Error(w, "error when reading from database", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history)
+}
+
+// Reports whether a sample is in a locked (read-only) workflow state
+func isSampleLocked(sampleId int) (bool, error) {
+	var locked bool
+	query := `
+		SELECT EXISTS(
+			SELECT 1 FROM samples s
+			JOIN workflow_states ws ON ws.id = s.status_id
+			WHERE s.id = ? AND ws.is_locked = 1
+		)
+	`
+	if err := DB.QueryRow(query, sampleId).Scan(&locked); err != nil {
+		return false, fmt.Errorf("isSampleLocked: %v", err)
+	}
+	return locked, nil
+}
+
+// Fails with lockedValuesError if a sample in a locked workflow state has a value
+// or replicate for the attribute. The unit of such an attribute cannot change,
+// converted or not, as the values would be read in the new unit.
+func checkAttributeUnlocked(q queryRower, attributeId int) error {
+	var name string
+	var locked bool
+	query := `
+		SELECT a.name, EXISTS(
+			SELECT 1 FROM samples s JOIN workflow_states ws ON ws.id = s.status_id
+			WHERE ws.is_locked = 1 AND (
+				s.id IN (SELECT sample_id FROM sample_attribute_values WHERE attribute_id = a.id)
+				OR s.id IN (SELECT sample_id FROM sample_replicate_values WHERE attribute_id = a.id)
+			)
+		)
+		FROM sample_attributes a WHERE a.id = ?
+	`
+	if err := q.QueryRow(query, attributeId).Scan(&name, &locked); err != nil {
+		return fmt.Errorf("checkAttributeUnlocked: %v", err)
+	}
+	if locked {
+		return lockedValuesError{name}
+	}
+	return nil
+}
+
+type lockedValuesError struct {
+	attribute string
+}
+
+func (err lockedValuesError) Error() string {
+	return "samples in a locked workflow state have values for " + err.attribute + ", its unit cannot change"
+}
+
+// Workflow is the set of states and transitions of a collection
+type Workflow struct {
+	States      []WorkflowState      `json:"states"`
+	Transitions []WorkflowTransition `json:"transitions"`
+}
+
+type WorkflowState struct {
+	Id           int    `json:"id"`
+	CollectionId int    `json:"collection_id"`
+	Name         string `json:"name"`
+	IsInitial    bool   `json:"is_initial"`
+	IsLocked     bool   `json:"is_locked"`
+}
+
+type WorkflowTransition struct {
+	Id          int  `json:"id"`
+	FromStateId int  `json:"from_state_id"`
+	ToStateId   int  `json:"to_state_id"`
+	RoleId      *int `json:"role_id,omitempty"` // Nullable
+}
+
+type SampleStatusChange struct {
+	Id          int     `json:"id"`
+	FromStateId *int    `json:"from_state_id,omitempty"`
+	ToStateId   int     `json:"to_state_id"`
+	UserId      *int    `json:"user_id,omitempty"`
+	Comment     *string `json:"comment,omitempty"`
+	CreatedAt   int64   `json:"created_at"`
+}
@@ -2,32 +2,245 @@
 CREATE TABLE IF NOT EXISTS units (
     id INTEGER PRIMARY KEY,
     name TEXT NOT NULL,
+    canonical TEXT, -- Nullable, normalized UCUM expression
+    symbol TEXT, -- Nullable, printable symbol
+    dimension TEXT, -- Nullable, units of the same dimension convert into each other
+    factor REAL, -- Nullable, base unit value = value * factor + offset
+    offset REAL, -- Nullable
     CONSTRAINT unique_name UNIQUE (name)
 );
 
+-- Equivalent UCUM spellings share the canonical form. Units from before UCUM have none.
+CREATE UNIQUE INDEX IF NOT EXISTS unique_unit_canonical ON units (canonical) WHERE canonical IS NOT NULL;
+
 -- Create table: collections
 CREATE TABLE IF NOT EXISTS collections (
     id INTEGER PRIMARY KEY,
     name TEXT NOT NULL,
     description TEXT,
+    identifier_pattern TEXT, -- Nullable, e.g. "WQ-{YYYY}-{seq:0000}", see identifiers.go
+    deleted_at INTEGER, -- Nullable, UNIX time the collection was moved to the trash
     CONSTRAINT unique_name UNIQUE (name)
 );
 
+-- Create table: identifier_sequences
+CREATE TABLE IF NOT EXISTS identifier_sequences (
+    collection_id INTEGER NOT NULL,
+    scope TEXT NOT NULL, -- The identifier pattern rendered without the sequence, e.g. "WQ-2025-{seq}"
+    last_value INTEGER NOT NULL, -- Last sequence number given out
+    PRIMARY KEY (collection_id, scope),
+    CONSTRAINT fk_collection FOREIGN KEY (collection_id) REFERENCES collections (id) ON DELETE CASCADE
+);
+
+-- Create table: workflow_states
+CREATE TABLE IF NOT EXISTS workflow_states (
+    id INTEGER PRIMARY KEY,
+    collection_id INTEGER NOT NULL,
+    name TEXT NOT NULL,
+    is_initial INTEGER NOT NULL DEFAULT 0, -- New samples start in this state
+    is_locked INTEGER NOT NULL DEFAULT 0, -- Samples in this state are read-only
+    CONSTRAINT unique_name UNIQUE (collection_id, name),
+    CONSTRAINT fk_collection FOREIGN KEY (collection_id) REFERENCES collections (id) ON DELETE CASCADE
+);
+
+-- Create table: workflow_transitions
+CREATE TABLE IF NOT EXISTS workflow_transitions (
+    id INTEGER PRIMARY KEY,
+    from_state_id INTEGER NOT NULL,
+    to_state_id INTEGER NOT NULL,
+    role_id INTEGER, -- Nullable, any role may use the transition if not set
+    CONSTRAINT unique_transition UNIQUE (from_state_id, to_state_id, role_id),
+    CONSTRAINT fk_from_state FOREIGN KEY (from_state_id) REFERENCES workflow_states (id) ON DELETE CASCADE,
+    CONSTRAINT fk_to_state FOREIGN KEY (to_state_id) REFERENCES workflow_states (id) ON DELETE CASCADE,
+    CONSTRAINT fk_role FOREIGN KEY (role_id) REFERENCES roles (id) ON DELETE CASCADE
+);
+
+-- Create table: storage_locations
+CREATE TABLE IF NOT EXISTS storage_locations (
+    id INTEGER PRIMARY KEY,
+    parent_id INTEGER, -- Nullable, top level locations have none
+    name TEXT NOT NULL,
+    kind TEXT NOT NULL, -- "site", "freezer", "shelf", "rack" or "box"
+    grid_rows INTEGER, -- Nullable, samples are stored at grid positions if set
+    grid_columns INTEGER, -- Nullable
+    capacity INTEGER, -- Nullable, most samples stored directly in the location
+    created_at INTEGER NOT NULL, -- UNIX time
+    CONSTRAINT fk_parent FOREIGN KEY (parent_id) REFERENCES storage_locations (id)
+);
+
+-- Siblings have distinct names
+CREATE UNIQUE INDEX IF NOT EXISTS unique_storage_location_name ON storage_locations (COALESCE(parent_id, 0), name);
+
+-- Create table: instruments
+-- Equipment that produces values, with its calibration schedule
+CREATE TABLE IF NOT EXISTS instruments (
+    id INTEGER PRIMARY KEY,
+    asset_id TEXT NOT NULL UNIQUE, -- Identifier of the asset, e.g. the inventory tag
+    model TEXT, -- Nullable
+    serial_number TEXT, -- Nullable
+    location TEXT, -- Nullable, e.g. "Lab 2, bench 4"
+    calibration_interval_days INTEGER, -- Nullable, not calibrated on a schedule if not set
+    last_calibrated_at INTEGER, -- Nullable, UNIX time
+    next_calibration_at INTEGER, -- Nullable, UNIX time the calibration is due
+    status TEXT NOT NULL DEFAULT 'active', -- "active", "out_of_service" or "retired"
+    overdue_policy TEXT NOT NULL DEFAULT 'warn', -- "warn" or "block" values entered after the calibration is due
+    created_at INTEGER NOT NULL -- UNIX time
+);
+
+-- Create table: instrument_calibrations
+CREATE TABLE IF NOT EXISTS instrument_calibrations (
+    id INTEGER PRIMARY KEY,
+    instrument_id INTEGER NOT NULL,
+    calibrated_at INTEGER NOT NULL, -- UNIX time
+    next_calibration_at INTEGER, -- Nullable, UNIX time the next calibration was due from this one
+    certificate TEXT, -- Nullable, e.g. the certificate number
+    note TEXT, -- Nullable
+    user_id INTEGER NOT NULL, -- References users
+    created_at INTEGER NOT NULL, -- UNIX time
+    CONSTRAINT fk_instrument FOREIGN KEY (instrument_id) REFERENCES instruments (id) ON DELETE CASCADE
+);
+
 -- Create table: samples
 CREATE TABLE IF NOT EXISTS samples (
     id INTEGER PRIMARY KEY,
     collection_id INTEGER NOT NULL,
     created_at INTEGER NOT NULL, -- Stores UNIX time at INSERT
     note TEXT,
-    CONSTRAINT fk_collection FOREIGN KEY (collection_id) REFERENCES collections (id) ON DELETE CASCADE
+    status_id INTEGER, -- Nullable, references workflow_states
+    identifier TEXT, -- Nullable, from the identifier pattern of the collection
+    location_id INTEGER, -- Nullable, storage location the sample is in
+    location_row INTEGER, -- Nullable, 1-based position in the grid of the location
+    location_column INTEGER, -- Nullable
+    custodian_id INTEGER, -- Nullable, references users, who holds the sample after the last custody transfer
+    inserted_at INTEGER, -- Nullable, UNIX time the sample was recorded, not set for samples from before it was kept
+    deleted_at INTEGER, -- Nullable, UNIX time the sample was moved to the trash
+    CONSTRAINT fk_collection FOREIGN KEY (collection_id) REFERENCES collections (id) ON DELETE CASCADE,
+    CONSTRAINT fk_status FOREIGN KEY (status_id) REFERENCES workflow_states (id),
+    CONSTRAINT fk_location FOREIGN KEY (location_id) REFERENCES storage_locations (id)
 );
 
+-- Identifiers are scanned from labels, so they must find a single sample
+CREATE UNIQUE INDEX IF NOT EXISTS unique_sample_identifier ON samples (identifier) WHERE identifier IS NOT NULL;
+
+-- A grid position holds a single sample
+CREATE UNIQUE INDEX IF NOT EXISTS unique_sample_position ON samples (location_id, location_row, location_column) WHERE location_row IS NOT NULL;
+CREATE INDEX IF NOT EXISTS samples_location ON samples (location_id);
+
+-- Create table: sample_status_history
+CREATE TABLE IF NOT EXISTS sample_status_history (
+    id INTEGER PRIMARY KEY,
+    sample_id INTEGER NOT NULL,
+    from_state_id INTEGER, -- Nullable, references workflow_states
+    to_state_id INTEGER NOT NULL,
+    user_id INTEGER, -- References users
+    comment TEXT,
+    created_at INTEGER NOT NULL, -- UNIX time
+    CONSTRAINT fk_sample FOREIGN KEY (sample_id) REFERENCES samples (id) ON DELETE CASCADE,
+    CONSTRAINT fk_from_state FOREIGN KEY (from_state_id) REFERENCES workflow_states (id) ON DELETE RESTRICT,
+    CONSTRAINT fk_to_state FOREIGN KEY (to_state_id) REFERENCES workflow_states (id) ON DELETE RESTRICT
+);
+
+-- Create table: sample_location_history
+CREATE TABLE IF NOT EXISTS sample_location_history (
+    id INTEGER PRIMARY KEY,
+    sample_id INTEGER NOT NULL,
+    location_id INTEGER, -- Nullable, not set when the sample was taken out of storage or the location deleted
+    location_path TEXT, -- Nullable, e.g. "Lab 1 / Freezer A / Box 3" at the time of the move
+    location_row INTEGER, -- Nullable
+    location_column INTEGER, -- Nullable
+    user_id INTEGER, -- Nullable, references users
+    comment TEXT,
+    created_at INTEGER NOT NULL, -- UNIX time of the move
+    CONSTRAINT fk_sample FOREIGN KEY (sample_id) REFERENCES samples (id) ON DELETE CASCADE,
+    CONSTRAINT fk_location FOREIGN KEY (location_id) REFERENCES storage_locations (id) ON DELETE SET NULL
+);
+
+CREATE INDEX IF NOT EXISTS sample_location_history_sample ON sample_location_history (sample_id);
+
+-- Create table: custody_transfers
+-- Append-only, every entry holds the hash of the previous entry of the sample
+CREATE TABLE IF NOT EXISTS custody_transfers (
+    id INTEGER PRIMARY KEY,
+    sample_id INTEGER NOT NULL,
+    from_user_id INTEGER NOT NULL, -- References users
+    from_username TEXT NOT NULL, -- Username at the time of the transfer
+    to_user_id INTEGER NOT NULL, -- References users
+    to_username TEXT NOT NULL,
+    location TEXT, -- Nullable, where the sample was handed over
+    condition TEXT NOT NULL, -- Condition of the sample on receipt
+    comment TEXT,
+    created_at INTEGER NOT NULL, -- UNIX time of the transfer
+    previous_hash TEXT NOT NULL, -- Empty for the first transfer of a sample
+    hash TEXT NOT NULL, -- SHA-256 of the entry and previous_hash, hex encoded
+    CONSTRAINT fk_sample FOREIGN KEY (sample_id) REFERENCES samples (id),
+    CONSTRAINT unique_previous_hash UNIQUE (sample_id, previous_hash)
+);
+
+CREATE TRIGGER IF NOT EXISTS custody_transfers_no_update BEFORE UPDATE ON custody_transfers
+BEGIN
+    SELECT RAISE(ABORT, 'custody transfers are append-only');
+END;
+
+CREATE TRIGGER IF NOT EXISTS custody_transfers_no_delete BEFORE DELETE ON custody_transfers
+BEGIN
+    SELECT RAISE(ABORT, 'custody transfers are append-only');
+END;
+
+-- Create table: sample_relations
+CREATE TABLE IF NOT EXISTS sample_relations (
+    id INTEGER PRIMARY KEY,
+    parent_id INTEGER NOT NULL,
+    child_id INTEGER NOT NULL,
+    relation TEXT NOT NULL, -- "aliquot", "dilution" or "derived"
+    created_at INTEGER NOT NULL, -- UNIX time
+    created_by INTEGER, -- Nullable, references users
+    CONSTRAINT unique_relation UNIQUE (parent_id, child_id),
+    CONSTRAINT fk_parent FOREIGN KEY (parent_id) REFERENCES samples (id) ON DELETE CASCADE,
+    CONSTRAINT fk_child FOREIGN KEY (child_id) REFERENCES samples (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS sample_relations_child ON sample_relations (child_id);
+
+-- Create table: attachments
+-- Files of a sample or a collection. The content is stored once per SHA-256
+-- in the attachments directory next to data.db.
+CREATE TABLE IF NOT EXISTS attachments (
+    id INTEGER PRIMARY KEY,
+    sample_id INTEGER, -- Nullable, set if the file belongs to a sample
+    collection_id INTEGER, -- Nullable, set if the file belongs to a collection
+    sha256 TEXT NOT NULL, -- Hex encoded, names the file in the store
+    filename TEXT NOT NULL,
+    content_type TEXT NOT NULL,
+    size INTEGER NOT NULL, -- Bytes
+    user_id INTEGER, -- Nullable, references users, who uploaded the file
+    created_at INTEGER NOT NULL, -- UNIX time
+    CONSTRAINT fk_sample FOREIGN KEY (sample_id) REFERENCES samples (id) ON DELETE CASCADE,
+    CONSTRAINT fk_collection FOREIGN KEY (collection_id) REFERENCES collections (id) ON DELETE CASCADE,
+    CONSTRAINT single_parent CHECK ((sample_id IS NULL) != (collection_id IS NULL))
+);
+
+CREATE INDEX IF NOT EXISTS attachments_sample ON attachments (sample_id);
+CREATE INDEX IF NOT EXISTS attachments_collection ON attachments (collection_id);
+CREATE INDEX IF NOT EXISTS attachments_sha256 ON attachments (sha256);
+
 -- Create table: sample_attributes
 CREATE TABLE IF NOT EXISTS sample_attributes (
     id INTEGER PRIMARY KEY,
     collection_id INTEGER NOT NULL,
     unit_id INTEGER, -- Nullable
     name TEXT NOT NULL,
+    position INTEGER NOT NULL DEFAULT 0, -- Display order within the collection
+    group_label TEXT, -- Nullable, section the attribute is shown under
+    description TEXT, -- Nullable, help text
+    decimals INTEGER, -- Nullable, decimal places to display
+    formula TEXT, -- Nullable, values are calculated from the other attributes if set
+    replicates INTEGER, -- Nullable, number of replicate values per sample. The value is their mean
+    lod REAL, -- Nullable, limit of detection
+    loq REAL, -- Nullable, limit of quantitation
+    uloq REAL, -- Nullable, upper limit of quantitation
+    substitution TEXT, -- Nullable, how censored values enter statistics, see censored.go. "half" if not set
+    inserted_at INTEGER, -- Nullable, UNIX time the attribute was added, not set for attributes from before it was kept
+    deleted_at INTEGER, -- Nullable, UNIX time the attribute was moved to the trash
     CONSTRAINT unique_name UNIQUE (collection_id, name),
     CONSTRAINT fk_collection FOREIGN KEY (collection_id) REFERENCES collections (id) ON DELETE CASCADE,
     CONSTRAINT fk_unit FOREIGN KEY (unit_id) REFERENCES units (id)
@@ -37,9 +250,126 @@ CREATE TABLE IF NOT EXISTS sample_attributes (
 CREATE TABLE IF NOT EXISTS sample_attribute_values (
     sample_id INTEGER NOT NULL,
     attribute_id INTEGER NOT NULL,
-    value TEXT,
+    value TEXT, -- The number of a censored value
+    flag TEXT, -- Nullable, "ok", "warn" or "fail" from attribute_limits
+    censor TEXT, -- Nullable, "<", ">", "≤" or "≥" if the value is censored at its number
+    qualifier TEXT, -- Nullable, references qualifier_codes
+    uncertainty TEXT, -- Nullable, standard uncertainty as it was written
+    uncertainty_type TEXT, -- Nullable, "absolute" in the unit of the value or "relative" in percent, set with the uncertainty
+    significant_figures INTEGER, -- Nullable, declared significant figures, the value is written with them
+    instrument_id INTEGER, -- Nullable, the instrument that produced the value
     PRIMARY KEY (sample_id, attribute_id),
     CONSTRAINT fk_sample FOREIGN KEY (sample_id) REFERENCES samples (id) ON DELETE CASCADE,
+    CONSTRAINT fk_attribute FOREIGN KEY (attribute_id) REFERENCES sample_attributes (id) ON DELETE CASCADE,
+    CONSTRAINT fk_qualifier FOREIGN KEY (qualifier) REFERENCES qualifier_codes (code),
+    CONSTRAINT fk_instrument FOREIGN KEY (instrument_id) REFERENCES instruments (id)
+);
+
+-- Create table: qualifier_codes
+-- Codes that qualify a value, like "J" for estimated
+CREATE TABLE IF NOT EXISTS qualifier_codes (
+    code TEXT PRIMARY KEY,
+    description TEXT NOT NULL
+);
+
+-- Create table: sample_replicate_values
+-- Replicates of attributes with replicates set. Excluded replicates are kept
+-- with the reason but left out of the mean in sample_attribute_values.
+CREATE TABLE IF NOT EXISTS sample_replicate_values (
+    id INTEGER PRIMARY KEY,
+    sample_id INTEGER NOT NULL,
+    attribute_id INTEGER NOT NULL,
+    replicate INTEGER NOT NULL, -- 1 up to replicates of the attribute
+    value TEXT NOT NULL,
+    user_id INTEGER NOT NULL, -- References users, who entered the value
+    created_at INTEGER NOT NULL, -- UNIX time
+    excluded_reason TEXT, -- Nullable, set if the replicate is excluded as an outlier
+    excluded_by INTEGER, -- Nullable, references users
+    excluded_at INTEGER, -- Nullable, UNIX time
+    CONSTRAINT unique_replicate UNIQUE (sample_id, attribute_id, replicate),
+    CONSTRAINT fk_sample FOREIGN KEY (sample_id) REFERENCES samples (id) ON DELETE CASCADE,
+    CONSTRAINT fk_attribute FOREIGN KEY (attribute_id) REFERENCES sample_attributes (id) ON DELETE CASCADE
+);
+
+-- Create table: comments
+-- A thread is a comment without parent_id and its replies. Threads are on a
+-- sample, or on a single value if attribute_id is set.
+CREATE TABLE IF NOT EXISTS comments (
+    id INTEGER PRIMARY KEY,
+    sample_id INTEGER NOT NULL,
+    attribute_id INTEGER, -- Nullable, set for comments on a value
+    parent_id INTEGER, -- Nullable, the first comment of the thread for replies
+    user_id INTEGER NOT NULL, -- References users, the author
+    body TEXT NOT NULL,
+    resolved_at INTEGER, -- Nullable, UNIX time the thread was resolved, first comments only
+    resolved_by INTEGER, -- Nullable, references users
+    created_at INTEGER NOT NULL, -- UNIX time
+    edited_at INTEGER, -- Nullable, UNIX time of the last edit
+    CONSTRAINT fk_sample FOREIGN KEY (sample_id) REFERENCES samples (id) ON DELETE CASCADE,
+    CONSTRAINT fk_attribute FOREIGN KEY (attribute_id) REFERENCES sample_attributes (id) ON DELETE CASCADE,
+    CONSTRAINT fk_parent FOREIGN KEY (parent_id) REFERENCES comments (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS comments_sample ON comments (sample_id);
+CREATE INDEX IF NOT EXISTS comments_parent ON comments (parent_id);
+
+-- Create table: comment_edits
+-- The body of a comment before each edit
+CREATE TABLE IF NOT EXISTS comment_edits (
+    id INTEGER PRIMARY KEY,
+    comment_id INTEGER NOT NULL,
+    body TEXT NOT NULL,
+    created_at INTEGER NOT NULL, -- UNIX time the body was written
+    edited_at INTEGER NOT NULL, -- UNIX time the body was replaced
+    CONSTRAINT fk_comment FOREIGN KEY (comment_id) REFERENCES comments (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS comment_edits_comment ON comment_edits (comment_id);
+
+-- Create table: comment_mentions
+-- Users mentioned with @username in the current body of a comment
+CREATE TABLE IF NOT EXISTS comment_mentions (
+    comment_id INTEGER NOT NULL,
+    user_id INTEGER NOT NULL, -- References users
+    PRIMARY KEY (comment_id, user_id),
+    CONSTRAINT fk_comment FOREIGN KEY (comment_id) REFERENCES comments (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS comment_mentions_user ON comment_mentions (user_id);
+
+-- Create table: sample_value_history
+-- Every version of every value, the newest is the one in sample_attribute_values
+CREATE TABLE IF NOT EXISTS sample_value_history (
+    id INTEGER PRIMARY KEY,
+    sample_id INTEGER NOT NULL,
+    attribute_id INTEGER NOT NULL,
+    value TEXT, -- Nullable, not set when the value was removed
+    flag TEXT, -- Nullable, flag from attribute_limits when the value was written
+    censor TEXT, -- Nullable, see sample_attribute_values
+    qualifier TEXT, -- Nullable
+    uncertainty TEXT, -- Nullable
+    uncertainty_type TEXT, -- Nullable
+    significant_figures INTEGER, -- Nullable
+    instrument_id INTEGER, -- Nullable, references instruments
+    user_id INTEGER, -- Nullable, references users, not set for values the system wrote
+    created_at INTEGER NOT NULL, -- UNIX time the version was written, 0 for values from before history was kept
+    CONSTRAINT fk_sample FOREIGN KEY (sample_id) REFERENCES samples (id) ON DELETE CASCADE,
+    CONSTRAINT fk_attribute FOREIGN KEY (attribute_id) REFERENCES sample_attributes (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS sample_value_history_value ON sample_value_history (sample_id, attribute_id);
+
+-- Create table: attribute_limits
+CREATE TABLE IF NOT EXISTS attribute_limits (
+    id INTEGER PRIMARY KEY,
+    attribute_id INTEGER NOT NULL,
+    lower_spec REAL, -- Nullable, values below fail
+    upper_spec REAL, -- Nullable, values above fail
+    lower_warn REAL, -- Nullable, values below warn
+    upper_warn REAL, -- Nullable, values above warn
+    valid_from INTEGER NOT NULL DEFAULT 0, -- UNIX time, applies to samples created from then on
+    created_at INTEGER NOT NULL, -- UNIX time
+    CONSTRAINT unique_version UNIQUE (attribute_id, valid_from),
     CONSTRAINT fk_attribute FOREIGN KEY (attribute_id) REFERENCES sample_attributes (id) ON DELETE CASCADE
 );
 
@@ -53,12 +383,40 @@ CREATE TABLE IF NOT EXISTS users (
     password_hash TEXT NOT NULL,
     role_id INTEGER, -- Nullable, references roles table
     display_name TEXT,
+    email TEXT, -- Nullable, where notifications are emailed
     access_token TEXT,
     token_expiry_date INTEGER, -- UNIX time in seconds
     CONSTRAINT unique_username UNIQUE (username),
     CONSTRAINT fk_role FOREIGN KEY (role_id) REFERENCES roles (id)
 );
 
+-- Create table: notifications
+CREATE TABLE IF NOT EXISTS notifications (
+    id INTEGER PRIMARY KEY,
+    user_id INTEGER NOT NULL, -- Who is notified
+    kind TEXT NOT NULL, -- "mention", "status_changed", "out_of_spec" or "webhook_failed"
+    title TEXT NOT NULL,
+    body TEXT,
+    collection_id INTEGER, -- Nullable, what the notification is about
+    sample_id INTEGER, -- Nullable
+    comment_id INTEGER, -- Nullable
+    read_at INTEGER, -- Nullable, UNIX time the user read it
+    created_at INTEGER NOT NULL, -- UNIX time
+    CONSTRAINT fk_user FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS notifications_user ON notifications (user_id, read_at);
+
+-- Create table: notification_preferences
+-- Kinds of notifications a user wants emailed, nothing is emailed by default
+CREATE TABLE IF NOT EXISTS notification_preferences (
+    user_id INTEGER NOT NULL,
+    kind TEXT NOT NULL,
+    email INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (user_id, kind),
+    CONSTRAINT fk_user FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
 -- Create table: logs
 CREATE TABLE IF NOT EXISTS logs (
     id INTEGER PRIMARY KEY,
@@ -70,6 +428,88 @@ CREATE TABLE IF NOT EXISTS logs (
     response_code INTEGER
 );
 
+-- Create table: webhooks
+CREATE TABLE IF NOT EXISTS webhooks (
+    id INTEGER PRIMARY KEY,
+    collection_id INTEGER NOT NULL,
+    url TEXT NOT NULL,
+    secret TEXT NOT NULL, -- Shared secret for the HMAC-SHA256 signature
+    events TEXT NOT NULL, -- Comma separated event filter, e.g. "sample.created,value.updated" or "*"
+    active INTEGER NOT NULL DEFAULT 1,
+    created_at INTEGER NOT NULL, -- UNIX time
+    CONSTRAINT fk_collection FOREIGN KEY (collection_id) REFERENCES collections (id) ON DELETE CASCADE
+);
+
+-- Create table: webhook_deliveries
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id INTEGER PRIMARY KEY,
+    webhook_id INTEGER NOT NULL,
+    event TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    status TEXT NOT NULL, -- "pending", "succeeded" or "failed"
+    attempts INTEGER NOT NULL DEFAULT 0,
+    response_code INTEGER, -- Nullable, last HTTP status received
+    error TEXT, -- Nullable, last error
+    created_at INTEGER NOT NULL, -- UNIX time
+    delivered_at INTEGER, -- Nullable, UNIX time
+    CONSTRAINT fk_webhook FOREIGN KEY (webhook_id) REFERENCES webhooks (id) ON DELETE CASCADE
+);
+
+-- Create table: collection_templates
+CREATE TABLE IF NOT EXISTS collection_templates (
+    id INTEGER PRIMARY KEY,
+    name TEXT NOT NULL,
+    description TEXT,
+    schema TEXT NOT NULL, -- JSON, attributes, limits and workflow of a collection
+    created_at INTEGER NOT NULL, -- UNIX time
+    created_by INTEGER, -- Nullable, references users
+    CONSTRAINT unique_name UNIQUE (name)
+);
+
+-- Values from before history was kept become its first versions
+INSERT INTO
+    sample_value_history (sample_id, attribute_id, value, flag, created_at)
+SELECT
+    v.sample_id,
+    v.attribute_id,
+    v.value,
+    v.flag,
+    0
+FROM
+    sample_attribute_values v
+WHERE
+    NOT EXISTS (
+        SELECT
+            NULL
+        FROM
+            sample_value_history h
+        WHERE
+            h.sample_id = v.sample_id
+            AND h.attribute_id = v.attribute_id
+    );
+
+-- Initialize qualifier codes only if empty
+INSERT INTO
+    qualifier_codes
+SELECT
+    *
+FROM
+    (
+        VALUES
+            ('J', 'Estimated value'),
+            ('U', 'Not detected above the reported limit'),
+            ('B', 'Also found in the blank'),
+            ('E', 'Exceeds the calibration range'),
+            ('R', 'Rejected, unusable')
+    ) source_data
+WHERE
+    NOT EXISTS (
+        SELECT
+            NULL
+        FROM
+            qualifier_codes
+    );
+
 -- Initialize roles table only if empty
 INSERT INTO
     roles